@@ -4,30 +4,61 @@
 //
 //	nlab version                     – print the nlab version
 //	nlab doctor                      – check host prerequisites
+//	nlab config view|get|set|path    – inspect or edit ~/.config/nlab/config.yaml
 //	nlab validate [<stack>|-f <file>] – validate a v1alpha1 stack manifest
+//	nlab render [<stack>|-f <file>]   – print the libvirt XML a stack defines
+//	nlab schema [--kind Stack]       – print the JSON Schema of a manifest kind
+//	nlab migrate [<stack>|-f <file>]  – convert a legacy stack.yaml to v1alpha1
 //	nlab image download              – download the Ubuntu 22.04 base cloud image
+//	nlab stack init <name>           – scaffold a new stack from a template
+//	nlab stack list|ls               – list stacks and their instances
+//	nlab stack status <stack>        – show networks, VMs, impairments and forwards
+//	nlab stack pack <stack>          – write a portable .nlab.tar.zst bundle
+//	nlab stack unpack <bundle>       – verify a bundle and install it in the library
+//	nlab stack inspect <bundle>      – show a bundle's index and verify checksums
 //	nlab key generate <stack>        – generate a per-stack ed25519 SSH key pair
+//	nlab key rotate <stack>          – replace a stack key on running VMs
+//	nlab key show <stack>            – show a stack's keys and fingerprints
+//	nlab key agent <stack>           – load a stack's keys into ssh-agent
 //	nlab network create <stack>      – define and start the libvirt network
 //	nlab network destroy <stack>     – stop and undefine the libvirt network
+//	nlab network verify <stack>      – probe that each network's egress policy holds
+//	nlab network impair <stack>      – add latency, loss or a rate cap to VM links
 //	nlab vm create <stack> <role>    – provision a single VM
 //	nlab vm destroy <stack> <role>   – destroy a single VM
+//	nlab vm exec <stack> <role> -- <cmd> – run a command on a VM over SSH
+//	nlab vm cp <stack> <src> <dst>   – copy a file to or from a VM over SSH
 //	nlab session <stack>             – wait for SSH readiness then open tmux
+//	nlab ssh-config <stack>          – write an Include-able OpenSSH config
+//	nlab port-forward <stack> [<role> <host>:<guest>...] – forward host ports to a VM
 //	nlab dashboard <stack>           – show the live creation dashboard
-//	nlab up <stack>                  – full stack bring-up (key+net+vms+session)
+//	nlab events <stack>              – print or follow the stack's event journal
+//	nlab up|apply <stack>            – full stack bring-up (key+net+vms+session)
 //	nlab down <stack>                – full stack tear-down
 //	nlab list                        – list all libvirt domains
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 
 	lab "github.com/h3ow3d/nlab/internal"
 	"github.com/h3ow3d/nlab/internal/manifest"
+	"github.com/h3ow3d/nlab/internal/types"
 )
 
 // Version is the nlab release string. Override at build time with:
@@ -35,6 +66,30 @@ import (
 //	go build -ldflags "-X main.Version=v1.2.3" ./cmd/nlab
 var Version = "dev"
 
+// stackFile is the global -f flag.
+var stackFile string
+
+// paramFlags are the --values and --set flags that give spec.parameters
+// values.
+type paramFlags struct {
+	valuesFile string
+	sets       []string
+}
+
+func (p *paramFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&p.valuesFile, "values", "", "YAML file of spec.parameters values")
+	cmd.Flags().StringArrayVar(&p.sets, "set", nil, "Set a spec.parameters value (key=value, repeatable; wins over --values)")
+}
+
+// values returns the parameter values given on the command line, or nil when
+// neither flag is used so that the values saved by the last 'nlab up' apply.
+func (p *paramFlags) values() (map[string]interface{}, error) {
+	if p.valuesFile == "" && len(p.sets) == 0 {
+		return nil, nil
+	}
+	return lab.ParamValues(p.valuesFile, p.sets)
+}
+
 func main() {
 	root := &cobra.Command{
 		Use:   "nlab",
@@ -47,19 +102,49 @@ then opens a tmux session so you can start working immediately.
 Quick start:
   nlab image download   # one-time: fetch Ubuntu 22.04 base image
   nlab up basic         # bring up the basic stack
-  nlab down basic       # tear it all down`,
+  nlab down basic       # tear it all down
+
+Stacks are looked up in each directory of the stackPath setting, by default
+./stacks/<stack>/, then ~/.local/share/nlab/stacks/<stack>/; -f <file> uses
+the given stack.yaml instead.`,
+		PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
+			cfg, err := loadConfig(cmd)
+			if err != nil {
+				// The config commands must keep working so a broken file can
+				// be inspected and repaired.
+				if cmd.Parent() == nil || cmd.Parent().Name() != "config" {
+					return err
+				}
+			} else {
+				lab.SetConfig(cfg)
+			}
+			lab.SetStackFile(stackFile)
+			return nil
+		},
+	}
+	root.PersistentFlags().StringVarP(&stackFile, "file", "f", "", "path to a stack manifest, or a directory of them (overrides the stack search path)")
+	for _, k := range lab.ConfigKeys() {
+		root.PersistentFlags().String(k.Flag, "", fmt.Sprintf("%s (config %s, env %s)", k.Doc, k.Key, k.Env))
 	}
 
 	root.AddCommand(
 		versionCmd(),
 		doctorCmd(),
+		configCmd(),
 		validateCmd(),
+		renderCmd(),
+		schemaCmd(),
+		migrateCmd(),
 		imageCmd(),
+		stackCmd(),
 		keyCmd(),
 		networkCmd(),
 		vmCmd(),
 		sessionCmd(),
+		sshConfigCmd(),
+		portForwardCmd(),
 		dashboardCmd(),
+		eventsCmd(),
 		upCmd(),
 		downCmd(),
 		listCmd(),
@@ -91,7 +176,7 @@ func doctorCmd() *cobra.Command {
 		SilenceUsage: true,
 		Long: `Verifies that all required tools and system features are present:
 
-  • virsh / libvirt connectivity (local qemu:///system)
+  • virsh / libvirt connectivity (libvirtURI, qemu:///system by default)
   • qemu/kvm availability (/dev/kvm)
   • tmux
   • tcpdump
@@ -124,10 +209,111 @@ Exits with a non-zero status if any critical prerequisite is missing.`,
 	}
 }
 
+// ── config ────────────────────────────────────────────────────────────────────
+
+// loadConfig resolves the effective settings for cmd: defaults, the config
+// file, NLAB_* environment variables, then any setting flags given.
+func loadConfig(cmd *cobra.Command) (*lab.Config, error) {
+	cfg, err := lab.LoadConfig(lab.DefaultXDGDirs().ConfigFile())
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range lab.ConfigKeys() {
+		if f := cmd.Flags().Lookup(k.Flag); f != nil && f.Changed {
+			if err := cfg.Set(k.Key, f.Value.String(), lab.SourceFlag); err != nil {
+				return nil, fmt.Errorf("--%s: %w", k.Flag, err)
+			}
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func configCmd() *cobra.Command {
+	var keys strings.Builder
+	for _, k := range lab.ConfigKeys() {
+		fmt.Fprintf(&keys, "  %-16s %-22s --%-18s %s\n", k.Key, k.Env, k.Flag, k.Doc)
+	}
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect or edit the nlab config file",
+		Long: `Manages ~/.config/nlab/config.yaml.
+
+Each setting is resolved with the precedence
+  flag > NLAB_* environment variable > config file > built-in default.
+
+Settings:
+` + keys.String(),
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:          "view",
+		SilenceUsage: true,
+		Short:        "Print the effective settings and where each came from",
+		Args:         cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			cfg, err := loadConfig(cmd)
+			if err != nil {
+				return err
+			}
+			fmt.Print(lab.RenderConfig(cfg))
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:          "get <key>",
+		SilenceUsage: true,
+		Short:        "Print the effective value of one setting",
+		Example:      "  nlab config get libvirtURI",
+		Args:         cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig(cmd)
+			if err != nil {
+				return err
+			}
+			v, err := cfg.Get(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Println(v)
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:          "set <key> <value>",
+		SilenceUsage: true,
+		Short:        "Write one setting to the config file",
+		Example:      "  nlab config set maxWaitSeconds 300\n  nlab config set libvirtURI qemu+ssh://lab-host/system",
+		Args:         cobra.ExactArgs(2),
+		RunE: func(_ *cobra.Command, args []string) error {
+			path := lab.DefaultXDGDirs().ConfigFile()
+			if err := lab.SetConfigFileValue(path, args[0], args[1]); err != nil {
+				return err
+			}
+			lab.Ok(fmt.Sprintf("%s set in %s", args[0], path))
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "path",
+		Short: "Print the config file path",
+		Args:  cobra.NoArgs,
+		Run: func(_ *cobra.Command, _ []string) {
+			fmt.Println(lab.DefaultXDGDirs().ConfigFile())
+		},
+	})
+	return cmd
+}
+
 // ── validate ─────────────────────────────────────────────────────────────────────────
 
 func validateCmd() *cobra.Command {
-	var file string
+	var asJSON bool
 	cmd := &cobra.Command{
 		Use:          "validate [<stack> | -f <file>]",
 		Short:        "Validate a v1alpha1 stack manifest",
@@ -136,7 +322,7 @@ func validateCmd() *cobra.Command {
 
 Supply either a stack name or an explicit file path:
 
-  nlab validate basic              reads stacks/basic/stack.yaml
+  nlab validate basic              resolves basic via the stack search path
   nlab validate -f /my/stack.yaml  reads the given file directly
 
 Checks performed:
@@ -144,26 +330,288 @@ Checks performed:
   • metadata.name is set and non-whitespace
   • spec.networks and spec.vms are non-empty
   • Network and VM names must not be empty or whitespace-only
-  • Each network and VM has a non-empty xml field
-  • All xml fields are well-formed XML`,
-		Example: "  nlab validate basic\n  nlab validate -f stacks/basic/stack.yaml",
+  • Each network and VM has either xml/xmlFile or typed fields, not both
+  • All xml fields and xmlFile files are well-formed XML
+  • Typed networks have a valid cidr, mode, bridge and dhcp range
+  • Typed VMs have memory and vcpus and only attach to defined networks
+  • cloudInit files exist; meta-data, network-config and #cloud-config
+    user-data are valid YAML
+  • Network <name>s match their keys and raw VMs only attach to networks
+    of the stack; bridge names are unique and at most 15 characters
+  • Raw VMs have a <memory> in a known unit and a positive <vcpu>
+  • MAC and DHCP host addresses are unique; subnets do not overlap and
+    DHCP ranges stay inside their subnet, clear of the host address
+
+Warnings do not make a manifest invalid:
+  • a raw domain <name> other than <stack>-<vm>, or under 256 MiB of memory
+  • interfaces on bridges outside the stack
+  • disks outside the libvirt image directory or spec.storage.diskDir
+  • subnets or bridges shared with other stacks on the search path, and
+    subnets that overlap a host route
+
+Each issue is printed as file:line:col: severity: message, followed by the
+line it points at. Errors in inline xml are reported at their line in the
+manifest; errors in xmlFile files at their line in that file.
+
+With --json, prints {"file", "valid", "issues": [{"file", "line", "column",
+"severity", "message"}]}, where each issue names the file it was found in: the
+manifest or a referenced file. line and column are omitted when unknown.
+valid is false only when there are errors.`,
+		Example: "  nlab validate basic\n  nlab validate -f stacks/basic/stack.yaml\n  nlab validate basic --json",
 		Args:    cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if stackFile == "" && len(args) == 0 {
+				return fmt.Errorf("provide a stack name (e.g. nlab validate basic) or use -f <file>")
+			}
+			name := ""
+			if len(args) == 1 {
+				name = args[0]
+			}
+			path, err := lab.ResolveStackFile(name)
+			if err != nil {
+				return err
+			}
+			_, warnings, err := lab.CheckStackFile(path)
+			if asJSON {
+				cmd.SilenceErrors = true
+				return printValidationJSON(path, warnings, err)
+			}
+			issues := warnings
+			var verr *manifest.ValidationError
+			if errors.As(err, &verr) {
+				issues = append(verr.Issues, warnings...)
+			}
+			for _, is := range issues {
+				fmt.Fprintln(os.Stderr, manifest.Diagnostic(is))
+			}
+			if verr != nil {
+				return fmt.Errorf("manifest %q is invalid: %d error(s)", path, len(verr.Issues))
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Printf("manifest %q is valid\n", path)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the result as JSON")
+	return cmd
+}
+
+// printValidationJSON prints the outcome of loading the manifest at path and
+// passes err through, so an invalid manifest still exits non-zero.
+func printValidationJSON(path string, warnings []manifest.Issue, err error) error {
+	result := struct {
+		File   string           `json:"file"`
+		Valid  bool             `json:"valid"`
+		Issues []manifest.Issue `json:"issues"`
+	}{File: path, Valid: err == nil, Issues: []manifest.Issue{}}
+	var verr *manifest.ValidationError
+	if errors.As(err, &verr) {
+		result.Issues = append(result.Issues, verr.Issues...)
+	} else if err != nil {
+		result.Issues = []manifest.Issue{{File: path, Severity: manifest.SeverityError, Message: err.Error()}}
+	}
+	result.Issues = append(result.Issues, warnings...)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false) // messages quote XML elements
+	if encErr := enc.Encode(result); encErr != nil {
+		return encErr
+	}
+	return err
+}
+
+// ── render ────────────────────────────────────────────────────────────────────
+
+func renderCmd() *cobra.Command {
+	var only string
+	var effective, flatten bool
+	var params paramFlags
+	cmd := &cobra.Command{
+		Use:          "render [<stack> | -f <file>]",
+		Short:        "Print the libvirt XML a stack defines",
+		SilenceUsage: true,
+		Long: `Validates the manifest and prints the effective libvirt XML of every
+network and VM, each preceded by a comment naming its manifest entry.
+
+Networks written with typed fields (cidr/mode/dhcp) are rendered exactly as
+nlab defines them; raw xml entries are printed as written.
+
+Domain XML is a preview. nlab creates VMs with virt-install, from the same
+name, memory, vCPUs, overlay disk, seed ISO and networks as the XML for
+typed fields (memory/vcpus/disk/networks/image/cloudInit). libvirt fills in
+the rest. Of a raw domain xml, nlab uses only the memory, vCPUs and
+networks.
+
+--effective prints the manifest instead, with spec.defaults merged into
+every VM, parameters substituted and referenced files resolved: the settings
+nlab actually uses.
+
+--flatten prints the manifest as written, with the stacks it extends
+(spec.extends), the components it imports (spec.components) and its
+kind: Network and kind: VM documents merged in. Fields that come from another
+file than the one around them are followed by a "# from <file>:<line>"
+comment.
+
+Parameters take the values saved by the last 'nlab up', unless --values or
+--set is given.`,
+		Example: `  nlab render basic
+  nlab render basic --only attacker
+  nlab render basic --effective --set targetVersion=2.4.49
+  nlab render web --flatten
+  nlab render -f stack.yaml`,
+		Args: cobra.MaximumNArgs(1),
 		RunE: func(_ *cobra.Command, args []string) error {
-			path := file
-			if path == "" {
-				if len(args) == 0 {
-					return fmt.Errorf("provide a stack name (e.g. nlab validate basic) or use -f <file>")
+			if stackFile == "" && len(args) == 0 {
+				return fmt.Errorf("provide a stack name (e.g. nlab render basic) or use -f <file>")
+			}
+			name := ""
+			if len(args) == 1 {
+				name = args[0]
+			}
+			values, err := params.values()
+			if err != nil {
+				return err
+			}
+			if flatten {
+				if only != "" || effective {
+					return fmt.Errorf("--flatten cannot be combined with --only or --effective")
+				}
+				out, err := lab.FlattenedManifest(name)
+				if err != nil {
+					return err
 				}
-				path = fmt.Sprintf("stacks/%s/stack.yaml", args[0])
+				_, err = os.Stdout.Write(out)
+				return err
 			}
-			if _, err := manifest.Load(path); err != nil {
+			if effective {
+				if only != "" {
+					return fmt.Errorf("--only cannot be combined with --effective")
+				}
+				out, err := lab.EffectiveManifest(name, values)
+				if err != nil {
+					return err
+				}
+				_, err = os.Stdout.Write(out)
 				return err
 			}
-			fmt.Printf("manifest %q is valid\n", path)
+			docs, err := lab.RenderStack(name, values)
+			if err != nil {
+				return err
+			}
+			found := false
+			for _, d := range docs {
+				if only != "" && d.Name != only {
+					continue
+				}
+				if found {
+					fmt.Println()
+				}
+				found = true
+				fmt.Printf("<!-- %s -->\n%s", d, d.XML)
+			}
+			if !found {
+				return fmt.Errorf("no network or VM named %q in the manifest", only)
+			}
 			return nil
 		},
 	}
-	cmd.Flags().StringVarP(&file, "file", "f", "", "Path to the stack manifest YAML file (overrides stack name)")
+	cmd.Flags().StringVar(&only, "only", "", "Print only the network or VM with this name")
+	cmd.Flags().BoolVar(&effective, "effective", false, "Print the manifest with spec.defaults applied instead of XML")
+	cmd.Flags().BoolVar(&flatten, "flatten", false, "Print the manifest with extends, components and Network/VM documents merged in")
+	params.register(cmd)
+	return cmd
+}
+
+// ── schema ────────────────────────────────────────────────────────────────────
+
+func schemaCmd() *cobra.Command {
+	var kind string
+	cmd := &cobra.Command{
+		Use:          "schema",
+		Short:        "Print the JSON Schema of a v1alpha1 manifest",
+		SilenceUsage: true,
+		Long: `Prints the JSON Schema (draft 2020-12) of a manifest kind, generated from
+nlab's own types: field names, descriptions, enums, required fields and hints
+for embedded libvirt XML.
+
+Point an editor at it to get completion and linting in stack.yaml, either with
+a modeline on the first line (nlab stack init adds it):
+
+  # yaml-language-server: $schema=` + manifest.SchemaURL + `
+
+or with a local copy: nlab schema > ~/.config/nlab/stack.schema.json`,
+		Example: "  nlab schema\n  nlab schema --kind Stack > stack.schema.json",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			out, err := manifest.Schema(kind)
+			if err != nil {
+				return err
+			}
+			_, err = os.Stdout.Write(out)
+			return err
+		},
+	}
+	cmd.Flags().StringVar(&kind, "kind", "Stack", "Manifest kind ("+strings.Join(manifest.SchemaKinds(), ", ")+")")
+	return cmd
+}
+
+// ── migrate ───────────────────────────────────────────────────────────────────
+
+func migrateCmd() *cobra.Command {
+	var dryRun bool
+	cmd := &cobra.Command{
+		Use:          "migrate [<stack> | -f <file>]",
+		Short:        "Convert a legacy stack.yaml to a v1alpha1 manifest",
+		SilenceUsage: true,
+		Long: `Rewrites a stack in the legacy flat format (network: + vms: with memory and
+vcpus, plus network.xml) as a v1alpha1 manifest:
+
+  • network.xml is inlined under spec.networks
+  • every VM gets the domain XML nlab renders for its memory and vcpus
+    (nlab up reads back its memory, vCPUs and networks; see nlab render)
+  • layout.yaml, or one ssh pane per VM, becomes spec.tmux
+  • comments move to the network or VM they were written next to
+
+The old files are kept as stack.yaml.bak, network.xml.bak and
+layout.yaml.bak. --dry-run prints the new manifest instead of writing it.
+
+The legacy format is deprecated: nlab warns whenever it loads one, and the
+legacy parser will be removed in the next minor release.`,
+		Example: "  nlab migrate basic --dry-run\n  nlab migrate basic\n  nlab migrate -f old/stack.yaml",
+		Args:    cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if stackFile == "" && len(args) == 0 {
+				return fmt.Errorf("provide a stack name (e.g. nlab migrate basic) or use -f <file>")
+			}
+			name := ""
+			if len(args) == 1 {
+				name = args[0]
+			}
+			path, err := lab.ResolveStackFile(name)
+			if err != nil {
+				return err
+			}
+			mg, err := lab.MigrateStack(path)
+			if err != nil {
+				return err
+			}
+			if dryRun {
+				_, err = os.Stdout.Write(mg.Manifest)
+				return err
+			}
+			if err := mg.Write(); err != nil {
+				return err
+			}
+			lab.Ok(fmt.Sprintf("Migrated %s to v1alpha1 (backup: %s.bak)", path, path))
+			for _, f := range mg.Retired {
+				lab.Info(fmt.Sprintf("%s is now embedded in the manifest (backup: %s.bak)", filepath.Base(f), f))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print the migrated manifest without writing anything")
 	return cmd
 }
 
@@ -177,8 +625,10 @@ func imageCmd() *cobra.Command {
 	cmd.AddCommand(&cobra.Command{
 		Use:   "download",
 		Short: "Download the Ubuntu 22.04 base cloud image",
-		Long: `Downloads jammy-server-cloudimg-amd64.img, verifies its SHA-256 checksum,
-and installs it to /var/lib/libvirt/images/ubuntu-base.qcow2.
+		Long: `Downloads the cloud image at imageURL (jammy-server-cloudimg-amd64.img by
+default), verifies its SHA-256 checksum against the SHA256SUMS published next
+to it, and installs it to baseImage
+(/var/lib/libvirt/images/ubuntu-base.qcow2 by default). See 'nlab config'.
 
 Replaces: ./images/download_base.sh`,
 		Example: "  nlab image download",
@@ -189,6 +639,316 @@ Replaces: ./images/download_base.sh`,
 	return cmd
 }
 
+// ── stack ─────────────────────────────────────────────────────────────────────
+
+func stackCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stack",
+		Short: "Create and list stacks",
+	}
+
+	var from, subnet, dir string
+	var roles []string
+	initCmd := &cobra.Command{
+		Use:          "init <name>",
+		Short:        "Scaffold a new stack from a template or existing stack",
+		SilenceUsage: true,
+		Long: `Renders a complete stack — v1alpha1 manifest (including spec.tmux) and
+per-VM cloud-init files — from an existing stack, rewriting every derived name
+consistently: libvirt network and domain names, the virbr-<stack> bridge,
+disk paths and VM hostnames. --subnet re-addresses the primary network,
+keeping each address at the same offset (gateway, DHCP range). --roles picks
+the VMs; roles the source lacks are cloned from its "target" VM. Without a
+"template" on the search path, the default source is the copy built into
+nlab.
+
+The stack is written to the stack library (~/.local/share/nlab/stacks/<name>)
+unless --dir is given, then validated exactly like 'nlab validate'.`,
+		Example: `  nlab stack init web
+  nlab stack init ad --from basic --subnet 10.10.30.0/24 --roles attacker,target,dc
+  nlab stack init tmp --from ./stacks/basic --dir ./stacks`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			name := args[0]
+			srcDir, cleanup, err := lab.StackInitSource(from)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+			sc, err := lab.RenderStackInit(srcDir, lab.StackInitOptions{
+				Name: name, Subnet: subnet, Roles: roles,
+			})
+			if err != nil {
+				return err
+			}
+			parent := dir
+			if parent == "" {
+				parent = lab.DefaultXDGDirs().StacksDir()
+			}
+			target := filepath.Join(parent, name)
+			if err := sc.Write(target); err != nil {
+				return err
+			}
+			path := filepath.Join(target, "stack.yaml")
+			if _, err := manifest.Load(path); err != nil {
+				_ = os.RemoveAll(target)
+				return fmt.Errorf("generated stack failed validation (nothing written): %w", err)
+			}
+			lab.Ok(fmt.Sprintf("Stack %s created at %s from %s", name, target, srcDir))
+			fmt.Printf("manifest %q is valid\n", path)
+			return nil
+		},
+	}
+	initCmd.Flags().StringVar(&from, "from", "template", "source stack: a name on the search path or a directory")
+	initCmd.Flags().StringVar(&subnet, "subnet", "", "IPv4 CIDR for the primary network (default: keep the source's)")
+	initCmd.Flags().StringSliceVar(&roles, "roles", nil, "comma-separated VM roles (default: the source's)")
+	initCmd.Flags().StringVar(&dir, "dir", "", "parent directory for the new stack (default: the stack library)")
+	cmd.AddCommand(initCmd)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List stacks on the search path",
+		Long: `Lists every stack found in ./stacks and the stack library, in search order.
+A stack hidden by an earlier one with the same name is marked (shadowed).
+The instances of a stack that are up (nlab up --instance) are listed under
+it by their qualified name.`,
+		Args: cobra.NoArgs,
+		Run: func(_ *cobra.Command, _ []string) {
+			stacks := lab.ListStacks()
+			instances := map[string][]lab.Instance{}
+			var orphans []lab.Instance // instances of stacks not on the search path
+			listed := map[string]bool{}
+			for _, s := range stacks {
+				listed[s.Name] = true
+			}
+			for _, in := range lab.ListInstances() {
+				if listed[in.Stack] {
+					instances[in.Stack] = append(instances[in.Stack], in)
+				} else {
+					orphans = append(orphans, in)
+				}
+			}
+			if len(stacks) == 0 && len(orphans) == 0 {
+				fmt.Println("no stacks found; create one with 'nlab stack init <name>'")
+				return
+			}
+			for _, s := range stacks {
+				note := ""
+				if s.Shadowed {
+					note = "  (shadowed)"
+				}
+				fmt.Printf("%-16s %s%s\n", s.Name, s.Dir, note)
+				if s.Shadowed {
+					continue
+				}
+				for _, in := range instances[s.Name] {
+					fmt.Printf("  %-14s %s\n", in.Name, in.Qualified())
+				}
+			}
+			for _, in := range orphans {
+				fmt.Printf("%-16s %s  (instance %s of %s)\n", in.Qualified(), in.Manifest, in.Name, in.Stack)
+			}
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "status <stack>",
+		Short: "Show a stack's networks, VMs, link impairments and port forwards",
+		Long: `Prints a one-off snapshot of the stack: each network with its bridge and
+egress policy, each VM with its state and address, each running VM link
+with the impairment tc reports on it, and each active port forward with the
+process serving it.`,
+		Example: "  nlab stack status basic",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			cfg, err := lab.LoadStack(args[0])
+			if err != nil {
+				return err
+			}
+			printStatus(lab.Status(args[0], cfg))
+			return nil
+		},
+	})
+
+	cmd.AddCommand(stackPackCmd(), stackUnpackCmd(), stackInspectCmd())
+	return cmd
+}
+
+// printStatus prints a stack status as tables, leaving out empty ones.
+func printStatus(st lab.StackStatus) {
+	fmt.Printf("%-16s %-7s %-15s %s\n", "NETWORK", "ACTIVE", "BRIDGE", "EGRESS")
+	for _, n := range st.Networks {
+		active := "no"
+		if n.Active {
+			active = "yes"
+		}
+		fmt.Printf("%-16s %-7s %-15s %s\n", n.Name, active, orDash(n.Bridge), n.Egress)
+	}
+	fmt.Printf("\n%-16s %-12s %s\n", "VM", "STATE", "IP")
+	for _, v := range st.VMs {
+		fmt.Printf("%-16s %-12s %s\n", v.Name, orDash(v.State), orDash(v.IP))
+	}
+	if len(st.Links) > 0 {
+		fmt.Printf("\n%-16s %-16s %-10s %s\n", "LINK", "NETWORK", "DEVICE", "IMPAIRMENT")
+		for _, l := range st.Links {
+			fmt.Printf("%-16s %-16s %-10s %s\n", l.VM, l.Network, l.Dev, orDash(l.Impairment))
+		}
+	}
+	if len(st.Forwards) > 0 {
+		fmt.Printf("\n%-22s %-16s %-6s %s\n", "FORWARD", "TO", "PROTO", "PID")
+		for _, r := range st.Forwards {
+			for _, f := range r.Forwards {
+				fmt.Printf("%-22s %-16s %-6s %d\n", f.Listen(), fmt.Sprintf("%s:%d", f.VM, f.Guest), f.Proto, r.PID)
+			}
+		}
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func stackPackCmd() *cobra.Command {
+	var opts lab.PackOptions
+	cmd := &cobra.Command{
+		Use:          "pack <stack>",
+		Short:        "Write a stack into a portable tar.zst bundle",
+		SilenceUsage: true,
+		Long: `Packs the stack's manifest, cloud-init files and layout — file modes
+preserved — into <stack>.nlab.tar.zst together with:
+
+  images.lock        the base image URL, expected host path and SHA-256
+  nlab-bundle.json   an index with the size, mode and SHA-256 of every file
+
+--sign signs the index with an SSH private key so recipients can check who
+produced the bundle. --include-images embeds the base image itself for a
+fully offline hand-off (expect several hundred MiB).`,
+		Example: `  nlab stack pack basic
+  nlab stack pack basic --sign ~/.ssh/id_ed25519 -o /tmp/basic.nlab.tar.zst
+  nlab stack pack basic --include-images`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			opts.Stack = args[0]
+			opts.Version = Version
+			out, err := lab.PackStack(opts)
+			if err != nil {
+				return err
+			}
+			lab.Ok("Bundle written to " + out)
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&opts.Output, "output", "o", "", "bundle path (default ./<stack>.nlab.tar.zst)")
+	cmd.Flags().BoolVar(&opts.IncludeImages, "include-images", false, "embed the base image for offline use")
+	cmd.Flags().StringVar(&opts.SignKey, "sign", "", "SSH private key used to sign the bundle index")
+	return cmd
+}
+
+func stackUnpackCmd() *cobra.Command {
+	var opts lab.UnpackOptions
+	cmd := &cobra.Command{
+		Use:          "unpack <bundle>",
+		Short:        "Verify a bundle and install its stack",
+		SilenceUsage: true,
+		Long: `Verifies every checksum in the bundle, then installs the stack into the
+stack library (~/.local/share/nlab/stacks/<stack>) or --dir. Bundled images
+are saved under ~/.local/share/nlab/images/. Nothing is installed if any
+check fails.
+
+The stack's images.lock then names the base image its VMs use: the bundled
+copy, or else the configured baseImage. 'nlab up' checks that image against
+the lock's SHA-256 before creating any VM.
+
+--trusted-keys takes an authorized_keys-style file; the bundle must then be
+signed by one of its keys.`,
+		Example: `  nlab stack unpack basic.nlab.tar.zst
+  nlab stack unpack basic.nlab.tar.zst --trusted-keys team_keys.pub`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			info, dir, err := lab.UnpackBundle(args[0], opts)
+			if err != nil {
+				return err
+			}
+			printBundleSignature(info)
+			lab.Ok(fmt.Sprintf("Stack %s installed at %s", info.Index.Stack, dir))
+			for _, img := range info.Lock.Images {
+				if img.Bundled {
+					continue
+				}
+				if _, err := os.Stat(img.Path); err != nil {
+					lab.Info(fmt.Sprintf("Stack expects image %s at %s – run 'nlab image download'", img.Name, img.Path))
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&opts.Dest, "dir", "", "parent directory to install into (default: the stack library)")
+	cmd.Flags().StringVar(&opts.TrustedKeys, "trusted-keys", "", "authorized_keys file of trusted signers")
+	cmd.Flags().BoolVar(&opts.RequireSignature, "require-signature", false, "refuse bundles not signed by a trusted key")
+	cmd.Flags().BoolVar(&opts.Force, "force", false, "replace an existing stack with the same name")
+	return cmd
+}
+
+func stackInspectCmd() *cobra.Command {
+	var trustedKeys string
+	cmd := &cobra.Command{
+		Use:          "inspect <bundle>",
+		Short:        "Show a bundle's contents and verify its checksums",
+		SilenceUsage: true,
+		Example:      "  nlab stack inspect basic.nlab.tar.zst",
+		Args:         cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			info, err := lab.InspectBundle(args[0], trustedKeys)
+			if err != nil {
+				return err
+			}
+			idx := info.Index
+			fmt.Printf("Stack:    %s\n", idx.Stack)
+			fmt.Printf("Created:  %s\n", idx.Created.Local().Format(time.RFC3339))
+			if idx.NlabVersion != "" {
+				fmt.Printf("nlab:     %s\n", idx.NlabVersion)
+			}
+			fmt.Println("\nFiles:")
+			for _, f := range idx.Files {
+				fmt.Printf("  %s  %10d  %s  %s\n", f.Mode, f.Size, f.SHA256[:12], f.Path)
+			}
+			fmt.Println("\nImages:")
+			for _, img := range info.Lock.Images {
+				sum := img.SHA256
+				if sum == "" {
+					sum = "(no checksum)"
+				}
+				bundled := ""
+				if img.Bundled {
+					bundled = "  [bundled]"
+				}
+				fmt.Printf("  %s  %s  %s%s\n", img.Name, img.Path, sum, bundled)
+			}
+			fmt.Println()
+			printBundleSignature(info)
+			lab.Ok("All checksums verified")
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&trustedKeys, "trusted-keys", "", "authorized_keys file of trusted signers")
+	return cmd
+}
+
+func printBundleSignature(info *lab.BundleInfo) {
+	switch {
+	case info.Trusted:
+		lab.Ok("Signed by trusted key " + info.Signer)
+	case info.Signed:
+		lab.Info("Signed by " + info.Signer + " (not checked against trusted keys)")
+	default:
+		lab.Info("Bundle is not signed")
+	}
+}
+
 // ── key ───────────────────────────────────────────────────────────────────────
 
 func keyCmd() *cobra.Command {
@@ -196,19 +956,112 @@ func keyCmd() *cobra.Command {
 		Use:   "key",
 		Short: "Manage per-stack SSH key pairs",
 	}
+
+	var vms []string
+	generateCmd := &cobra.Command{
+		Use:   "generate <stack>",
+		Short: "Generate an ed25519 SSH key pair for a stack",
+		Long: `Generates the stack key pair under ~/.local/share/nlab/keys/<stack>/ if it
+does not already exist. Keys are generated natively and written with mode
+0600; a key left in ./keys/<stack> by older nlab versions is moved there.
+
+With --vm, also generates a dedicated key pair for each named VM. VMs
+created afterwards authorize only their own key.
+
+Replaces: ./scripts/generate-key.sh <stack>`,
+		Example: `  nlab key generate basic
+  nlab key generate basic --vm target`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			if err := lab.EnsureKey(args[0]); err != nil {
+				return err
+			}
+			for _, role := range vms {
+				if err := lab.EnsureVMKey(args[0], role); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	generateCmd.Flags().StringSliceVar(&vms, "vm", nil, "Also generate a dedicated key pair for this VM role (repeatable)")
+	cmd.AddCommand(generateCmd)
+
+	var rotateVM string
+	var force bool
+	rotateCmd := &cobra.Command{
+		Use:          "rotate <stack>",
+		Short:        "Replace a stack's SSH key without losing access to running VMs",
+		SilenceUsage: true,
+		Long: `Generates a new key pair, pushes the new public key to every running VM
+that uses the old key, verifies that the new key logs in, and only then
+removes the old key from the VMs and from disk. If any VM rejects the new
+key, the change is rolled back.
+
+With --force, VMs that cannot be reached are skipped. They keep the old
+key, which is kept as id_ed25519.old and used to reach them until they are
+rotated again or recreated.
+
+With --vm, rotates (or creates) the dedicated key of a single VM instead.`,
+		Example: `  nlab key rotate basic
+  nlab key rotate basic --vm target`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			cfg, err := lab.LoadStack(args[0])
+			if err != nil {
+				return err
+			}
+			return lab.RotateKey(args[0], cfg, rotateVM, force)
+		},
+	}
+	rotateCmd.Flags().StringVar(&rotateVM, "vm", "", "Rotate the dedicated key of this VM role only")
+	rotateCmd.Flags().BoolVar(&force, "force", false, "Skip defined VMs that cannot be reached (they keep the old key, kept aside)")
+	cmd.AddCommand(rotateCmd)
+
 	cmd.AddCommand(&cobra.Command{
-		Use:   "generate <stack>",
-		Short: "Generate an ed25519 SSH key pair for a stack",
-		Long: `Generates keys/<stack>/id_ed25519 and keys/<stack>/id_ed25519.pub if they
-do not already exist.
+		Use:          "show <stack>",
+		Short:        "Show a stack's SSH keys and fingerprints",
+		SilenceUsage: true,
+		Example:      "  nlab key show basic",
+		Args:         cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			keys, err := lab.StackKeys(args[0])
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				scope := "stack"
+				if k.Role != "" {
+					scope = "vm " + k.Role
+				}
+				agent := "no"
+				if k.InAgent {
+					agent = "yes"
+				}
+				fmt.Printf("%s\n  path:        %s\n  fingerprint: %s\n  in agent:    %s\n  public key:  %s\n",
+					scope, k.Path, k.Fingerprint, agent, k.PublicKey)
+			}
+			return nil
+		},
+	})
 
-Replaces: ./scripts/generate-key.sh <stack>`,
-		Example: "  nlab key generate basic",
+	var lifetime time.Duration
+	agentCmd := &cobra.Command{
+		Use:          "agent <stack>",
+		Short:        "Load a stack's SSH keys into ssh-agent",
+		SilenceUsage: true,
+		Long: `Adds every key of the stack to the ssh-agent at $SSH_AUTH_SOCK. While the
+keys are loaded, tmux panes opened by nlab authenticate through the agent
+instead of referencing key files directly.`,
+		Example: "  nlab key agent basic --lifetime 8h",
 		Args:    cobra.ExactArgs(1),
 		RunE: func(_ *cobra.Command, args []string) error {
-			return lab.EnsureKey(args[0])
+			return lab.AgentAddKeys(args[0], lifetime)
 		},
-	})
+	}
+	agentCmd.Flags().DurationVar(&lifetime, "lifetime", 0, "Remove the keys from the agent after this long (0 = never)")
+	cmd.AddCommand(agentCmd)
+
 	return cmd
 }
 
@@ -223,10 +1076,13 @@ func networkCmd() *cobra.Command {
 	cmd.AddCommand(&cobra.Command{
 		Use:   "create <stack>",
 		Short: "Define and start the libvirt network for a stack",
-		Long: `Reads stacks/<stack>/stack.yaml, then defines, starts, and sets the
+		Long: `Reads the stack's stack.yaml, then defines, starts, and sets the
 network to autostart in libvirt using the XML embedded in the manifest.
+Every network in spec.networks is created; typed networks (cidr/mode/dhcp)
+are rendered to XML first, as shown by 'nlab render'. Networks with an
+egress allow-list get their rules in the nftables table nlab-<stack>.
 
-Replaces: ./scripts/create-network.sh stacks/<stack>/network.xml <network> <stack>`,
+Replaces: ./scripts/create-network.sh <network.xml> <network> <stack>`,
 		Example: "  nlab network create basic",
 		Args:    cobra.ExactArgs(1),
 		RunE: func(_ *cobra.Command, args []string) error {
@@ -235,15 +1091,20 @@ Replaces: ./scripts/create-network.sh stacks/<stack>/network.xml <network> <stac
 			if err != nil {
 				return err
 			}
-			return lab.CreateNetwork(cfg.NetworkXML, cfg.Network)
+			for _, n := range cfg.AllNetworks() {
+				if err := lab.CreateNetwork(stackName, n.XML, n.Name); err != nil {
+					return err
+				}
+			}
+			return lab.ApplyEgress(stackName, cfg)
 		},
 	})
 
 	cmd.AddCommand(&cobra.Command{
 		Use:   "destroy <stack>",
 		Short: "Stop and undefine the libvirt network for a stack",
-		Long: `Reads stacks/<stack>/stack.yaml for the network name, then stops and
-undefines the libvirt network.
+		Long: `Reads the stack's stack.yaml for the network name, then stops and
+undefines the libvirt network and removes the stack's egress rules.
 
 Replaces: ./scripts/destroy-network.sh <network>`,
 		Example: "  nlab network destroy basic",
@@ -253,13 +1114,170 @@ Replaces: ./scripts/destroy-network.sh <network>`,
 			if err != nil {
 				return err
 			}
-			return lab.DestroyNetwork(cfg.Network)
+			_, err = destroyNetworks(args[0], cfg)
+			return err
 		},
 	})
 
+	var deny string
+	var port int
+	verifyCmd := &cobra.Command{
+		Use:   "verify <stack>",
+		Short: "Probe from inside the VMs that each network's egress policy holds",
+		Long: `Connects to every VM on a network with an egress policy and, from the
+VM, opens TCP connections: to each allow-list entry on --port, which should
+get through, and to --deny, which should get through only under egress: nat.
+
+A probe reaches its destination when it connects or the destination
+refuses it, and is blocked when it is rejected on the way or has no route.
+A probe that times out proves nothing either way and is reported as a
+warning. Probes leave through the VM's default route, so a VM on several
+networks is checked against the policy of that route's network.`,
+		Example: `  nlab network verify basic
+  nlab network verify basic --deny 9.9.9.9:53 --port 80`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return verifyEgress(args[0], deny, port)
+		},
+	}
+	verifyCmd.Flags().StringVar(&deny, "deny", "1.1.1.1:443", "a host:port outside every allow-list")
+	verifyCmd.Flags().IntVar(&port, "port", 443, "the port to probe allow-list entries on")
+	cmd.AddCommand(verifyCmd)
+
+	var im types.ImpairmentSpec
+	var vm, network string
+	var clear bool
+	impairCmd := &cobra.Command{
+		Use:   "impair <stack>",
+		Short: "Add latency, loss or a bandwidth cap to VM links",
+		Long: `Puts tc netem (delay, jitter, loss) and tbf (rate) queueing disciplines
+on the tap devices that join the stack's running VMs to their networks,
+replacing any impairment already there. The traffic each VM receives on the
+link is degraded. --vm and --network narrow the links to one VM or one
+network, named as in the manifest also for an instance; by default every
+link of the stack is impaired.
+
+Impairments set here last until they are cleared with --clear or the VM
+stops; spec.networks.<n>.impairment applies one on every 'nlab up'.
+'nlab stack status' shows the active impairments. tc runs through sudo -n
+when nlab is not root.`,
+		Example: `  nlab network impair basic --vm target --delay 200ms --loss 5% --rate 1mbit
+  nlab network impair basic --network lab_net --delay 80ms --jitter 20ms
+  nlab network impair basic --vm target --clear`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			stackName := args[0]
+			if clear && im != (types.ImpairmentSpec{}) {
+				return fmt.Errorf("--clear cannot be combined with --delay, --jitter, --loss or --rate")
+			}
+			if !clear {
+				if errs := manifest.ValidateImpairment("impairment", im); len(errs) > 0 {
+					return errors.New(strings.Join(errs, "; "))
+				}
+			}
+			cfg, err := lab.LoadStack(stackName)
+			if err != nil {
+				return err
+			}
+			// --network names a network of the manifest; an instance's is
+			// named <network>-<instance> in libvirt.
+			var links []lab.VMLink
+			for _, l := range lab.StackLinks(stackName, cfg) {
+				onNetwork := network == "" || l.Network == network || l.Network == cfg.NetworkName(network)
+				if (vm == "" || l.VM == vm) && onNetwork {
+					links = append(links, l)
+				}
+			}
+			if len(links) == 0 {
+				return fmt.Errorf("stack %s has no running VM links matching --vm %q --network %q", stackName, vm, network)
+			}
+			for _, l := range links {
+				if clear {
+					err = lab.ClearImpairment(stackName, l)
+				} else {
+					err = lab.Impair(stackName, l, im)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	impairCmd.Flags().StringVar(&vm, "vm", "", "only the links of this VM role")
+	impairCmd.Flags().StringVar(&network, "network", "", "only the links on this network")
+	impairCmd.Flags().StringVar(&im.Delay, "delay", "", "delay added to every packet, e.g. 200ms")
+	impairCmd.Flags().StringVar(&im.Jitter, "jitter", "", "variation of the delay, e.g. 20ms")
+	impairCmd.Flags().StringVar(&im.Loss, "loss", "", "share of packets dropped, e.g. 5%")
+	impairCmd.Flags().StringVar(&im.Rate, "rate", "", "bandwidth cap, e.g. 1mbit")
+	impairCmd.Flags().BoolVar(&clear, "clear", false, "remove the impairments instead")
+	cmd.AddCommand(impairCmd)
+
 	return cmd
 }
 
+// verifyEgress runs the egress probes of stack and reports each; it fails
+// when a probe gets the opposite of what the policy says.
+func verifyEgress(stackName, deny string, port int) error {
+	if _, _, err := net.SplitHostPort(deny); err != nil {
+		return fmt.Errorf("--deny %q: want host:port", deny)
+	}
+	cfg, err := lab.LoadStack(stackName)
+	if err != nil {
+		return err
+	}
+	probes := lab.EgressProbes(cfg, deny, port)
+	if len(probes) == 0 {
+		lab.Skip(fmt.Sprintf("Stack %s has no VMs on a network with an egress policy", stackName))
+		return nil
+	}
+	client := lab.StackSSHClient(stackName)
+	defer client.Close()
+	failed := 0
+	for _, p := range probes {
+		// The VM is reached on the network being checked, or on another of
+		// its networks when the host has no address on that one.
+		onHost := false
+		for _, n := range cfg.HostNetworks {
+			onHost = onHost || n == p.Network
+		}
+		var ip string
+		if onHost {
+			ip, err = lab.VMAddress(stackName, p.Network, p.VM)
+		} else {
+			ip, err = lab.StackVMAddress(stackName, cfg, p.VM)
+		}
+		if err == nil {
+			client.SetHostAlias(ip, stackName+"-"+p.VM)
+		}
+		var got lab.ProbeResult
+		if err == nil {
+			got, err = lab.RunProbe(client, ip, p)
+		}
+		want := "blocked"
+		if p.Reach {
+			want = "reachable"
+		}
+		msg := fmt.Sprintf("%s (%s) → %s: %s", p.VM, p.Network, p.Dest, got)
+		switch {
+		case err != nil:
+			lab.Error(fmt.Sprintf("%s (%s) → %s: %v", p.VM, p.Network, p.Dest, err))
+			failed++
+		case got == lab.ProbeTimeout || got == lab.ProbeUnresolved:
+			lab.Warn(msg + ", should be " + want)
+		case (got == lab.ProbeReached) == p.Reach:
+			lab.Ok(msg)
+		default:
+			lab.Error(msg + ", should be " + want)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d egress probes failed", failed, len(probes))
+	}
+	return nil
+}
+
 // ── vm ────────────────────────────────────────────────────────────────────────
 
 func vmCmd() *cobra.Command {
@@ -275,7 +1293,7 @@ func vmCmd() *cobra.Command {
 		Use:   "create <stack> <role>",
 		Short: "Provision a single VM within a stack",
 		Long: `Creates a VM named <stack>-<role> using virt-install and cloud-init.
-VM specs (memory, vcpus) are read from stacks/<stack>/stack.yaml unless
+VM specs (memory, vcpus) are read from the stack's stack.yaml unless
 overridden with --memory / --vcpus flags.
 
 Replaces: ./scripts/create-vm.sh <stack> <role> <memory-mb> <vcpus> <network>`,
@@ -288,19 +1306,16 @@ Replaces: ./scripts/create-vm.sh <stack> <role> <memory-mb> <vcpus> <network>`,
 			if err != nil {
 				return err
 			}
+			if err := lab.ApplyImageLock(stackName, cfg); err != nil {
+				return err
+			}
+			spec, _ := cfg.VM(role)
 			mem, cpus := memory, vcpus
-			if mem == 0 || cpus == 0 {
-				for _, v := range cfg.VMs {
-					if v.Name == role {
-						if mem == 0 {
-							mem = v.Memory
-						}
-						if cpus == 0 {
-							cpus = v.VCPUs
-						}
-						break
-					}
-				}
+			if mem == 0 {
+				mem = spec.Memory
+			}
+			if cpus == 0 {
+				cpus = spec.VCPUs
 			}
 			if mem == 0 {
 				return fmt.Errorf("no memory spec found for role %q in stack.yaml; use --memory", role)
@@ -314,6 +1329,13 @@ Replaces: ./scripts/create-vm.sh <stack> <role> <memory-mb> <vcpus> <network>`,
 				Memory:  mem,
 				VCPUs:   cpus,
 				Network: cfg.Network,
+
+				Networks:  spec.Networks,
+				DiskSize:  spec.DiskSize,
+				Image:     spec.Image,
+				DiskDir:   cfg.DiskDir,
+				CloudInit: spec.CloudInit,
+				Params:    cfg.Params,
 			})
 		},
 	}
@@ -334,6 +1356,67 @@ Replaces: ./scripts/destroy-vm.sh <stack> <role>`,
 		},
 	})
 
+	cmd.AddCommand(&cobra.Command{
+		Use:   "exec <stack> <role> -- <command> [args...]",
+		Short: "Run a command on a VM over SSH",
+		Long: `Connects to <stack>-<role> with the stack's SSH key and runs the given
+command, streaming its stdin, stdout and stderr.`,
+		Example: "  nlab vm exec basic target -- systemctl status apache2",
+		Args:    cobra.MinimumNArgs(3),
+		RunE: func(_ *cobra.Command, args []string) error {
+			stackName, role := args[0], args[1]
+			cfg, err := lab.LoadStack(stackName)
+			if err != nil {
+				return err
+			}
+			ip, err := lab.VMAddress(stackName, cfg.Network, role)
+			if err != nil {
+				return err
+			}
+			client := lab.StackSSHClient(stackName)
+			defer client.Close()
+			client.SetHostAlias(ip, stackName+"-"+role)
+			return client.Run(ip, strings.Join(args[2:], " "), os.Stdin, os.Stdout, os.Stderr)
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "cp <stack> <src> <dst>",
+		Short: "Copy a file to or from a VM over SSH",
+		Long: `Copies a single file between the host and a VM. Exactly one of <src> and
+<dst> must be a remote path of the form <role>:<path>.`,
+		Example: `  nlab vm cp basic ./payload.sh attacker:/tmp/payload.sh
+  nlab vm cp basic target:/var/log/apache2/access.log ./access.log`,
+		Args: cobra.ExactArgs(3),
+		RunE: func(_ *cobra.Command, args []string) error {
+			stackName, src, dst := args[0], args[1], args[2]
+			srcRole, srcPath, srcRemote := strings.Cut(src, ":")
+			dstRole, dstPath, dstRemote := strings.Cut(dst, ":")
+			if srcRemote == dstRemote {
+				return fmt.Errorf("exactly one of <src> and <dst> must be <role>:<path>")
+			}
+			role := dstRole
+			if srcRemote {
+				role = srcRole
+			}
+			cfg, err := lab.LoadStack(stackName)
+			if err != nil {
+				return err
+			}
+			ip, err := lab.VMAddress(stackName, cfg.Network, role)
+			if err != nil {
+				return err
+			}
+			client := lab.StackSSHClient(stackName)
+			defer client.Close()
+			client.SetHostAlias(ip, stackName+"-"+role)
+			if srcRemote {
+				return client.CopyFrom(ip, srcPath, dst)
+			}
+			return client.CopyTo(ip, src, dstPath)
+		},
+	})
+
 	return cmd
 }
 
@@ -343,8 +1426,8 @@ func sessionCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "session <stack>",
 		Short: "Wait for SSH readiness then open a tmux session",
-		Long: `Polls each SSH VM defined in stacks/<stack>/layout.yaml until it is
-reachable, then opens a tmux session with the configured pane layout.
+		Long: `Polls each SSH VM in the stack's spec.tmux panes until it is reachable,
+then opens a tmux session with the configured windows and panes.
 
 Replaces: ./scripts/launch-tmux.sh <stack> <network>`,
 		Example: "  nlab session basic",
@@ -354,11 +1437,230 @@ Replaces: ./scripts/launch-tmux.sh <stack> <network>`,
 			if err != nil {
 				return err
 			}
-			return lab.LaunchTmux(args[0], cfg.Network)
+			return lab.LaunchTmux(args[0], cfg)
+		},
+	}
+}
+
+// ── ssh-config ────────────────────────────────────────────────────────────────
+
+func sshConfigCmd() *cobra.Command {
+	var printOnly, include bool
+	cmd := &cobra.Command{
+		Use:          "ssh-config <stack>",
+		Short:        "Write an Include-able OpenSSH config for a stack",
+		SilenceUsage: true,
+		Long: `Writes a "Host <stack>-<role>" block for every VM in the stack to
+~/.config/nlab/ssh/<stack>.conf, so that plain "ssh basic-target", scp and
+VS Code Remote work from any terminal. Each block pins the VM's host key via
+the stack's managed known_hosts file and uses ProxyJump for VMs the host
+cannot reach directly.
+
+The file only picks up VM addresses that are currently leased; "nlab up"
+and "nlab session" regenerate it once VMs are ready and "nlab down" removes
+it.
+
+On first use, nlab offers to add a single Include line to ~/.ssh/config that
+covers every stack.`,
+		Example: `  nlab ssh-config basic
+  nlab ssh-config basic --include   # add the Include line without asking
+  nlab ssh-config basic --print     # write to stdout instead`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			stackName := args[0]
+			cfg, err := lab.LoadStack(stackName)
+			if err != nil {
+				return err
+			}
+			if printOnly {
+				hosts, err := lab.StackSSHHosts(stackName, cfg)
+				if err != nil {
+					return err
+				}
+				fmt.Print(lab.RenderSSHConfig(stackName, hosts))
+				return nil
+			}
+			path, err := lab.WriteSSHConfig(stackName, cfg)
+			if err != nil {
+				return err
+			}
+			lab.Ok("SSH config written to " + path)
+			return offerSSHInclude(include)
+		},
+	}
+	cmd.Flags().BoolVar(&printOnly, "print", false, "Print the config to stdout instead of writing it")
+	cmd.Flags().BoolVar(&include, "include", false, "Add the Include line to ~/.ssh/config without prompting")
+	return cmd
+}
+
+// offerSSHInclude adds the nlab Include line to ~/.ssh/config when asked to,
+// or prompts for it on an interactive terminal.
+func offerSSHInclude(force bool) error {
+	userCfg, err := lab.UserSSHConfigPath()
+	if err != nil {
+		return err
+	}
+	line := lab.SSHIncludeLine()
+	has, err := lab.HasSSHInclude(userCfg, line)
+	if err != nil || has {
+		return err
+	}
+	if !force {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			lab.Info(fmt.Sprintf("Add this line to the top of %s to use it:\n    %s", userCfg, line))
+			return nil
+		}
+		fmt.Printf("Add %q to the top of %s? [y/N] ", line, userCfg)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			lab.Skip("Left " + userCfg + " unchanged")
+			return nil
+		}
+	}
+	if err := lab.AddSSHInclude(userCfg, line); err != nil {
+		return fmt.Errorf("update %s: %w", userCfg, err)
+	}
+	lab.Ok("Added Include line to " + userCfg)
+	return nil
+}
+
+// ── port-forward ──────────────────────────────────────────────────────────────
+
+func portForwardCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "port-forward <stack> [<role> [bind:]<host>:<guest>[/udp]...]",
+		Short: "Forward host ports to a VM until interrupted",
+		Long: `Listens on host ports and proxies each connection to a port of a VM, in
+userspace. The VM's address is looked up again every few seconds and
+whenever it stops answering, so a forward follows the VM to a new DHCP
+lease. Forwards bind to 127.0.0.1 unless a bind address is given; an IPv6
+address goes in brackets, as in [::1]:8080:80.
+
+With only <stack>, the ports in spec.vms.<role>.ports are forwarded; 'nlab
+up' starts this in the background and 'nlab down' stops it. Running
+forwarders are listed by 'nlab stack status'.`,
+		Example: `  nlab port-forward basic target 8080:80
+  nlab port-forward basic target 0.0.0.0:8443:443 5353:53/udp
+  nlab port-forward basic target [::1]:8080:80
+  nlab port-forward basic`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 2 {
+				return fmt.Errorf("%s: give at least one [bind:]<host>:<guest> to forward to", args[1])
+			}
+			return cobra.MinimumNArgs(1)(cmd, args)
+		},
+		RunE: func(_ *cobra.Command, args []string) error {
+			stackName := args[0]
+			cfg, err := lab.LoadStack(stackName)
+			if err != nil {
+				return err
+			}
+			forwards := lab.StackForwards(cfg)
+			if len(args) > 1 {
+				forwards = nil
+				role := args[1]
+				if !hasVM(cfg, role) {
+					return fmt.Errorf("stack %s has no VM %q", stackName, role)
+				}
+				for _, spec := range args[2:] {
+					f, err := lab.ParsePortForward(role, spec)
+					if err != nil {
+						return err
+					}
+					forwards = append(forwards, f)
+				}
+			} else if len(forwards) == 0 {
+				return fmt.Errorf("stack %s has no spec.vms.<role>.ports; give a role and ports to forward", stackName)
+			}
+			done := make(chan struct{})
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			defer signal.Stop(sig)
+			go func() {
+				<-sig
+				close(done)
+			}()
+			return lab.NewForwarder(stackName, cfg).Run(forwards, len(args) == 1, done)
 		},
 	}
 }
 
+func hasVM(cfg *lab.StackConfig, role string) bool {
+	for _, v := range cfg.VMs {
+		if v.Name == role {
+			return true
+		}
+	}
+	return false
+}
+
+// startPortForwarder runs 'nlab port-forward <stack>' in the background for
+// the manifest's ports, unless it already runs, and waits until it listens.
+func startPortForwarder(stackName string, cfg *lab.StackConfig) error {
+	if len(lab.StackForwards(cfg)) == 0 {
+		return nil
+	}
+	for _, r := range lab.ActiveForwards(stackName) {
+		if r.Manifest {
+			lab.Skip(fmt.Sprintf("Port forwarder %d already running", r.PID))
+			return nil
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("start port forwarder: %w", err)
+	}
+	logPath := filepath.Join(lab.DefaultXDGDirs().LogsDir(), stackName+"-ports.log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return fmt.Errorf("open log %s: %w", logPath, err)
+	}
+	defer logFile.Close()
+	args := []string{"port-forward", stackName}
+	if stackFile != "" {
+		args = append(args, "--file", stackFile)
+	}
+	// The forwarder inherits the environment, so only settings given as
+	// flags (such as --libvirt-uri) have to be passed on.
+	conf := lab.CurrentConfig()
+	for _, k := range lab.ConfigKeys() {
+		if conf.Source(k.Key) == lab.SourceFlag {
+			v, _ := conf.Get(k.Key)
+			args = append(args, "--"+k.Flag+"="+v)
+		}
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true} // outlives nlab up
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start port forwarder: %w", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+	deadline := time.After(5 * time.Second)
+	for {
+		for _, r := range lab.ActiveForwards(stackName) {
+			if r.PID == cmd.Process.Pid {
+				lab.Ok(fmt.Sprintf("Port forwarder %d started (%d forwards, log %s)", r.PID, len(r.Forwards), logPath))
+				return nil
+			}
+		}
+		select {
+		case <-exited:
+			// The lab is up all the same; a taken host port should not undo it.
+			lab.Warn(fmt.Sprintf("Port forwarder exited; see %s", logPath))
+			return nil
+		case <-deadline:
+			lab.Warn(fmt.Sprintf("Port forwarder %d has not started listening; see %s", cmd.Process.Pid, logPath))
+			return nil
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
 // ── dashboard ─────────────────────────────────────────────────────────────────
 
 func dashboardCmd() *cobra.Command {
@@ -384,12 +1686,65 @@ Replaces: ./scripts/create-dashboard.sh <stack> <network>`,
 	}
 }
 
+// ── events ────────────────────────────────────────────────────────────────────
+
+func eventsCmd() *cobra.Command {
+	var follow, asJSON bool
+	cmd := &cobra.Command{
+		Use:   "events <stack>",
+		Short: "Print the event journal for a stack",
+		Long: `Prints the structured events recorded for a stack: key generation and
+rotation, network and VM lifecycle, IP leases, SSH state changes and errors.
+
+Events are stored as JSON lines under the XDG state directory. --json prints
+them verbatim for scripting; --follow keeps printing new events as they are
+appended until interrupted.`,
+		Example: "  nlab events basic\n  nlab events basic --follow\n  nlab events basic --json | jq 'select(.type==\"error\")'",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			emit := func(e lab.Event) {
+				if asJSON {
+					line, _ := json.Marshal(e)
+					fmt.Println(string(line))
+					return
+				}
+				fmt.Println(e.Line())
+			}
+			if !follow {
+				events, err := lab.ReadEvents(args[0])
+				if err != nil {
+					return err
+				}
+				for _, e := range events {
+					emit(e)
+				}
+				return nil
+			}
+			done := make(chan struct{})
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			defer signal.Stop(sig)
+			go func() {
+				<-sig
+				close(done)
+			}()
+			return lab.FollowEvents(args[0], 500*time.Millisecond, done, emit)
+		},
+	}
+	cmd.Flags().BoolVar(&follow, "follow", false, "keep printing new events until interrupted")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "print events as JSON lines")
+	return cmd
+}
+
 // ── up ────────────────────────────────────────────────────────────────────────
 
 func upCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "up <stack>",
-		Short: "Stand up a complete lab stack",
+	var params paramFlags
+	var instance string
+	cmd := &cobra.Command{
+		Use:     "up <stack>",
+		Aliases: []string{"apply"},
+		Short:   "Stand up a complete lab stack",
 		Long: `Brings up the named stack end-to-end:
   1. nlab key generate  <stack>
   2. nlab network create <stack>
@@ -397,24 +1752,87 @@ func upCmd() *cobra.Command {
   4. nlab dashboard <stack>          (live progress display)
   5. nlab session <stack>            (tmux when all VMs are SSH-ready)
 
-Stack configuration is read from stacks/<stack>/stack.yaml.
+Stack configuration is read from ./stacks/<stack>/stack.yaml, then
+~/.local/share/nlab/stacks/<stack>/stack.yaml, or the file given with -f.
+
+spec.parameters take their defaults, overridden by --values and then --set.
+The effective values are saved in the stack state
+(~/.local/state/nlab/stacks/<stack>.yaml): later commands and a repeated
+'nlab up' without flags reuse them until 'nlab down'.
+
+--instance brings up a separate copy of the stack named <stack>-<instance>:
+its domains, networks, bridges, keys, tmux session and state all carry that
+name, and every network gets a subnet of its own from subnetPool. Later
+commands take the qualified name (nlab ssh basic-alice attacker).
 
 Replaces: make <stack>`,
-		Example: "  nlab up basic",
-		Args:    cobra.ExactArgs(1),
+		Example: `  nlab up basic
+  nlab up basic --instance alice
+  nlab up web --set targetVersion=2.4.49 --set targetPackages=apache2,php
+  nlab apply web --values thursday.yaml`,
+		Args: cobra.ExactArgs(1),
 		RunE: func(_ *cobra.Command, args []string) error {
-			return runUp(args[0])
+			values, err := params.values()
+			if err != nil {
+				return err
+			}
+			// Keys and logs an older nlab left in this working directory.
+			moved, err := lab.DefaultXDGDirs().MigrateLegacyDirs(".")
+			for _, path := range moved {
+				lab.Info("Migrated to " + path)
+			}
+			if err != nil {
+				return err
+			}
+			return runUp(args[0], instance, values)
 		},
 	}
+	params.register(cmd)
+	cmd.Flags().StringVar(&instance, "instance", "", "bring up a separate, namespaced copy of the stack")
+	return cmd
 }
 
-func runUp(stackName string) error {
-	cfg, err := lab.LoadStack(stackName)
+func runUp(stack, instance string, values map[string]interface{}) error {
+	if prev, err := lab.LoadStackState(stack); err == nil && instance == "" && prev.Instance != "" {
+		stack, instance = prev.Stack, prev.Instance // nlab up <stack>-<instance>
+	}
+	stackName := stack
+	var cfg *lab.StackConfig
+	var err error
+	if instance != "" {
+		stackName = lab.InstanceName(stack, instance)
+		cfg, err = lab.LoadInstanceParams(stack, instance, values)
+	} else {
+		cfg, err = lab.LoadStackParams(stack, values)
+	}
+	if err != nil {
+		return err
+	}
+	path, err := lab.ResolveStackFile(stack)
 	if err != nil {
 		return err
 	}
+	if err := lab.ApplyImageLock(stack, cfg); err != nil {
+		return err
+	}
+	st := lab.StackState{Manifest: path, Parameters: cfg.Params, Leases: cfg.Leases}
+	if instance != "" {
+		st.Stack, st.Instance = stack, instance
+	}
+	if prev, err := lab.LoadStackState(stackName); err == nil {
+		st.PreviousKeys = prev.PreviousKeys // VMs a forced key rotation skipped
+	}
+	if err := lab.SaveStackState(stackName, st); err != nil {
+		return err
+	}
+	for _, n := range cfg.NetworkDefs {
+		if l, ok := cfg.Leases[n.Name]; ok {
+			lab.Info(fmt.Sprintf("Network %s leased %s", n.Name, strings.TrimSpace(l.CIDR+" "+l.Bridge)))
+		}
+	}
 
-	if err := os.MkdirAll("logs", 0o755); err != nil {
+	logsDir := lab.DefaultXDGDirs().LogsDir()
+	if err := os.MkdirAll(logsDir, 0o700); err != nil {
 		return fmt.Errorf("create logs dir: %w", err)
 	}
 
@@ -422,7 +1840,12 @@ func runUp(stackName string) error {
 		return err
 	}
 
-	if err := lab.CreateNetwork(cfg.NetworkXML, cfg.Network); err != nil {
+	for _, n := range cfg.AllNetworks() {
+		if err := lab.CreateNetwork(stackName, n.XML, n.Name); err != nil {
+			return err
+		}
+	}
+	if err := lab.ApplyEgress(stackName, cfg); err != nil {
 		return err
 	}
 
@@ -444,7 +1867,7 @@ func runUp(stackName string) error {
 		vmWg.Add(1)
 		go func() {
 			defer vmWg.Done()
-			logPath := fmt.Sprintf("logs/%s.log", v.Name)
+			logPath := filepath.Join(logsDir, fmt.Sprintf("%s-%s.log", stackName, v.Name))
 			logFile, err := os.Create(logPath)
 			if err != nil {
 				errs <- fmt.Errorf("open log %s: %w", logPath, err)
@@ -459,6 +1882,13 @@ func runUp(stackName string) error {
 				VCPUs:   v.VCPUs,
 				Network: cfg.Network,
 				Out:     logFile, // redirect virt-install / cloud-localds away from stdout
+
+				Networks:  v.Networks,
+				DiskSize:  v.DiskSize,
+				Image:     v.Image,
+				DiskDir:   cfg.DiskDir,
+				CloudInit: v.CloudInit,
+				Params:    cfg.Params,
 			}); err != nil {
 				errs <- fmt.Errorf("create VM %s: %w", v.Name, err)
 			}
@@ -475,14 +1905,22 @@ func runUp(stackName string) error {
 			return e
 		}
 	}
+	if err := lab.ApplyImpairments(stackName, cfg); err != nil {
+		return err
+	}
+	if err := startPortForwarder(stackName, cfg); err != nil {
+		return err
+	}
 
-	return lab.LaunchTmux(stackName, cfg.Network)
+	return lab.LaunchTmux(stackName, cfg)
 }
 
 // ── down ──────────────────────────────────────────────────────────────────────
 
 func downCmd() *cobra.Command {
-	return &cobra.Command{
+	var instance string
+	var all bool
+	cmd := &cobra.Command{
 		Use:   "down <stack>",
 		Short: "Tear down a complete lab stack",
 		Long: `Destroys every VM in the stack (and their storage), then removes the
@@ -492,15 +1930,57 @@ Equivalent to running:
   nlab vm destroy <stack> <role>  (for each VM)
   nlab network destroy <stack>
 
-Stack configuration is read from stacks/<stack>/stack.yaml.
+Stack configuration is read from ./stacks/<stack>/stack.yaml, then
+~/.local/share/nlab/stacks/<stack>/stack.yaml, or the file given with -f.
+
+--instance tears down one instance (the same as 'nlab down <stack>-<instance>');
+--all-instances tears down every instance of the stack, leaving the stack
+itself up.
 
 Replaces: make <stack>-destroy`,
-		Example: "  nlab down basic",
-		Args:    cobra.ExactArgs(1),
+		Example: `  nlab down basic
+  nlab down basic --instance alice
+  nlab down basic --all-instances`,
+		Args: cobra.ExactArgs(1),
 		RunE: func(_ *cobra.Command, args []string) error {
+			switch {
+			case instance != "" && all:
+				return fmt.Errorf("--instance and --all-instances cannot be combined")
+			case instance != "":
+				return runDown(lab.InstanceName(args[0], instance))
+			case all:
+				return downInstances(args[0])
+			}
 			return runDown(args[0])
 		},
 	}
+	cmd.Flags().StringVar(&instance, "instance", "", "tear down this instance of the stack")
+	cmd.Flags().BoolVar(&all, "all-instances", false, "tear down every instance of the stack")
+	return cmd
+}
+
+// downInstances tears down every instance of stack, reporting the first
+// failure after attempting them all.
+func downInstances(stack string) error {
+	var first error
+	found := false
+	for _, in := range lab.ListInstances() {
+		if in.Stack != stack {
+			continue
+		}
+		found = true
+		lab.Info(fmt.Sprintf("Tearing down instance %s", in.Qualified()))
+		if err := runDown(in.Qualified()); err != nil {
+			lab.Error(err.Error())
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if !found {
+		lab.Skip(fmt.Sprintf("Stack %s has no instances up", stack))
+	}
+	return first
 }
 
 func runDown(stackName string) error {
@@ -509,13 +1989,46 @@ func runDown(stackName string) error {
 		return err
 	}
 
+	if err := lab.StopForwards(stackName); err != nil {
+		lab.Error(err.Error())
+	}
+	if err := lab.ClearImpairments(stackName, cfg); err != nil {
+		lab.Error(err.Error())
+	}
 	for _, v := range cfg.VMs {
 		if err := lab.DestroyVM(stackName, v.Name); err != nil {
 			lab.Error(err.Error())
 		}
 	}
 
-	return lab.DestroyNetwork(cfg.Network)
+	if err := lab.RemoveSSHConfig(stackName); err != nil {
+		lab.Error(err.Error())
+	}
+
+	// Leases are released only once their networks are gone, so a network
+	// left behind keeps its subnet and bridge from the next nlab up.
+	failed, err := destroyNetworks(stackName, cfg)
+	if rerr := lab.ReleaseStackState(stackName, failed); rerr != nil {
+		lab.Error(rerr.Error())
+	}
+	return err
+}
+
+// destroyNetworks removes the stack's egress rules and every network of the
+// stack, reporting the networks that could not be removed and the first
+// failure after attempting them all.
+func destroyNetworks(stackName string, cfg *lab.StackConfig) ([]string, error) {
+	first := lab.RemoveEgress(stackName, cfg)
+	var failed []string
+	for _, n := range cfg.AllNetworks() {
+		if err := lab.DestroyNetwork(stackName, n.Name); err != nil {
+			failed = append(failed, n.Name)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return failed, first
 }
 
 // ── list ──────────────────────────────────────────────────────────────────────
@@ -529,7 +2042,7 @@ func listCmd() *cobra.Command {
 Replaces: make list`,
 		Example: "  nlab list",
 		RunE: func(_ *cobra.Command, _ []string) error {
-			cmd := exec.Command("virsh", "--connect", "qemu:///system", "list", "--all")
+			cmd := exec.Command("virsh", "--connect", lab.CurrentConfig().LibvirtURI, "list", "--all")
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
 			return cmd.Run()
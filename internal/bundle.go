@@ -0,0 +1,576 @@
+package lab
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+// Bundle archive layout. The index is always the first entry so a reader
+// knows every checksum before it sees any payload.
+const (
+	BundleFormat     = "nlab.io/bundle/v1"
+	bundleIndexName  = "nlab-bundle.json"
+	bundleSigName    = "nlab-bundle.sig"
+	bundleLockName   = "images.lock"
+	bundleStackDir   = "stack/"
+	bundleImagesDir  = "images/"
+	bundleBaseImage  = "base"
+	bundleFileSuffix = ".nlab.tar.zst"
+)
+
+// BundleIndex is the metadata index stored as the first entry of a bundle.
+type BundleIndex struct {
+	Format      string       `json:"format"`
+	Stack       string       `json:"stack"`
+	Created     time.Time    `json:"created"`
+	NlabVersion string       `json:"nlabVersion,omitempty"`
+	Files       []BundleFile `json:"files"`
+}
+
+// BundleFile is one archived file with its permissions and checksum.
+type BundleFile struct {
+	Path   string      `json:"path"`
+	Mode   fs.FileMode `json:"mode"`
+	Size   int64       `json:"size"`
+	SHA256 string      `json:"sha256"`
+}
+
+// ImageLock pins the base images a stack expects.
+type ImageLock struct {
+	Images []ImageRef `yaml:"images"`
+}
+
+// ImageRef is one locked image reference.
+type ImageRef struct {
+	Name    string `yaml:"name"`
+	URL     string `yaml:"url,omitempty"`
+	Path    string `yaml:"path"`             // where the stack expects the image on the host
+	SHA256  string `yaml:"sha256,omitempty"` // empty when the image was not present at pack time
+	Size    int64  `yaml:"size,omitempty"`
+	Bundled bool   `yaml:"bundled,omitempty"` // the image itself is inside the bundle
+}
+
+// bundleSignature is the detached signature over the index bytes.
+type bundleSignature struct {
+	PublicKey string `json:"publicKey"` // authorized_keys format
+	Format    string `json:"format"`
+	Blob      []byte `json:"blob"`
+}
+
+// PackOptions controls PackStack.
+type PackOptions struct {
+	Stack         string
+	Output        string // defaults to ./<stack>.nlab.tar.zst
+	IncludeImages bool   // embed the base image for offline hand-off
+	SignKey       string // private SSH key used to sign the index
+	Version       string // nlab version recorded in the index
+}
+
+// PackStack writes the stack's manifest, cloud-init files and layout, an
+// image lock and a checksummed index into a tar.zst bundle. It returns the
+// output path.
+func PackStack(opts PackOptions) (string, error) {
+	dir, err := StackDir(opts.Stack)
+	if err != nil {
+		return "", err
+	}
+	out := opts.Output
+	if out == "" {
+		out = opts.Stack + bundleFileSuffix
+	}
+
+	type source struct {
+		file BundleFile
+		from string // on-disk path; empty for in-memory content
+		data []byte
+	}
+	var sources []source
+
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return fmt.Errorf("%s: only regular files can be bundled", p)
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == bundleLockName {
+			return nil // left by a previous unpack; regenerated below
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum, err := sha256File(p)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, source{
+			file: BundleFile{Path: bundleStackDir + filepath.ToSlash(rel), Mode: fi.Mode().Perm(), Size: fi.Size(), SHA256: sum},
+			from: p,
+		})
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("read stack %s: %w", dir, err)
+	}
+
+	ref := ImageRef{Name: bundleBaseImage, URL: conf.ImageURL, Path: conf.BaseImage}
+	if fi, err := os.Stat(conf.BaseImage); err == nil {
+		Info(fmt.Sprintf("Checksumming base image %s", conf.BaseImage))
+		if ref.SHA256, err = sha256File(conf.BaseImage); err != nil {
+			return "", fmt.Errorf("checksum base image: %w", err)
+		}
+		ref.Size = fi.Size()
+		if opts.IncludeImages {
+			ref.Bundled = true
+			sources = append(sources, source{
+				file: BundleFile{Path: bundleImagesDir + filepath.Base(conf.BaseImage), Mode: 0o644, Size: fi.Size(), SHA256: ref.SHA256},
+				from: conf.BaseImage,
+			})
+		}
+	} else if opts.IncludeImages {
+		return "", fmt.Errorf("cannot include base image: %w", err)
+	} else {
+		Skip(fmt.Sprintf("Base image %s not present; image lock records no checksum", conf.BaseImage))
+	}
+	lock, err := yaml.Marshal(ImageLock{Images: []ImageRef{ref}})
+	if err != nil {
+		return "", err
+	}
+	sources = append(sources, source{
+		file: BundleFile{Path: bundleLockName, Mode: 0o644, Size: int64(len(lock)), SHA256: sha256Hex(lock)},
+		data: lock,
+	})
+
+	sort.SliceStable(sources, func(i, j int) bool { return sources[i].file.Path < sources[j].file.Path })
+	index := BundleIndex{Format: BundleFormat, Stack: opts.Stack, Created: time.Now().UTC(), NlabVersion: opts.Version}
+	for _, s := range sources {
+		index.Files = append(index.Files, s.file)
+	}
+	indexBytes, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	var sigBytes []byte
+	if opts.SignKey != "" {
+		if sigBytes, err = signBundleIndex(opts.SignKey, indexBytes); err != nil {
+			return "", err
+		}
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return "", err
+	}
+	ok := false
+	defer func() {
+		f.Close()
+		if !ok {
+			_ = os.Remove(out)
+		}
+	}()
+	zw, err := zstd.NewWriter(f)
+	if err != nil {
+		return "", err
+	}
+	tw := tar.NewWriter(zw)
+
+	writeEntry := func(name string, mode fs.FileMode, size int64, r io.Reader) error {
+		hdr := &tar.Header{Name: name, Mode: int64(mode), Size: size, ModTime: index.Created, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	}
+	if err := writeEntry(bundleIndexName, 0o644, int64(len(indexBytes)), bytes.NewReader(indexBytes)); err != nil {
+		return "", err
+	}
+	if sigBytes != nil {
+		if err := writeEntry(bundleSigName, 0o644, int64(len(sigBytes)), bytes.NewReader(sigBytes)); err != nil {
+			return "", err
+		}
+	}
+	for _, s := range sources {
+		var r io.Reader = bytes.NewReader(s.data)
+		if s.from != "" {
+			src, err := os.Open(s.from)
+			if err != nil {
+				return "", err
+			}
+			defer src.Close()
+			r = src
+		}
+		if err := writeEntry(s.file.Path, s.file.Mode, s.file.Size, r); err != nil {
+			return "", fmt.Errorf("write %s: %w", s.file.Path, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	ok = true
+	return out, nil
+}
+
+func signBundleIndex(keyPath string, index []byte) ([]byte, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read signing key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse signing key %s: %w", keyPath, err)
+	}
+	sig, err := signer.Sign(rand.Reader, index)
+	if err != nil {
+		return nil, fmt.Errorf("sign bundle: %w", err)
+	}
+	return json.MarshalIndent(bundleSignature{
+		PublicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))),
+		Format:    sig.Format,
+		Blob:      sig.Blob,
+	}, "", "  ")
+}
+
+// BundleInfo is what InspectBundle and UnpackBundle learned about a bundle.
+type BundleInfo struct {
+	Index  BundleIndex
+	Lock   ImageLock
+	Signed bool
+	// Signer is the SHA256 fingerprint of the signing key, when signed.
+	Signer string
+	// Trusted is true when the signature verified against a trusted key.
+	Trusted bool
+}
+
+// UnpackOptions controls UnpackBundle.
+type UnpackOptions struct {
+	Dest             string // parent directory; defaults to XDGDirs.StacksDir
+	TrustedKeys      string // authorized_keys-style file of trusted signers
+	RequireSignature bool
+	Force            bool // replace an existing stack directory
+}
+
+// InspectBundle reads a bundle and verifies every checksum and, with
+// trustedKeys, the signature. Nothing is written to disk.
+func InspectBundle(bundlePath, trustedKeys string) (*BundleInfo, error) {
+	return readBundle(bundlePath, trustedKeys, nil)
+}
+
+// UnpackBundle verifies a bundle and installs its stack under opts.Dest and
+// any bundled images under XDGDirs.ImagesDir. Files are staged and only moved
+// into place once every checksum has matched. The installed images.lock
+// names the image this host will use: the bundled copy, or the configured
+// baseImage. It returns the stack directory.
+func UnpackBundle(bundlePath string, opts UnpackOptions) (*BundleInfo, string, error) {
+	dest := opts.Dest
+	if dest == "" {
+		dest = DefaultXDGDirs().StacksDir()
+	}
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		return nil, "", err
+	}
+	stage, err := os.MkdirTemp(dest, ".unpack-")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.RemoveAll(stage)
+
+	info, err := readBundle(bundlePath, opts.TrustedKeys, func(name string, mode fs.FileMode, r io.Reader) error {
+		mode = mode.Perm() // never setuid, setgid or sticky from a bundle
+		p := filepath.Join(stage, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Chmod(mode); err != nil { // not subject to umask
+			f.Close()
+			return err
+		}
+		return f.Close()
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if opts.RequireSignature && !info.Trusted {
+		return info, "", fmt.Errorf("bundle is not signed by a trusted key")
+	}
+	if err := ValidateStackName(info.Index.Stack); err != nil {
+		return info, "", fmt.Errorf("bundle: %w", err)
+	}
+
+	target := filepath.Join(dest, info.Index.Stack)
+	if _, err := os.Stat(target); err == nil {
+		if !opts.Force {
+			return info, "", fmt.Errorf("%s already exists (use --force to replace it)", target)
+		}
+		if err := os.RemoveAll(target); err != nil {
+			return info, "", err
+		}
+	}
+	if err := os.Rename(filepath.Join(stage, "stack"), target); err != nil {
+		return info, "", fmt.Errorf("install stack: %w", err)
+	}
+
+	for i, ref := range info.Lock.Images {
+		if !ref.Bundled {
+			info.Lock.Images[i].Path = conf.BaseImage
+			continue
+		}
+		img := filepath.Join(stage, "images", filepath.Base(ref.Path))
+		dst := filepath.Join(DefaultXDGDirs().ImagesDir(), filepath.Base(ref.Path))
+		if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+			return info, "", err
+		}
+		if err := moveFile(img, dst); err != nil {
+			return info, "", fmt.Errorf("install image: %w", err)
+		}
+		info.Lock.Images[i].Path = dst
+		Ok(fmt.Sprintf("Bundled image saved to %s", dst))
+	}
+	lock, err := yaml.Marshal(info.Lock)
+	if err != nil {
+		return info, "", err
+	}
+	if err := os.WriteFile(filepath.Join(target, bundleLockName), lock, 0o644); err != nil {
+		return info, "", fmt.Errorf("install image lock: %w", err)
+	}
+	return info, target, nil
+}
+
+// ApplyImageLock points the VMs of an unpacked stack that use the base image
+// at the image its images.lock names, and checks that image against the
+// lock's SHA-256. A stack without a lock is left as it is.
+func ApplyImageLock(stack string, cfg *StackConfig) error {
+	dir, err := StackDir(stack)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, bundleLockName)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var lock ImageLock
+	if err := yaml.Unmarshal(data, &lock); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, ref := range lock.Images {
+		if ref.Name != bundleBaseImage || ref.Path == "" {
+			continue
+		}
+		for i, vm := range cfg.VMs {
+			if vm.Image == "" || vm.Image == conf.BaseImage {
+				cfg.VMs[i].Image = ref.Path
+			}
+		}
+		if ref.SHA256 == "" || !fileExists(ref.Path) {
+			continue // createVM reports a missing image
+		}
+		Info(fmt.Sprintf("Verifying %s against %s", ref.Path, bundleLockName))
+		sum, err := sha256File(ref.Path)
+		if err != nil {
+			return fmt.Errorf("checksum %s: %w", ref.Path, err)
+		}
+		if sum != ref.SHA256 {
+			return fmt.Errorf("base image %s does not match %s: sha256 is %s, the lock has %s", ref.Path, path, sum, ref.SHA256)
+		}
+	}
+	return nil
+}
+
+// readBundle streams a bundle, checking each entry against the index. extract,
+// when non-nil, receives the content of every payload entry; the checksum is
+// verified as the content is read and a mismatch aborts with an error.
+func readBundle(bundlePath, trustedKeys string, extract func(string, fs.FileMode, io.Reader) error) (*BundleInfo, error) {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: not a zstd stream: %w", bundlePath, err)
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != bundleIndexName {
+		return nil, fmt.Errorf("%s: not an nlab bundle (missing %s)", bundlePath, bundleIndexName)
+	}
+	indexBytes, err := io.ReadAll(tr)
+	if err != nil {
+		return nil, err
+	}
+	info := &BundleInfo{}
+	if err := json.Unmarshal(indexBytes, &info.Index); err != nil {
+		return nil, fmt.Errorf("parse bundle index: %w", err)
+	}
+	if info.Index.Format != BundleFormat {
+		return nil, fmt.Errorf("unsupported bundle format %q (want %s)", info.Index.Format, BundleFormat)
+	}
+	want := make(map[string]BundleFile, len(info.Index.Files))
+	for _, bf := range info.Index.Files {
+		if err := checkBundlePath(bf.Path); err != nil {
+			return nil, err
+		}
+		want[bf.Path] = bf
+	}
+
+	seen := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read bundle: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("bundle entry %s is not a regular file", hdr.Name)
+		}
+		if hdr.Name == bundleSigName {
+			sigBytes, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			if err := verifyBundleSignature(info, indexBytes, sigBytes, trustedKeys); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		bf, ok := want[hdr.Name]
+		if !ok {
+			return nil, fmt.Errorf("bundle entry %s is not listed in the index", hdr.Name)
+		}
+		if seen[hdr.Name] {
+			return nil, fmt.Errorf("bundle entry %s appears twice", hdr.Name)
+		}
+		seen[hdr.Name] = true
+
+		h := sha256.New()
+		var buf bytes.Buffer
+		r := io.TeeReader(io.LimitReader(tr, bf.Size+1), h)
+		if hdr.Name == bundleLockName {
+			r = io.TeeReader(r, &buf)
+		}
+		if extract != nil {
+			err = extract(hdr.Name, bf.Mode, r)
+		} else {
+			_, err = io.Copy(io.Discard, r)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("extract %s: %w", hdr.Name, err)
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != bf.SHA256 {
+			return nil, fmt.Errorf("checksum mismatch for %s: index has %s, content is %s", hdr.Name, bf.SHA256, got)
+		}
+		if hdr.Name == bundleLockName {
+			if err := yaml.Unmarshal(buf.Bytes(), &info.Lock); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", bundleLockName, err)
+			}
+		}
+	}
+	for p := range want {
+		if !seen[p] {
+			return nil, fmt.Errorf("bundle is missing %s listed in the index", p)
+		}
+	}
+	if trustedKeys != "" && !info.Trusted {
+		return nil, fmt.Errorf("bundle is not signed by a key in %s", trustedKeys)
+	}
+	return info, nil
+}
+
+// checkBundlePath rejects absolute paths, parent references and anything
+// outside the known top-level entries.
+func checkBundlePath(p string) error {
+	clean := path.Clean(p)
+	if clean != p || path.IsAbs(p) || strings.HasPrefix(p, "../") || p == ".." {
+		return fmt.Errorf("bundle path %q is not allowed", p)
+	}
+	if p != bundleLockName && !strings.HasPrefix(p, bundleStackDir) && !strings.HasPrefix(p, bundleImagesDir) {
+		return fmt.Errorf("bundle path %q is outside stack/ and images/", p)
+	}
+	return nil
+}
+
+func verifyBundleSignature(info *BundleInfo, index, sigBytes []byte, trustedKeys string) error {
+	var s bundleSignature
+	if err := json.Unmarshal(sigBytes, &s); err != nil {
+		return fmt.Errorf("parse bundle signature: %w", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s.PublicKey))
+	if err != nil {
+		return fmt.Errorf("parse signer key: %w", err)
+	}
+	if err := pub.Verify(index, &ssh.Signature{Format: s.Format, Blob: s.Blob}); err != nil {
+		return fmt.Errorf("bundle signature does not match its index: %w", err)
+	}
+	info.Signed = true
+	info.Signer = ssh.FingerprintSHA256(pub)
+	if trustedKeys == "" {
+		return nil
+	}
+	data, err := os.ReadFile(trustedKeys)
+	if err != nil {
+		return fmt.Errorf("read trusted keys: %w", err)
+	}
+	for len(data) > 0 {
+		trusted, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		if bytes.Equal(trusted.Marshal(), pub.Marshal()) {
+			info.Trusted = true
+			break
+		}
+		data = rest
+	}
+	return nil
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,251 @@
+package lab_test
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/ssh"
+
+	lab "github.com/h3ow3d/nlab/internal"
+)
+
+// writeDemoStack creates ./stacks/demo with an executable hook to check that
+// file modes survive a round trip.
+func writeDemoStack(t *testing.T) {
+	t.Helper()
+	writeStackFile(t, filepath.Join("stacks", "demo", "stack.yaml"))
+	hook := filepath.Join("stacks", "demo", "attacker", "user-data")
+	if err := os.MkdirAll(filepath.Dir(hook), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(hook, []byte("#cloud-config\n"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	tmp := isolateXDG(t)
+	writeDemoStack(t)
+
+	key, pub := writeTestKey(t, tmp)
+	signerPub := filepath.Join(tmp, "trusted.pub")
+	if err := os.WriteFile(signerPub, ssh.MarshalAuthorizedKey(pub), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := lab.PackStack(lab.PackOptions{Stack: "demo", SignKey: key, Version: "test"})
+	if err != nil {
+		t.Fatalf("PackStack: %v", err)
+	}
+
+	info, err := lab.InspectBundle(out, signerPub)
+	if err != nil {
+		t.Fatalf("InspectBundle: %v", err)
+	}
+	if !info.Signed || !info.Trusted {
+		t.Errorf("signature: signed=%v trusted=%v, want both", info.Signed, info.Trusted)
+	}
+	if info.Index.Stack != "demo" || info.Index.NlabVersion != "test" {
+		t.Errorf("index = %+v", info.Index)
+	}
+	if len(info.Lock.Images) != 1 || info.Lock.Images[0].Path == "" {
+		t.Errorf("image lock = %+v", info.Lock)
+	}
+
+	_, dir, err := lab.UnpackBundle(out, lab.UnpackOptions{TrustedKeys: signerPub, RequireSignature: true})
+	if err != nil {
+		t.Fatalf("UnpackBundle: %v", err)
+	}
+	if want := filepath.Join(lab.DefaultXDGDirs().StacksDir(), "demo"); dir != want {
+		t.Errorf("unpacked to %s, want %s", dir, want)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "attacker", "user-data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o750 {
+		t.Errorf("mode = %o, want 750 preserved", fi.Mode().Perm())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "images.lock")); err != nil {
+		t.Errorf("images.lock not installed: %v", err)
+	}
+
+	if _, _, err := lab.UnpackBundle(out, lab.UnpackOptions{}); err == nil {
+		t.Error("unpacking over an existing stack without Force succeeded")
+	}
+	if _, _, err := lab.UnpackBundle(out, lab.UnpackOptions{Force: true}); err != nil {
+		t.Errorf("UnpackBundle with Force: %v", err)
+	}
+}
+
+func TestBundleRejectsUntrustedSigner(t *testing.T) {
+	tmp := isolateXDG(t)
+	writeDemoStack(t)
+
+	out, err := lab.PackStack(lab.PackOptions{Stack: "demo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(tmp, "other.pub")
+	if err := os.WriteFile(other, []byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGJ5dGVzYnl0ZXNieXRlc2J5dGVzYnl0ZXNieXRlc2J5dA== x\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lab.InspectBundle(out, other); err == nil {
+		t.Error("unsigned bundle passed a trusted-keys check")
+	}
+	if _, _, err := lab.UnpackBundle(out, lab.UnpackOptions{RequireSignature: true}); err == nil {
+		t.Error("unsigned bundle unpacked with RequireSignature")
+	}
+}
+
+func TestBundleDetectsTampering(t *testing.T) {
+	isolateXDG(t)
+
+	content := []byte("network: lab\n")
+	index := lab.BundleIndex{
+		Format: lab.BundleFormat,
+		Stack:  "demo",
+		Files: []lab.BundleFile{
+			{Path: "stack/stack.yaml", Mode: 0o644, Size: int64(len(content)), SHA256: hexSum([]byte("something else"))},
+		},
+	}
+	bad := writeRawBundle(t, index, map[string][]byte{"stack/stack.yaml": content})
+	if _, err := lab.InspectBundle(bad, ""); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("InspectBundle error = %v, want checksum mismatch", err)
+	}
+	if _, _, err := lab.UnpackBundle(bad, lab.UnpackOptions{}); err == nil {
+		t.Error("tampered bundle unpacked")
+	}
+	if _, err := os.Stat(filepath.Join(lab.DefaultXDGDirs().StacksDir(), "demo")); !os.IsNotExist(err) {
+		t.Error("tampered bundle left a stack behind")
+	}
+
+	index.Files[0] = lab.BundleFile{Path: "../escape", Mode: 0o644, Size: int64(len(content)), SHA256: hexSum(content)}
+	escape := writeRawBundle(t, index, map[string][]byte{"../escape": content})
+	if _, err := lab.InspectBundle(escape, ""); err == nil {
+		t.Error("bundle with a ../ path was accepted")
+	}
+}
+
+func hexSum(b []byte) string {
+	s := sha256.Sum256(b)
+	return hex.EncodeToString(s[:])
+}
+
+func writeRawBundle(t *testing.T, index lab.BundleIndex, files map[string][]byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "raw.nlab.tar.zst")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw, _ := zstd.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	add := func(name string, data []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx, _ := json.Marshal(index)
+	add("nlab-bundle.json", idx)
+	for _, bf := range index.Files {
+		add(bf.Path, files[bf.Path])
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// useBaseImage makes path the configured baseImage for the test.
+func useBaseImage(t *testing.T, path string) {
+	t.Helper()
+	cfg := lab.DefaultConfig()
+	if err := cfg.Set("baseImage", path, lab.SourceFlag); err != nil {
+		t.Fatal(err)
+	}
+	lab.SetConfig(cfg)
+	t.Cleanup(func() { lab.SetConfig(lab.DefaultConfig()) })
+}
+
+func TestBundleImageLock(t *testing.T) {
+	tmp := isolateXDG(t)
+	writeDemoStack(t)
+	packed := filepath.Join(tmp, "jammy.img")
+	if err := os.WriteFile(packed, []byte("base image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	useBaseImage(t, packed)
+	out, err := lab.PackStack(lab.PackOptions{Stack: "demo", IncludeImages: true})
+	if err != nil {
+		t.Fatalf("PackStack: %v", err)
+	}
+
+	// Unpacked on a host whose own base image lives elsewhere.
+	if err := os.RemoveAll("stacks"); err != nil {
+		t.Fatal(err)
+	}
+	useBaseImage(t, filepath.Join(tmp, "elsewhere.img"))
+	info, _, err := lab.UnpackBundle(out, lab.UnpackOptions{})
+	if err != nil {
+		t.Fatalf("UnpackBundle: %v", err)
+	}
+	bundled := filepath.Join(lab.DefaultXDGDirs().ImagesDir(), "jammy.img")
+	if len(info.Lock.Images) != 1 || info.Lock.Images[0].Path != bundled {
+		t.Errorf("image lock = %+v, want the bundled image at %s", info.Lock, bundled)
+	}
+
+	cfg := &lab.StackConfig{VMs: []lab.VMSpec{{Name: "a"}, {Name: "b", Image: "/srv/other.img"}}}
+	if err := lab.ApplyImageLock("demo", cfg); err != nil {
+		t.Fatalf("ApplyImageLock: %v", err)
+	}
+	if cfg.VMs[0].Image != bundled || cfg.VMs[1].Image != "/srv/other.img" {
+		t.Errorf("VM images = %q, %q; want the bundled base image and the VM's own", cfg.VMs[0].Image, cfg.VMs[1].Image)
+	}
+
+	if err := os.WriteFile(bundled, []byte("tampered"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := lab.ApplyImageLock("demo", cfg); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("ApplyImageLock with a changed image = %v, want a checksum error", err)
+	}
+}
+
+func TestBundleMasksFileModes(t *testing.T) {
+	isolateXDG(t)
+
+	content := []byte("network: lab\n")
+	index := lab.BundleIndex{
+		Format: lab.BundleFormat,
+		Stack:  "demo",
+		Files: []lab.BundleFile{
+			{Path: "stack/stack.yaml", Mode: 0o755 | fs.ModeSetuid | fs.ModeSticky, Size: int64(len(content)), SHA256: hexSum(content)},
+		},
+	}
+	_, dir, err := lab.UnpackBundle(writeRawBundle(t, index, map[string][]byte{"stack/stack.yaml": content}), lab.UnpackOptions{})
+	if err != nil {
+		t.Fatalf("UnpackBundle: %v", err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "stack.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != 0o755 {
+		t.Errorf("mode = %v, want -rwxr-xr-x", fi.Mode())
+	}
+}
@@ -0,0 +1,405 @@
+package lab
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the user-tunable settings read from XDGDirs.ConfigFile.
+// Effective values are resolved with the precedence
+// flags > NLAB_* environment > config file > defaults.
+type Config struct {
+	// LibvirtURI is the libvirt connection used by virsh and virt-install.
+	LibvirtURI string `yaml:"libvirtURI"`
+	// BaseImage is the qcow2 backing image new VMs are cloned from.
+	BaseImage string `yaml:"baseImage"`
+	// SSHUser is the login user created by cloud-init on every VM.
+	SSHUser string `yaml:"sshUser"`
+	// MaxWaitSeconds bounds how long the session waits for VMs to become
+	// SSH-ready.
+	MaxWaitSeconds int `yaml:"maxWaitSeconds"`
+	// ImageURL is the cloud image downloaded by 'nlab image download'. A
+	// SHA256SUMS file is expected next to it.
+	ImageURL string `yaml:"imageURL"`
+	// DownloadTimeout bounds the whole image download.
+	DownloadTimeout time.Duration `yaml:"downloadTimeout"`
+	// DashWidth is the inner width of the dashboard, in columns.
+	DashWidth int `yaml:"dashWidth"`
+	// SubnetPool is the IPv4 range networks with cidr: auto are allocated
+	// from.
+	SubnetPool string `yaml:"subnetPool"`
+	// StackPath lists the directories searched, in order, for
+	// <dir>/<stack>/stack.yaml, separated by ':'. Empty means ./stacks, then
+	// the stack library. Relative entries in the config file are relative
+	// to the file.
+	StackPath string `yaml:"stackPath"`
+
+	sources map[string]ConfigSource
+}
+
+// ConfigSource records where an effective setting came from.
+type ConfigSource string
+
+const (
+	SourceDefault ConfigSource = "default"
+	SourceFile    ConfigSource = "file"
+	SourceEnv     ConfigSource = "env"
+	SourceFlag    ConfigSource = "flag"
+)
+
+// DefaultConfig returns the built-in settings.
+func DefaultConfig() *Config {
+	return &Config{
+		LibvirtURI:      "qemu:///system",
+		BaseImage:       "/var/lib/libvirt/images/ubuntu-base.qcow2",
+		SSHUser:         "ubuntu",
+		MaxWaitSeconds:  180,
+		ImageURL:        "https://cloud-images.ubuntu.com/jammy/current/jammy-server-cloudimg-amd64.img",
+		DownloadTimeout: 20 * time.Minute,
+		DashWidth:       78,
+		SubnetPool:      "10.200.0.0/16",
+	}
+}
+
+// ConfigKey describes one setting: its config-file key, environment variable,
+// command-line flag and documentation.
+type ConfigKey struct {
+	Key  string
+	Env  string
+	Flag string
+	Doc  string
+
+	get func(*Config) string
+	set func(*Config, string) error
+}
+
+var configKeys = []ConfigKey{
+	{
+		Key: "libvirtURI", Env: "NLAB_LIBVIRT_URI", Flag: "libvirt-uri",
+		Doc: "libvirt connection URI",
+		get: func(c *Config) string { return c.LibvirtURI },
+		set: func(c *Config, v string) error { c.LibvirtURI = v; return nil },
+	},
+	{
+		Key: "baseImage", Env: "NLAB_BASE_IMAGE", Flag: "base-image",
+		Doc: "qcow2 backing image for new VMs",
+		get: func(c *Config) string { return c.BaseImage },
+		set: func(c *Config, v string) error { c.BaseImage = v; return nil },
+	},
+	{
+		Key: "sshUser", Env: "NLAB_SSH_USER", Flag: "ssh-user",
+		Doc: "login user created by cloud-init",
+		get: func(c *Config) string { return c.SSHUser },
+		set: func(c *Config, v string) error { c.SSHUser = v; return nil },
+	},
+	{
+		Key: "maxWaitSeconds", Env: "NLAB_MAX_WAIT_SECONDS", Flag: "max-wait-seconds",
+		Doc: "seconds to wait for VMs to become SSH-ready",
+		get: func(c *Config) string { return strconv.Itoa(c.MaxWaitSeconds) },
+		set: func(c *Config, v string) error { return setInt(&c.MaxWaitSeconds, v) },
+	},
+	{
+		Key: "imageURL", Env: "NLAB_IMAGE_URL", Flag: "image-url",
+		Doc: "cloud image URL (SHA256SUMS must sit next to it)",
+		get: func(c *Config) string { return c.ImageURL },
+		set: func(c *Config, v string) error { c.ImageURL = v; return nil },
+	},
+	{
+		Key: "downloadTimeout", Env: "NLAB_DOWNLOAD_TIMEOUT", Flag: "download-timeout",
+		Doc: "timeout for the base image download (e.g. 20m)",
+		get: func(c *Config) string { return c.DownloadTimeout.String() },
+		set: func(c *Config, v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid duration %q", v)
+			}
+			c.DownloadTimeout = d
+			return nil
+		},
+	},
+	{
+		Key: "dashWidth", Env: "NLAB_DASH_WIDTH", Flag: "dash-width",
+		Doc: "dashboard width in columns",
+		get: func(c *Config) string { return strconv.Itoa(c.DashWidth) },
+		set: func(c *Config, v string) error { return setInt(&c.DashWidth, v) },
+	},
+	{
+		Key: "subnetPool", Env: "NLAB_SUBNET_POOL", Flag: "subnet-pool",
+		Doc: "IPv4 range cidr: auto networks are allocated from",
+		get: func(c *Config) string { return c.SubnetPool },
+		set: func(c *Config, v string) error { c.SubnetPool = v; return nil },
+	},
+	{
+		Key: "stackPath", Env: "NLAB_STACK_PATH", Flag: "stack-path",
+		Doc: "':'-separated directories searched for stacks, in order",
+		get: func(c *Config) string { return strings.Join(c.stackPath(), string(os.PathListSeparator)) },
+		set: func(c *Config, v string) error { c.StackPath = v; return nil },
+	},
+}
+
+// stackPath returns the absolute directories of StackPath, or the default
+// ./stacks and stack library when it is empty.
+func (c *Config) stackPath() []string {
+	var dirs []string
+	for _, d := range filepath.SplitList(c.StackPath) {
+		if d != "" {
+			dirs = append(dirs, d)
+		}
+	}
+	if len(dirs) == 0 {
+		dirs = []string{"stacks", DefaultXDGDirs().StacksDir()}
+	}
+	for i, d := range dirs {
+		if abs, err := filepath.Abs(d); err == nil {
+			dirs[i] = abs
+		}
+	}
+	return dirs
+}
+
+func setInt(dst *int, v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid integer %q", v)
+	}
+	*dst = n
+	return nil
+}
+
+// ConfigKeys returns every supported setting in documentation order.
+func ConfigKeys() []ConfigKey {
+	return append([]ConfigKey(nil), configKeys...)
+}
+
+func lookupConfigKey(key string) (ConfigKey, error) {
+	for _, k := range configKeys {
+		if k.Key == key {
+			return k, nil
+		}
+	}
+	names := make([]string, len(configKeys))
+	for i, k := range configKeys {
+		names[i] = k.Key
+	}
+	sort.Strings(names)
+	return ConfigKey{}, fmt.Errorf("unknown config key %q (valid keys: %s)", key, strings.Join(names, ", "))
+}
+
+// Get returns the effective value of key formatted as it would be written in
+// the config file.
+func (c *Config) Get(key string) (string, error) {
+	k, err := lookupConfigKey(key)
+	if err != nil {
+		return "", err
+	}
+	return k.get(c), nil
+}
+
+// Set parses value into key and records src as its source. The result is not
+// validated; call Validate once every layer has been applied.
+func (c *Config) Set(key, value string, src ConfigSource) error {
+	k, err := lookupConfigKey(key)
+	if err != nil {
+		return err
+	}
+	if err := k.set(c, value); err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	if c.sources == nil {
+		c.sources = make(map[string]ConfigSource)
+	}
+	c.sources[key] = src
+	return nil
+}
+
+// Source reports where the effective value of key came from.
+func (c *Config) Source(key string) ConfigSource {
+	if s, ok := c.sources[key]; ok {
+		return s
+	}
+	return SourceDefault
+}
+
+// Validate checks every setting and returns the first problem found.
+func (c *Config) Validate() error {
+	switch {
+	case !strings.Contains(c.LibvirtURI, "://"):
+		return fmt.Errorf("libvirtURI %q is not a libvirt URI (e.g. qemu:///system)", c.LibvirtURI)
+	case !filepath.IsAbs(c.BaseImage):
+		return fmt.Errorf("baseImage %q must be an absolute path", c.BaseImage)
+	case c.SSHUser == "" || strings.ContainsAny(c.SSHUser, " \t:@"):
+		return fmt.Errorf("sshUser %q is not a valid user name", c.SSHUser)
+	case c.MaxWaitSeconds <= 0:
+		return fmt.Errorf("maxWaitSeconds must be positive, got %d", c.MaxWaitSeconds)
+	case c.DownloadTimeout <= 0:
+		return fmt.Errorf("downloadTimeout must be positive, got %s", c.DownloadTimeout)
+	case c.DashWidth < 60:
+		return fmt.Errorf("dashWidth must be at least 60, got %d", c.DashWidth)
+	}
+	if ip, pool, err := net.ParseCIDR(c.SubnetPool); err != nil || ip.To4() == nil || !ip.Equal(pool.IP) {
+		return fmt.Errorf("subnetPool %q must be an IPv4 network such as 10.200.0.0/16", c.SubnetPool)
+	}
+	u, err := url.Parse(c.ImageURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("imageURL %q must be an http(s) URL", c.ImageURL)
+	}
+	if strings.HasSuffix(u.Path, "/") || u.Path == "" {
+		return fmt.Errorf("imageURL %q must name a file", c.ImageURL)
+	}
+	return nil
+}
+
+// LoadConfig resolves settings from the defaults, the config file at path (a
+// missing file is not an error) and NLAB_* environment variables. Flags are
+// applied by the caller with Set; call Validate once they have been.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+	values, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range configKeys {
+		if v, ok := values[k.Key]; ok {
+			if err := c.Set(k.Key, v, SourceFile); err != nil {
+				return nil, fmt.Errorf("config %s: %w", path, err)
+			}
+		}
+	}
+	if c.Source("stackPath") == SourceFile {
+		// Relative to the config file, not to wherever nlab runs.
+		dirs := filepath.SplitList(c.StackPath)
+		for i, d := range dirs {
+			if d != "" && !filepath.IsAbs(d) {
+				dirs[i] = filepath.Join(filepath.Dir(path), d)
+			}
+		}
+		c.StackPath = strings.Join(dirs, string(os.PathListSeparator))
+	}
+	for _, k := range configKeys {
+		if v, ok := os.LookupEnv(k.Env); ok && v != "" {
+			if err := c.Set(k.Key, v, SourceEnv); err != nil {
+				return nil, fmt.Errorf("%s: %w", k.Env, err)
+			}
+		}
+	}
+	return c, nil
+}
+
+// readConfigFile returns the scalar values set in the config file, keyed by
+// config key. Unknown keys are rejected so typos do not go unnoticed.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read config %s: %w", path, err)
+	}
+	var raw map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	values := make(map[string]string, len(raw))
+	for key, node := range raw {
+		if _, err := lookupConfigKey(key); err != nil {
+			return nil, fmt.Errorf("config %s line %d: %w", path, node.Line, err)
+		}
+		if node.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("config %s line %d: %s must be a scalar", path, node.Line, key)
+		}
+		values[key] = node.Value
+	}
+	return values, nil
+}
+
+// SetConfigFileValue validates value for key and writes it to the config file
+// at path, creating the file if needed. Comments and other keys are kept.
+func SetConfigFileValue(path, key, value string) error {
+	probe := DefaultConfig()
+	if err := probe.Set(key, value, SourceFile); err != nil {
+		return err
+	}
+	if err := probe.Validate(); err != nil {
+		return err
+	}
+
+	var doc yaml.Node
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read config %s: %w", path, err)
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("parse config %s: %w", path, err)
+		}
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	m := doc.Content[0]
+	if m.Kind != yaml.MappingNode {
+		return fmt.Errorf("config %s: top level must be a mapping", path)
+	}
+	updated := false
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content[i+1] = &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+			updated = true
+		}
+	}
+	if !updated {
+		m.Content = append(m.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: key},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: value})
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return fmt.Errorf("encode config: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("create config dir: %w", err)
+	}
+	return writeFileAtomic(path, buf.Bytes(), 0o600)
+}
+
+// RenderConfig formats the effective settings as config-file YAML, annotating
+// each line with where the value came from.
+func RenderConfig(c *Config) string {
+	lines := make([]string, len(configKeys))
+	width := 0
+	for i, k := range configKeys {
+		lines[i] = fmt.Sprintf("%s: %s", k.Key, k.get(c))
+		width = max(width, len(lines[i]))
+	}
+	var b strings.Builder
+	for i, k := range configKeys {
+		fmt.Fprintf(&b, "%-*s  # %s\n", width, lines[i], c.Source(k.Key))
+	}
+	return b.String()
+}
+
+// conf holds the settings in effect for this process.
+var conf = DefaultConfig()
+
+// SetConfig makes c the settings in effect for this process.
+func SetConfig(c *Config) {
+	conf = c
+}
+
+// CurrentConfig returns the settings in effect for this process.
+func CurrentConfig() *Config {
+	return conf
+}
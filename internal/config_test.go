@@ -0,0 +1,121 @@
+package lab_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	lab "github.com/h3ow3d/nlab/internal"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("sshUser: kali\nmaxWaitSeconds: 300\ndownloadTimeout: 45m\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("NLAB_MAX_WAIT_SECONDS", "600")
+
+	cfg, err := lab.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if err := cfg.Set("sshUser", "root", lab.SourceFlag); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	for _, tc := range []struct {
+		key, want string
+		src       lab.ConfigSource
+	}{
+		{"sshUser", "root", lab.SourceFlag},
+		{"maxWaitSeconds", "600", lab.SourceEnv},
+		{"downloadTimeout", "45m0s", lab.SourceFile},
+		{"libvirtURI", "qemu:///system", lab.SourceDefault},
+	} {
+		got, err := cfg.Get(tc.key)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", tc.key, err)
+		}
+		if got != tc.want || cfg.Source(tc.key) != tc.src {
+			t.Errorf("%s = %q (%s), want %q (%s)", tc.key, got, cfg.Source(tc.key), tc.want, tc.src)
+		}
+	}
+	if cfg.DownloadTimeout != 45*time.Minute {
+		t.Errorf("DownloadTimeout = %s, want 45m", cfg.DownloadTimeout)
+	}
+}
+
+func TestLoadConfigRejectsUnknownKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("sshUser: kali\nsshUsr: typo\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := lab.LoadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), `"sshUsr"`) || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("LoadConfig error = %v, want unknown key sshUsr on line 2", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for key, value := range map[string]string{
+		"libvirtURI":      "system",
+		"baseImage":       "relative.qcow2",
+		"sshUser":         "a b",
+		"maxWaitSeconds":  "0",
+		"imageURL":        "ftp://example.com/x.img",
+		"downloadTimeout": "-1s",
+		"dashWidth":       "10",
+		"subnetPool":      "10.200.0.1/16",
+	} {
+		cfg := lab.DefaultConfig()
+		if err := cfg.Set(key, value, lab.SourceFlag); err != nil {
+			continue // rejected while parsing is fine too
+		}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Validate accepted %s=%q", key, value)
+		}
+	}
+	if err := lab.DefaultConfig().Validate(); err != nil {
+		t.Errorf("defaults do not validate: %v", err)
+	}
+}
+
+func TestSetConfigFileValue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nlab", "config.yaml")
+
+	if err := lab.SetConfigFileValue(path, "dashWidth", "100"); err != nil {
+		t.Fatalf("SetConfigFileValue (create): %v", err)
+	}
+	if err := os.WriteFile(path, []byte("# team defaults\ndashWidth: 100\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := lab.SetConfigFileValue(path, "dashWidth", "120"); err != nil {
+		t.Fatalf("SetConfigFileValue (update): %v", err)
+	}
+	if err := lab.SetConfigFileValue(path, "sshUser", "kali"); err != nil {
+		t.Fatalf("SetConfigFileValue (append): %v", err)
+	}
+	if err := lab.SetConfigFileValue(path, "maxWaitSeconds", "soon"); err == nil {
+		t.Error("SetConfigFileValue accepted a non-integer maxWaitSeconds")
+	}
+
+	data, _ := os.ReadFile(path)
+	got := string(data)
+	for _, want := range []string{"# team defaults", "dashWidth: 120", "sshUser: kali"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("config file missing %q:\n%s", want, got)
+		}
+	}
+	cfg, err := lab.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig after set: %v", err)
+	}
+	if cfg.DashWidth != 120 || cfg.SSHUser != "kali" {
+		t.Errorf("loaded %+v", cfg)
+	}
+}
@@ -1,13 +1,13 @@
 package lab
 
 import (
-	"bufio"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 // ── Dashboard ANSI palette ────────────────────────────────────────────────────
@@ -28,9 +28,6 @@ const (
 
 const dashMaxEvents = 8
 
-// dashWidth is the total inner width (excluding the │ borders).
-const dashWidth = 78
-
 func dc(color, s string) string { return color + s + dReset }
 
 // ── Public entry point ────────────────────────────────────────────────────────
@@ -38,7 +35,7 @@ func dc(color, s string) string { return color + s + dReset }
 // RunDashboard renders a refreshing dashboard for the given stack and network
 // until the done channel is closed.
 func RunDashboard(stack, network string, done <-chan struct{}) {
-	vmSSH := make(map[string]bool)
+	vmSSH := make(map[string]SSHState)
 	startTime := time.Now()
 	prevLines := 0
 
@@ -68,13 +65,14 @@ func RunDashboard(stack, network string, done <-chan struct{}) {
 
 // ── Top-level renderer ────────────────────────────────────────────────────────
 
-func renderDashboard(stack, network string, vmSSH map[string]bool, start time.Time) []string {
+func renderDashboard(stack, network string, vmSSH map[string]SSHState, start time.Time) []string {
 	var out []string
 	out = append(out, dashHeader(stack, start))
 	out = append(out, "")
 	out = append(out, renderDashKeys(stack)...)
 	out = append(out, renderDashNetworks(network)...)
 	out = append(out, renderDashVMs(stack, network, vmSSH)...)
+	out = append(out, renderDashLinks(stack)...)
 	out = append(out, renderDashArtifacts(stack)...)
 	out = append(out, renderDashEvents(stack)...)
 	return out
@@ -97,7 +95,7 @@ func dashHeader(stack string, start time.Time) string {
 	// Strip ANSI for length calculation.
 	visLeft := " ◆ nlab │ stack=" + stack
 	visRight := "up " + uptime + "  " + clock + " "
-	pad := dashWidth - len(visLeft) - len(visRight)
+	pad := conf.DashWidth - len(visLeft) - len(visRight)
 	if pad < 1 {
 		pad = 1
 	}
@@ -111,7 +109,7 @@ func dashSectionHeader(title string) []string {
 	// visible length of label
 	visLabel := " " + title + " "
 	leftLine := dc(dDim, strings.Repeat("─", 2))
-	rightLen := dashWidth - 2 - len(visLabel)
+	rightLen := conf.DashWidth - 2 - len(visLabel)
 	if rightLen < 0 {
 		rightLen = 0
 	}
@@ -128,22 +126,18 @@ func dashColHeader(cols string) string {
 func renderDashKeys(stack string) []string {
 	var out []string
 	out = append(out, dashSectionHeader("KEYS")...)
-	out = append(out, dashColHeader(fmt.Sprintf("  %-38s  %-8s  %s", "FILE", "STATUS", "FINGERPRINT")))
-
-	priv := filepath.Join("keys", stack, "id_ed25519")
-	pub := priv + ".pub"
-
-	if _, err := os.Stat(priv); err == nil {
-		fp := keyFingerprint(priv)
+	out = append(out, dashColHeader(fmt.Sprintf("  %-38s  %-8s  %s", "KEY", "STATUS", "FINGERPRINT")))
+
+	keysDir := DefaultXDGDirs().KeysDir()
+	for _, priv := range StackKeyPaths(stack) {
+		name, _ := filepath.Rel(keysDir, priv)
+		pub, err := readPublicKey(priv)
+		if err != nil || !fileExists(priv) {
+			out = append(out, fmt.Sprintf("  %-38s  %s", name, dc(dYellow, "⚠ missing")))
+			continue
+		}
 		out = append(out, fmt.Sprintf("  %-38s  %s  %s",
-			priv, dc(dGreen, "✓ ok    "), dc(dDim, fp)))
-	} else {
-		out = append(out, fmt.Sprintf("  %-38s  %s", priv, dc(dYellow, "⚠ missing")))
-	}
-	if _, err := os.Stat(pub); err == nil {
-		out = append(out, fmt.Sprintf("  %-38s  %s", pub, dc(dGreen, "✓ ok")))
-	} else {
-		out = append(out, fmt.Sprintf("  %-38s  %s", pub, dc(dYellow, "⚠ missing")))
+			name, dc(dGreen, "✓ ok    "), dc(dDim, ssh.FingerprintSHA256(pub))))
 	}
 	out = append(out, "")
 	return out
@@ -157,21 +151,7 @@ func renderDashNetworks(network string) []string {
 	out = append(out, dashColHeader(fmt.Sprintf("  %-22s  %-8s  %-8s  %-10s  %s",
 		"NAME", "DEFINED", "ACTIVE", "AUTOSTART", "BRIDGE")))
 
-	defined, active, autostart, bridge := false, false, false, "n/a"
-	info, err := virshCmd("net-info", network).Output()
-	if err == nil {
-		defined = true
-		for _, line := range strings.Split(string(info), "\n") {
-			switch {
-			case strings.HasPrefix(line, "Active:"):
-				active = strings.TrimSpace(strings.TrimPrefix(line, "Active:")) == "yes"
-			case strings.HasPrefix(line, "Autostart:"):
-				autostart = strings.TrimSpace(strings.TrimPrefix(line, "Autostart:")) == "yes"
-			case strings.HasPrefix(line, "Bridge:"):
-				bridge = strings.TrimSpace(strings.TrimPrefix(line, "Bridge:"))
-			}
-		}
-	}
+	defined, active, autostart, bridge := networkInfo(network)
 
 	out = append(out, fmt.Sprintf("  %-22s  %-8s  %-8s  %-10s  %s",
 		dc(dWhite, network),
@@ -186,7 +166,7 @@ func renderDashNetworks(network string) []string {
 
 // ── VMs section ───────────────────────────────────────────────────────────────
 
-func renderDashVMs(stack, network string, vmSSH map[string]bool) []string {
+func renderDashVMs(stack, network string, vmSSH map[string]SSHState) []string {
 	var out []string
 	out = append(out, dashSectionHeader("VMS")...)
 	out = append(out, dashColHeader(fmt.Sprintf("  %-24s  %-10s  %-17s  %-15s  %s",
@@ -210,7 +190,7 @@ func renderDashVMs(stack, network string, vmSSH map[string]bool) []string {
 	if len(domains) == 0 {
 		out = append(out, dc(dDim, "  (no VMs yet — provisioning…)"))
 	} else {
-		key := filepath.Join("keys", stack, "id_ed25519")
+		client := sharedSSHClient(stack)
 		for _, dom := range domains {
 			state := DomainState(dom)
 			mac := DomainMAC(dom)
@@ -219,13 +199,13 @@ func renderDashVMs(stack, network string, vmSSH map[string]bool) []string {
 				ip = DHCPLeaseIP(network, mac)
 			}
 
-			sshReady := vmSSH[dom]
-			if !sshReady && ip != "" {
-				if sshReachable(key, ip) {
-					vmSSH[dom] = true
-					sshReady = true
-				}
+			sshState := vmSSH[dom]
+			if !sshState.Ready() && ip != "" {
+				client.SetHostAlias(ip, dom)
+				sshState = client.Probe(ip)
+				vmSSH[dom] = sshState
 			}
+			observeVM(stack, strings.TrimPrefix(dom, stack+"-"), ip, sshState)
 
 			ipStr := ip
 			if ipStr == "" {
@@ -236,8 +216,8 @@ func renderDashVMs(stack, network string, vmSSH map[string]bool) []string {
 				dc(dWhite, dom),
 				stateBadge(state),
 				ipStr,
-				sshBadge(sshReady),
-				readinessBadge(state, sshReady, ip),
+				sshBadge(sshState),
+				readinessBadge(state, sshState, ip),
 			))
 		}
 	}
@@ -245,6 +225,36 @@ func renderDashVMs(stack, network string, vmSSH map[string]bool) []string {
 	return out
 }
 
+// ── Links section ─────────────────────────────────────────────────────────────
+
+// renderDashLinks lists the impaired VM links; the section is left out while
+// there are none.
+func renderDashLinks(stack string) []string {
+	domainsOut, err := virshCmd("list", "--name").Output()
+	if err != nil {
+		return nil
+	}
+	var rows []string
+	for _, d := range strings.Fields(string(domainsOut)) {
+		if !strings.HasPrefix(d, stack+"-") {
+			continue
+		}
+		for _, l := range domainLinks(stack, strings.TrimPrefix(d, stack+"-")) {
+			if im := ActiveImpairment(l.Dev); im != "" {
+				rows = append(rows, fmt.Sprintf("  %-24s  %-16s  %-8s  %s",
+					dc(dWhite, d), l.Network, dc(dDim, l.Dev), dc(dYellow, im)))
+			}
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	out := dashSectionHeader("IMPAIRED LINKS")
+	out = append(out, dashColHeader(fmt.Sprintf("  %-24s  %-16s  %-8s  %s", "VM", "NETWORK", "DEVICE", "IMPAIRMENT")))
+	out = append(out, rows...)
+	return append(out, "")
+}
+
 // ── Artifacts section ─────────────────────────────────────────────────────────
 
 func renderDashArtifacts(stack string) []string {
@@ -252,20 +262,15 @@ func renderDashArtifacts(stack string) []string {
 	out = append(out, dashSectionHeader("ARTIFACTS")...)
 	out = append(out, dashColHeader(fmt.Sprintf("  %-38s  %s", "FILE", "SIZE")))
 
+	dirs := DefaultXDGDirs()
 	found := false
-	isos, _ := filepath.Glob(stack + "-*-seed.iso")
-	for _, iso := range isos {
+	isos, _ := filepath.Glob(filepath.Join(dirs.CloudInitDir(), stack+"-*-seed.iso"))
+	logFiles, _ := filepath.Glob(filepath.Join(dirs.LogsDir(), stack+"-*.log"))
+	for _, f := range append(isos, logFiles...) {
 		found = true
 		out = append(out, fmt.Sprintf("  %s  %s",
-			dc(dDim, fmt.Sprintf("%-38s", iso)),
-			dc(dDim, fileSize(iso))))
-	}
-	logFiles, _ := filepath.Glob("logs/*.log")
-	for _, lf := range logFiles {
-		found = true
-		out = append(out, fmt.Sprintf("  %s  %s",
-			dc(dDim, fmt.Sprintf("%-38s", lf)),
-			dc(dDim, fileSize(lf))))
+			dc(dDim, fmt.Sprintf("%-38s", filepath.Base(f))),
+			dc(dDim, fileSize(f))))
 	}
 	if !found {
 		out = append(out, dc(dDim, "  (none yet)"))
@@ -277,33 +282,25 @@ func renderDashArtifacts(stack string) []string {
 // ── Events section ────────────────────────────────────────────────────────────
 
 func renderDashEvents(stack string) []string {
-	eventsFile := filepath.Join("logs", stack+"-events.log")
 	var out []string
 	out = append(out, dashSectionHeader(fmt.Sprintf("EVENTS  (last %d)", dashMaxEvents))...)
 
-	f, err := os.Open(eventsFile)
+	events, err := ReadEvents(stack)
 	if err != nil {
-		out = append(out, dc(dDim, "  (no events yet)"))
-		out = append(out, "")
-		return out
-	}
-	defer f.Close()
-
-	var lines []string
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
-	}
-
-	if len(lines) == 0 {
+		out = append(out, dc(dRed, fmt.Sprintf("  (cannot read events: %v)", err)))
+	} else if len(events) == 0 {
 		out = append(out, dc(dDim, "  (no events yet)"))
 	} else {
-		start := len(lines) - dashMaxEvents
+		start := len(events) - dashMaxEvents
 		if start < 0 {
 			start = 0
 		}
-		for _, l := range lines[start:] {
-			out = append(out, "  "+colorizeEvent(l))
+		for _, e := range events[start:] {
+			line := colorizeEvent(e.Line())
+			if e.Type == EventError {
+				line = dc(dRed, e.Line())
+			}
+			out = append(out, "  "+line)
 		}
 	}
 	out = append(out, "")
@@ -335,20 +332,36 @@ func stateBadge(state string) string {
 }
 
 // sshBadge returns a colored SSH readiness indicator.
-func sshBadge(ready bool) string {
-	if ready {
+func sshBadge(s SSHState) string {
+	switch s {
+	case SSHAuthOK:
 		return dc(dGreen, "✓ ready  ")
+	case SSHHostKeyMismatch:
+		return dc(dRed, "✗ hostkey")
+	case SSHAuthFailed:
+		return dc(dRed, "✗ auth   ")
+	case SSHBanner:
+		return dc(dYellow, "⏳ banner ")
+	case SSHTCPClosed:
+		return dc(dYellow, "⏳ closed ")
+	default:
+		return dc(dYellow, "⏳ pending")
 	}
-	return dc(dYellow, "⏳ pending")
 }
 
 // readinessBadge returns a summary badge for the VM's overall readiness.
-func readinessBadge(state string, sshReady bool, ip string) string {
+func readinessBadge(state string, ssh SSHState, ip string) string {
 	switch {
-	case state == "running" && sshReady:
+	case state == "running" && ssh == SSHAuthOK:
 		return dc(dGreen+dBold, "✓ ready")
+	case ssh == SSHHostKeyMismatch:
+		return dc(dRed+dBold, "✗ host key mismatch")
+	case state == "running" && ssh == SSHAuthFailed:
+		return dc(dYellow, "⏳ key not installed yet")
+	case state == "running" && ssh == SSHBanner:
+		return dc(dYellow, "⏳ ssh handshake")
 	case state == "running" && ip != "":
-		return dc(dYellow, "⏳ waiting for ssh")
+		return dc(dYellow, "⏳ sshd not up yet")
 	case state == "running":
 		return dc(dYellow, "⏳ booting")
 	default:
@@ -380,34 +393,6 @@ func colorizeEvent(line string) string {
 
 // ── Shared helpers ─────────────────────────────────────────────────────────────
 
-// sshReachable returns true if SSH can connect with BatchMode=yes.
-func sshReachable(key, ip string) bool {
-	cmd := exec.Command("ssh",
-		"-n",
-		"-o", "BatchMode=yes",
-		"-o", "ConnectTimeout=1",
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "UserKnownHostsFile=/dev/null",
-		"-i", key,
-		sshUser+"@"+ip,
-		"true",
-	)
-	return cmd.Run() == nil
-}
-
-// keyFingerprint returns the SHA256 fingerprint of an SSH key file.
-func keyFingerprint(path string) string {
-	out, err := exec.Command("ssh-keygen", "-l", "-f", path).Output()
-	if err != nil {
-		return "n/a"
-	}
-	fields := strings.Fields(string(out))
-	if len(fields) >= 2 {
-		return fields[1]
-	}
-	return "n/a"
-}
-
 // fileSize returns a human-readable size string for path.
 func fileSize(path string) string {
 	fi, err := os.Stat(path)
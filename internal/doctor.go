@@ -50,7 +50,8 @@ func checkCommand(name, bin string, args ...string) CheckResult {
 	return CheckResult{Name: name, OK: true, Message: fmt.Sprintf("%s found", path)}
 }
 
-// checkLibvirtConn verifies that virsh can contact the local libvirt daemon.
+// checkLibvirtConn verifies that virsh can contact the configured libvirt
+// daemon.
 func checkLibvirtConn() CheckResult {
 	const name = "libvirt connectivity"
 	path, err := exec.LookPath("virsh")
@@ -62,18 +63,18 @@ func checkLibvirtConn() CheckResult {
 			HowToFix: "sudo apt install libvirt-clients",
 		}
 	}
-	cmd := exec.Command(path, "--connect", "qemu:///system", "version") //nolint:gosec
+	cmd := exec.Command(path, "--connect", conf.LibvirtURI, "version") //nolint:gosec
 	if out, err := cmd.CombinedOutput(); err != nil {
 		return CheckResult{
 			Name:    name,
 			OK:      false,
-			Message: fmt.Sprintf("cannot connect to qemu:///system: %s", string(out)),
+			Message: fmt.Sprintf("cannot connect to %s: %s", conf.LibvirtURI, string(out)),
 			HowToFix: "Ensure libvirtd is running and your user is in the 'libvirt' group:\n" +
 				"  sudo systemctl start libvirtd\n" +
 				"  sudo usermod -aG libvirt \"$USER\"   # then log out and back in",
 		}
 	}
-	return CheckResult{Name: name, OK: true, Message: "connected to qemu:///system"}
+	return CheckResult{Name: name, OK: true, Message: "connected to " + conf.LibvirtURI}
 }
 
 // checkKVM verifies that /dev/kvm exists and is accessible.
@@ -0,0 +1,257 @@
+package lab
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+// EgressTable returns the nftables table nlab owns for stack's allow-lists.
+func EgressTable(stack string) string {
+	return "nlab-" + stack
+}
+
+// EgressRuleset returns the nft script that (re)creates stack's egress table
+// for the networks with an allow-list, or "" when none has one. Forwarded
+// traffic from such a network is rejected unless it answers a connection or
+// goes to an allowed destination; lookup resolves the domain names.
+func EgressRuleset(stack string, nets []NetworkDef, lookup func(host string) ([]net.IP, error)) (string, error) {
+	var rules []string
+	for _, n := range nets {
+		if n.Egress == nil || n.Egress.Policy != types.EgressAllow {
+			continue
+		}
+		subnet, err := networkSubnet(n.XML)
+		if err != nil {
+			return "", fmt.Errorf("network %s: egress needs an IPv4 subnet: %w", n.Name, err)
+		}
+		dests, err := egressDestinations(n.Egress.Allow, lookup)
+		if err != nil {
+			return "", fmt.Errorf("network %s: %w", n.Name, err)
+		}
+		rules = append(rules, "# "+n.Name)
+		if len(dests) > 0 {
+			rules = append(rules, fmt.Sprintf("ip saddr %s ip daddr { %s } accept", subnet, strings.Join(dests, ", ")))
+		}
+		rules = append(rules, fmt.Sprintf("ip saddr %s reject with icmpx type admin-prohibited", subnet))
+	}
+	if len(rules) == 0 {
+		return "", nil
+	}
+	table := "inet " + EgressTable(stack)
+	var b strings.Builder
+	// Declaring the table first lets the delete succeed on the first run.
+	fmt.Fprintf(&b, "table %s\ndelete table %s\n", table, table)
+	fmt.Fprintf(&b, "table %s {\n\tchain forward {\n", table)
+	// Runs just before libvirt's own filter rules; its accepts do not
+	// override a reject here.
+	b.WriteString("\t\ttype filter hook forward priority -1; policy accept;\n")
+	b.WriteString("\t\tct state established,related accept\n")
+	for _, r := range rules {
+		b.WriteString("\t\t" + r + "\n")
+	}
+	b.WriteString("\t}\n}\n")
+	return b.String(), nil
+}
+
+// egressDestinations returns the nft set elements for an allow-list: CIDRs
+// and addresses as they are, domain names as the IPv4 addresses they
+// resolve to now.
+func egressDestinations(allow []string, lookup func(string) ([]net.IP, error)) ([]string, error) {
+	var out []string
+	seen := map[string]bool{}
+	add := func(d string) {
+		if !seen[d] {
+			seen[d] = true
+			out = append(out, d)
+		}
+	}
+	for _, a := range allow {
+		if _, subnet, err := net.ParseCIDR(a); err == nil {
+			add(subnet.String())
+			continue
+		}
+		if ip := net.ParseIP(a); ip != nil {
+			add(ip.String())
+			continue
+		}
+		ips, err := lookup(a)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s for egress: %w", a, err)
+		}
+		n := len(out)
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				add(ip.String())
+			}
+		}
+		if len(out) == n {
+			return nil, fmt.Errorf("resolve %s for egress: no IPv4 address", a)
+		}
+	}
+	return out, nil
+}
+
+// ApplyEgress creates stack's egress table from its allow-lists, replacing
+// the one from the last run. Domain names are resolved now; run it again to
+// pick up changed addresses. Without an allow-list any table an earlier run
+// left is deleted, so dropping the list or switching to nat lifts it.
+func ApplyEgress(stack string, cfg *StackConfig) error {
+	ruleset, err := EgressRuleset(stack, cfg.AllNetworks(), net.LookupIP)
+	if err != nil {
+		return err
+	}
+	if ruleset == "" {
+		return RemoveEgress(stack, cfg)
+	}
+	Info(fmt.Sprintf("Applying egress rules (nftables table %s)", EgressTable(stack)))
+	if err := nft(ruleset); err != nil {
+		return fmt.Errorf("apply egress rules: %w", err)
+	}
+	Ok("Egress rules applied")
+	return nil
+}
+
+// RemoveEgress deletes stack's egress table; one that does not exist is not
+// an error. When cfg has no allow-list the table can only be left from an
+// earlier manifest, so a host without nft or passwordless sudo gets a
+// warning rather than a failure.
+func RemoveEgress(stack string, cfg *StackConfig) error {
+	owned := hasAllowList(cfg)
+	if !owned && !nftInstalled() {
+		return nil // no nftables, no table
+	}
+	table := "inet " + EgressTable(stack)
+	if err := nft(fmt.Sprintf("table %s\ndelete table %s\n", table, table)); err != nil {
+		err = fmt.Errorf("remove egress rules: %w", err)
+		if !owned {
+			Warn(err.Error())
+			return nil
+		}
+		return err
+	}
+	if owned {
+		Ok(fmt.Sprintf("Egress rules removed (nftables table %s)", EgressTable(stack)))
+	}
+	return nil
+}
+
+func hasAllowList(cfg *StackConfig) bool {
+	for _, n := range cfg.AllNetworks() {
+		if n.Egress != nil && n.Egress.Policy == types.EgressAllow {
+			return true
+		}
+	}
+	return false
+}
+
+// nftInstalled reports whether the nft binary exists, looking in sbin too:
+// it is often not on an unprivileged user's PATH.
+func nftInstalled() bool {
+	if _, err := exec.LookPath("nft"); err == nil {
+		return true
+	}
+	return fileExists("/usr/sbin/nft") || fileExists("/sbin/nft")
+}
+
+// nft runs an nft script.
+func nft(script string) error {
+	cmd := rootCmd("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// EgressProbe is one connection nlab network verify attempts from a VM.
+type EgressProbe struct {
+	VM      string
+	Network string // the network whose policy is being checked
+	Dest    string // host:port
+	Reach   bool   // whether the policy lets it through
+}
+
+// EgressProbes plans the probes that check the egress policies of cfg: from
+// every VM on a network with a policy, each allowed destination on port
+// should connect, and deny (a host:port outside every allow-list) should
+// connect only under nat.
+func EgressProbes(cfg *StackConfig, deny string, port int) []EgressProbe {
+	policies := map[string]*types.EgressSpec{}
+	for _, n := range cfg.AllNetworks() {
+		if n.Egress != nil {
+			policies[n.Name] = n.Egress
+		}
+	}
+	var out []EgressProbe
+	for _, vm := range cfg.VMs {
+		for _, name := range vm.Networks {
+			e := policies[name]
+			if e == nil {
+				continue
+			}
+			for _, a := range e.Allow {
+				host := a
+				if _, subnet, err := net.ParseCIDR(a); err == nil {
+					host = uintToIP(ipToUint(subnet.IP) + 1).String() // its first host
+					if ones, _ := subnet.Mask.Size(); ones == 32 {
+						host = subnet.IP.String()
+					}
+				}
+				out = append(out, EgressProbe{VM: vm.Name, Network: name,
+					Dest: net.JoinHostPort(host, strconv.Itoa(port)), Reach: true})
+			}
+			out = append(out, EgressProbe{VM: vm.Name, Network: name, Dest: deny,
+				Reach: e.Policy == types.EgressNAT})
+		}
+	}
+	return out
+}
+
+// ProbeResult is what a probe connection ran into.
+type ProbeResult string
+
+const (
+	ProbeReached    ProbeResult = "reached"    // connected or refused by the destination
+	ProbeBlocked    ProbeResult = "blocked"    // rejected on the way or no route
+	ProbeTimeout    ProbeResult = "timed out"  // no answer; a firewall or a dead host
+	ProbeUnresolved ProbeResult = "unresolved" // the VM could not resolve the name
+)
+
+// probeTimeout is how long a probe waits for a connection, in seconds.
+const probeTimeout = 5
+
+// probeCommand connects to host:port from a VM's shell and reports how it
+// went; ParseProbe reads the report.
+func probeCommand(dest string) string {
+	host, port, _ := net.SplitHostPort(dest)
+	return fmt.Sprintf("timeout %d bash -c %s 2>&1; echo exit=$?", probeTimeout,
+		shellQuote(fmt.Sprintf("exec 3<>/dev/tcp/%s/%s", host, port)))
+}
+
+// ParseProbe classifies the output of a probe command.
+func ParseProbe(out string) ProbeResult {
+	lower := strings.ToLower(out)
+	switch {
+	case strings.Contains(out, "exit=0"), strings.Contains(lower, "connection refused"):
+		return ProbeReached
+	case strings.Contains(out, "exit=124"):
+		return ProbeTimeout
+	case strings.Contains(lower, "name or service not known"), strings.Contains(lower, "temporary failure in name resolution"):
+		return ProbeUnresolved
+	}
+	return ProbeBlocked
+}
+
+// RunProbe runs p from its VM over SSH.
+func RunProbe(client *SSHClient, addr string, p EgressProbe) (ProbeResult, error) {
+	out, err := client.Output(addr, probeCommand(p.Dest))
+	if err != nil {
+		return "", err
+	}
+	return ParseProbe(string(out)), nil
+}
@@ -0,0 +1,98 @@
+package lab_test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	lab "github.com/h3ow3d/nlab/internal"
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+const egressNetXML = `<network>
+  <name>%s</name>
+  <forward mode="nat"/>
+  <ip address="%s" netmask="255.255.255.0"/>
+</network>`
+
+func TestEgressRuleset(t *testing.T) {
+	lookup := func(host string) ([]net.IP, error) {
+		if host != "deb.debian.org" {
+			return nil, fmt.Errorf("no such host %s", host)
+		}
+		return []net.IP{net.ParseIP("151.101.2.132"), net.ParseIP("2a04:4e42::644")}, nil
+	}
+	nets := []lab.NetworkDef{
+		{Name: "dmz", XML: fmt.Sprintf(egressNetXML, "dmz", "10.20.0.1"),
+			Egress: &types.EgressSpec{Policy: types.EgressAllow, Allow: []string{"10.0.0.0/8", "192.0.2.7", "deb.debian.org"}}},
+		{Name: "lan", XML: fmt.Sprintf(egressNetXML, "lan", "10.30.0.1"), Egress: &types.EgressSpec{Policy: types.EgressNAT}},
+		{Name: "jail", XML: fmt.Sprintf(egressNetXML, "jail", "10.40.0.1"), Egress: &types.EgressSpec{Policy: types.EgressAllow}},
+	}
+	got, err := lab.EgressRuleset("basic", nets, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"table inet nlab-basic\ndelete table inet nlab-basic\n",
+		"ct state established,related accept",
+		"ip saddr 10.20.0.0/24 ip daddr { 10.0.0.0/8, 192.0.2.7, 151.101.2.132 } accept",
+		"ip saddr 10.20.0.0/24 reject",
+		"ip saddr 10.40.0.0/24 reject",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("ruleset lacks %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "10.30.0.0") || strings.Contains(got, "10.40.0.0/24 ip daddr") {
+		t.Errorf("only allow-lists get rules:\n%s", got)
+	}
+
+	if got, err := lab.EgressRuleset("basic", nets[1:2], lookup); err != nil || got != "" {
+		t.Errorf("no allow-list should need no table, got %q, %v", got, err)
+	}
+	nets[0].Egress.Allow = []string{"nowhere.example"}
+	if _, err := lab.EgressRuleset("basic", nets, lookup); err == nil || !strings.Contains(err.Error(), "nowhere.example") {
+		t.Errorf("an unresolvable domain: %v", err)
+	}
+}
+
+func TestEgressProbes(t *testing.T) {
+	cfg := &lab.StackConfig{
+		NetworkDefs: []lab.NetworkDef{
+			{Name: "dmz", Egress: &types.EgressSpec{Policy: types.EgressAllow, Allow: []string{"10.0.0.0/8", "deb.debian.org"}}},
+			{Name: "lan"},
+			{Name: "jail", Egress: &types.EgressSpec{Policy: types.EgressNone}},
+		},
+		VMs: []lab.VMSpec{
+			{Name: "web", Networks: []string{"dmz"}},
+			{Name: "box", Networks: []string{"lan", "jail"}},
+			{Name: "free", Networks: []string{"lan"}},
+		},
+	}
+	got := lab.EgressProbes(cfg, "1.1.1.1:443", 80)
+	want := []lab.EgressProbe{
+		{VM: "web", Network: "dmz", Dest: "10.0.0.1:80", Reach: true},
+		{VM: "web", Network: "dmz", Dest: "deb.debian.org:80", Reach: true},
+		{VM: "web", Network: "dmz", Dest: "1.1.1.1:443"},
+		{VM: "box", Network: "jail", Dest: "1.1.1.1:443"},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("probes = %+v\nwant %+v", got, want)
+	}
+}
+
+func TestParseProbe(t *testing.T) {
+	for out, want := range map[string]lab.ProbeResult{
+		"exit=0\n": lab.ProbeReached,
+		"bash: connect: Connection refused\nbash: line 1: /dev/tcp/10.0.0.1/80: Connection refused\nexit=1\n": lab.ProbeReached,
+		"bash: connect: No route to host\nexit=1\n":                                                           lab.ProbeBlocked,
+		"bash: connect: Network is unreachable\nexit=1\n":                                                     lab.ProbeBlocked,
+		"exit=124\n": lab.ProbeTimeout,
+		"bash: nowhere.example: Name or service not known\nexit=1\n": lab.ProbeUnresolved,
+	} {
+		if got := lab.ParseProbe(out); got != want {
+			t.Errorf("ParseProbe(%q) = %s, want %s", out, got, want)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package lab
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// EventType identifies what happened. Consumers should switch on Type rather
+// than parse Message.
+type EventType string
+
+const (
+	EventKeyGenerated     EventType = "key.generated"
+	EventKeyMigrated      EventType = "key.migrated"
+	EventKeyRotated       EventType = "key.rotated"
+	EventNetworkDefined   EventType = "network.defined"
+	EventNetworkStarted   EventType = "network.started"
+	EventNetworkDestroyed EventType = "network.destroyed"
+	EventLinkImpaired     EventType = "link.impaired"
+	EventLinkCleared      EventType = "link.cleared"
+	EventVMCreating       EventType = "vm.creating"
+	EventVMCreated        EventType = "vm.created"
+	EventVMDestroyed      EventType = "vm.destroyed"
+	EventVMIP             EventType = "vm.ip"
+	EventVMSSH            EventType = "vm.ssh"
+	EventError            EventType = "error"
+)
+
+// Event is one entry in a stack's event journal. It is persisted as a single
+// JSON line.
+type Event struct {
+	Time    time.Time         `json:"time"`
+	Stack   string            `json:"stack"`
+	Type    EventType         `json:"type"`
+	Source  string            `json:"source"`
+	VM      string            `json:"vm,omitempty"`
+	Message string            `json:"message"`
+	Data    map[string]string `json:"data,omitempty"`
+}
+
+// Line formats the event for human display as
+// "EVENT HH:MM:SS [source] message".
+func (e Event) Line() string {
+	return fmt.Sprintf("EVENT %s [%s] %s", e.Time.Local().Format("15:04:05"), e.Source, e.Message)
+}
+
+// eventBus fans published events out to the per-stack journal file and to
+// in-process subscribers.
+type eventBus struct {
+	mu       sync.Mutex
+	subs     map[int]func(Event)
+	nextSub  int
+	observed map[string]string // last value per stack/vm/attribute, for PublishChange
+}
+
+var bus = &eventBus{
+	subs:     make(map[int]func(Event)),
+	observed: make(map[string]string),
+}
+
+// Publish timestamps e, appends it to the stack's journal and delivers it to
+// every subscriber. Journal write failures are reported on stderr but never
+// interrupt the caller.
+func Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	bus.mu.Lock()
+	if err := appendEvent(EventsPath(e.Stack), e); err != nil {
+		Error(fmt.Sprintf("write event journal: %v", err))
+	}
+	subs := make([]func(Event), 0, len(bus.subs))
+	for _, fn := range bus.subs {
+		subs = append(subs, fn)
+	}
+	bus.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(e)
+	}
+}
+
+// PublishChange publishes e only when value differs from the last value
+// recorded for the same stack, VM and event type. The dashboard and the
+// readiness wait loop both observe IPs and SSH states; this keeps the journal
+// from recording every poll.
+func PublishChange(e Event, value string) {
+	key := e.Stack + "/" + e.VM + "/" + string(e.Type)
+	bus.mu.Lock()
+	if bus.observed[key] == value {
+		bus.mu.Unlock()
+		return
+	}
+	bus.observed[key] = value
+	bus.mu.Unlock()
+	Publish(e)
+}
+
+// Subscribe registers fn to receive every event published by this process and
+// returns a function that removes the subscription.
+func Subscribe(fn func(Event)) func() {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	id := bus.nextSub
+	bus.nextSub++
+	bus.subs[id] = fn
+	return func() {
+		bus.mu.Lock()
+		defer bus.mu.Unlock()
+		delete(bus.subs, id)
+	}
+}
+
+// publishError records err as an error event and returns it unchanged.
+func publishError(stack, source, vm string, err error) error {
+	if err != nil {
+		Publish(Event{Stack: stack, Type: EventError, Source: source, VM: vm, Message: err.Error()})
+	}
+	return err
+}
+
+// observeVM records the IP and SSH state last seen for <stack>-<role>,
+// publishing an event for each that changed.
+func observeVM(stack, role, ip string, state SSHState) {
+	if ip != "" {
+		PublishChange(Event{Stack: stack, Type: EventVMIP, Source: "dhcp", VM: role,
+			Message: fmt.Sprintf("%s-%s leased %s", stack, role, ip),
+			Data:    map[string]string{"ip": ip}}, ip)
+	}
+	if state != SSHUnknown {
+		PublishChange(Event{Stack: stack, Type: EventVMSSH, Source: "ssh", VM: role,
+			Message: fmt.Sprintf("%s-%s ssh: %s", stack, role, state),
+			Data:    map[string]string{"state": state.String()}}, state.String())
+	}
+}
+
+// EventsPath returns the JSON-lines event journal for a stack.
+func EventsPath(stack string) string {
+	return DefaultXDGDirs().EventsFile(stack)
+}
+
+func appendEvent(path string, e Event) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// ReadEvents returns every event in the stack's journal, oldest first. A
+// missing journal yields no events. Lines that are not valid events are
+// skipped.
+func ReadEvents(stack string) ([]Event, error) {
+	f, err := os.Open(EventsPath(stack))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	events, _, err := decodeEvents(f)
+	return events, err
+}
+
+// FollowEvents calls fn for every event already in the stack's journal and
+// then for each new one as it is appended, polling every interval until done
+// is closed.
+func FollowEvents(stack string, interval time.Duration, done <-chan struct{}, fn func(Event)) error {
+	path := EventsPath(stack)
+	var offset int64
+	for {
+		if f, err := os.Open(path); err == nil {
+			if fi, err := f.Stat(); err == nil && fi.Size() < offset {
+				offset = 0 // journal was truncated or replaced
+			}
+			if _, err := f.Seek(offset, io.SeekStart); err == nil {
+				events, n, err := decodeEvents(f)
+				for _, e := range events {
+					fn(e)
+				}
+				offset += n
+				if err != nil {
+					f.Close()
+					return err
+				}
+			}
+			f.Close()
+		}
+		select {
+		case <-done:
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// decodeEvents reads complete JSON lines from r and returns the decoded
+// events and the number of bytes consumed. A trailing partial line is left
+// unconsumed so a follower can pick it up once it is complete.
+func decodeEvents(r io.Reader) ([]Event, int64, error) {
+	var events []Event
+	var consumed int64
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return events, consumed, nil
+		}
+		if err != nil {
+			return events, consumed, err
+		}
+		consumed += int64(len(line))
+		var e Event
+		if json.Unmarshal(line, &e) == nil && e.Type != "" {
+			events = append(events, e)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package lab_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	lab "github.com/h3ow3d/nlab/internal"
+)
+
+func TestPublishAndReadEvents(t *testing.T) {
+	isolateXDG(t)
+
+	var got []lab.Event
+	unsubscribe := lab.Subscribe(func(e lab.Event) { got = append(got, e) })
+	lab.Publish(lab.Event{Stack: "basic", Type: lab.EventVMCreating, Source: "create-vm", VM: "attacker", Message: "Creating VM basic-attacker"})
+	lab.Publish(lab.Event{Stack: "other", Type: lab.EventVMCreated, Source: "create-vm", Message: "elsewhere"})
+	unsubscribe()
+	lab.Publish(lab.Event{Stack: "basic", Type: lab.EventError, Source: "create-vm", VM: "attacker", Message: "boom"})
+
+	if len(got) != 2 {
+		t.Errorf("subscriber saw %d events, want 2 (unsubscribed before the third)", len(got))
+	}
+
+	events, err := lab.ReadEvents("basic")
+	if err != nil {
+		t.Fatalf("ReadEvents: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("len(events) = %d, want 2", len(events))
+	}
+	if events[0].Type != lab.EventVMCreating || events[0].VM != "attacker" || events[0].Time.IsZero() {
+		t.Errorf("events[0] = %+v", events[0])
+	}
+	if events[1].Type != lab.EventError || events[1].Message != "boom" {
+		t.Errorf("events[1] = %+v", events[1])
+	}
+	if line := events[0].Line(); !strings.HasPrefix(line, "EVENT ") || !strings.HasSuffix(line, "[create-vm] Creating VM basic-attacker") {
+		t.Errorf("Line() = %q", line)
+	}
+
+	if events, err := lab.ReadEvents("missing"); err != nil || len(events) != 0 {
+		t.Errorf("ReadEvents(missing) = %v, %v; want none", events, err)
+	}
+}
+
+func TestPublishChangeDedupes(t *testing.T) {
+	isolateXDG(t)
+
+	e := lab.Event{Stack: "dedupe", Type: lab.EventVMIP, Source: "dhcp", VM: "target"}
+	lab.PublishChange(e, "10.10.10.5")
+	lab.PublishChange(e, "10.10.10.5")
+	lab.PublishChange(e, "10.10.10.6")
+
+	events, err := lab.ReadEvents("dedupe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Errorf("len(events) = %d, want 2 (repeat value suppressed)", len(events))
+	}
+}
+
+func TestFollowEventsWaitsForCompleteLines(t *testing.T) {
+	isolateXDG(t)
+
+	lab.Publish(lab.Event{Stack: "follow", Type: lab.EventNetworkDefined, Source: "network", Message: "first"})
+	f, err := os.OpenFile(lab.EventsPath("follow"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	partial := `{"time":"2026-01-01T00:00:00Z","stack":"follow","type":"network.started","source":"network","message":"second"}`
+	if _, err := f.WriteString(partial[:40]); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(chan lab.Event, 4)
+	done := make(chan struct{})
+	finished := make(chan error, 1)
+	go func() {
+		finished <- lab.FollowEvents("follow", 10*time.Millisecond, done, func(e lab.Event) { seen <- e })
+	}()
+
+	if e := <-seen; e.Message != "first" {
+		t.Fatalf("first event = %+v", e)
+	}
+	select {
+	case e := <-seen:
+		t.Fatalf("partial line delivered as %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := f.WriteString(partial[40:] + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-seen:
+		if e.Message != "second" {
+			t.Errorf("second event = %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("completed line was never delivered")
+	}
+
+	close(done)
+	if err := <-finished; err != nil {
+		t.Errorf("FollowEvents: %v", err)
+	}
+}
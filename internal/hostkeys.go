@@ -0,0 +1,166 @@
+package lab
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"gopkg.in/yaml.v3"
+)
+
+// HostKey is a freshly generated SSH host key pair for one VM.
+type HostKey struct {
+	PrivatePEM []byte        // OpenSSH-format private key, injected via cloud-init
+	Public     ssh.PublicKey // pinned in the stack's known_hosts file
+}
+
+// GenerateHostKey creates a new ed25519 SSH host key pair.
+func GenerateHostKey() (*HostKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate host key: %w", err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		return nil, fmt.Errorf("marshal host key: %w", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("convert host public key: %w", err)
+	}
+	return &HostKey{PrivatePEM: pem.EncodeToMemory(block), Public: sshPub}, nil
+}
+
+// AddToUserData merges the cloud-config keys that install this host key
+// into userData: ssh_keys becomes the ed25519 pair, replacing any host keys
+// set there, and ssh_genkeytypes becomes empty so cloud-init generates no
+// others. The rest of the document, comments included, is kept.
+func (k *HostKey) AddToUserData(userData string) (string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(userData), "#cloud-config") {
+		return "", fmt.Errorf("user-data is not #cloud-config; the VM's host key cannot be installed")
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(userData), &doc); err != nil {
+		return "", fmt.Errorf("parse user-data: %w", err)
+	}
+	if len(doc.Content) == 0 { // only the header
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return "", fmt.Errorf("user-data is not a YAML mapping")
+	}
+	keys := &yaml.Node{Kind: yaml.MappingNode}
+	setMappingValue(keys, "ed25519_private", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str",
+		Style: yaml.LiteralStyle, Value: string(k.PrivatePEM)})
+	setMappingValue(keys, "ed25519_public", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str",
+		Value: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k.Public)))})
+	setMappingValue(root, "ssh_keys", keys)
+	setMappingValue(root, "ssh_genkeytypes", &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle})
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return "", fmt.Errorf("render user-data: %w", err)
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, "#cloud-config") {
+		out = "#cloud-config\n" + out
+	}
+	return out, nil
+}
+
+// setMappingValue sets key in the mapping node m to v, appending it when
+// absent.
+func setMappingValue(m *yaml.Node, key string, v *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content[i+1] = v
+			return
+		}
+	}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, v)
+}
+
+// KnownHostsPath returns the stack's managed known_hosts file.
+func KnownHostsPath(stack string) string {
+	return DefaultXDGDirs().KnownHostsFile(stack)
+}
+
+// PinHostKey records key as the only accepted host key for alias in the
+// known_hosts file at path, replacing any previous entry for alias.
+func PinHostKey(path, alias string, key ssh.PublicKey) error {
+	lines, err := knownHostsWithout(path, alias)
+	if err != nil {
+		return err
+	}
+	lines = append(lines, knownhosts.Line([]string{alias}, key))
+	return writeKnownHosts(path, lines)
+}
+
+// UnpinHostKey removes every entry for alias from the known_hosts file at path.
+// A missing file is not an error.
+func UnpinHostKey(path, alias string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	lines, err := knownHostsWithout(path, alias)
+	if err != nil {
+		return err
+	}
+	return writeKnownHosts(path, lines)
+}
+
+// knownHostsWithout returns the lines of path whose host field does not name
+// alias.
+func knownHostsWithout(path, alias string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read known_hosts: %w", err)
+	}
+	var out []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := sc.Text()
+		if fields := strings.Fields(line); len(fields) > 0 && knownHostsNames(fields[0], alias) {
+			continue
+		}
+		out = append(out, line)
+	}
+	return out, sc.Err()
+}
+
+func knownHostsNames(hosts, alias string) bool {
+	for _, h := range strings.Split(hosts, ",") {
+		if h == alias {
+			return true
+		}
+	}
+	return false
+}
+
+func writeKnownHosts(path string, lines []string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("create known_hosts dir: %w", err)
+	}
+	content := strings.Join(lines, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		return fmt.Errorf("write known_hosts: %w", err)
+	}
+	return nil
+}
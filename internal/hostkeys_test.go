@@ -0,0 +1,135 @@
+package lab_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+
+	lab "github.com/h3ow3d/nlab/internal"
+)
+
+func TestPinHostKeyReplacesEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts", "basic")
+
+	first, err := lab.GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := lab.GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := lab.GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lab.PinHostKey(path, "basic-attacker", first.Public); err != nil {
+		t.Fatalf("PinHostKey: %v", err)
+	}
+	if err := lab.PinHostKey(path, "basic-target", other.Public); err != nil {
+		t.Fatalf("PinHostKey: %v", err)
+	}
+	if err := lab.PinHostKey(path, "basic-attacker", second.Public); err != nil {
+		t.Fatalf("PinHostKey (rotate): %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("known_hosts has %d lines, want 2:\n%s", len(lines), data)
+	}
+	oldKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(first.Public)))
+	if strings.Contains(string(data), oldKey) {
+		t.Error("rotated key is still pinned")
+	}
+	newKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(second.Public)))
+	if !strings.Contains(string(data), "basic-attacker "+newKey) {
+		t.Errorf("new key not pinned for basic-attacker:\n%s", data)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("known_hosts mode = %o, want 600", fi.Mode().Perm())
+	}
+
+	if err := lab.UnpinHostKey(path, "basic-attacker"); err != nil {
+		t.Fatalf("UnpinHostKey: %v", err)
+	}
+	data, _ = os.ReadFile(path)
+	if strings.Contains(string(data), "basic-attacker") {
+		t.Errorf("basic-attacker still present after unpin:\n%s", data)
+	}
+	if !strings.Contains(string(data), "basic-target") {
+		t.Errorf("unpin removed unrelated entry:\n%s", data)
+	}
+}
+
+func TestUnpinHostKeyMissingFile(t *testing.T) {
+	if err := lab.UnpinHostKey(filepath.Join(t.TempDir(), "nope"), "x"); err != nil {
+		t.Errorf("UnpinHostKey on missing file: %v", err)
+	}
+}
+
+func TestHostKeyAddToUserData(t *testing.T) {
+	k, err := lab.GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keys the template already sets are replaced, not repeated, and a
+	// missing trailing newline does not run into them.
+	userData, err := k.AddToUserData("#cloud-config\n# the web server\nhostname: web\n" +
+		"ssh_genkeytypes: [rsa]\nssh_keys:\n  rsa_private: old\npackages: [nginx]")
+	if err != nil {
+		t.Fatalf("AddToUserData: %v", err)
+	}
+	if !strings.HasPrefix(userData, "#cloud-config\n") || !strings.Contains(userData, "# the web server") {
+		t.Errorf("header or comment lost:\n%s", userData)
+	}
+
+	var parsed struct {
+		Hostname    string            `yaml:"hostname"`
+		Packages    []string          `yaml:"packages"`
+		SSHKeys     map[string]string `yaml:"ssh_keys"`
+		GenKeyTypes []string          `yaml:"ssh_genkeytypes"`
+	}
+	if err := yaml.Unmarshal([]byte(userData), &parsed); err != nil {
+		t.Fatalf("user-data is not valid YAML: %v\n%s", err, userData)
+	}
+	if parsed.Hostname != "web" || len(parsed.Packages) != 1 {
+		t.Errorf("the rest of the user-data changed:\n%s", userData)
+	}
+	if _, ok := parsed.SSHKeys["rsa_private"]; ok || len(parsed.SSHKeys) != 2 {
+		t.Errorf("ssh_keys = %v, want only the ed25519 pair", parsed.SSHKeys)
+	}
+	if _, err := ssh.ParsePrivateKey([]byte(parsed.SSHKeys["ed25519_private"])); err != nil {
+		t.Errorf("ed25519_private does not parse: %v", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(parsed.SSHKeys["ed25519_public"]))
+	if err != nil {
+		t.Fatalf("ed25519_public does not parse: %v", err)
+	}
+	if string(pub.Marshal()) != string(k.Public.Marshal()) {
+		t.Error("ed25519_public does not match the generated key")
+	}
+	if parsed.GenKeyTypes == nil || len(parsed.GenKeyTypes) != 0 {
+		t.Errorf("ssh_genkeytypes = %v, want empty list", parsed.GenKeyTypes)
+	}
+
+	if _, err := k.AddToUserData("#cloud-config\n"); err != nil {
+		t.Errorf("AddToUserData on an empty cloud-config: %v", err)
+	}
+	if _, err := k.AddToUserData("#!/bin/sh\necho hi\n"); err == nil {
+		t.Error("a shell script user-data was accepted")
+	}
+}
@@ -8,22 +8,26 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
-	"time"
 )
 
-const (
-	imageBaseDir    = "/var/lib/libvirt/images"
-	imageName       = "jammy-server-cloudimg-amd64.img"
-	imageURL        = "https://cloud-images.ubuntu.com/jammy/current/" + imageName
-	sumsURL         = "https://cloud-images.ubuntu.com/jammy/current/SHA256SUMS"
-	downloadTimeout = 20 * time.Minute
-)
+// imageName returns the file name of the configured cloud image, as listed in
+// its SHA256SUMS.
+func imageName() string {
+	return path.Base(conf.ImageURL)
+}
+
+// sumsURL returns the SHA256SUMS file published next to the cloud image.
+func sumsURL() string {
+	return strings.TrimSuffix(conf.ImageURL, imageName()) + "SHA256SUMS"
+}
 
-// Download downloads, verifies, and installs the Ubuntu 22.04 base cloud image
-// into /var/lib/libvirt/images/ubuntu-base.qcow2.
+// Download downloads, verifies, and installs the configured base cloud image
+// (Ubuntu 22.04 by default) at Config.BaseImage.
 func Download() error {
-	if _, err := os.Stat(baseImage); err == nil {
+	if _, err := os.Stat(conf.BaseImage); err == nil {
 		Skip("Base image already exists")
 		return nil
 	}
@@ -40,12 +44,12 @@ func Download() error {
 
 func downloadBaseImage() error {
 	Info("Downloading Ubuntu cloud image")
-	ctx, cancel := context.WithTimeout(context.Background(), downloadTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), conf.DownloadTimeout)
 	defer cancel()
-	if err := downloadFile(ctx, imageURL, "ubuntu.img"); err != nil {
+	if err := downloadFile(ctx, conf.ImageURL, "ubuntu.img"); err != nil {
 		return fmt.Errorf("download image: %w", err)
 	}
-	if err := downloadFile(ctx, sumsURL, "ubuntu.SHA256SUMS"); err != nil {
+	if err := downloadFile(ctx, sumsURL(), "ubuntu.SHA256SUMS"); err != nil {
 		return fmt.Errorf("download SHA256SUMS: %w", err)
 	}
 	return nil
@@ -53,7 +57,7 @@ func downloadBaseImage() error {
 
 func verifyChecksum() error {
 	Info("Verifying checksum")
-	expected, err := readExpectedChecksum("ubuntu.SHA256SUMS", imageName)
+	expected, err := readExpectedChecksum("ubuntu.SHA256SUMS", imageName())
 	_ = os.Remove("ubuntu.SHA256SUMS")
 	if err != nil {
 		return err
@@ -71,17 +75,17 @@ func verifyChecksum() error {
 
 func installImage() error {
 	Info("Moving image to libvirt storage")
-	if err := os.MkdirAll(imageBaseDir, 0o755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(conf.BaseImage), 0o755); err != nil {
 		return fmt.Errorf("create image dir: %w", err)
 	}
-	if err := os.Rename("ubuntu.img", baseImage); err != nil {
-		if err2 := copyFile("ubuntu.img", baseImage); err2 != nil {
+	if err := os.Rename("ubuntu.img", conf.BaseImage); err != nil {
+		if err2 := copyFile("ubuntu.img", conf.BaseImage); err2 != nil {
 			return fmt.Errorf("install image: %w", err2)
 		}
 		_ = os.Remove("ubuntu.img")
 	}
-	Ok("Base image ready at " + baseImage)
-	Info("Run: sudo chown libvirt-qemu:kvm " + baseImage)
+	Ok("Base image ready at " + conf.BaseImage)
+	Info("Run: sudo chown libvirt-qemu:kvm " + conf.BaseImage)
 	return nil
 }
 
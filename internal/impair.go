@@ -0,0 +1,209 @@
+package lab
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+// tbf parameters for a rate cap: enough burst for a full-size packet at
+// low rates, and a queue bounded in time rather than bytes.
+const (
+	tbfBurst   = "32kbit"
+	tbfLatency = "400ms"
+)
+
+// VMLink is one interface of a VM: the tap device on the host that joins it
+// to a libvirt network. Impairments are queueing disciplines on the tap.
+type VMLink struct {
+	VM      string // role
+	Network string
+	Dev     string // e.g. vnet3
+}
+
+// StackLinks returns the links of cfg's VMs that are running, in VM order.
+func StackLinks(stack string, cfg *StackConfig) []VMLink {
+	var out []VMLink
+	for _, vm := range cfg.VMs {
+		out = append(out, domainLinks(stack, vm.Name)...)
+	}
+	return out
+}
+
+// domainLinks parses virsh domiflist for <stack>-<role>. Interfaces without a
+// tap (the domain is shut off) are left out.
+func domainLinks(stack, role string) []VMLink {
+	out, err := virshCmd("domiflist", stack+"-"+role).Output()
+	if err != nil {
+		return nil
+	}
+	var links []VMLink
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) >= 5 && f[1] == "network" && f[0] != "-" {
+			links = append(links, VMLink{VM: role, Network: f[2], Dev: f[0]})
+		}
+	}
+	return links
+}
+
+// ImpairCommands returns the tc arguments that put im on dev, after any
+// earlier impairment is cleared: netem for delay and loss, and tbf for a
+// rate cap, below netem when both are asked for.
+func ImpairCommands(dev string, im types.ImpairmentSpec) [][]string {
+	var netem []string
+	if im.Delay != "" {
+		netem = append(netem, "delay", im.Delay)
+		if im.Jitter != "" {
+			netem = append(netem, im.Jitter)
+		}
+	}
+	if im.Loss != "" {
+		netem = append(netem, "loss", im.Loss)
+	}
+	tbf := []string{"tbf", "rate", im.Rate, "burst", tbfBurst, "latency", tbfLatency}
+	switch {
+	case len(netem) > 0 && im.Rate != "":
+		return [][]string{
+			append([]string{"qdisc", "add", "dev", dev, "root", "handle", "1:", "netem"}, netem...),
+			append([]string{"qdisc", "add", "dev", dev, "parent", "1:1", "handle", "10:"}, tbf...),
+		}
+	case len(netem) > 0:
+		return [][]string{append([]string{"qdisc", "add", "dev", dev, "root", "netem"}, netem...)}
+	case im.Rate != "":
+		return [][]string{append([]string{"qdisc", "add", "dev", dev, "root"}, tbf...)}
+	}
+	return nil
+}
+
+// Impair puts im on link, replacing what was there.
+func Impair(stack string, link VMLink, im types.ImpairmentSpec) error {
+	if _, err := clearLink(link); err != nil {
+		return err
+	}
+	for _, args := range ImpairCommands(link.Dev, im) {
+		if out, err := rootCmd("tc", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("tc %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	msg := fmt.Sprintf("Link %s (%s, %s) impaired: %s", link.VM, link.Network, link.Dev, FormatImpairment(im))
+	Ok(msg)
+	Publish(Event{Stack: stack, Type: EventLinkImpaired, Source: "network", VM: link.VM, Message: msg})
+	return nil
+}
+
+// ClearImpairment removes the impairment on link, if it has one.
+func ClearImpairment(stack string, link VMLink) error {
+	cleared, err := clearLink(link)
+	if err != nil || !cleared {
+		return err
+	}
+	msg := fmt.Sprintf("Link %s (%s, %s) cleared", link.VM, link.Network, link.Dev)
+	Ok(msg)
+	Publish(Event{Stack: stack, Type: EventLinkCleared, Source: "network", VM: link.VM, Message: msg})
+	return nil
+}
+
+// clearLink deletes link's root qdisc when it is an impairment, so links
+// nlab never touched need no privileges.
+func clearLink(link VMLink) (bool, error) {
+	if ActiveImpairment(link.Dev) == "" {
+		return false, nil
+	}
+	if out, err := rootCmd("tc", "qdisc", "del", "dev", link.Dev, "root").CombinedOutput(); err != nil {
+		return false, fmt.Errorf("clear %s: %s: %s", link.Dev, err, strings.TrimSpace(string(out)))
+	}
+	return true, nil
+}
+
+// ApplyImpairments puts each network's impairment on the links of the VMs
+// attached to it. Run it once the VMs are up; their taps exist only then.
+func ApplyImpairments(stack string, cfg *StackConfig) error {
+	specs := map[string]types.ImpairmentSpec{}
+	for _, n := range cfg.AllNetworks() {
+		if n.Impairment != nil {
+			specs[n.Name] = *n.Impairment
+		}
+	}
+	if len(specs) == 0 {
+		return nil
+	}
+	for _, link := range StackLinks(stack, cfg) {
+		if im, ok := specs[link.Network]; ok {
+			if err := publishError(stack, "network", link.VM, Impair(stack, link, im)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ClearImpairments removes the impairments on every link of the stack,
+// reporting the first failure after attempting them all.
+func ClearImpairments(stack string, cfg *StackConfig) error {
+	var first error
+	for _, link := range StackLinks(stack, cfg) {
+		if err := ClearImpairment(stack, link); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// ActiveImpairment describes the impairment on dev as tc reports it, or ""
+// when there is none. Reading it needs no privileges.
+func ActiveImpairment(dev string) string {
+	out, err := exec.Command("tc", "qdisc", "show", "dev", dev).Output()
+	if err != nil {
+		return ""
+	}
+	return ParseQdiscs(string(out))
+}
+
+// ParseQdiscs summarises tc qdisc show output as delay, loss and rate, or
+// "" when only the kernel's default qdiscs are there.
+func ParseQdiscs(out string) string {
+	var parts []string
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 || (f[1] != "netem" && f[1] != "tbf") {
+			continue
+		}
+		for i := 2; i+1 < len(f); i++ {
+			switch f[i] {
+			case "delay":
+				d := "delay " + f[i+1]
+				if i+2 < len(f) && strings.HasSuffix(f[i+2], "s") && f[i+2][0] >= '0' && f[i+2][0] <= '9' {
+					d += " ±" + f[i+2]
+				}
+				parts = append(parts, d)
+			case "loss":
+				parts = append(parts, "loss "+f[i+1])
+			case "rate":
+				parts = append(parts, "rate "+f[i+1])
+			}
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// FormatImpairment describes im the way ParseQdiscs does.
+func FormatImpairment(im types.ImpairmentSpec) string {
+	var parts []string
+	if im.Delay != "" {
+		d := "delay " + im.Delay
+		if im.Jitter != "" {
+			d += " ±" + im.Jitter
+		}
+		parts = append(parts, d)
+	}
+	if im.Loss != "" {
+		parts = append(parts, "loss "+im.Loss)
+	}
+	if im.Rate != "" {
+		parts = append(parts, "rate "+im.Rate)
+	}
+	return strings.Join(parts, " ")
+}
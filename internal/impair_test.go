@@ -0,0 +1,47 @@
+package lab_test
+
+import (
+	"fmt"
+	"testing"
+
+	lab "github.com/h3ow3d/nlab/internal"
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+func TestImpairCommands(t *testing.T) {
+	tests := []struct {
+		im   types.ImpairmentSpec
+		want string
+	}{
+		{types.ImpairmentSpec{Delay: "200ms", Jitter: "20ms", Loss: "5%"},
+			"[[qdisc add dev vnet3 root netem delay 200ms 20ms loss 5%]]"},
+		{types.ImpairmentSpec{Rate: "1mbit"},
+			"[[qdisc add dev vnet3 root tbf rate 1mbit burst 32kbit latency 400ms]]"},
+		{types.ImpairmentSpec{Delay: "200ms", Loss: "5%", Rate: "1mbit"},
+			"[[qdisc add dev vnet3 root handle 1: netem delay 200ms loss 5%] " +
+				"[qdisc add dev vnet3 parent 1:1 handle 10: tbf rate 1mbit burst 32kbit latency 400ms]]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(lab.ImpairCommands("vnet3", tt.im)); got != tt.want {
+			t.Errorf("ImpairCommands(%+v) =\n%s\nwant\n%s", tt.im, got, tt.want)
+		}
+	}
+}
+
+func TestParseQdiscs(t *testing.T) {
+	for out, want := range map[string]string{
+		"qdisc noqueue 0: root refcnt 2 \n": "",
+		"qdisc netem 1: root refcnt 2 limit 1000 delay 200ms  20ms loss 5%\n" +
+			"qdisc tbf 10: parent 1:1 rate 1Mbit burst 4Kb lat 400ms \n": "delay 200ms ±20ms loss 5% rate 1Mbit",
+		"qdisc netem 8001: root refcnt 2 limit 1000 delay 80.0ms\n":         "delay 80.0ms",
+		"qdisc tbf 8002: root refcnt 2 rate 500Kbit burst 4Kb lat 400ms \n": "rate 500Kbit",
+	} {
+		if got := lab.ParseQdiscs(out); got != want {
+			t.Errorf("ParseQdiscs(%q) = %q, want %q", out, got, want)
+		}
+	}
+	im := types.ImpairmentSpec{Delay: "200ms", Jitter: "20ms", Loss: "5%", Rate: "1mbit"}
+	if got := lab.FormatImpairment(im); got != "delay 200ms ±20ms loss 5% rate 1mbit" {
+		t.Errorf("FormatImpairment = %q", got)
+	}
+}
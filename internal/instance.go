@@ -0,0 +1,187 @@
+package lab
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+// Instance is one copy of a stack brought up with nlab up --instance. Every
+// name derived from the stack (domains, networks, bridges, keys, the tmux
+// session and the state file) uses its qualified name <stack>-<instance>.
+type Instance struct {
+	Stack    string // the stack it is a copy of
+	Name     string
+	Manifest string
+}
+
+// Qualified returns the name the instance is known by to every other command.
+func (i Instance) Qualified() string {
+	return InstanceName(i.Stack, i.Name)
+}
+
+// InstanceName returns the qualified name of instance of stack.
+func InstanceName(stack, instance string) string {
+	return stack + "-" + instance
+}
+
+// ValidateInstanceName checks that instance is a usable name and that its
+// qualified name is not already that of a stack on the search path.
+func ValidateInstanceName(stack, instance string) error {
+	if !stackNameRe.MatchString(instance) {
+		return fmt.Errorf("instance name %q must start with a letter and contain only a-z, 0-9 and '-'", instance)
+	}
+	if path, err := searchStack(InstanceName(stack, instance)); err == nil {
+		return fmt.Errorf("instance %s of %s would share its name with the stack at %s", instance, stack, path)
+	}
+	return nil
+}
+
+// ListInstances returns the instances that are up, sorted by stack and name.
+func ListInstances() []Instance {
+	var out []Instance
+	files, _ := filepath.Glob(filepath.Join(DefaultXDGDirs().StackStateDir(), "*.yaml"))
+	for _, f := range files {
+		st, err := LoadStackState(strings.TrimSuffix(filepath.Base(f), ".yaml"))
+		if err == nil && st.Instance != "" {
+			out = append(out, Instance{Stack: st.Stack, Name: st.Instance, Manifest: st.Manifest})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Stack != out[j].Stack {
+			return out[i].Stack < out[j].Stack
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// LoadInstanceParams loads stack as its instance: like LoadStackParams for
+// the qualified name, with every network renamed <network>-<instance> and
+// given a subnet of its own.
+func LoadInstanceParams(stack, instance string, values map[string]interface{}) (*StackConfig, error) {
+	if err := ValidateInstanceName(stack, instance); err != nil {
+		return nil, err
+	}
+	path, err := ResolveStackFile(stack)
+	if err != nil {
+		return nil, err
+	}
+	return loadInstance(path, stack, instance, values)
+}
+
+func loadInstance(path, stack, instance string, values map[string]interface{}) (*StackConfig, error) {
+	if !isV1alpha1(path) {
+		return nil, fmt.Errorf("stack config %s: instances need a v1alpha1 manifest; run nlab migrate %s", path, stack)
+	}
+	return loadStackV1alpha1(path, InstanceName(stack, instance), values, instance)
+}
+
+var (
+	netNameRe   = regexp.MustCompile(`<name>\s*([^<]*?)\s*</name>`)
+	bridgeRe    = regexp.MustCompile(`(<bridge\s[^>]*name=)["'][^"']*["']`)
+	netSourceRe = regexp.MustCompile(`(<source\s[^>]*network=)["']([^"']*)["']`)
+)
+
+// instantiate makes m the manifest of instance, qualified as name: its
+// metadata.name becomes name, every network is renamed <network>-<instance>
+// and moved to an allocated subnet of the same size, keeping each address
+// at its offset, and a named bridge becomes an allocated one. It returns the
+// leases, as allocateNetworks does.
+func instantiate(name, path, instance string, m *types.StackManifest) (map[string]SubnetLease, error) {
+	m.Metadata.Name = name
+	renamed := make(map[string]string, len(m.Spec.Networks))
+	for n := range m.Spec.Networks {
+		renamed[n] = n + "-" + instance
+	}
+
+	networks := make(map[string]types.NetworkSpec, len(m.Spec.Networks))
+	moved := map[string]string{} // renamed network → its XML before the move
+	for n, spec := range m.Spec.Networks {
+		if _, auto := manifest.AutoPrefix(spec.CIDR); !auto {
+			probe := spec
+			if probe.Bridge == manifest.Auto {
+				probe.Bridge = ""
+			}
+			x, err := manifest.NetworkXML(n, probe)
+			if err != nil {
+				return nil, err
+			}
+			moved[renamed[n]] = x
+			if !spec.Typed() && bridgeRe.MatchString(x) {
+				spec.Bridge = manifest.Auto
+			}
+			if subnet, err := networkSubnet(x); err == nil {
+				ones, _ := subnet.Mask.Size()
+				spec.CIDR = fmt.Sprintf("%s/%d", manifest.Auto, ones)
+			}
+		}
+		if spec.Bridge != "" {
+			spec.Bridge = manifest.Auto
+		}
+		networks[renamed[n]] = spec
+	}
+	m.Spec.Networks = networks
+	for role, vm := range m.Spec.VMs {
+		if vm.Typed() {
+			vm.Networks = manifest.VMNetworks(m, vm) // before the primary is renamed
+		}
+		nets := make([]string, len(vm.Networks))
+		for i, n := range vm.Networks {
+			nets[i] = orDefault(renamed[n], n)
+		}
+		vm.Networks = nets
+		vm.XML = netSourceRe.ReplaceAllStringFunc(vm.XML, func(s string) string {
+			sm := netSourceRe.FindStringSubmatch(s)
+			if r, ok := renamed[sm[2]]; ok {
+				return sm[1] + `"` + r + `"`
+			}
+			return s
+		})
+		m.Spec.VMs[role] = vm
+	}
+
+	leases, err := allocateNetworks(name, path, m)
+	if err != nil {
+		return nil, err
+	}
+	for n, orig := range moved {
+		spec, lease := m.Spec.Networks[n], leases[n]
+		move := func(s string) (string, error) { return s, nil }
+		if lease.CIDR != "" {
+			if move, err = subnetRewriter(orig, lease.CIDR); err != nil {
+				return nil, err
+			}
+		}
+		if spec.XML != "" {
+			x, err := move(spec.XML)
+			if err != nil {
+				return nil, err
+			}
+			x = netNameRe.ReplaceAllString(x, "<name>"+n+"</name>")
+			if lease.Bridge != "" {
+				x = bridgeRe.ReplaceAllString(x, `${1}"`+lease.Bridge+`"`)
+			}
+			// The XML now carries the lease; the rest of the spec, such as
+			// an impairment, stays.
+			spec.XML, spec.XMLFile, spec.CIDR, spec.Bridge = x, "", "", ""
+			m.Spec.Networks[n] = spec
+			continue
+		}
+		if d := spec.DHCP; d != nil && d.Start != "" {
+			start, err1 := move(d.Start)
+			end, err2 := move(d.End)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("spec.networks.%s.dhcp: range does not fit %s", n, lease.CIDR)
+			}
+			spec.DHCP = &types.DHCPSpec{Enabled: true, Start: start, End: end}
+			m.Spec.Networks[n] = spec
+		}
+	}
+	return leases, nil
+}
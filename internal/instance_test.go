@@ -0,0 +1,225 @@
+package lab_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lab "github.com/h3ow3d/nlab/internal"
+)
+
+const instanceStack = `apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata: {name: lab}
+spec:
+  networks:
+    lab_net:
+      xml: |
+        <network>
+          <name>lab_net</name>
+          <bridge name="virbr-lab" stp="on" delay="0"/>
+          <forward mode="nat"/>
+          <ip address="10.10.10.1" netmask="255.255.255.0">
+            <dhcp>
+              <range start="10.10.10.100" end="10.10.10.200"/>
+            </dhcp>
+          </ip>
+        </network>
+    dmz:
+      cidr: 10.20.0.0/26
+      bridge: virbr-labdmz
+      dhcp: {start: 10.20.0.10, end: 10.20.0.20}
+  vms:
+    attacker:
+      xml: |
+        <domain type="kvm">
+          <name>lab-attacker</name>
+          <memory unit="MiB">1024</memory>
+          <vcpu>1</vcpu>
+          <devices>
+            <interface type="network"><source network="lab_net"/></interface>
+          </devices>
+        </domain>
+    target: {memory: 512, vcpus: 1}
+`
+
+func TestInstances(t *testing.T) {
+	isolateXDG(t)
+	cfg := lab.DefaultConfig()
+	if err := cfg.Set("subnetPool", "10.232.0.0/16", lab.SourceFlag); err != nil {
+		t.Fatal(err)
+	}
+	lab.SetConfig(cfg)
+	t.Cleanup(func() { lab.SetConfig(lab.DefaultConfig()) })
+	dir := filepath.Join("stacks", "lab")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path, _ := filepath.Abs(writeFile(t, dir, "stack.yaml", instanceStack))
+
+	alice, err := lab.LoadInstanceParams("lab", "alice", nil)
+	if err != nil {
+		t.Fatalf("LoadInstanceParams: %v", err)
+	}
+	xml := map[string]string{}
+	for _, n := range alice.NetworkDefs {
+		xml[n.Name] = n.XML
+	}
+	raw := xml["lab_net-alice"]
+	for _, want := range []string{"<name>lab_net-alice</name>", `<ip address="10.232.1.1"`, `<range start="10.232.1.100" end="10.232.1.200"/>`} {
+		if !strings.Contains(raw, want) {
+			t.Errorf("lab_net-alice lacks %s:\n%s", want, raw)
+		}
+	}
+	if strings.Contains(raw, `"virbr-lab"`) || strings.Contains(xml["dmz-alice"], "virbr-labdmz") {
+		t.Errorf("bridges should be allocated per instance:\n%s\n%s", raw, xml["dmz-alice"])
+	}
+	if !strings.Contains(xml["dmz-alice"], `<range start="10.232.0.10" end="10.232.0.20"/>`) {
+		t.Errorf("dmz range should keep its offsets:\n%s", xml["dmz-alice"])
+	}
+	for _, vm := range alice.VMs {
+		want := map[string]string{"attacker": "lab_net-alice", "target": "dmz-alice"}[vm.Name]
+		if len(vm.Networks) != 1 || vm.Networks[0] != want {
+			t.Errorf("%s networks = %v, want [%s]", vm.Name, vm.Networks, want)
+		}
+	}
+
+	// What nlab up records makes the qualified name a stack of its own.
+	if err := lab.SaveStackState("lab-alice", lab.StackState{Manifest: path, Stack: "lab", Instance: "alice", Leases: alice.Leases}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := lab.ResolveStackFile("lab-alice"); err != nil || got != path {
+		t.Errorf("ResolveStackFile(lab-alice) = %q, %v", got, err)
+	}
+	again, err := lab.LoadStack("lab-alice")
+	if err != nil || again.NetworkDefs[1].XML != alice.NetworkDefs[1].XML {
+		t.Errorf("LoadStack(lab-alice) differs: %v", err)
+	}
+	if in := lab.ListInstances(); len(in) != 1 || in[0].Qualified() != "lab-alice" {
+		t.Errorf("ListInstances = %+v", in)
+	}
+
+	bob, err := lab.LoadInstanceParams("lab", "bob", nil)
+	if err != nil {
+		t.Fatalf("LoadInstanceParams: %v", err)
+	}
+	if bob.Leases["dmz-bob"].CIDR != "10.232.0.64/26" || bob.Leases["lab_net-bob"].CIDR != "10.232.2.0/24" {
+		t.Errorf("bob should steer clear of alice: %+v", bob.Leases)
+	}
+
+	if _, err := lab.LoadInstanceParams("lab", "Bad", nil); err == nil {
+		t.Error("an invalid instance name was accepted")
+	}
+}
+
+func TestInstanceSingleQuotedXML(t *testing.T) {
+	isolateXDG(t)
+	cfg := lab.DefaultConfig()
+	if err := cfg.Set("subnetPool", "10.232.0.0/16", lab.SourceFlag); err != nil {
+		t.Fatal(err)
+	}
+	lab.SetConfig(cfg)
+	t.Cleanup(func() { lab.SetConfig(lab.DefaultConfig()) })
+	dir := filepath.Join("stacks", "basic")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, "stack.yaml", `apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata: {name: basic}
+spec:
+  networks:
+    lab_net:
+      xml: |
+        <network>
+          <name>lab_net</name>
+          <bridge name='virbr-basic' stp='on' delay='0'/>
+          <ip address='10.10.10.1' netmask='255.255.255.0'>
+            <dhcp><range start='10.10.10.100' end='10.10.10.200'/></dhcp>
+          </ip>
+        </network>
+  vms:
+    target: {memory: 512, vcpus: 1}
+`)
+
+	alice, err := lab.LoadInstanceParams("basic", "alice", nil)
+	if err != nil {
+		t.Fatalf("LoadInstanceParams: %v", err)
+	}
+	raw := alice.NetworkDefs[0].XML
+	if strings.Contains(raw, "virbr-basic") || strings.Contains(raw, "10.10.10.") {
+		t.Errorf("single-quoted bridge and subnet were not moved:\n%s", raw)
+	}
+	if !strings.Contains(raw, "10.232.0.1") {
+		t.Errorf("lab_net-alice should get an allocated subnet:\n%s", raw)
+	}
+}
+
+func TestInstanceKeepsImpairment(t *testing.T) {
+	isolateXDG(t)
+	dir := filepath.Join("stacks", "slow")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, "stack.yaml", `apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata: {name: slow}
+spec:
+  networks:
+    lab_net:
+      xml: |
+        <network>
+          <name>lab_net</name>
+          <ip address="10.10.10.1" netmask="255.255.255.0"/>
+        </network>
+      impairment: {delay: 200ms, loss: 5%}
+  vms:
+    target: {memory: 512, vcpus: 1}
+`)
+
+	alice, err := lab.LoadInstanceParams("slow", "alice", nil)
+	if err != nil {
+		t.Fatalf("LoadInstanceParams: %v", err)
+	}
+	n := alice.AllNetworks()[0]
+	if n.Name != "lab_net-alice" || n.Impairment == nil || lab.FormatImpairment(*n.Impairment) != "delay 200ms loss 5%" {
+		t.Errorf("instance network = %s with impairment %+v, want lab_net-alice with delay 200ms loss 5%%", n.Name, n.Impairment)
+	}
+	if got := alice.NetworkName("lab_net"); got != n.Name {
+		t.Errorf("NetworkName(lab_net) = %s, want %s", got, n.Name)
+	}
+}
+
+func TestInstanceBridgeRef(t *testing.T) {
+	isolateXDG(t)
+	cfg := lab.DefaultConfig()
+	if err := cfg.Set("subnetPool", "10.232.0.0/16", lab.SourceFlag); err != nil {
+		t.Fatal(err)
+	}
+	lab.SetConfig(cfg)
+	t.Cleanup(func() { lab.SetConfig(lab.DefaultConfig()) })
+	dir := filepath.Join("stacks", "lab")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, "stack.yaml", instanceStack)
+
+	// lab-longinstancename is too long for a virbr- bridge name.
+	inst, err := lab.LoadInstanceParams("lab", "longinstancename", nil)
+	if err != nil {
+		t.Fatalf("LoadInstanceParams: %v", err)
+	}
+	for net, lease := range map[string]lab.SubnetLease{
+		"lab_net": inst.Leases["lab_net-longinstancename"],
+		"dmz":     inst.Leases["dmz-longinstancename"],
+	} {
+		if lease.Bridge == "" || !strings.HasPrefix(lease.Bridge, "nlabbr") {
+			t.Fatalf("%s lease = %+v, want an nlabbrN bridge", net, lease)
+		}
+		got := lab.ExpandCommand("sudo tcpdump -i {bridge:"+net+"} -nn", "lab-longinstancename", inst)
+		if want := "sudo tcpdump -i " + lease.Bridge + " -nn"; got != want {
+			t.Errorf("ExpandCommand = %q, want %q", got, want)
+		}
+	}
+}
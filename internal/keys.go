@@ -1,35 +1,591 @@
 package lab
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
 	"fmt"
+	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
-// EnsureKey generates an ed25519 key pair at keys/<stack>/id_ed25519 if it
-// does not already exist.
+const keyFileName = "id_ed25519"
+
+// StackKeyPath returns the path of the stack's private SSH key under
+// XDGDirs.KeysDir.
+func StackKeyPath(stack string) string {
+	return filepath.Join(DefaultXDGDirs().KeysDir(), stack, keyFileName)
+}
+
+// VMKeyPath returns the path of a per-VM private SSH key. The file only
+// exists when the VM was given its own key pair.
+func VMKeyPath(stack, role string) string {
+	return filepath.Join(DefaultXDGDirs().KeysDir(), stack, role, keyFileName)
+}
+
+// KeyPathFor returns the private key that authorizes access to <stack>-<role>:
+// the old key a forced rotation left it with, else the per-VM key when one
+// exists, otherwise the stack key.
+func KeyPathFor(stack, role string) string {
+	if st, err := LoadStackState(stack); err == nil {
+		if p := st.PreviousKeys[role]; p != "" && fileExists(p) {
+			return p
+		}
+	}
+	return currentKeyPath(stack, role)
+}
+
+// currentKeyPath returns the key a VM created now would authorize: the
+// per-VM key when one exists, otherwise the stack key.
+func currentKeyPath(stack, role string) string {
+	if p := VMKeyPath(stack, role); fileExists(p) {
+		return p
+	}
+	return StackKeyPath(stack)
+}
+
+// StackKeyPaths returns the stack key followed by every per-VM key that
+// exists for the stack.
+func StackKeyPaths(stack string) []string {
+	paths := []string{StackKeyPath(stack)}
+	vmKeys, _ := filepath.Glob(filepath.Join(DefaultXDGDirs().KeysDir(), stack, "*", keyFileName))
+	return append(paths, vmKeys...)
+}
+
+// EnsureKey generates the stack's ed25519 key pair if it does not already
+// exist. A key left in ./keys/<stack> by older nlab versions is moved into
+// place instead.
 func EnsureKey(stack string) error {
-	keyDir := filepath.Join("keys", stack)
-	keyPath := filepath.Join(keyDir, "id_ed25519")
+	keyPath := StackKeyPath(stack)
+	if err := migrateLegacyKey(stack, keyPath); err != nil {
+		return publishError(stack, "key", "", err)
+	}
+	return publishError(stack, "key", "", ensureKeyPair(stack, "", keyPath, "nlab-"+stack, fmt.Sprintf("stack %s", stack)))
+}
 
-	if err := os.MkdirAll(keyDir, 0o700); err != nil {
+// EnsureVMKey generates a dedicated key pair for <stack>-<role> if it does
+// not already exist. VMs created afterwards authorize only this key.
+func EnsureVMKey(stack, role string) error {
+	return publishError(stack, "key", role, ensureKeyPair(stack, role, VMKeyPath(stack, role),
+		fmt.Sprintf("nlab-%s-%s", stack, role), fmt.Sprintf("VM %s-%s", stack, role)))
+}
+
+func ensureKeyPair(stack, role, path, comment, what string) error {
+	if fileExists(path) {
+		Skip(fmt.Sprintf("SSH key already exists for %s", what))
+		return nil
+	}
+	Info(fmt.Sprintf("Generating SSH key for %s", what))
+	if err := writeKeyPair(path, comment); err != nil {
+		return err
+	}
+	Ok(fmt.Sprintf("Key generated at %s", path))
+	Publish(Event{Stack: stack, Type: EventKeyGenerated, Source: "key", VM: role,
+		Message: fmt.Sprintf("SSH key generated for %s", what), Data: map[string]string{"path": path}})
+	return nil
+}
+
+// writeKeyPair generates a new ed25519 key pair and writes it to path (0600)
+// and path.pub (0644). Both files are written atomically.
+func writeKeyPair(path, comment string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate key: %w", err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, comment)
+	if err != nil {
+		return fmt.Errorf("marshal private key: %w", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return fmt.Errorf("convert public key: %w", err)
+	}
+	pubLine := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " " + comment + "\n"
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
 		return fmt.Errorf("create key dir: %w", err)
 	}
+	if err := writeFileAtomic(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		return fmt.Errorf("write private key: %w", err)
+	}
+	if err := writeFileAtomic(path+".pub", []byte(pubLine), 0o644); err != nil {
+		return fmt.Errorf("write public key: %w", err)
+	}
+	return nil
+}
 
-	if _, err := os.Stat(keyPath); err == nil {
-		Skip(fmt.Sprintf("SSH key already exists for stack %s", stack))
+// migrateLegacyKey moves ./keys/<stack>/id_ed25519{,.pub} to dst when dst does
+// not exist yet.
+func migrateLegacyKey(stack, dst string) error {
+	legacy := filepath.Join("keys", stack, keyFileName)
+	if fileExists(dst) || !fileExists(legacy) {
 		return nil
 	}
+	Info(fmt.Sprintf("Moving SSH key for stack %s from %s to %s", stack, legacy, dst))
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return fmt.Errorf("create key dir: %w", err)
+	}
+	for _, suffix := range []string{"", ".pub"} {
+		if err := moveFile(legacy+suffix, dst+suffix); err != nil {
+			return fmt.Errorf("migrate key: %w", err)
+		}
+	}
+	if err := os.Chmod(dst, 0o600); err != nil {
+		return err
+	}
+	Publish(Event{Stack: stack, Type: EventKeyMigrated, Source: "key",
+		Message: fmt.Sprintf("SSH key moved from %s", legacy), Data: map[string]string{"path": dst}})
+	return nil
+}
 
-	Info(fmt.Sprintf("Generating SSH key for stack %s", stack))
-	cmd := exec.Command("ssh-keygen", "-t", "ed25519", "-f", keyPath, "-N", "", "-q")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("ssh-keygen: %w", err)
+// KeyInfo describes one key pair on disk.
+type KeyInfo struct {
+	Role        string // empty for the stack key
+	Path        string
+	Fingerprint string
+	PublicKey   string
+	InAgent     bool
+}
+
+// StackKeys returns the stack key and any per-VM keys that exist on disk.
+func StackKeys(stack string) ([]KeyInfo, error) {
+	var out []KeyInfo
+	for _, p := range StackKeyPaths(stack) {
+		if !fileExists(p) {
+			continue
+		}
+		pub, err := readPublicKey(p)
+		if err != nil {
+			return nil, err
+		}
+		info := KeyInfo{
+			Path:        p,
+			Fingerprint: ssh.FingerprintSHA256(pub),
+			PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))),
+			InAgent:     agentHasKey(pub),
+		}
+		if p != StackKeyPath(stack) {
+			info.Role = filepath.Base(filepath.Dir(p))
+		}
+		out = append(out, info)
 	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no SSH keys for stack %s – run 'nlab key generate %s' first", stack, stack)
+	}
+	return out, nil
+}
 
-	Ok(fmt.Sprintf("Key generated at %s", keyPath))
+// RotateKey replaces the key that authorizes access to the stack's VMs (or,
+// with role set, a single VM). The new public key is pushed to every affected
+// VM over SSH and verified before the old key is removed from the VMs and
+// from disk, so access is never lost. Defined VMs that cannot be reached
+// abort the rotation unless force is set.
+func RotateKey(stack string, cfg *StackConfig, role string, force bool) error {
+	return publishError(stack, "key", role, rotateKey(stack, cfg, role, force))
+}
+
+func rotateKey(stack string, cfg *StackConfig, role string, force bool) error {
+	target := StackKeyPath(stack)
+	if role != "" {
+		if _, ok := cfg.VM(role); !ok {
+			return fmt.Errorf("stack %s has no VM %q", stack, role)
+		}
+		target = VMKeyPath(stack, role)
+	}
+
+	type vmTarget struct{ name, role, addr, oldKey, user string }
+	var targets []vmTarget
+	skipped := map[string]string{} // role → the only key it authorizes
+	for _, v := range cfg.VMs {
+		if role != "" && v.Name != role {
+			continue
+		}
+		if role == "" && currentKeyPath(stack, v.Name) != target {
+			continue // has its own per-VM key
+		}
+		oldKey := KeyPathFor(stack, v.Name)
+		name := stack + "-" + v.Name
+		if !DomainExists(name) {
+			continue
+		}
+		ip, err := StackVMAddress(stack, cfg, v.Name)
+		if err != nil {
+			if !force {
+				return fmt.Errorf("cannot rotate: %w (use --force to skip unreachable VMs)", err)
+			}
+			skipped[v.Name] = oldKey
+			Skip(fmt.Sprintf("%s is unreachable; it keeps authorizing only the old key", name))
+			continue
+		}
+		targets = append(targets, vmTarget{name: name, role: v.Name, addr: ip, oldKey: oldKey, user: v.User()})
+	}
+
+	newPath := target + ".new"
+	defer func() { _ = os.Remove(newPath); _ = os.Remove(newPath + ".pub") }()
+	comment := "nlab-" + stack
+	if role != "" {
+		comment += "-" + role
+	}
+	if err := writeKeyPair(newPath, comment); err != nil {
+		return err
+	}
+	newPub, err := os.ReadFile(newPath + ".pub")
+	if err != nil {
+		return err
+	}
+	newLine := strings.TrimSpace(string(newPub))
+
+	knownHosts := KnownHostsPath(stack)
+	var pushed []vmTarget
+	rollback := func() {
+		for _, t := range pushed {
+			c := NewSSHClient(t.user, knownHosts, t.oldKey)
+			c.SetHostAlias(t.addr, t.name)
+			_, _ = c.Output(t.addr, removeAuthorizedKeyCmd(newLine))
+			c.Close()
+		}
+	}
+
+	for _, t := range targets {
+		Info(fmt.Sprintf("Authorizing new key on %s", t.name))
+		c := NewSSHClient(t.user, knownHosts, t.oldKey)
+		c.SetHostAlias(t.addr, t.name)
+		_, err := c.Output(t.addr, addAuthorizedKeyCmd(newLine))
+		c.Close()
+		if err != nil {
+			rollback()
+			return fmt.Errorf("push new key to %s: %w", t.name, err)
+		}
+		pushed = append(pushed, t)
+
+		nc := NewSSHClient(t.user, knownHosts, newPath)
+		nc.SetHostAlias(t.addr, t.name)
+		state := nc.Probe(t.addr)
+		nc.Close()
+		if !state.Ready() {
+			rollback()
+			return fmt.Errorf("new key rejected by %s (%s); rotation rolled back", t.name, state)
+		}
+	}
+
+	var oldLines []string
+	for _, t := range targets {
+		if pub, err := os.ReadFile(t.oldKey + ".pub"); err == nil {
+			oldLines = append(oldLines, strings.TrimSpace(string(pub)))
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+		return err
+	}
+	if fileExists(target) {
+		agentRemoveKey(target)
+	}
+	// The skipped VMs keep authorizing their old key, so the state records
+	// it; one about to be overwritten is moved aside first.
+	previous := map[string]string{}
+	kept := ""
+	for r, old := range skipped {
+		if old == target {
+			if kept == "" {
+				kept = previousKeyPath(stack, target)
+				for _, suffix := range []string{"", ".pub"} {
+					if err := os.Rename(target+suffix, kept+suffix); err != nil {
+						rollback()
+						return fmt.Errorf("keep old key: %w", err)
+					}
+				}
+			}
+			old = kept
+		}
+		previous[r] = old
+	}
+	if err := os.Rename(newPath, target); err != nil {
+		rollback()
+		if kept != "" {
+			_ = os.Rename(kept, target)
+			_ = os.Rename(kept+".pub", target+".pub")
+		}
+		return fmt.Errorf("install new key: %w", err)
+	}
+	if err := os.Rename(newPath+".pub", target+".pub"); err != nil {
+		return fmt.Errorf("install new public key: %w", err)
+	}
+
+	for _, t := range targets {
+		c := NewSSHClient(t.user, knownHosts, target)
+		c.SetHostAlias(t.addr, t.name)
+		for _, old := range oldLines {
+			if old == newLine {
+				continue
+			}
+			if _, err := c.Output(t.addr, removeAuthorizedKeyCmd(old)); err != nil {
+				Error(fmt.Sprintf("retire old key on %s: %v", t.name, err))
+			}
+		}
+		c.Close()
+		Ok(fmt.Sprintf("%s now authorizes only the new key", t.name))
+		previous[t.role] = ""
+	}
+	if err := updatePreviousKeys(stack, previous); err != nil {
+		return err
+	}
+	for _, r := range sortedKeys(skipped) {
+		Info(fmt.Sprintf("%s-%s is reached with %s until it is rotated again", stack, r, previous[r]))
+	}
+
+	Ok(fmt.Sprintf("Key rotated: %s", target))
+	Publish(Event{Stack: stack, Type: EventKeyRotated, Source: "key", VM: role,
+		Message: fmt.Sprintf("SSH key rotated on %d VM(s)", len(targets)), Data: map[string]string{"path": target}})
 	return nil
 }
+
+// previousKeyPath returns where the key at target is kept for VMs a rotation
+// skipped: target.old, or target.old2, … while an earlier one is still in use.
+func previousKeyPath(stack, target string) string {
+	inUse := map[string]bool{}
+	if st, err := LoadStackState(stack); err == nil {
+		for _, p := range st.PreviousKeys {
+			inUse[p] = true
+		}
+	}
+	for n := 1; ; n++ {
+		p := target + ".old"
+		if n > 1 {
+			p += strconv.Itoa(n)
+		}
+		if !inUse[p] {
+			return p
+		}
+	}
+}
+
+// updatePreviousKeys records in the stack state the old key each VM in keys
+// is left with; an empty path clears the VM's entry. Keys kept aside by
+// previousKeyPath that no VM needs any more are deleted.
+func updatePreviousKeys(stack string, keys map[string]string) error {
+	st, err := LoadStackState(stack)
+	if os.IsNotExist(err) {
+		st, err = &StackState{}, nil
+		changed := false
+		for _, p := range keys {
+			changed = changed || p != ""
+		}
+		if !changed {
+			return nil // nothing to record for a stack that is not up
+		}
+	}
+	if err != nil {
+		return err
+	}
+	before := st.PreviousKeys
+	st.PreviousKeys = map[string]string{}
+	for r, p := range before {
+		st.PreviousKeys[r] = p
+	}
+	for r, p := range keys {
+		if p == "" {
+			delete(st.PreviousKeys, r)
+		} else {
+			st.PreviousKeys[r] = p
+		}
+	}
+	inUse := map[string]bool{}
+	for _, p := range st.PreviousKeys {
+		inUse[p] = true
+	}
+	for _, p := range before {
+		if !inUse[p] && strings.HasPrefix(filepath.Base(p), keyFileName+".old") {
+			_ = os.Remove(p)
+			_ = os.Remove(p + ".pub")
+		}
+	}
+	if len(st.PreviousKeys) == 0 {
+		st.PreviousKeys = nil
+	}
+	st.UpdatedAt = time.Time{}
+	return SaveStackState(stack, *st)
+}
+
+// authorizedKeyMatch returns the "type base64" part of an authorized_keys
+// line, which identifies the key regardless of its comment.
+func authorizedKeyMatch(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) >= 2 {
+		return fields[0] + " " + fields[1]
+	}
+	return line
+}
+
+func addAuthorizedKeyCmd(line string) string {
+	return fmt.Sprintf("mkdir -p ~/.ssh && chmod 700 ~/.ssh && touch ~/.ssh/authorized_keys && "+
+		"(grep -qF %s ~/.ssh/authorized_keys || echo %s >> ~/.ssh/authorized_keys) && chmod 600 ~/.ssh/authorized_keys",
+		shellQuote(authorizedKeyMatch(line)), shellQuote(line))
+}
+
+func removeAuthorizedKeyCmd(line string) string {
+	return fmt.Sprintf("grep -vF %s ~/.ssh/authorized_keys > ~/.ssh/authorized_keys.nlab; "+
+		"mv ~/.ssh/authorized_keys.nlab ~/.ssh/authorized_keys && chmod 600 ~/.ssh/authorized_keys",
+		shellQuote(authorizedKeyMatch(line)))
+}
+
+// ── ssh-agent ─────────────────────────────────────────────────────────────────
+
+// AgentAddKeys loads every key of the stack into the running ssh-agent
+// (SSH_AUTH_SOCK). A zero lifetime keeps the keys until the agent exits.
+func AgentAddKeys(stack string, lifetime time.Duration) error {
+	a, conn, err := dialAgent()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	keys, err := StackKeys(stack)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		data, err := os.ReadFile(k.Path)
+		if err != nil {
+			return err
+		}
+		priv, err := ssh.ParseRawPrivateKey(data)
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", k.Path, err)
+		}
+		if err := a.Add(agent.AddedKey{
+			PrivateKey:   priv,
+			Comment:      "nlab:" + k.Path,
+			LifetimeSecs: uint32(lifetime.Seconds()),
+		}); err != nil {
+			return fmt.Errorf("add %s to ssh-agent: %w", k.Path, err)
+		}
+		Ok(fmt.Sprintf("Loaded %s into ssh-agent (%s)", k.Path, k.Fingerprint))
+	}
+	return nil
+}
+
+// AgentHasKeys reports whether every key of the stack is loaded in the
+// running ssh-agent.
+func AgentHasKeys(stack string) bool {
+	keys, err := StackKeys(stack)
+	if err != nil {
+		return false
+	}
+	for _, k := range keys {
+		if !k.InAgent {
+			return false
+		}
+	}
+	return true
+}
+
+func dialAgent() (agent.ExtendedAgent, net.Conn, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, nil, fmt.Errorf("SSH_AUTH_SOCK is not set; start ssh-agent first (eval \"$(ssh-agent)\")")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connect to ssh-agent: %w", err)
+	}
+	return agent.NewClient(conn), conn, nil
+}
+
+func agentHasKey(pub ssh.PublicKey) bool {
+	a, conn, err := dialAgent()
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	keys, err := a.List()
+	if err != nil {
+		return false
+	}
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), pub.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// agentRemoveKey drops the key at path from the agent, if it is loaded.
+func agentRemoveKey(path string) {
+	pub, err := readPublicKey(path)
+	if err != nil {
+		return
+	}
+	a, conn, err := dialAgent()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_ = a.Remove(pub)
+}
+
+// ── helpers ───────────────────────────────────────────────────────────────────
+
+// readPublicKey returns the public half of the private key at path, preferring
+// path.pub when present.
+func readPublicKey(path string) (ssh.PublicKey, error) {
+	if data, err := os.ReadFile(path + ".pub"); err == nil {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err == nil {
+			return pub, nil
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key %s: %w", path, err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse key %s: %w", path, err)
+	}
+	return signer.PublicKey(), nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// moveFile renames src to dst, falling back to copy+remove across devices.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,204 @@
+package lab_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	lab "github.com/h3ow3d/nlab/internal"
+)
+
+// isolateXDG points every XDG base directory at a fresh temp dir and makes it
+// the working directory.
+func isolateXDG(t *testing.T) string {
+	t.Helper()
+	tmp := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(tmp, "config"))
+	t.Setenv("XDG_DATA_HOME", filepath.Join(tmp, "data"))
+	t.Setenv("XDG_STATE_HOME", filepath.Join(tmp, "state"))
+	orig, _ := os.Getwd()
+	t.Cleanup(func() { _ = os.Chdir(orig) })
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatal(err)
+	}
+	return tmp
+}
+
+func TestEnsureKeyGeneratesUnderXDG(t *testing.T) {
+	tmp := isolateXDG(t)
+
+	if err := lab.EnsureKey("basic"); err != nil {
+		t.Fatalf("EnsureKey: %v", err)
+	}
+	priv := lab.StackKeyPath("basic")
+	if want := filepath.Join(tmp, "data", "nlab", "keys", "basic", "id_ed25519"); priv != want {
+		t.Errorf("StackKeyPath = %q, want %q", priv, want)
+	}
+
+	fi, err := os.Stat(priv)
+	if err != nil {
+		t.Fatalf("private key not written: %v", err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("private key mode = %o, want 600", fi.Mode().Perm())
+	}
+
+	data, _ := os.ReadFile(priv)
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		t.Fatalf("private key does not parse: %v", err)
+	}
+	pubData, _ := os.ReadFile(priv + ".pub")
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey(pubData)
+	if err != nil {
+		t.Fatalf("public key does not parse: %v", err)
+	}
+	if string(pub.Marshal()) != string(signer.PublicKey().Marshal()) {
+		t.Error("public key does not match private key")
+	}
+	if comment != "nlab-basic" {
+		t.Errorf("comment = %q, want nlab-basic", comment)
+	}
+
+	// Second call must keep the existing key.
+	if err := lab.EnsureKey("basic"); err != nil {
+		t.Fatalf("EnsureKey (second): %v", err)
+	}
+	again, _ := os.ReadFile(priv)
+	if string(again) != string(data) {
+		t.Error("EnsureKey replaced an existing key")
+	}
+}
+
+func TestEnsureKeyMigratesLegacyKey(t *testing.T) {
+	isolateXDG(t)
+
+	legacyDir := filepath.Join("keys", "basic")
+	if err := os.MkdirAll(legacyDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	writeTestKey(t, legacyDir)
+	if err := os.WriteFile(filepath.Join(legacyDir, "id_ed25519.pub"), []byte("ssh-ed25519 AAAA legacy\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	legacy, _ := os.ReadFile(filepath.Join(legacyDir, "id_ed25519"))
+
+	if err := lab.EnsureKey("basic"); err != nil {
+		t.Fatalf("EnsureKey: %v", err)
+	}
+	moved, err := os.ReadFile(lab.StackKeyPath("basic"))
+	if err != nil {
+		t.Fatalf("migrated key missing: %v", err)
+	}
+	if string(moved) != string(legacy) {
+		t.Error("migrated key differs from legacy key")
+	}
+	if _, err := os.Stat(filepath.Join(legacyDir, "id_ed25519")); !os.IsNotExist(err) {
+		t.Error("legacy key was not removed after migration")
+	}
+}
+
+func TestPerVMKeys(t *testing.T) {
+	isolateXDG(t)
+
+	if err := lab.EnsureKey("basic"); err != nil {
+		t.Fatal(err)
+	}
+	if got := lab.KeyPathFor("basic", "target"); got != lab.StackKeyPath("basic") {
+		t.Errorf("KeyPathFor without per-VM key = %q, want stack key", got)
+	}
+
+	if err := lab.EnsureVMKey("basic", "target"); err != nil {
+		t.Fatalf("EnsureVMKey: %v", err)
+	}
+	if got := lab.KeyPathFor("basic", "target"); got != lab.VMKeyPath("basic", "target") {
+		t.Errorf("KeyPathFor = %q, want per-VM key %q", got, lab.VMKeyPath("basic", "target"))
+	}
+	if got := lab.KeyPathFor("basic", "attacker"); got != lab.StackKeyPath("basic") {
+		t.Errorf("KeyPathFor(attacker) = %q, want stack key", got)
+	}
+
+	keys, err := lab.StackKeys("basic")
+	if err != nil {
+		t.Fatalf("StackKeys: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("len(StackKeys) = %d, want 2", len(keys))
+	}
+	if keys[0].Role != "" || keys[1].Role != "target" {
+		t.Errorf("roles = %q, %q; want \"\", \"target\"", keys[0].Role, keys[1].Role)
+	}
+	if !strings.HasPrefix(keys[1].Fingerprint, "SHA256:") {
+		t.Errorf("fingerprint = %q, want SHA256:…", keys[1].Fingerprint)
+	}
+}
+
+func TestRotateKeyUnknownVM(t *testing.T) {
+	isolateXDG(t)
+	cfg := &lab.StackConfig{Network: "lab", VMs: []lab.VMSpec{{Name: "attacker"}}}
+	err := lab.RotateKey("basic", cfg, "ghost", false)
+	if err == nil || !strings.Contains(err.Error(), `stack basic has no VM "ghost"`) {
+		t.Errorf("RotateKey(ghost) error = %v, want no such VM", err)
+	}
+	if _, err := os.Stat(filepath.Dir(lab.VMKeyPath("basic", "ghost"))); !os.IsNotExist(err) {
+		t.Error("a key directory was created for a VM that does not exist")
+	}
+}
+
+// fakeVirsh puts a virsh on PATH that prints out[<command> <first arg>]
+// for the commands in out and fails every other one.
+func fakeVirsh(t *testing.T, out map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	script := "#!/bin/sh\n[ \"$1\" = --connect ] && shift 2\ncase \"$1 $2\" in\n"
+	for cmd, text := range out {
+		script += fmt.Sprintf("  %s) printf '%%s\\n' %s; exit 0 ;;\n", shellQuote(cmd), shellQuote(text))
+	}
+	script += "esac\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(dir, "virsh"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func TestRotateKeyForceKeepsOldKey(t *testing.T) {
+	isolateXDG(t)
+	fakeVirsh(t, map[string]string{"dominfo basic-target": "", "domiflist basic-target": ""})
+	if err := lab.EnsureKey("basic"); err != nil {
+		t.Fatal(err)
+	}
+	orig, _ := os.ReadFile(lab.StackKeyPath("basic") + ".pub")
+	cfg := &lab.StackConfig{Network: "lab", HostNetworks: []string{"lab"}, VMs: []lab.VMSpec{{Name: "target"}}}
+
+	if err := lab.RotateKey("basic", cfg, "", false); err == nil {
+		t.Fatal("RotateKey rotated past an unreachable VM without --force")
+	}
+	if err := lab.RotateKey("basic", cfg, "", true); err != nil {
+		t.Fatalf("RotateKey --force: %v", err)
+	}
+	rotated, _ := os.ReadFile(lab.StackKeyPath("basic") + ".pub")
+	if string(rotated) == string(orig) {
+		t.Error("the stack key was not rotated")
+	}
+	// The skipped VM is still reached with the key it authorizes.
+	kept := lab.KeyPathFor("basic", "target")
+	if pub, err := os.ReadFile(kept + ".pub"); err != nil || string(pub) != string(orig) {
+		t.Fatalf("KeyPathFor(target) = %s, want the old key kept aside (%v)", kept, err)
+	}
+
+	// Another forced rotation leaves it where it is.
+	if err := lab.RotateKey("basic", cfg, "", true); err != nil {
+		t.Fatalf("second RotateKey --force: %v", err)
+	}
+	if got := lab.KeyPathFor("basic", "target"); got != kept {
+		t.Errorf("after a second rotation KeyPathFor(target) = %s, want %s", got, kept)
+	}
+}
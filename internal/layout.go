@@ -3,23 +3,41 @@ package lab
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+	"github.com/h3ow3d/nlab/internal/types"
 )
 
-// Layout is the top-level structure of a layout.yaml file.
+// Layout is the tmux session of a stack. A layout.yaml file describes a single
+// window with Layout and Panes; layouts built from spec.tmux set Windows.
 type Layout struct {
-	Layout string `yaml:"layout"`
-	Panes  []Pane `yaml:"panes"`
+	Layout  string   `yaml:"layout"`
+	Panes   []Pane   `yaml:"panes"`
+	Windows []Window `yaml:"-"`
+}
+
+// Window is one tmux window.
+type Window struct {
+	Name   string
+	Layout string // tmux select-layout value
+	Panes  []Pane
 }
 
 // Pane describes one tmux pane.
 type Pane struct {
-	Name    string `yaml:"name"`
-	Type    string `yaml:"type"`    // "ssh" | "command"
-	VM      string `yaml:"vm"`      // set when Type == "ssh"
-	Command string `yaml:"command"` // set when Type == "command"
+	Name    string            `yaml:"name"`
+	Type    string            `yaml:"type"`              // "ssh" | "command" | "shell"
+	VM      string            `yaml:"vm,omitempty"`      // set when Type == "ssh"
+	Command string            `yaml:"command,omitempty"` // set when Type == "command"
+	Cwd     string            `yaml:"cwd,omitempty"`
+	Env     map[string]string `yaml:"env,omitempty"`
+	Title   string            `yaml:"title,omitempty"`
 }
 
 // LoadLayout reads and parses a layout.yaml file.
@@ -38,20 +56,109 @@ func LoadLayout(path string) (*Layout, error) {
 	return &l, nil
 }
 
+// tmuxWindow converts a layout.yaml into the spec.tmux window it stands for,
+// pane by pane in its order.
+func (l *Layout) tmuxWindow() types.TmuxWindow {
+	w := types.TmuxWindow{Layout: l.Layout}
+	for _, p := range l.Panes {
+		w.Panes = append(w.Panes, types.TmuxPane{Type: p.Type, VM: p.VM, Command: p.Command,
+			Cwd: p.Cwd, Env: p.Env, Title: orDefault(p.Title, p.Name)})
+	}
+	return w
+}
+
+// LayoutFromSpec converts a manifest's spec.tmux into a Layout. Relative pane
+// working directories are resolved against dir. Without windows, the preset
+// opens one window with an ssh pane per VM in vms.
+func LayoutFromSpec(spec *types.TmuxSpec, vms []string, dir string) *Layout {
+	preset := manifest.PresetLayout(spec.Preset)
+	l := &Layout{}
+	if len(spec.Windows) == 0 {
+		w := Window{Layout: preset}
+		for _, vm := range vms {
+			w.Panes = append(w.Panes, Pane{Name: vm, Type: "ssh", VM: vm, Title: vm})
+		}
+		l.Windows = []Window{w}
+		return l
+	}
+	for _, sw := range spec.Windows {
+		w := Window{Name: sw.Name, Layout: orDefault(sw.Layout, preset)}
+		for _, p := range sw.Panes {
+			cwd := p.Cwd
+			if cwd != "" && !filepath.IsAbs(cwd) && !strings.HasPrefix(cwd, "~") {
+				cwd = filepath.Join(dir, cwd)
+			}
+			w.Panes = append(w.Panes, Pane{Name: p.Title, Type: p.PaneType(), VM: p.VM,
+				Command: p.Command, Cwd: cwd, Env: p.Env, Title: p.Title})
+		}
+		l.Windows = append(l.Windows, w)
+	}
+	return l
+}
+
+// StackLayout returns the tmux layout of a stack: spec.tmux, else the
+// deprecated layout.yaml next to the manifest, else the default preset.
+func StackLayout(stack string, cfg *StackConfig) (*Layout, error) {
+	dir, err := StackDir(stack)
+	if err != nil {
+		return nil, err
+	}
+	vms := make([]string, 0, len(cfg.VMs))
+	for _, v := range cfg.VMs {
+		vms = append(vms, v.Name)
+	}
+	sort.Strings(vms)
+	if cfg.Tmux != nil {
+		return LayoutFromSpec(cfg.Tmux, vms, dir), nil
+	}
+	path := filepath.Join(dir, "layout.yaml")
+	if _, err := os.Stat(path); err == nil {
+		Warn(fmt.Sprintf("%s is deprecated: move it into spec.tmux in %s", path, stackFileName))
+		return LoadLayout(path)
+	}
+	return LayoutFromSpec(&types.TmuxSpec{}, vms, dir), nil
+}
+
+// AllWindows returns the windows to open: Windows when set, otherwise the
+// single window of a layout.yaml.
+func (l *Layout) AllWindows() []Window {
+	if len(l.Windows) > 0 {
+		return l.Windows
+	}
+	return []Window{{Layout: l.Layout, Panes: l.Panes}}
+}
+
 // SSHVMs returns the deduplicated list of VM names whose panes have type "ssh".
 func (l *Layout) SSHVMs() []string {
 	seen := make(map[string]bool)
 	var out []string
-	for _, p := range l.Panes {
-		if p.Type == "ssh" && !seen[p.VM] {
-			seen[p.VM] = true
-			out = append(out, p.VM)
+	for _, w := range l.AllWindows() {
+		for _, p := range w.Panes {
+			if p.Type == "ssh" && !seen[p.VM] {
+				seen[p.VM] = true
+				out = append(out, p.VM)
+			}
 		}
 	}
 	return out
 }
 
-// ExpandCommand substitutes {stack} in a pane command with the given stack name.
-func ExpandCommand(cmd, stack string) string {
-	return strings.ReplaceAll(cmd, "{stack}", stack)
+// bridgeRefRe matches a {bridge:<network>} reference in a pane command.
+var bridgeRefRe = regexp.MustCompile(`\{bridge:([^}]*)\}`)
+
+// ExpandCommand substitutes {stack} in a pane command with the given stack
+// name and {bridge:<network>} with the bridge of that network of cfg, which
+// for an instance is the one its lease gave it. A reference cfg cannot
+// resolve is left as it is.
+func ExpandCommand(cmd, stack string, cfg *StackConfig) string {
+	cmd = strings.ReplaceAll(cmd, "{stack}", stack)
+	if cfg == nil {
+		return cmd
+	}
+	return bridgeRefRe.ReplaceAllStringFunc(cmd, func(ref string) string {
+		if b := cfg.Bridge(bridgeRefRe.FindStringSubmatch(ref)[1]); b != "" {
+			return b
+		}
+		return ref
+	})
 }
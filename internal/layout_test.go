@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	lab "github.com/h3ow3d/nlab/internal"
+	"github.com/h3ow3d/nlab/internal/types"
 )
 
 func writeFile(t *testing.T, dir, name, content string) string {
@@ -101,11 +102,85 @@ func TestExpandCommand(t *testing.T) {
 		{"sudo tcpdump -i virbr-{stack} -nn", "basic", "sudo tcpdump -i virbr-basic -nn"},
 		{"echo hello", "mystack", "echo hello"},
 		{"{stack}/{stack}", "x", "x/x"},
+		{"tcpdump -i {bridge:lab_net}", "x", "tcpdump -i {bridge:lab_net}"},
 	}
 	for _, tc := range tests {
-		got := lab.ExpandCommand(tc.cmd, tc.stack)
+		got := lab.ExpandCommand(tc.cmd, tc.stack, nil)
 		if got != tc.want {
 			t.Errorf("ExpandCommand(%q, %q) = %q, want %q", tc.cmd, tc.stack, got, tc.want)
 		}
 	}
 }
+
+func TestLayoutFromSpec(t *testing.T) {
+	spec := &types.TmuxSpec{Preset: "wide", Windows: []types.TmuxWindow{
+		{Name: "lab", Panes: []types.TmuxPane{{VM: "a", Title: "a"}, {Command: "htop", Cwd: "work"}}},
+		{Name: "logs", Layout: "tiled", Panes: []types.TmuxPane{{Cwd: "/var/log"}}},
+	}}
+	l := lab.LayoutFromSpec(spec, []string{"a", "b"}, "/stacks/x")
+	if len(l.Windows) != 2 {
+		t.Fatalf("len(Windows) = %d, want 2", len(l.Windows))
+	}
+	w := l.Windows[0]
+	if w.Name != "lab" || w.Layout != "even-horizontal" {
+		t.Errorf("Windows[0] = %q %q, want lab even-horizontal", w.Name, w.Layout)
+	}
+	if w.Panes[0].Type != "ssh" || w.Panes[1].Type != "command" {
+		t.Errorf("pane types = %q %q, want ssh command", w.Panes[0].Type, w.Panes[1].Type)
+	}
+	if w.Panes[1].Cwd != "/stacks/x/work" {
+		t.Errorf("relative cwd = %q, want /stacks/x/work", w.Panes[1].Cwd)
+	}
+	if w := l.Windows[1]; w.Layout != "tiled" || w.Panes[0].Type != "shell" || w.Panes[0].Cwd != "/var/log" {
+		t.Errorf("Windows[1] = %+v", w)
+	}
+	if got := l.SSHVMs(); len(got) != 1 || got[0] != "a" {
+		t.Errorf("SSHVMs = %v, want [a]", got)
+	}
+}
+
+func TestLayoutFromSpecPreset(t *testing.T) {
+	l := lab.LayoutFromSpec(&types.TmuxSpec{}, []string{"a", "b"}, "/stacks/x")
+	if len(l.Windows) != 1 || l.Windows[0].Layout != "main-vertical" {
+		t.Fatalf("Windows = %+v, want one main-vertical window", l.Windows)
+	}
+	if got := l.SSHVMs(); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("SSHVMs = %v, want [a b]", got)
+	}
+}
+
+func TestStackLayoutFallsBackToLayoutYAML(t *testing.T) {
+	setupStack(t, "legacy", `apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: legacy
+spec:
+  networks:
+    net:
+      cidr: 10.0.0.0/24
+  vms:
+    a:
+      memory: 1
+      vcpus: 1
+`)
+	cfg, err := lab.LoadStack("legacy")
+	if err != nil {
+		t.Fatalf("LoadStack: %v", err)
+	}
+	l, err := lab.StackLayout("legacy", cfg)
+	if err != nil {
+		t.Fatalf("StackLayout: %v", err)
+	}
+	if got := l.AllWindows(); len(got) != 1 || got[0].Layout != "main-vertical" {
+		t.Errorf("default layout = %+v", got)
+	}
+
+	writeFile(t, filepath.Join("stacks", "legacy"), "layout.yaml", "layout: tiled\npanes:\n  - type: ssh\n    vm: a\n")
+	l, err = lab.StackLayout("legacy", cfg)
+	if err != nil {
+		t.Fatalf("StackLayout: %v", err)
+	}
+	if got := l.AllWindows(); len(got) != 1 || got[0].Layout != "tiled" {
+		t.Errorf("layout.yaml layout = %+v", got)
+	}
+}
@@ -37,4 +37,5 @@ func colorizeStderr(color, msg string) string {
 func Info(msg string)  { fmt.Printf("%s %s\n", colorize(cyan, "[+]"), msg) }
 func Ok(msg string)    { fmt.Printf("%s %s\n", colorize(green, "[✓]"), msg) }
 func Skip(msg string)  { fmt.Printf("%s %s\n", colorize(yellow, "[=]"), msg) }
+func Warn(msg string)  { fmt.Fprintf(os.Stderr, "%s %s\n", colorizeStderr(yellow, "[~]"), msg) }
 func Error(msg string) { fmt.Fprintf(os.Stderr, "%s %s\n", colorizeStderr(red, "[!]"), msg) }
@@ -0,0 +1,494 @@
+package manifest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+// componentKind is the kind of the manifests spec.components imports.
+const componentKind = "Component"
+
+// deleteMarker, as the value of a mapping key, removes that key from what
+// is merged so far. A list item with "$delete: true" removes the item with
+// the same name or title.
+const deleteMarker = "$delete"
+
+// FindStack returns the manifest of the stack called name, for
+// spec.extends entries that are not paths and not a stack next to the
+// extending one. lab points it at the stack search path.
+var FindStack func(name string) (string, error)
+
+// pathFields are the fields whose relative paths are rebased when a spec is
+// merged into a manifest in another directory.
+var pathFields = map[string]bool{
+	"xmlFile": true, "dir": true, "userDataFile": true, "metaDataFile": true, "networkConfigFile": true,
+}
+
+// composes reports whether the Stack document root extends other stacks or
+// imports components.
+func composes(root *yaml.Node) bool {
+	spec := mapValue(root, "spec")
+	return mapValue(spec, "extends") != nil || mapValue(spec, "components") != nil
+}
+
+// composer merges a manifest with the stacks it extends and the components
+// it imports, remembering the file every node came from.
+type composer struct {
+	origin map[*yaml.Node]string
+	data   map[string][]byte
+	issues []Issue
+}
+
+// compose replaces the root of a Stack document that uses spec.extends or
+// spec.components with the merged manifest, and decodes it. Merging is
+// deterministic: each base in extends order, then each component, then the
+// document itself. Mappings merge key by key; lists of named windows or
+// titled panes merge item by item; anything else is replaced.
+func (d *document) compose() []Issue {
+	c := &composer{origin: map[*yaml.Node]string{}, data: map[string][]byte{d.file: d.data}}
+	c.mark(d.root, d.file)
+	abs, _ := filepath.Abs(d.file)
+	root := c.compose(d.root, d.file, []string{abs})
+	c.issues = append(c.issues, unknownFields(root, reflect.TypeOf(types.StackManifest{}), "",
+		func(n *yaml.Node) string { return c.origin[n] })...)
+	if len(c.issues) > 0 {
+		return c.issues
+	}
+	if err := root.Decode(d.stack); err != nil {
+		return yamlError(d.file, err).Issues
+	}
+	d.root, d.origin, d.files = root, c.origin, c.data
+	return nil
+}
+
+// compose returns root, from file, with what its spec extends and imports
+// merged underneath it. chain holds the files being composed, to catch
+// cycles.
+func (c *composer) compose(root *yaml.Node, file string, chain []string) *yaml.Node {
+	spec := mapValue(root, "spec")
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: root.Line, Column: root.Column}
+	c.origin[merged] = c.origin[root]
+	for _, ref := range items(mapValue(spec, "extends")) {
+		path, err := c.stackPath(ref.Value, file)
+		if err != nil {
+			c.refIssue(ref, "spec.extends: %v", err)
+			continue
+		}
+		if base := c.load(path, supportedKind, ref, chain); base != nil {
+			c.merge(merged, mapValue(base, "spec"))
+		}
+	}
+	for _, ref := range items(mapValue(spec, "components")) {
+		path := ref.Value
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(file), path)
+		}
+		if comp := c.load(path, componentKind, ref, chain); comp != nil {
+			c.merge(merged, mapValue(comp, "spec"))
+		}
+	}
+	own := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if spec != nil {
+		for i := 0; i+1 < len(spec.Content); i += 2 {
+			if k := spec.Content[i].Value; k != "extends" && k != "components" {
+				own.Content = append(own.Content, spec.Content[i], spec.Content[i+1])
+			}
+		}
+	}
+	c.merge(merged, own)
+
+	out := &yaml.Node{Kind: yaml.MappingNode, Tag: root.Tag, Line: root.Line, Column: root.Column,
+		HeadComment: root.HeadComment}
+	c.origin[out] = c.origin[root]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		k, v := root.Content[i], root.Content[i+1]
+		if k.Value == "spec" {
+			merged.Line, merged.Column = v.Line, v.Column
+			v = merged
+		} else {
+			v = c.clone(v)
+		}
+		out.Content = append(out.Content, c.clone(k), v)
+	}
+	if spec == nil {
+		k := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "spec"}
+		c.origin[k] = c.origin[root]
+		out.Content = append(out.Content, k, merged)
+	}
+	return out
+}
+
+// load reads the document of kind in path that ref names, composed with
+// what it in turn extends and imports.
+func (c *composer) load(path, kind string, ref *yaml.Node, chain []string) *yaml.Node {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		c.refIssue(ref, "%v", err)
+		return nil
+	}
+	for _, f := range chain {
+		if f == abs {
+			c.refIssue(ref, "%s: cycle: %s", refField(kind), strings.Join(append(chain, abs), " -> "))
+			return nil
+		}
+	}
+	data, err := os.ReadFile(abs)
+	if err != nil {
+		c.refIssue(ref, "%s: cannot read %s: %v", refField(kind), ref.Value, unwrapPathError(err))
+		return nil
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var n yaml.Node
+		if err := dec.Decode(&n); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			c.refIssue(ref, "%s: %s: %v", refField(kind), ref.Value, err)
+			return nil
+		}
+		if len(n.Content) == 0 || scalarField(n.Content[0], "kind") != kind {
+			continue
+		}
+		root := n.Content[0]
+		c.data[abs] = data
+		c.mark(root, abs)
+		c.rebase(mapValue(root, "spec"), filepath.Dir(abs))
+		return c.compose(root, abs, append(chain, abs))
+	}
+	c.refIssue(ref, "%s: %s has no kind: %s document", refField(kind), ref.Value, kind)
+	return nil
+}
+
+func refField(kind string) string {
+	if kind == componentKind {
+		return "spec.components"
+	}
+	return "spec.extends"
+}
+
+// stackPath returns the manifest a spec.extends entry of file names: a path
+// (relative to file) when it looks like one, otherwise a stack name, looked
+// up next to file's stack and then with FindStack.
+func (c *composer) stackPath(ref, file string) (string, error) {
+	path := ref
+	if !strings.ContainsRune(ref, '/') && !strings.HasSuffix(ref, ".yaml") && !strings.HasSuffix(ref, ".yml") {
+		sibling := filepath.Join(filepath.Dir(file), "..", ref, stackFile)
+		if _, err := os.Stat(sibling); err == nil || FindStack == nil {
+			return sibling, nil
+		}
+		return FindStack(ref)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(file), path)
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, stackFile)
+	}
+	return path, nil
+}
+
+// merge merges src into dst, both mappings. src is left untouched.
+func (c *composer) merge(dst, src *yaml.Node) {
+	if src == nil || src.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		k, v := src.Content[i], src.Content[i+1]
+		j := keyIndex(dst, k.Value)
+		switch {
+		case isDelete(v):
+			if j >= 0 {
+				dst.Content = append(dst.Content[:j], dst.Content[j+2:]...)
+			}
+		case j < 0:
+			dst.Content = append(dst.Content, c.clone(k), c.clone(v))
+		case v.Kind == yaml.ScalarNode && dst.Content[j+1].Kind == yaml.ScalarNode && v.Value == dst.Content[j+1].Value:
+			// Unchanged: keep where it was first set.
+		case dst.Content[j+1].Kind == yaml.MappingNode && v.Kind == yaml.MappingNode:
+			c.merge(dst.Content[j+1], v)
+		case dst.Content[j+1].Kind == yaml.SequenceNode && v.Kind == yaml.SequenceNode && itemKey(dst.Content[j+1], v) != "":
+			c.mergeItems(dst.Content[j+1], v, itemKey(dst.Content[j+1], v))
+		default:
+			dst.Content[j], dst.Content[j+1] = c.clone(k), c.clone(v)
+		}
+	}
+}
+
+// mergeItems merges the items of list src into list dst by their key field.
+func (c *composer) mergeItems(dst, src *yaml.Node, key string) {
+	for _, item := range src.Content {
+		id := scalarField(item, key)
+		j := -1
+		for i, have := range dst.Content {
+			if scalarField(have, key) == id {
+				j = i
+				break
+			}
+		}
+		switch {
+		case scalarField(item, deleteMarker) == "true":
+			if j >= 0 {
+				dst.Content = append(dst.Content[:j], dst.Content[j+1:]...)
+			}
+		case j < 0:
+			dst.Content = append(dst.Content, c.clone(item))
+		default:
+			c.merge(dst.Content[j], item)
+		}
+	}
+}
+
+// itemKey returns the field, name or title, that identifies every item of
+// lists a and b, or "" when they are not lists of named mappings.
+func itemKey(a, b *yaml.Node) string {
+	all := append(append([]*yaml.Node{}, a.Content...), b.Content...)
+	for _, key := range []string{"name", "title"} {
+		ok := len(all) > 0
+		for _, item := range all {
+			ok = ok && scalarField(item, key) != ""
+		}
+		if ok {
+			return key
+		}
+	}
+	return ""
+}
+
+// clone copies n with the file it came from, leaving out delete markers.
+func (c *composer) clone(n *yaml.Node) *yaml.Node {
+	out := *n
+	out.Content = nil
+	c.origin[&out] = c.origin[n]
+	for i := 0; i < len(n.Content); i++ {
+		child := n.Content[i]
+		switch {
+		case n.Kind == yaml.MappingNode && i+1 < len(n.Content) && isDelete(n.Content[i+1]):
+			i++
+			continue
+		case n.Kind == yaml.SequenceNode && scalarField(child, deleteMarker) == "true":
+			continue
+		}
+		out.Content = append(out.Content, c.clone(child))
+	}
+	return &out
+}
+
+// mark records file as the origin of n and everything under it.
+func (c *composer) mark(n *yaml.Node, file string) {
+	if n == nil {
+		return
+	}
+	c.origin[n] = file
+	for _, child := range n.Content {
+		c.mark(child, file)
+	}
+}
+
+// rebase makes the relative paths under n, a spec from a manifest in dir,
+// absolute, so they still point at the right files once merged elsewhere.
+func (c *composer) rebase(n *yaml.Node, dir string) {
+	if n == nil {
+		return
+	}
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			v := n.Content[i+1]
+			if pathFields[n.Content[i].Value] && v.Kind == yaml.ScalarNode && v.Value != "" &&
+				!filepath.IsAbs(v.Value) && !isDelete(v) && !strings.Contains(v.Value, "${") {
+				v.Value = filepath.Join(dir, v.Value)
+			}
+		}
+	}
+	for _, child := range n.Content {
+		c.rebase(child, dir)
+	}
+}
+
+// unknownFields returns an issue for each field of n that t does not have,
+// as a strict decode would report it, at the position of its key. file
+// returns the file a key node was read from.
+func unknownFields(n *yaml.Node, t reflect.Type, path string, file func(*yaml.Node) string) []Issue {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var issues []Issue
+	switch {
+	case t == reflect.TypeOf(types.DHCPSpec{}), t == reflect.TypeOf(types.EgressSpec{}):
+	case t.Kind() == reflect.Struct && n.Kind == yaml.MappingNode:
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			if name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]; name != "" && name != "-" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k := n.Content[i]
+			p := joinPath(path, k.Value)
+			ft, ok := fields[k.Value]
+			if !ok {
+				issues = append(issues, Issue{File: file(k), Line: k.Line, Column: k.Column,
+					Severity: SeverityError, Message: fmt.Sprintf("%s: unknown field %q", p, k.Value)})
+				continue
+			}
+			issues = append(issues, unknownFields(n.Content[i+1], ft, p, file)...)
+		}
+	case t.Kind() == reflect.Map && n.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			issues = append(issues, unknownFields(n.Content[i+1], t.Elem(), joinPath(path, n.Content[i].Value), file)...)
+		}
+	case t.Kind() == reflect.Slice && n.Kind == yaml.SequenceNode:
+		for i, item := range n.Content {
+			issues = append(issues, unknownFields(item, t.Elem(), path+"["+strconv.Itoa(i)+"]", file)...)
+		}
+	}
+	return issues
+}
+
+// refIssue reports a problem with the spec.extends or spec.components entry
+// ref.
+func (c *composer) refIssue(ref *yaml.Node, format string, args ...interface{}) {
+	c.issues = append(c.issues, Issue{File: c.origin[ref], Line: ref.Line, Column: ref.Column,
+		Severity: SeverityError, Message: fmt.Sprintf(format, args...)})
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func isDelete(n *yaml.Node) bool {
+	return n.Kind == yaml.ScalarNode && n.Value == deleteMarker
+}
+
+// mapValue returns the value of key in mapping n, or nil.
+func mapValue(n *yaml.Node, key string) *yaml.Node {
+	if j := keyIndex(n, key); j >= 0 {
+		return n.Content[j+1]
+	}
+	return nil
+}
+
+// keyIndex returns the index of key in mapping n, or -1.
+func keyIndex(n *yaml.Node, key string) int {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return -1
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// items returns the items of sequence n.
+func items(n *yaml.Node) []*yaml.Node {
+	if n == nil || n.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return n.Content
+}
+
+// Flatten returns the valid manifest at path as a single Stack document,
+// with what it extends and imports and its Network and VM documents merged
+// in. A field that comes from another file than the mapping holding it is
+// followed by a comment naming that file and line.
+func Flatten(path string) ([]byte, error) {
+	if _, _, err := Check(path); err != nil {
+		return nil, err
+	}
+	docs, err := readDocuments(path)
+	if err != nil {
+		return nil, err
+	}
+	_, a, _ := assemble(docs, path)
+	files := map[*yaml.Node]string{}
+	root := a.stack.root
+	a.stack.markFiles(root, files)
+	spec := mapValue(root, "spec")
+	for _, key := range sortedNames(a.origins) {
+		d := a.origins[key]
+		field, name, _ := strings.Cut(strings.TrimPrefix(key, "spec."), ".")
+		target := mapValue(spec, field)
+		if target == nil {
+			target = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			k := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: field}
+			files[k], files[target] = a.source, a.source
+			spec.Content = append(spec.Content, k, target)
+		}
+		k := *mapValue(mapValue(d.root, "metadata"), "name")
+		k.Value = name
+		v := mapValue(d.root, "spec")
+		if v == nil {
+			v = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		d.markFiles(v, files)
+		files[&k] = d.file
+		target.Content = append(target.Content, &k, v)
+	}
+	annotate(root, a.source, files, filepath.Dir(a.source))
+
+	out := &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root},
+		HeadComment: "# Flattened from " + path + " by nlab render --flatten."}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(out); err != nil {
+		return nil, fmt.Errorf("encode manifest: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// markFiles records the file of n, a node of d, and of everything under it.
+func (d *document) markFiles(n *yaml.Node, files map[*yaml.Node]string) {
+	files[n] = d.fileOf(n)
+	for _, child := range n.Content {
+		d.markFiles(child, files)
+	}
+}
+
+// annotate adds a provenance comment to every key or list item under n whose
+// file is not parent, the file of the node holding it. Block style is used
+// throughout, so that every comment has a line of its own.
+func annotate(n *yaml.Node, parent string, files map[*yaml.Node]string, base string) {
+	n.Style &^= yaml.FlowStyle
+	from := func(k *yaml.Node, file string) {
+		shown := file
+		if rel, err := filepath.Rel(base, file); err == nil {
+			shown = rel
+		}
+		k.LineComment = fmt.Sprintf("# from %s:%d", shown, k.Line)
+	}
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			file := orDefault(files[k], parent)
+			if file != parent {
+				from(k, file)
+			}
+			annotate(v, file, files, base)
+		}
+	case yaml.SequenceNode:
+		for _, item := range n.Content {
+			file := orDefault(files[item], parent)
+			if file != parent && item.Kind == yaml.MappingNode && len(item.Content) > 0 {
+				from(item.Content[0], file)
+			}
+			annotate(item, file, files, base)
+		}
+	}
+}
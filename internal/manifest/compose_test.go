@@ -0,0 +1,165 @@
+package manifest_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+)
+
+const baseStack = `apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata: {name: base}
+spec:
+  defaults: {memory: 1024, vcpus: 1}
+  networks:
+    lan: {cidr: 10.50.0.0/24}
+  vms:
+    target: {memory: 2048}
+    extra: {}
+  tmux:
+    windows:
+      - name: lab
+        panes:
+          - {title: target, vm: target}
+          - {title: extra, vm: extra}
+`
+
+const attackerComponent = `apiVersion: nlab.io/v1alpha1
+kind: Component
+metadata: {name: attacker}
+spec:
+  vms:
+    attacker:
+      memory: 4096
+      cloudInit: {dir: attacker}
+  tmux:
+    windows:
+      - name: lab
+        panes:
+          - {title: attacker, vm: attacker}
+`
+
+const webStack = `apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata: {name: web}
+spec:
+  extends: [base]
+  components: [../../components/attacker.yaml]
+  networks:
+    lan: {cidr: 10.51.0.0/24}
+  vms:
+    extra: $delete
+    target: {vcpus: 2}
+  tmux:
+    windows:
+      - name: lab
+        panes:
+          - {title: extra, $delete: true}
+`
+
+func composeTree(t *testing.T, web string) string {
+	t.Helper()
+	dir := writeTree(t, map[string]string{
+		"stacks/base/stack.yaml":        baseStack,
+		"stacks/web/stack.yaml":         web,
+		"components/attacker.yaml":      attackerComponent,
+		"components/attacker/user-data": "#cloud-config\n",
+		"components/attacker/meta-data": "instance-id: attacker\n",
+		"stacks/loop/stack.yaml":        strings.Replace(baseStack, "spec:\n", "spec:\n  extends: [loop]\n", 1),
+	})
+	return filepath.Join(dir, "stacks", "web", "stack.yaml")
+}
+
+func TestComposeMerge(t *testing.T) {
+	path := composeTree(t, webStack)
+	m, err := manifest.Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if m.Metadata.Name != "web" || len(m.Spec.Extends) != 0 || len(m.Spec.Components) != 0 {
+		t.Errorf("metadata and the composition fields should be the extending stack's own: %+v", m)
+	}
+	if got := m.Spec.Networks["lan"].CIDR; got != "10.51.0.0/24" {
+		t.Errorf("lan cidr = %q, want the override", got)
+	}
+	if _, ok := m.Spec.VMs["extra"]; ok {
+		t.Error("$delete should remove spec.vms.extra")
+	}
+	if vm := m.Spec.VMs["target"]; vm.Memory != 2048 || vm.VCPUs != 2 {
+		t.Errorf("target = %+v, want memory from base and vcpus from web", vm)
+	}
+	if m.Spec.Defaults == nil || m.Spec.Defaults.Memory != 1024 {
+		t.Errorf("defaults not inherited: %+v", m.Spec.Defaults)
+	}
+	attacker := m.Spec.VMs["attacker"]
+	if want := filepath.Join(filepath.Dir(path), "..", "..", "components", "attacker"); attacker.CloudInit == nil ||
+		attacker.CloudInit.Dir != filepath.Clean(want) {
+		t.Errorf("component cloudInit.dir should be relative to the component: %+v", attacker.CloudInit)
+	}
+	w := m.Spec.Tmux.Windows
+	if len(w) != 1 || len(w[0].Panes) != 2 || w[0].Panes[0].Title != "target" || w[0].Panes[1].Title != "attacker" {
+		t.Errorf("windows should merge by name and panes by title: %+v", w)
+	}
+}
+
+func TestComposeIssues(t *testing.T) {
+	for _, tc := range []struct{ name, web, want string }{
+		{"missing base", strings.Replace(webStack, "[base]", "[nowhere]", 1), "spec.extends: cannot read nowhere"},
+		{"cycle", strings.Replace(webStack, "[base]", "[loop]", 1), "cycle"},
+		{"unknown field", strings.Replace(webStack, "{vcpus: 2}", "{vcpus: 2, colour: red}", 1),
+			`spec.vms.target.colour: unknown field "colour"`},
+		{"wrong kind", strings.Replace(webStack, "components/attacker.yaml", "stacks/base/stack.yaml", 1),
+			"has no kind: Component document"},
+	} {
+		_, err := manifest.Load(composeTree(t, tc.web))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: want %q, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestComposeIssueInBase(t *testing.T) {
+	path := composeTree(t, webStack)
+	base := filepath.Join(filepath.Dir(path), "..", "base", "stack.yaml")
+	if err := os.WriteFile(base, []byte(strings.Replace(baseStack, "{memory: 2048}", "{memory: 2048, sshUser: Root}", 1)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := manifest.Load(path)
+	var verr *manifest.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+	is := verr.Issues[0]
+	if filepath.Clean(is.File) != filepath.Clean(base) || is.Line != 9 {
+		t.Errorf("issue at %s:%d, want the base's line 9: %s", is.File, is.Line, is.Message)
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	path := composeTree(t, webStack)
+	out, err := manifest.Flatten(path)
+	if err != nil {
+		t.Fatalf("Flatten: %v", err)
+	}
+	got := string(out)
+	for _, want := range []string{
+		"defaults: # from ../base/stack.yaml:5",
+		"cidr: 10.51.0.0/24 # from stack.yaml:8",
+		"attacker: # from ../../components/attacker.yaml:6",
+		"- title: attacker # from ../../components/attacker.yaml:13",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("flattened manifest lacks %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "extends") || strings.Contains(got, "$delete") || strings.Contains(got, "extra") {
+		t.Errorf("composition should be resolved:\n%s", got)
+	}
+	if _, err := manifest.LoadBytes(out, path); err != nil {
+		t.Errorf("the flattened manifest should load: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package manifest
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+var sshUserRe = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+// Effective returns a copy of m with spec.defaults applied to every VM and
+// removed: a VM's own settings win, then spec.defaults. Domain settings are
+// only inherited by typed VMs and VMs that have no xml or xmlFile.
+func Effective(m *types.StackManifest) *types.StackManifest {
+	out := *m
+	out.Spec.Defaults = nil
+	if m.Spec.Defaults == nil {
+		return &out
+	}
+	out.Spec.VMs = make(map[string]types.VMSpec, len(m.Spec.VMs))
+	for name, vm := range m.Spec.VMs {
+		out.Spec.VMs[name] = applyDefaults(*m.Spec.Defaults, vm)
+	}
+	return &out
+}
+
+func applyDefaults(d types.DefaultsSpec, vm types.VMSpec) types.VMSpec {
+	if strings.TrimSpace(vm.XML) == "" && vm.XMLFile == "" {
+		if vm.Memory == 0 {
+			vm.Memory = d.Memory
+		}
+		if vm.VCPUs == 0 {
+			vm.VCPUs = d.VCPUs
+		}
+		if d.Disk != nil && (vm.Disk == nil || vm.Disk.Size == 0) {
+			disk := *d.Disk
+			vm.Disk = &disk
+		}
+		if vm.Image == "" {
+			vm.Image = d.Image
+		}
+		if len(vm.Networks) == 0 && len(d.Networks) > 0 {
+			vm.Networks = append([]string(nil), d.Networks...)
+		}
+	}
+	if vm.SSHUser == "" {
+		vm.SSHUser = d.SSHUser
+	}
+	if d.CloudInit != nil {
+		var ci types.CloudInitSpec
+		if vm.CloudInit != nil {
+			ci = *vm.CloudInit
+		}
+		dc := d.CloudInit
+		if ci.Dir == "" {
+			ci.Dir = dc.Dir
+		}
+		if ci.UserData == "" && ci.UserDataFile == "" {
+			ci.UserData, ci.UserDataFile = dc.UserData, dc.UserDataFile
+		}
+		if ci.MetaDataFile == "" {
+			ci.MetaDataFile = dc.MetaDataFile
+		}
+		if ci.NetworkConfigFile == "" {
+			ci.NetworkConfigFile = dc.NetworkConfigFile
+		}
+		vm.CloudInit = &ci
+	}
+	return vm
+}
+
+// validateDefaults checks spec.defaults and spec.storage on their own; the
+// VMs they apply to are checked after Effective.
+func validateDefaults(m *types.StackManifest) []string {
+	var errs []string
+	if d := m.Spec.Defaults; d != nil {
+		if d.Memory < 0 {
+			errs = append(errs, "spec.defaults.memory: must be a positive number of MiB")
+		}
+		if d.VCPUs < 0 {
+			errs = append(errs, "spec.defaults.vcpus: must be a positive number")
+		}
+		if d.Disk != nil && d.Disk.Size < 0 {
+			errs = append(errs, "spec.defaults.disk.size: must be a positive number of GiB")
+		}
+		seen := map[string]bool{}
+		for _, n := range d.Networks {
+			if _, ok := m.Spec.Networks[n]; !ok {
+				errs = append(errs, fmt.Sprintf("spec.defaults.networks: %q is not defined in spec.networks", n))
+			} else if seen[n] {
+				errs = append(errs, fmt.Sprintf("spec.defaults.networks: %q is listed twice", n))
+			}
+			seen[n] = true
+		}
+		if d.SSHUser != "" && !sshUserRe.MatchString(d.SSHUser) {
+			errs = append(errs, fmt.Sprintf("spec.defaults.sshUser: %q is not a valid user name", d.SSHUser))
+		}
+	}
+	for _, name := range sortedNames(m.Spec.VMs) {
+		if u := m.Spec.VMs[name].SSHUser; u != "" && !sshUserRe.MatchString(u) {
+			errs = append(errs, fmt.Sprintf("spec.vms.%s.sshUser: %q is not a valid user name", name, u))
+		}
+	}
+	if s := m.Spec.Storage; s != nil {
+		if s.DiskDir != "" && !filepath.IsAbs(s.DiskDir) {
+			errs = append(errs, fmt.Sprintf("spec.storage.diskDir: %q must be an absolute path", s.DiskDir))
+		}
+		if s.ImageDir != "" && !filepath.IsAbs(s.ImageDir) {
+			errs = append(errs, fmt.Sprintf("spec.storage.imageDir: %q must be an absolute path", s.ImageDir))
+		}
+	}
+	return errs
+}
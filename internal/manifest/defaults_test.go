@@ -0,0 +1,122 @@
+package manifest_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+)
+
+const defaultsManifest = `
+apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: defs
+spec:
+  storage:
+    diskDir: /srv/disks
+  defaults:
+    memory: 2048
+    vcpus: 2
+    disk: {size: 30}
+    image: jammy.img
+    networks: [lan]
+    sshUser: kali
+    cloudInit:
+      userData: |
+        #cloud-config
+        hostname: common
+  networks:
+    lan:
+      cidr: 10.30.0.0/24
+    wan:
+      cidr: 10.31.0.0/24
+  vms:
+    attacker:
+      memory: 4096
+      networks: [wan, lan]
+      sshUser: root
+    target: {}
+    legacy:
+      xml: <domain type="kvm"><name>defs-legacy</name><memory unit="MiB">1024</memory></domain>
+`
+
+func TestEffectiveAppliesDefaults(t *testing.T) {
+	m, err := manifest.LoadBytes([]byte(defaultsManifest), "test")
+	if err != nil {
+		t.Fatalf("LoadBytes: %v", err)
+	}
+	if m.Spec.Defaults == nil || m.Spec.VMs["target"].Memory != 0 {
+		t.Fatal("LoadBytes should return the manifest as written")
+	}
+	eff := manifest.Effective(m)
+	if eff.Spec.Defaults != nil {
+		t.Error("Effective should drop spec.defaults")
+	}
+
+	a := eff.Spec.VMs["attacker"]
+	if a.Memory != 4096 || a.VCPUs != 2 || a.SSHUser != "root" || strings.Join(a.Networks, ",") != "wan,lan" {
+		t.Errorf("attacker = %+v, want own memory/networks/sshUser and default vcpus", a)
+	}
+	tg := eff.Spec.VMs["target"]
+	if tg.Memory != 2048 || tg.VCPUs != 2 || tg.Disk == nil || tg.Disk.Size != 30 ||
+		tg.Image != "jammy.img" || tg.SSHUser != "kali" || strings.Join(tg.Networks, ",") != "lan" {
+		t.Errorf("target = %+v, want every default", tg)
+	}
+	if tg.CloudInit == nil || !strings.Contains(tg.CloudInit.UserData, "hostname: common") {
+		t.Errorf("target cloudInit = %+v, want the default userData", tg.CloudInit)
+	}
+	l := eff.Spec.VMs["legacy"]
+	if l.Typed() || l.SSHUser != "kali" || l.CloudInit == nil {
+		t.Errorf("legacy = %+v, want only sshUser and cloudInit inherited", l)
+	}
+
+	x, err := manifest.DomainXML(eff, "target", manifest.RenderOptions{Stack: "defs", ImageDir: "/cache", DiskDir: eff.Spec.Storage.DiskDir})
+	if err != nil {
+		t.Fatalf("DomainXML: %v", err)
+	}
+	for _, want := range []string{`<memory unit="MiB">2048</memory>`, "/srv/disks/defs-target.qcow2", "/cache/jammy.img"} {
+		if !strings.Contains(x, want) {
+			t.Errorf("target XML missing %q:\n%s", want, x)
+		}
+	}
+}
+
+func TestEffectiveCloudInitLayering(t *testing.T) {
+	doc := strings.Replace(defaultsManifest, "      sshUser: root\n",
+		"      sshUser: root\n      cloudInit: {userData: \"#cloud-config\\nhostname: own\\n\", metaDataFile: /dev/null}\n", 1)
+	m, err := manifest.LoadBytes([]byte(doc), "test")
+	if err != nil {
+		t.Fatalf("LoadBytes: %v", err)
+	}
+	ci := manifest.Effective(m).Spec.VMs["attacker"].CloudInit
+	if ci == nil || !strings.Contains(ci.UserData, "hostname: own") || ci.MetaDataFile != "/dev/null" {
+		t.Errorf("attacker cloudInit = %+v, want its own userData kept", ci)
+	}
+}
+
+func TestValidateDefaultsErrors(t *testing.T) {
+	tests := []struct {
+		name, from, to, want string
+	}{
+		{"unknown defaults key", "    vcpus: 2\n    disk", "    vcpus: 2\n    cpu: 4\n    disk", `spec.defaults.cpu: unknown field "cpu"`},
+		{"unknown storage key", "    diskDir: /srv/disks\n", "    diskDir: /srv/disks\n    pool: default\n", `spec.storage.pool: unknown field "pool"`},
+		{"relative diskDir", "diskDir: /srv/disks", "diskDir: disks", "spec.storage.diskDir"},
+		{"undefined network", "networks: [lan]\n    sshUser", "networks: [dmz]\n    sshUser", "spec.defaults.networks"},
+		{"bad sshUser", "sshUser: kali", "sshUser: Kali Linux", "spec.defaults.sshUser"},
+		{"negative memory", "    memory: 2048\n    vcpus: 2", "    memory: -1\n    vcpus: 2", "spec.defaults.memory"},
+		{"missing vcpus", "    memory: 2048\n    vcpus: 2\n", "    memory: 2048\n", "spec.vms.target.vcpus"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := strings.Replace(defaultsManifest, tt.from, tt.to, 1)
+			if doc == defaultsManifest {
+				t.Fatalf("replacement %q did not apply", tt.from)
+			}
+			_, err := manifest.LoadBytes([]byte(doc), "test")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package manifest
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlLineRe finds the line yaml.v3 puts in its error messages.
+var yamlLineRe = regexp.MustCompile(`line (\d+):`)
+
+// issuePathRe matches the manifest path an issue message starts with, e.g.
+// spec.vms.target or spec.tmux.windows[0].panes[1].command.
+var issuePathRe = regexp.MustCompile(`^((?:apiVersion|kind|metadata|spec)[\w.\-\[\]]*):`)
+
+// Diagnostic formats is as "file:line:col: severity: message", the form
+// compilers and editors use. When the issue has a line and the file can be
+// read, the line follows with a caret under the column.
+func Diagnostic(is Issue) string {
+	sev := is.Severity
+	if sev == "" {
+		sev = SeverityError
+	}
+	loc := is.File
+	if is.Line > 0 {
+		loc += fmt.Sprintf(":%d", is.Line)
+		if is.Column > 0 {
+			loc += fmt.Sprintf(":%d", is.Column)
+		}
+	}
+	out := fmt.Sprintf("%s: %s: %s", loc, sev, is.Message)
+	if snippet := snippet(is); snippet != "" {
+		out += "\n" + snippet
+	}
+	return out
+}
+
+// snippet returns the line of the issue's file it points at, numbered, with
+// a caret under its column.
+func snippet(is Issue) string {
+	if is.Line <= 0 {
+		return ""
+	}
+	data, err := os.ReadFile(is.File)
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(string(data), "\n")
+	if is.Line > len(lines) {
+		return ""
+	}
+	text := strings.ReplaceAll(lines[is.Line-1], "\t", " ")
+	gutter := fmt.Sprintf("%5d | ", is.Line)
+	out := gutter + text
+	if is.Column > 0 {
+		out += "\n" + strings.Repeat(" ", len(gutter)-2) + "| " + strings.Repeat(" ", is.Column-1) + "^"
+	}
+	return out
+}
+
+// Locate sets the line and column of issues found by other checks in the
+// manifest at path, such as CheckHost.
+func Locate(issues []Issue, path string) {
+	docs, err := readDocuments(path)
+	if err != nil {
+		return
+	}
+	if _, a, _ := assemble(docs, path); a.stack != nil {
+		a.locate(issues)
+	}
+}
+
+// indexNodes records the key and value node of every path under n.
+// Sequence items are their own key.
+func indexNodes(path string, n *yaml.Node, keys, values map[string]*yaml.Node) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			p := n.Content[i].Value
+			if path != "" {
+				p = path + "." + p
+			}
+			keys[p], values[p] = n.Content[i], n.Content[i+1]
+			indexNodes(p, n.Content[i+1], keys, values)
+		}
+	case yaml.SequenceNode:
+		for i, item := range n.Content {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			keys[p], values[p] = item, item
+			indexNodes(p, item, keys, values)
+		}
+	}
+}
+
+// issuePath returns the manifest path an issue message is about.
+func issuePath(msg string) string {
+	if m := issuePathRe.FindStringSubmatch(msg); m != nil {
+		return m[1]
+	}
+	for _, prefix := range []string{"missing required field: ", "unsupported "} {
+		if rest, ok := strings.CutPrefix(msg, prefix); ok {
+			return strings.Fields(rest)[0]
+		}
+	}
+	return ""
+}
+
+// parentPath drops the last element of a manifest path.
+func parentPath(path string) string {
+	if i := strings.LastIndexAny(path, ".["); i > 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// xmlPosition maps line xmlLine of the XML in scalar x to a line and column
+// of the manifest. Block scalars start on the line after their key.
+func xmlPosition(x *yaml.Node, xmlLine int, lines []string) (int, int) {
+	if x.Style == yaml.LiteralStyle || x.Style == yaml.FoldedStyle {
+		line := x.Line + xmlLine
+		if line > len(lines) {
+			return x.Line, x.Column
+		}
+		text := lines[line-1]
+		return line, len(text) - len(strings.TrimLeft(text, " \t")) + 1
+	}
+	if xmlLine == 1 {
+		return x.Line, x.Column
+	}
+	return x.Line + xmlLine - 1, 1
+}
@@ -0,0 +1,118 @@
+package manifest_test
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+)
+
+const positionsManifest = `apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: pos
+spec:
+  networks:
+    lan:
+      cidr: 10.60.0.0/24
+  defaults:
+    sshUser: "Bad User"
+  vms:
+    box:
+      xml: |
+        <domain type="kvm">
+          <name>pos-box</name>
+          <memory unit="MiB">1024</memory
+        </domain>
+    flat:
+      xml: "<domain><memory>1024</memory><name>pos-flat</name></domain"
+    file:
+      xmlFile: file.xml
+`
+
+// issuesOf returns the issues of a ValidationError.
+func issuesOf(t *testing.T, err error) []manifest.Issue {
+	t.Helper()
+	var verr *manifest.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+	return verr.Issues
+}
+
+func TestIssuePositions(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"stack.yaml": positionsManifest,
+		"file.xml":   "<domain>\n  <name>pos-file</name>\n  <memory>1024</memory>\n</domain\n",
+	})
+	source := filepath.Join(dir, "stack.yaml")
+	_, err := manifest.Load(source)
+	got := map[string]manifest.Issue{}
+	for _, is := range issuesOf(t, err) {
+		got[strings.SplitN(is.Message, ":", 2)[0]] = is
+	}
+	for _, tc := range []struct {
+		path, file   string
+		line, column int
+	}{
+		{"spec.defaults.sshUser", source, 10, 14}, // the value
+		{"spec.vms.box", source, 17, 9},           // line 4 of the block scalar
+		{"spec.vms.flat", source, 19, 12},         // a quoted scalar holding the XML
+		{"spec.vms.file", filepath.Join(dir, "file.xml"), 5, 0},
+	} {
+		is, ok := got[tc.path]
+		if !ok {
+			t.Errorf("no issue for %s in %v", tc.path, got)
+			continue
+		}
+		if is.File != tc.file || is.Line != tc.line || is.Column != tc.column {
+			t.Errorf("%s at %s:%d:%d, want %s:%d:%d", tc.path, is.File, is.Line, is.Column, tc.file, tc.line, tc.column)
+		}
+	}
+}
+
+func TestYAMLErrorLine(t *testing.T) {
+	_, err := manifest.LoadBytes([]byte("apiVersion: nlab.io/v1alpha1\nkind: Stack\nspec:\n  vms:\n    box:\n      memroy: 1\n"), "test")
+	issues := issuesOf(t, err)
+	if len(issues) != 1 || issues[0].Line != 6 {
+		t.Errorf("issues = %+v, want one on line 6", issues)
+	}
+}
+
+func TestDiagnostic(t *testing.T) {
+	dir := writeTree(t, map[string]string{"stack.yaml": positionsManifest, "file.xml": "<domain/>"})
+	source := filepath.Join(dir, "stack.yaml")
+	got := manifest.Diagnostic(manifest.Issue{File: source, Line: 10, Column: 14,
+		Severity: manifest.SeverityWarning, Message: "spec.defaults.sshUser: bad"})
+	want := source + `:10:14: warning: spec.defaults.sshUser: bad
+   10 |     sshUser: "Bad User"
+      |              ^`
+	if got != want {
+		t.Errorf("Diagnostic =\n%s\nwant\n%s", got, want)
+	}
+	if got := manifest.Diagnostic(manifest.Issue{File: "test", Message: "missing"}); got != "test: error: missing" {
+		t.Errorf("Diagnostic without a position = %q", got)
+	}
+}
+
+func TestLocate(t *testing.T) {
+	dir := writeTree(t, map[string]string{"stack.yaml": positionsManifest})
+	source := filepath.Join(dir, "stack.yaml")
+	issues := []manifest.Issue{
+		{File: source, Message: "spec.networks.lan: 10.60.0.0/24 overlaps a host route"},
+		{File: source, Message: "missing required field: metadata.name"},
+		{File: "elsewhere", Message: "spec.networks.lan: not this file"},
+	}
+	manifest.Locate(issues, source)
+	if issues[0].Line != 7 || issues[0].Column != 5 {
+		t.Errorf("lan at %d:%d, want 7:5", issues[0].Line, issues[0].Column)
+	}
+	if issues[1].Line != 4 {
+		t.Errorf("metadata.name at line %d, want 4", issues[1].Line)
+	}
+	if issues[2].Line != 0 {
+		t.Errorf("issues of other files must not be located: %+v", issues[2])
+	}
+}
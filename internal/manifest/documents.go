@@ -0,0 +1,343 @@
+package manifest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+// StackLabel is the metadata label that attaches a standalone Network or VM
+// manifest to a stack.
+const StackLabel = "nlab.io/stack"
+
+const (
+	networkKind = "Network"
+	vmKind      = "VM"
+
+	// stackFile is the manifest of a stack directory. Loading it also loads
+	// the Network and VM manifests next to it.
+	stackFile = "stack.yaml"
+)
+
+// nlabDocRe tells nlab manifests apart from the other YAML files a stack
+// directory holds, such as layout.yaml or a values file.
+var nlabDocRe = regexp.MustCompile(`(?m)^apiVersion:\s*["']?nlab\.io/`)
+
+// document is one YAML document of a manifest stream.
+type document struct {
+	file string
+	data []byte // all of file, for positions inside block scalars
+	root *yaml.Node
+	kind string
+
+	stack   *types.StackManifest
+	network *types.NetworkManifest
+	vm      *types.VMManifest
+
+	keys, values map[string]*yaml.Node // indexNodes of root, built on demand
+
+	// A composed Stack document has nodes from several files.
+	origin map[*yaml.Node]string
+	files  map[string][]byte
+}
+
+// parseDocuments decodes every document of the YAML stream in data. A
+// document without a kind is taken to be a Stack, so that validate reports
+// what it is missing; one of an unknown kind is not decoded.
+func parseDocuments(data []byte, file string) ([]*document, error) {
+	nodes := yaml.NewDecoder(bytes.NewReader(data))
+	typed := yaml.NewDecoder(bytes.NewReader(data))
+	typed.KnownFields(true)
+	var docs []*document
+	for {
+		var n yaml.Node
+		if err := nodes.Decode(&n); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, yamlError(file, err)
+		}
+		d := &document{file: file, data: data}
+		if len(n.Content) > 0 {
+			d.root = n.Content[0]
+			d.kind = scalarField(d.root, "kind")
+		}
+		var target interface{} = &yaml.Node{} // unknown kinds are reported by assemble
+		switch d.kind {
+		case networkKind:
+			d.network = &types.NetworkManifest{}
+			target = d.network
+		case vmKind:
+			d.vm = &types.VMManifest{}
+			target = d.vm
+		case "", supportedKind:
+			d.stack = &types.StackManifest{}
+			if !composes(d.root) {
+				target = d.stack
+			}
+		}
+		// Unknown fields are reported by manifest path, each at its key; the
+		// decoder would give only a line and Go type names.
+		if _, ok := target.(*yaml.Node); !ok && d.root != nil {
+			inFile := func(*yaml.Node) string { return file }
+			if issues := unknownFields(d.root, reflect.TypeOf(target), "", inFile); len(issues) > 0 {
+				return nil, &ValidationError{Source: file, Issues: issues}
+			}
+		}
+		if err := typed.Decode(target); err != nil && !errors.Is(err, io.EOF) {
+			return nil, yamlError(file, err)
+		}
+		if d.stack != nil && composes(d.root) {
+			if issues := d.compose(); len(issues) > 0 {
+				return nil, &ValidationError{Source: file, Issues: issues}
+			}
+		}
+		if d.root != nil {
+			docs = append(docs, d)
+		}
+	}
+	return docs, nil
+}
+
+// readDocuments reads the manifest documents at path. A directory holds a
+// stack split over its *.yaml and *.yml files. A file named stack.yaml also
+// takes in the Network and VM manifests next to it; any other file stands on
+// its own. YAML files that are not nlab manifests are skipped.
+func readDocuments(path string) ([]*document, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read manifest %q: %w", path, err)
+	}
+	files, own := []string{path}, path
+	if info.IsDir() {
+		files, own = manifestFiles(path, ""), ""
+	} else if filepath.Base(path) == stackFile {
+		files = append(files, manifestFiles(filepath.Dir(path), path)...)
+	}
+	var docs []*document
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read manifest %q: %w", f, err)
+		}
+		fileDocs, err := parseDocuments(data, f)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range fileDocs {
+			switch {
+			case f == own:
+			case !strings.HasPrefix(scalarField(d.root, "apiVersion"), "nlab.io/"):
+				continue
+			case own != "" && d.stack != nil:
+				continue // a sibling of stack.yaml only adds networks and VMs
+			}
+			docs = append(docs, d)
+		}
+	}
+	return docs, nil
+}
+
+// manifestFiles returns the nlab manifests in dir, sorted, except skip.
+func manifestFiles(dir, skip string) []string {
+	var files []string
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		for _, f := range matches {
+			if f == skip {
+				continue
+			}
+			if data, err := os.ReadFile(f); err == nil && nlabDocRe.Match(data) {
+				files = append(files, f)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// assembly is a stack manifest put together from documents, with the
+// document each standalone network and VM came from.
+type assembly struct {
+	path    string // what was loaded: a file, a directory or a source name
+	source  string // the file of the Stack document
+	stack   *document
+	origins map[string]*document // keyed spec.networks.<name>, spec.vms.<name>
+}
+
+// assemble merges the Network and VM documents into the one Stack document.
+// Issues with the documents themselves (a second Stack, a wrong label, a
+// name defined twice) are returned located; the documents at fault are left
+// out.
+func assemble(docs []*document, path string) (*types.StackManifest, *assembly, []Issue) {
+	a := &assembly{path: path, source: path, origins: map[string]*document{}}
+	var issues []Issue
+	add := func(d *document, at, format string, args ...interface{}) {
+		is := Issue{File: d.file, Severity: SeverityError, Message: fmt.Sprintf(format, args...)}
+		d.locate(&is, at)
+		issues = append(issues, is)
+	}
+	var parts []*document
+	for _, d := range docs {
+		switch {
+		case d.network != nil || d.vm != nil:
+			parts = append(parts, d)
+		case d.stack == nil:
+			add(d, "kind", "unsupported kind %q: expected Stack, Network or VM", d.kind)
+		case a.stack == nil:
+			a.stack, a.source = d, d.file
+		default:
+			add(d, "kind", "a second Stack document; %s already has one", a.stack.file)
+		}
+	}
+	if a.stack == nil {
+		return nil, a, append(issues, Issue{File: path, Severity: SeverityError,
+			Message: fmt.Sprintf("no kind: Stack document; Network and VM manifests join a stack through metadata.labels[%q]", StackLabel)})
+	}
+	m := *a.stack.stack
+	if m.Spec.Networks == nil && len(parts) > 0 {
+		m.Spec.Networks = map[string]types.NetworkSpec{}
+	}
+	if m.Spec.VMs == nil && len(parts) > 0 {
+		m.Spec.VMs = map[string]types.VMSpec{}
+	}
+	for _, d := range parts {
+		api, meta, key := d.object()
+		name := strings.TrimSpace(meta.Name)
+		switch {
+		case api != supportedAPIVersion:
+			add(d, "apiVersion", "unsupported apiVersion %q: only %q is supported", api, supportedAPIVersion)
+			continue
+		case name == "":
+			add(d, "metadata", "missing required field: metadata.name")
+			continue
+		case meta.Labels[StackLabel] != m.Metadata.Name:
+			add(d, "metadata.labels", "metadata.labels: %s %q has %s=%q, not the stack %q",
+				d.kind, name, StackLabel, meta.Labels[StackLabel], m.Metadata.Name)
+			continue
+		}
+		key += "." + name
+		if prev, ok := a.origins[key]; ok {
+			add(d, "metadata.name", "%s: defined twice, here and in %s", key, prev.file)
+			continue
+		}
+		if d.network != nil {
+			if _, ok := m.Spec.Networks[name]; ok {
+				add(d, "metadata.name", "%s: defined twice, here and in %s", key, a.source)
+				continue
+			}
+			m.Spec.Networks[name] = d.network.Spec
+		} else {
+			if _, ok := m.Spec.VMs[name]; ok {
+				add(d, "metadata.name", "%s: defined twice, here and in %s", key, a.source)
+				continue
+			}
+			m.Spec.VMs[name] = d.vm.Spec
+		}
+		a.origins[key] = d
+	}
+	return &m, a, issues
+}
+
+// object returns the apiVersion and metadata of a Network or VM document and
+// the spec map it joins.
+func (d *document) object() (string, types.ObjectMeta, string) {
+	if d.network != nil {
+		return d.network.APIVersion, d.network.Metadata, "spec.networks"
+	}
+	return d.vm.APIVersion, d.vm.Metadata, "spec.vms"
+}
+
+// locate sets the line and column of the issues found in the assembled
+// manifest, from the manifest path their message starts with. An issue
+// under a standalone network or VM is moved to the file of its document.
+func (a *assembly) locate(issues []Issue) {
+	for i := range issues {
+		is := &issues[i]
+		if (is.File != a.source && is.File != a.path) || is.Line > 0 {
+			continue
+		}
+		is.File = a.source
+		if a.stack == nil {
+			continue
+		}
+		d, path := a.origin(issuePath(is.Message))
+		is.File = d.file
+		d.locate(is, path)
+	}
+}
+
+// origin returns the document that manifest path came from and the path
+// within it: spec.vms.web.memory of a kind: VM document is its spec.memory.
+func (a *assembly) origin(path string) (*document, string) {
+	for key, d := range a.origins {
+		switch {
+		case path == key:
+			return d, "metadata.name"
+		case strings.HasPrefix(path, key+"."):
+			return d, "spec" + strings.TrimPrefix(path, key)
+		}
+	}
+	return a.stack, path
+}
+
+// locate sets the line and column of is from the manifest path it is about,
+// or its closest parent in the document. XML syntax errors in inline xml
+// fields are mapped to the line of the file they are on.
+func (d *document) locate(is *Issue, path string) {
+	if d.keys == nil {
+		d.keys, d.values = map[string]*yaml.Node{}, map[string]*yaml.Node{}
+		indexNodes("", d.root, d.keys, d.values)
+	}
+	for path != "" && d.keys[path] == nil {
+		path = parentPath(path)
+	}
+	if path == "" {
+		return
+	}
+	if x := d.values[path+".xml"]; is.xmlLine > 0 && x != nil {
+		is.File = d.fileOf(x)
+		data := d.data
+		if f, ok := d.files[is.File]; ok {
+			data = f
+		}
+		is.Line, is.Column = xmlPosition(x, is.xmlLine, strings.Split(string(data), "\n"))
+		return
+	}
+	n := d.keys[path]
+	if v := d.values[path]; v.Kind == yaml.ScalarNode {
+		n = v
+	}
+	is.File, is.Line, is.Column = d.fileOf(n), n.Line, n.Column
+}
+
+// fileOf returns the file node n of the document was read from.
+func (d *document) fileOf(n *yaml.Node) string {
+	if f, ok := d.origin[n]; ok {
+		return f
+	}
+	return d.file
+}
+
+// scalarField returns the value of key in mapping n, or "".
+func scalarField(n *yaml.Node, key string) string {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return ""
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1].Value
+		}
+	}
+	return ""
+}
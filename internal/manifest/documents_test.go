@@ -0,0 +1,134 @@
+package manifest_test
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+)
+
+const labStack = `apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: big
+spec:
+  defaults: {memory: 1024, vcpus: 1, networks: [lan]}
+  networks:
+    lan: {cidr: 10.40.0.0/24}
+  vms:
+    gw: {}
+`
+
+const vmDoc = `apiVersion: nlab.io/v1alpha1
+kind: VM
+metadata:
+  name: web
+  labels:
+    nlab.io/stack: big
+spec:
+  memory: 2048
+  networks: [lan, dmz]
+`
+
+const networkDoc = `apiVersion: nlab.io/v1alpha1
+kind: Network
+metadata:
+  name: dmz
+  labels: {nlab.io/stack: big}
+spec:
+  cidr: 10.41.0.0/24
+`
+
+func TestLoadMultiDocumentStream(t *testing.T) {
+	m, err := manifest.LoadBytes([]byte(labStack+"---\n"+vmDoc+"---\n"+networkDoc), "test")
+	if err != nil {
+		t.Fatalf("LoadBytes: %v", err)
+	}
+	if len(m.Spec.VMs) != 2 || m.Spec.VMs["web"].Memory != 2048 {
+		t.Errorf("VMs = %+v", m.Spec.VMs)
+	}
+	if m.Spec.Networks["dmz"].CIDR != "10.41.0.0/24" {
+		t.Errorf("Networks = %+v", m.Spec.Networks)
+	}
+}
+
+func TestLoadDirectory(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"lab.yaml":    labStack,
+		"web.yaml":    vmDoc,
+		"dmz.yml":     networkDoc,
+		"layout.yaml": "layout: tiled\n",
+		"values.yaml": "apiVersion: v1\nkind: ConfigMap\n",
+	})
+	m, err := manifest.Load(dir)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(m.Spec.VMs) != 2 || len(m.Spec.Networks) != 2 {
+		t.Errorf("spec = %+v", m.Spec)
+	}
+}
+
+func TestStackFileTakesInSiblings(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"stack.yaml":  labStack,
+		"web.yaml":    vmDoc,
+		"dmz.yaml":    networkDoc,
+		"other.yaml":  strings.Replace(labStack, "name: big", "name: other", 1),
+		"single.yaml": labStack,
+	})
+	m, err := manifest.Load(filepath.Join(dir, "stack.yaml"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if _, ok := m.Spec.VMs["web"]; !ok {
+		t.Errorf("web.yaml not merged: %+v", m.Spec.VMs)
+	}
+	m, err = manifest.Load(filepath.Join(dir, "single.yaml"))
+	if err != nil || len(m.Spec.VMs) != 1 {
+		t.Errorf("a file not named stack.yaml should stand alone: %v %+v", err, m)
+	}
+}
+
+func TestDocumentIssues(t *testing.T) {
+	for _, tc := range []struct{ name, stream, want string }{
+		{"wrong label", labStack + "---\n" + strings.Replace(vmDoc, "nlab.io/stack: big", "nlab.io/stack: small", 1),
+			`metadata.labels: VM "web" has nlab.io/stack="small", not the stack "big"`},
+		{"no label", labStack + "---\n" + strings.Replace(vmDoc, "  labels:\n    nlab.io/stack: big\n", "", 1),
+			`nlab.io/stack=""`},
+		{"defined twice", labStack + "---\n" + strings.Replace(vmDoc, "name: web", "name: gw", 1),
+			"spec.vms.gw: defined twice"},
+		{"two stacks", labStack + "---\n" + labStack, "a second Stack document"},
+		{"no stack", vmDoc, "no kind: Stack document"},
+		{"unknown kind", labStack + "---\n" + strings.Replace(vmDoc, "kind: VM", "kind: Router", 1), `unsupported kind "Router"`},
+	} {
+		_, err := manifest.LoadBytes([]byte(tc.stream), "test")
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: want %q, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestIssuesPointIntoTheirDocument(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"stack.yaml": labStack,
+		"web.yaml":   strings.Replace(vmDoc, "spec:\n", "spec:\n  sshUser: Root\n", 1),
+	})
+	_, err := manifest.Load(filepath.Join(dir, "stack.yaml"))
+	var verr *manifest.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+	is := verr.Issues[0]
+	if is.File != filepath.Join(dir, "web.yaml") || is.Line != 8 || is.Column != 12 {
+		t.Errorf("issue at %s:%d:%d, want web.yaml:8:12: %s", is.File, is.Line, is.Column, is.Message)
+	}
+
+	// A stream: the VM document starts on line 12.
+	_, err = manifest.LoadBytes([]byte(labStack+"---\n"+strings.Replace(vmDoc, "memory: 2048", "memory: 2048\n  xml: <domain/>", 1)), "test")
+	if !errors.As(err, &verr) || verr.Issues[0].Line != 15 {
+		t.Errorf("expected the issue on the VM's metadata.name, line 15: %+v", verr)
+	}
+}
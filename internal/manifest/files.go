@@ -0,0 +1,157 @@
+package manifest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+// ResolveFiles reads the XML files a manifest references into the xml fields
+// and makes every referenced path (xmlFile, cloudInit.*) absolute, relative to
+// the directory of source. It returns a *ValidationError when a file cannot
+// be read or does not parse.
+func ResolveFiles(m *types.StackManifest, source string) error {
+	if issues := resolveFiles(m, source); len(issues) > 0 {
+		return &ValidationError{Source: source, Issues: issues}
+	}
+	return nil
+}
+
+func resolveFiles(m *types.StackManifest, source string) []Issue {
+	r := resolver{m: m, base: filepath.Dir(source), source: source}
+	if d := m.Spec.Defaults; d != nil {
+		d.CloudInit = r.cloudInit("spec.defaults", d.CloudInit)
+	}
+	for _, name := range sortedNames(m.Spec.Networks) {
+		n := m.Spec.Networks[name]
+		n.XML, n.XMLFile = r.xmlFile("spec.networks."+name, n.XML, n.XMLFile)
+		m.Spec.Networks[name] = n
+	}
+	for _, name := range sortedNames(m.Spec.VMs) {
+		vm := m.Spec.VMs[name]
+		at := "spec.vms." + name
+		vm.XML, vm.XMLFile = r.xmlFile(at, vm.XML, vm.XMLFile)
+		vm.CloudInit = r.cloudInit(at, vm.CloudInit)
+		m.Spec.VMs[name] = vm
+	}
+	return r.issues
+}
+
+// resolver accumulates issues while resolving the files of one manifest.
+type resolver struct {
+	m            *types.StackManifest
+	base, source string
+	issues       []Issue
+}
+
+func (r *resolver) add(file, format string, args ...interface{}) {
+	r.issues = append(r.issues, Issue{File: file, Severity: SeverityError, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *resolver) abs(path string) string {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(r.base, path)
+	}
+	if a, err := filepath.Abs(path); err == nil {
+		return a
+	}
+	return path
+}
+
+// cloudInit returns a copy of the cloudInit section at path at with absolute
+// paths, checking the files it names.
+func (r *resolver) cloudInit(at string, ci *types.CloudInitSpec) *types.CloudInitSpec {
+	if ci == nil {
+		return nil
+	}
+	c := *ci
+	if c.Dir != "" {
+		c.Dir = r.abs(c.Dir)
+	}
+	if c.UserData != "" && c.UserDataFile != "" {
+		r.add(r.source, "%s.cloudInit: userData and userDataFile are mutually exclusive", at)
+	}
+	if c.UserData != "" {
+		r.checkCloudConfig(r.source, at+".cloudInit.userData", c.UserData)
+	}
+	c.UserDataFile = r.cloudInitFile(at+".cloudInit.userDataFile", c.UserDataFile, false)
+	c.MetaDataFile = r.cloudInitFile(at+".cloudInit.metaDataFile", c.MetaDataFile, true)
+	c.NetworkConfigFile = r.cloudInitFile(at+".cloudInit.networkConfigFile", c.NetworkConfigFile, true)
+	return &c
+}
+
+// xmlFile loads ref into the xml field at path at, returning the new xml and
+// the absolute file path.
+func (r *resolver) xmlFile(at, xml, ref string) (string, string) {
+	if ref == "" {
+		return xml, ""
+	}
+	path := r.abs(ref)
+	if strings.TrimSpace(xml) != "" {
+		r.add(r.source, "%s: xml and xmlFile are mutually exclusive", at)
+		return xml, path
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case err != nil:
+		r.add(r.source, "%s.xmlFile: cannot read %s: %v", at, ref, unwrapPathError(err))
+		return "", path
+	case strings.TrimSpace(string(data)) == "":
+		r.add(path, "%s.xmlFile: file is empty", at)
+	}
+	return string(data), path
+}
+
+// cloudInitFile checks that ref exists and parses, returning its absolute
+// path. meta-data and network-config are always YAML; user-data only when it
+// is a #cloud-config document (it may also be a script).
+func (r *resolver) cloudInitFile(at, ref string, yamlOnly bool) string {
+	if ref == "" {
+		return ""
+	}
+	path := r.abs(ref)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		r.add(r.source, "%s: cannot read %s: %v", at, ref, unwrapPathError(err))
+		return path
+	}
+	for _, e := range undeclaredParams(r.m, at, string(data)) {
+		r.add(path, "%s", e)
+	}
+	if yamlOnly {
+		var v interface{}
+		if err := yaml.Unmarshal([]byte(paramRefRe.ReplaceAllString(string(data), "param")), &v); err != nil {
+			r.add(path, "%s: not valid YAML: %v", at, err)
+		}
+		return path
+	}
+	r.checkCloudConfig(path, at, string(data))
+	return path
+}
+
+// checkCloudConfig reports user-data that claims to be #cloud-config but is
+// not valid YAML. Parameter references are checked as plain values.
+func (r *resolver) checkCloudConfig(file, at, text string) {
+	if !strings.HasPrefix(text, "#cloud-config") {
+		return
+	}
+	text = paramRefRe.ReplaceAllString(text, "param")
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(text), &v); err != nil {
+		r.add(file, "%s: #cloud-config is not valid YAML: %v", at, err)
+	}
+}
+
+// unwrapPathError drops the path from an *os.PathError, which the caller
+// already names.
+func unwrapPathError(err error) error {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err
+	}
+	return err
+}
@@ -0,0 +1,151 @@
+package manifest_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+)
+
+// writeTree writes files (relative path → content) under a temp dir and
+// returns the dir.
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+const fileRefManifest = `
+apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: refs
+spec:
+  networks:
+    net:
+      xmlFile: xml/net.xml
+  vms:
+    attacker:
+      xmlFile: xml/attacker.xml
+      cloudInit:
+        userDataFile: ci/user-data
+        metaDataFile: ci/meta-data
+        networkConfigFile: ci/network-config
+    target:
+      memory: 1024
+      vcpus: 1
+      cloudInit:
+        userData: |
+          #cloud-config
+          hostname: target
+`
+
+func TestLoadResolvesFileRefs(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"stack.yaml":          fileRefManifest,
+		"xml/net.xml":         "<network><name>net</name></network>\n",
+		"xml/attacker.xml":    "<domain type=\"kvm\"><name>refs-attacker</name><memory unit=\"MiB\">1024</memory></domain>\n",
+		"ci/user-data":        "#cloud-config\nhostname: attacker\n",
+		"ci/meta-data":        "instance-id: attacker\n",
+		"ci/network-config":   "version: 2\n",
+		"unrelated/README.md": "not referenced",
+	})
+	m, err := manifest.Load(filepath.Join(dir, "stack.yaml"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	net := m.Spec.Networks["net"]
+	if net.XML != "<network><name>net</name></network>\n" || net.XMLFile != filepath.Join(dir, "xml", "net.xml") {
+		t.Errorf("net = %+v, want XML read from an absolute xmlFile", net)
+	}
+	ci := m.Spec.VMs["attacker"].CloudInit
+	for _, got := range []string{ci.UserDataFile, ci.MetaDataFile, ci.NetworkConfigFile} {
+		if !filepath.IsAbs(got) || !strings.HasPrefix(got, filepath.Join(dir, "ci")) {
+			t.Errorf("cloud-init path %q should be absolute under %s/ci", got, dir)
+		}
+	}
+	if ud := m.Spec.VMs["target"].CloudInit.UserData; !strings.Contains(ud, "hostname: target") {
+		t.Errorf("inline userData = %q", ud)
+	}
+}
+
+func TestLoadAttributesIssuesToFiles(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"stack.yaml":        fileRefManifest,
+		"xml/net.xml":       "<network><name>net</name>",
+		"xml/attacker.xml":  "<domain type=\"kvm\"/>",
+		"ci/user-data":      "#cloud-config\nusers: [\n",
+		"ci/network-config": "version: 2\n",
+	})
+	manifestPath := filepath.Join(dir, "stack.yaml")
+	_, err := manifest.Load(manifestPath)
+	var verr *manifest.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Load error = %v, want *ValidationError", err)
+	}
+	want := map[string]string{
+		filepath.Join(dir, "xml", "net.xml"):  "xml is malformed",
+		filepath.Join(dir, "ci", "user-data"): "not valid YAML",
+		manifestPath:                          "metaDataFile: cannot read",
+	}
+	for file, msg := range want {
+		found := false
+		for _, is := range verr.Issues {
+			if is.File == file && strings.Contains(is.Message, msg) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no issue %q attributed to %s in %+v", msg, file, verr.Issues)
+		}
+	}
+	if !strings.Contains(err.Error(), "(in "+filepath.Join(dir, "xml", "net.xml")+")") {
+		t.Errorf("error text should name the referenced file:\n%v", err)
+	}
+}
+
+func TestLoadRejectsConflictingRefs(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"stack.yaml": `
+apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: c
+spec:
+  networks:
+    net:
+      xml: <network/>
+      xmlFile: net.xml
+  vms:
+    vm:
+      memory: 1024
+      vcpus: 1
+      cloudInit:
+        userData: "#cloud-config\n"
+        userDataFile: user-data
+`,
+		"net.xml":   "<network/>",
+		"user-data": "#cloud-config\n",
+	})
+	_, err := manifest.Load(filepath.Join(dir, "stack.yaml"))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{"xml and xmlFile are mutually exclusive", "userData and userDataFile are mutually exclusive"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should mention %q, got: %v", want, err)
+		}
+	}
+}
@@ -3,13 +3,13 @@ package manifest
 
 import (
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"sort"
+	"strconv"
 	"strings"
 
-	"gopkg.in/yaml.v3"
-
 	"github.com/h3ow3d/nlab/internal/types"
 )
 
@@ -18,90 +18,298 @@ const (
 	supportedKind       = "Stack"
 )
 
-// Load reads a manifest file from path, parses it, and validates it.
+// Severity says whether an Issue stops a manifest from loading.
+type Severity string
+
+const (
+	// SeverityError issues make a manifest invalid.
+	SeverityError Severity = "error"
+	// SeverityWarning issues are reported but the manifest still loads.
+	SeverityWarning Severity = "warning"
+)
+
+// Issue is one problem found in a manifest, attributed to the file it is in:
+// the manifest itself or a file the manifest references.
+// Line and Column, when set, are 1-based and point into File.
+type Issue struct {
+	File     string   `json:"file"`
+	Line     int      `json:"line,omitempty"`
+	Column   int      `json:"column,omitempty"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+
+	// xmlLine is the line of an XML syntax error inside an inline xml field,
+	// mapped to a line of File by locate.
+	xmlLine int
+}
+
+// ValidationError is returned when a manifest has one or more error issues.
+type ValidationError struct {
+	Source string
+	Issues []Issue
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Issues))
+	for i, is := range e.Issues {
+		lines[i] = is.Message
+		if is.Line > 0 {
+			lines[i] = fmt.Sprintf("line %d: %s", is.Line, lines[i])
+		}
+		if is.File != e.Source {
+			lines[i] += fmt.Sprintf(" (in %s)", is.File)
+		}
+	}
+	return fmt.Sprintf("manifest %q is invalid:\n  - %s", e.Source, strings.Join(lines, "\n  - "))
+}
+
+// Load reads a manifest from path, parses it, resolves the files it
+// references and validates it. path is a file, which may hold several YAML
+// documents, or a directory of them; see Parse for how they are put together.
 // It returns the parsed StackManifest or an error with actionable guidance.
 func Load(path string) (*types.StackManifest, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("cannot read manifest %q: %w", path, err)
-	}
-	return LoadBytes(data, path)
+	m, _, err := Check(path)
+	return m, err
 }
 
 // LoadBytes parses and validates a manifest from raw YAML bytes.
-// The source parameter is used only for error messages.
+// The source parameter is used for error messages and, when it is a path,
+// to resolve the files the manifest references. Warnings are dropped; use
+// CheckBytes to see them.
 func LoadBytes(data []byte, source string) (*types.StackManifest, error) {
-	var m types.StackManifest
-	dec := yaml.NewDecoder(strings.NewReader(string(data)))
-	dec.KnownFields(true)
-	if err := dec.Decode(&m); err != nil {
-		return nil, fmt.Errorf("manifest %q: YAML parse error: %w", source, err)
+	m, _, err := CheckBytes(data, source)
+	return m, err
+}
+
+// Check is Load that also returns the warnings found in a manifest.
+func Check(path string) (*types.StackManifest, []Issue, error) {
+	docs, err := readDocuments(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return check(docs, path)
+}
+
+// CheckBytes is LoadBytes that also returns the warnings found in a
+// manifest. Warnings are returned whether or not the manifest is valid.
+func CheckBytes(data []byte, source string) (*types.StackManifest, []Issue, error) {
+	docs, err := parseDocuments(data, source)
+	if err != nil {
+		return nil, nil, err
+	}
+	return check(docs, source)
+}
+
+func check(docs []*document, path string) (*types.StackManifest, []Issue, error) {
+	m, a, issues := assemble(docs, path)
+	if m != nil {
+		issues = append(issues, resolveFiles(m, a.source)...)
+		issues = append(issues, validate(m, a.source)...)
+		a.locate(issues)
 	}
-	if err := Validate(&m, source); err != nil {
+	errs, warnings := splitIssues(issues)
+	if len(errs) > 0 {
+		return nil, warnings, &ValidationError{Source: path, Issues: errs}
+	}
+	return m, warnings, nil
+}
+
+// Parse reads the manifest at path without validating it: the documents are
+// put together and the files they reference resolved. Network and VM
+// documents join the Stack document whose name their nlab.io/stack label
+// holds, as spec.networks.<name> and spec.vms.<name>. A directory is every
+// nlab manifest in it; stack.yaml also takes in the Network and VM
+// manifests next to it.
+func Parse(path string) (*types.StackManifest, error) {
+	docs, err := readDocuments(path)
+	if err != nil {
 		return nil, err
 	}
-	return &m, nil
+	m, a, issues := assemble(docs, path)
+	if m != nil {
+		issues = append(issues, resolveFiles(m, a.source)...)
+		a.locate(issues)
+	}
+	if len(issues) > 0 {
+		return nil, &ValidationError{Source: path, Issues: issues}
+	}
+	return m, nil
+}
+
+// yamlError reports a YAML syntax or type error at the line it names.
+func yamlError(source string, err error) *ValidationError {
+	is := Issue{File: source, Severity: SeverityError, Message: fmt.Sprintf("YAML parse error: %v", err)}
+	if m := yamlLineRe.FindStringSubmatch(err.Error()); m != nil {
+		is.Line, _ = strconv.Atoi(m[1])
+	}
+	return &ValidationError{Source: source, Issues: []Issue{is}}
 }
 
 // Validate checks a parsed StackManifest for correctness and returns a
-// descriptive error if any issue is found.
+// *ValidationError listing every error found. Warnings are ignored.
 func Validate(m *types.StackManifest, source string) error {
-	var errs []string
+	if errs, _ := splitIssues(validate(m, source)); len(errs) > 0 {
+		return &ValidationError{Source: source, Issues: errs}
+	}
+	return nil
+}
+
+// splitIssues separates errors from warnings, keeping their order.
+func splitIssues(issues []Issue) (errs, warnings []Issue) {
+	for _, is := range issues {
+		if is.Severity == SeverityWarning {
+			warnings = append(warnings, is)
+		} else {
+			errs = append(errs, is)
+		}
+	}
+	return errs, warnings
+}
+
+func validate(m *types.StackManifest, source string) []Issue {
+	var issues []Issue
+	add := func(file, format string, args ...interface{}) {
+		issues = append(issues, Issue{File: file, Severity: SeverityError, Message: fmt.Sprintf(format, args...)})
+	}
+	// xmlIssue adds an issue for malformed XML, keeping the line of the
+	// syntax error.
+	xmlIssue := func(file string, err error, format string, args ...interface{}) {
+		add(file, format, args...)
+		var se *xml.SyntaxError
+		if errors.As(err, &se) {
+			if file == source {
+				issues[len(issues)-1].xmlLine = se.Line
+			} else {
+				issues[len(issues)-1].Line = se.Line
+			}
+		}
+	}
 
 	// Schema / version checks.
 	if m.APIVersion == "" {
-		errs = append(errs, "missing required field: apiVersion (expected \"nlab.io/v1alpha1\")")
+		add(source, "missing required field: apiVersion (expected \"nlab.io/v1alpha1\")")
 	} else if m.APIVersion != supportedAPIVersion {
-		errs = append(errs, fmt.Sprintf("unsupported apiVersion %q: only %q is supported", m.APIVersion, supportedAPIVersion))
+		add(source, "unsupported apiVersion %q: only %q is supported", m.APIVersion, supportedAPIVersion)
 	}
 
 	if m.Kind == "" {
-		errs = append(errs, "missing required field: kind (expected \"Stack\")")
+		add(source, "missing required field: kind (expected \"Stack\")")
 	} else if m.Kind != supportedKind {
-		errs = append(errs, fmt.Sprintf("unsupported kind %q: only %q is supported", m.Kind, supportedKind))
+		add(source, "unsupported kind %q: expected Stack, Network or VM", m.Kind)
 	}
 
 	// Metadata checks.
 	if strings.TrimSpace(m.Metadata.Name) == "" {
-		errs = append(errs, "missing required field: metadata.name")
+		add(source, "missing required field: metadata.name")
 	}
 
 	// spec.networks checks.
 	if len(m.Spec.Networks) == 0 {
-		errs = append(errs, "spec.networks: at least one network is required")
+		add(source, "spec.networks: at least one network is required")
 	}
-	for name, net := range m.Spec.Networks {
+	for _, name := range sortedNames(m.Spec.Networks) {
+		net := m.Spec.Networks[name]
 		if strings.TrimSpace(name) == "" {
-			errs = append(errs, "spec.networks: network name must not be empty or whitespace-only")
+			add(source, "spec.networks: network name must not be empty or whitespace-only")
 			continue
 		}
-		if strings.TrimSpace(net.XML) == "" {
-			errs = append(errs, fmt.Sprintf("spec.networks.%s: xml field is required", name))
-		} else if xmlErr := validateXML(net.XML); xmlErr != nil {
-			errs = append(errs, fmt.Sprintf("spec.networks.%s: xml is malformed: %v", name, xmlErr))
+		if net.Impairment != nil {
+			for _, e := range ValidateImpairment("spec.networks."+name+".impairment", *net.Impairment) {
+				add(source, "%s", e)
+			}
 		}
+		raw := strings.TrimSpace(net.XML) != "" || net.XMLFile != ""
+		switch {
+		case net.Typed() && raw:
+			add(source, "spec.networks.%s: xml/xmlFile cannot be combined with cidr/mode/bridge/dhcp/egress", name)
+		case net.Typed():
+			for _, e := range validateTypedNetwork(name, net) {
+				add(source, "%s", e)
+			}
+		case !raw:
+			add(source, "spec.networks.%s: either xml, xmlFile or cidr is required", name)
+		case strings.TrimSpace(net.XML) == "":
+			// Unreadable or empty xmlFile, reported when it was resolved.
+		default:
+			if xmlErr := validateXML(net.XML); xmlErr != nil {
+				xmlIssue(orSource(net.XMLFile, source), xmlErr, "spec.networks.%s: xml is malformed: %v", name, xmlErr)
+			}
+		}
+	}
+
+	// spec.parameters checks and ${params.*} references.
+	for _, e := range validateParams(m) {
+		add(source, "%s", e)
+	}
+
+	// spec.defaults and spec.storage checks; VMs are checked with the
+	// defaults applied.
+	for _, e := range validateDefaults(m) {
+		add(source, "%s", e)
 	}
+	m = Effective(m)
 
 	// spec.vms checks.
 	if len(m.Spec.VMs) == 0 {
-		errs = append(errs, "spec.vms: at least one VM is required")
+		add(source, "spec.vms: at least one VM is required")
 	}
-	for name, vm := range m.Spec.VMs {
+	for _, name := range sortedNames(m.Spec.VMs) {
+		vm := m.Spec.VMs[name]
 		if strings.TrimSpace(name) == "" {
-			errs = append(errs, "spec.vms: VM name must not be empty or whitespace-only")
+			add(source, "spec.vms: VM name must not be empty or whitespace-only")
 			continue
 		}
-		if strings.TrimSpace(vm.XML) == "" {
-			errs = append(errs, fmt.Sprintf("spec.vms.%s: xml field is required", name))
-		} else if xmlErr := validateXML(vm.XML); xmlErr != nil {
-			errs = append(errs, fmt.Sprintf("spec.vms.%s: xml is malformed: %v", name, xmlErr))
+		raw := strings.TrimSpace(vm.XML) != "" || vm.XMLFile != ""
+		switch {
+		case vm.Typed() && raw:
+			add(source, "spec.vms.%s: xml/xmlFile cannot be combined with memory/vcpus/disk/networks/image", name)
+		case vm.Typed():
+			for _, e := range validateTypedVM(m, name, vm) {
+				add(source, "%s", e)
+			}
+		case !raw:
+			add(source, "spec.vms.%s: either xml, xmlFile or memory and vcpus are required", name)
+		case strings.TrimSpace(vm.XML) == "":
+			// Unreadable or empty xmlFile, reported when it was resolved.
+		default:
+			if xmlErr := validateXML(vm.XML); xmlErr != nil {
+				xmlIssue(orSource(vm.XMLFile, source), xmlErr, "spec.vms.%s: xml is malformed: %v", name, xmlErr)
+			}
 		}
 	}
 
-	if len(errs) > 0 {
-		return fmt.Errorf("manifest %q is invalid:\n  - %s", source, strings.Join(errs, "\n  - "))
+	for _, e := range validatePorts(m) {
+		add(source, "%s", e)
 	}
-	return nil
+
+	// spec.tmux checks.
+	if m.Spec.Tmux != nil {
+		for _, e := range validateTmux(m) {
+			add(source, "%s", e)
+		}
+	}
+
+	// Cross-references, addresses and naming inside the XML.
+	issues = append(issues, validateSemantics(m, source)...)
+
+	return issues
+}
+
+// orSource returns file, or source when file is empty.
+func orSource(file, source string) string {
+	if file != "" {
+		return file
+	}
+	return source
+}
+
+func sortedNames[V any](m map[string]V) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 // validateXML checks that s is well-formed XML.
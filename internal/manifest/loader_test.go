@@ -1,6 +1,7 @@
 package manifest_test
 
 import (
+	"errors"
 	"strings"
 	"testing"
 
@@ -115,7 +116,7 @@ func TestValidateMissingKind(t *testing.T) {
 }
 
 func TestValidateWrongKind(t *testing.T) {
-	yaml := strings.ReplaceAll(validManifest, "kind: Stack", "kind: Network")
+	yaml := strings.ReplaceAll(validManifest, "kind: Stack", "kind: Cluster")
 	_, err := manifest.LoadBytes([]byte(yaml), "test")
 	if err == nil {
 		t.Error("expected error for wrong kind, got nil")
@@ -310,8 +311,13 @@ spec:
       unknownField: should-fail
 `
 	_, err := manifest.LoadBytes([]byte(yaml), "test")
-	if err == nil {
-		t.Error("expected error for unknown YAML field, got nil")
+	var ve *manifest.ValidationError
+	if !errors.As(err, &ve) || len(ve.Issues) != 1 {
+		t.Fatalf("expected one issue for the unknown YAML field, got %v", err)
+	}
+	got := manifest.Diagnostic(ve.Issues[0])
+	if want := `test:13:7: error: spec.vms.attacker.unknownField: unknown field "unknownField"`; got != want {
+		t.Errorf("Diagnostic = %q, want %q", got, want)
 	}
 }
 
@@ -0,0 +1,291 @@
+package manifest
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+// paramRefRe matches a ${params.<name>} reference.
+var paramRefRe = regexp.MustCompile(`\$\{params\.([^}]*)\}`)
+
+// paramTypes are the accepted values of spec.parameters.<name>.type.
+var paramTypes = []string{"string", "int", "bool", "list"}
+
+// ResolveParams returns the value every parameter of m is substituted with:
+// the entry in values (nlab up --set/--values) or else the declared default.
+// Strings in values are converted to the parameter's type. Values for
+// undeclared parameters and required parameters without one are errors.
+func ResolveParams(m *types.StackManifest, values map[string]interface{}) (map[string]string, error) {
+	var errs []string
+	for _, name := range sortedNames(values) {
+		if _, ok := m.Spec.Parameters[name]; !ok {
+			errs = append(errs, fmt.Sprintf("%s: not declared in spec.parameters", name))
+		}
+	}
+	out := make(map[string]string, len(m.Spec.Parameters))
+	for _, name := range sortedNames(m.Spec.Parameters) {
+		p := m.Spec.Parameters[name]
+		v, ok := values[name]
+		if !ok {
+			v = p.Default
+		}
+		if v == nil {
+			errs = append(errs, fmt.Sprintf("%s: required; set it with --set %s=<%s>", name, name, paramType(p)))
+			continue
+		}
+		s, err := formatParam(paramType(p), v)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		out[name] = s
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid parameters:\n  - %s", strings.Join(errs, "\n  - "))
+	}
+	return out, nil
+}
+
+// Substitute replaces every ${params.<name>} in text with its value.
+func Substitute(text string, values map[string]string) (string, error) {
+	var missing []string
+	out := paramRefRe.ReplaceAllStringFunc(text, func(ref string) string {
+		name := paramRefRe.FindStringSubmatch(ref)[1]
+		v, ok := values[name]
+		if !ok {
+			missing = append(missing, name)
+			return ref
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("unknown parameter %q in ${params.%s}", missing[0], missing[0])
+	}
+	return out, nil
+}
+
+// ApplyParams substitutes values into the XML, inline cloud-init and
+// spec.tmux of m. Cloud-init files are substituted when they are read.
+func ApplyParams(m *types.StackManifest, values map[string]string) error {
+	var first error
+	sub := func(s string) string {
+		out, err := Substitute(s, values)
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			return s
+		}
+		return out
+	}
+	networks := make(map[string]types.NetworkSpec, len(m.Spec.Networks))
+	for name, n := range m.Spec.Networks {
+		n.XML = sub(n.XML)
+		networks[name] = n
+	}
+	m.Spec.Networks = networks
+	vms := make(map[string]types.VMSpec, len(m.Spec.VMs))
+	for name, vm := range m.Spec.VMs {
+		vm.XML = sub(vm.XML)
+		if vm.CloudInit != nil {
+			ci := *vm.CloudInit
+			ci.UserData = sub(ci.UserData)
+			vm.CloudInit = &ci
+		}
+		vms[name] = vm
+	}
+	m.Spec.VMs = vms
+	if t := m.Spec.Tmux; t != nil {
+		tmux := types.TmuxSpec{Preset: t.Preset}
+		for _, w := range t.Windows {
+			win := types.TmuxWindow{Name: sub(w.Name), Layout: w.Layout}
+			for _, p := range w.Panes {
+				p.Command, p.Cwd, p.Title = sub(p.Command), sub(p.Cwd), sub(p.Title)
+				if p.Env != nil {
+					env := make(map[string]string, len(p.Env))
+					for k, v := range p.Env {
+						env[k] = sub(v)
+					}
+					p.Env = env
+				}
+				win.Panes = append(win.Panes, p)
+			}
+			tmux.Windows = append(tmux.Windows, win)
+		}
+		m.Spec.Tmux = &tmux
+	}
+	return first
+}
+
+func paramType(p types.ParameterSpec) string {
+	if p.Type == "" {
+		return "string"
+	}
+	return p.Type
+}
+
+// formatParam converts v to the text substituted for a parameter of type typ.
+// A list may also be given as a comma-separated string or a flow sequence.
+func formatParam(typ string, v interface{}) (string, error) {
+	switch typ {
+	case "string":
+		switch v.(type) {
+		case string, int, float64, bool:
+			return fmt.Sprint(v), nil
+		}
+		return "", fmt.Errorf("expected a string, got %v", v)
+	case "int":
+		switch x := v.(type) {
+		case int:
+			return strconv.Itoa(x), nil
+		case string:
+			if _, err := strconv.Atoi(strings.TrimSpace(x)); err == nil {
+				return strings.TrimSpace(x), nil
+			}
+		}
+		return "", fmt.Errorf("%v is not an integer", v)
+	case "bool":
+		switch x := v.(type) {
+		case bool:
+			return strconv.FormatBool(x), nil
+		case string:
+			if b, err := strconv.ParseBool(strings.TrimSpace(x)); err == nil {
+				return strconv.FormatBool(b), nil
+			}
+		}
+		return "", fmt.Errorf("%v is not true or false", v)
+	case "list":
+		var items []string
+		switch x := v.(type) {
+		case []interface{}:
+			for _, item := range x {
+				s, err := formatParam("string", item)
+				if err != nil {
+					return "", fmt.Errorf("list items must be scalars, got %v", item)
+				}
+				items = append(items, s)
+			}
+		case string:
+			if strings.HasPrefix(strings.TrimSpace(x), "[") {
+				var seq []interface{}
+				if err := yaml.Unmarshal([]byte(x), &seq); err != nil {
+					return "", fmt.Errorf("%s is not a list: %v", x, err)
+				}
+				return formatParam("list", seq)
+			}
+			for _, item := range strings.Split(x, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+		default:
+			return "", fmt.Errorf("expected a list, got %v", v)
+		}
+		seq := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+		for _, item := range items {
+			seq.Content = append(seq.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: item})
+		}
+		out, err := yaml.Marshal(seq)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	return "", fmt.Errorf("unknown type %q", typ)
+}
+
+// ParamValue returns s, a value as ResolveParams formats it, as the declared
+// type of p: an int, a bool, a list or else the string itself.
+func ParamValue(p types.ParameterSpec, s string) interface{} {
+	switch paramType(p) {
+	case "int":
+		if n, err := strconv.Atoi(s); err == nil {
+			return n
+		}
+	case "bool":
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	case "list":
+		var seq []interface{}
+		if err := yaml.Unmarshal([]byte(s), &seq); err == nil {
+			return seq
+		}
+	}
+	return s
+}
+
+// validateParams checks spec.parameters and that every ${params.<name>} in
+// the manifest refers to one of them.
+func validateParams(m *types.StackManifest) []string {
+	var errs []string
+	for _, name := range sortedNames(m.Spec.Parameters) {
+		p := m.Spec.Parameters[name]
+		at := "spec.parameters." + name
+		if !envNameRe.MatchString(name) {
+			errs = append(errs, fmt.Sprintf("%s: name must be letters, digits and underscores", at))
+		}
+		if !contains(paramTypes, paramType(p)) {
+			errs = append(errs, fmt.Sprintf("%s.type: %q is not one of %s", at, p.Type, strings.Join(paramTypes, ", ")))
+			continue
+		}
+		if p.Default != nil {
+			if _, err := formatParam(paramType(p), p.Default); err != nil {
+				errs = append(errs, fmt.Sprintf("%s.default: %v", at, err))
+			}
+		}
+	}
+	check := func(at, text string) {
+		errs = append(errs, undeclaredParams(m, at, text)...)
+	}
+	for _, name := range sortedNames(m.Spec.Networks) {
+		check("spec.networks."+name+".xml", m.Spec.Networks[name].XML)
+	}
+	if d := m.Spec.Defaults; d != nil && d.CloudInit != nil {
+		check("spec.defaults.cloudInit.userData", d.CloudInit.UserData)
+	}
+	for _, name := range sortedNames(m.Spec.VMs) {
+		vm := m.Spec.VMs[name]
+		check("spec.vms."+name+".xml", vm.XML)
+		if vm.CloudInit != nil {
+			check("spec.vms."+name+".cloudInit.userData", vm.CloudInit.UserData)
+		}
+	}
+	if t := m.Spec.Tmux; t != nil {
+		for i, w := range t.Windows {
+			check(fmt.Sprintf("spec.tmux.windows[%d].name", i), w.Name)
+			for j, p := range w.Panes {
+				at := fmt.Sprintf("spec.tmux.windows[%d].panes[%d]", i, j)
+				check(at+".command", p.Command)
+				check(at+".cwd", p.Cwd)
+				check(at+".title", p.Title)
+				for _, k := range sortedNames(p.Env) {
+					check(at+".env."+k, p.Env[k])
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// undeclaredParams reports the ${params.<name>} references in text that name
+// no parameter of m.
+func undeclaredParams(m *types.StackManifest, at, text string) []string {
+	var errs []string
+	seen := map[string]bool{}
+	for _, ref := range paramRefRe.FindAllStringSubmatch(text, -1) {
+		name := ref[1]
+		if _, ok := m.Spec.Parameters[name]; ok || seen[name] {
+			continue
+		}
+		seen[name] = true
+		errs = append(errs, fmt.Sprintf("%s: ${params.%s} is not declared in spec.parameters", at, name))
+	}
+	return errs
+}
@@ -0,0 +1,161 @@
+package manifest_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+)
+
+const paramsManifest = `
+apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: web
+spec:
+  parameters:
+    targetVersion:
+      description: Apache version installed on the target
+      default: "2.4.52"
+    targetPackages:
+      type: list
+      default: [apache2]
+    workers:
+      type: int
+      default: 2
+    debug:
+      type: bool
+      default: false
+    flag:
+      description: required, no default
+  networks:
+    net:
+      cidr: 10.40.0.0/24
+  vms:
+    target:
+      memory: 1024
+      vcpus: 1
+      cloudInit:
+        userData: |
+          #cloud-config
+          packages: ${params.targetPackages}
+          runcmd: [echo ${params.targetVersion} ${params.flag}]
+  tmux:
+    windows:
+      - name: web-${params.targetVersion}
+        panes:
+          - command: tail -f /var/log/${params.flag}
+`
+
+func TestResolveParams(t *testing.T) {
+	m, err := manifest.LoadBytes([]byte(paramsManifest), "test")
+	if err != nil {
+		t.Fatalf("LoadBytes: %v", err)
+	}
+	if _, err := manifest.ResolveParams(m, nil); err == nil || !strings.Contains(err.Error(), "flag: required") {
+		t.Errorf("missing required parameter: error = %v", err)
+	}
+
+	got, err := manifest.ResolveParams(m, map[string]interface{}{
+		"flag":           "ctf",
+		"targetPackages": "apache2, php",
+		"workers":        "4",
+		"debug":          "yes",
+	})
+	if err == nil || !strings.Contains(err.Error(), "debug: yes is not true or false") {
+		t.Fatalf("bad bool: error = %v", err)
+	}
+	got, err = manifest.ResolveParams(m, map[string]interface{}{
+		"flag":           "ctf",
+		"targetPackages": "apache2, php",
+		"workers":        "4",
+	})
+	if err != nil {
+		t.Fatalf("ResolveParams: %v", err)
+	}
+	want := map[string]string{"targetVersion": "2.4.52", "targetPackages": "[apache2, php]", "workers": "4", "debug": "false", "flag": "ctf"}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+
+	// A resolved list round-trips, as when read back from the stack state.
+	again, err := manifest.ResolveParams(m, map[string]interface{}{"flag": "ctf", "targetPackages": got["targetPackages"]})
+	if err != nil || again["targetPackages"] != "[apache2, php]" {
+		t.Errorf("list round trip = %q, %v", again["targetPackages"], err)
+	}
+
+	if _, err := manifest.ResolveParams(m, map[string]interface{}{"flag": "x", "nope": "1"}); err == nil || !strings.Contains(err.Error(), "nope: not declared") {
+		t.Errorf("undeclared parameter: error = %v", err)
+	}
+}
+
+func TestApplyParams(t *testing.T) {
+	m, err := manifest.LoadBytes([]byte(paramsManifest), "test")
+	if err != nil {
+		t.Fatalf("LoadBytes: %v", err)
+	}
+	values, err := manifest.ResolveParams(m, map[string]interface{}{"flag": "ctf"})
+	if err != nil {
+		t.Fatalf("ResolveParams: %v", err)
+	}
+	orig := m.Spec.VMs["target"].CloudInit.UserData
+	if err := manifest.ApplyParams(m, values); err != nil {
+		t.Fatalf("ApplyParams: %v", err)
+	}
+	ud := m.Spec.VMs["target"].CloudInit.UserData
+	if !strings.Contains(ud, "packages: [apache2]") || !strings.Contains(ud, "echo 2.4.52 ctf") {
+		t.Errorf("userData not substituted:\n%s", ud)
+	}
+	if !strings.Contains(orig, "${params.") {
+		t.Error("ApplyParams changed the original cloudInit section")
+	}
+	w := m.Spec.Tmux.Windows[0]
+	if w.Name != "web-2.4.52" || w.Panes[0].Command != "tail -f /var/log/ctf" {
+		t.Errorf("tmux not substituted: %+v", w)
+	}
+	if _, err := manifest.Substitute("${params.missing}", values); err == nil {
+		t.Error("Substitute accepted an unknown parameter")
+	}
+}
+
+func TestValidateParamsErrors(t *testing.T) {
+	tests := []struct {
+		name, from, to, want string
+	}{
+		{"undeclared reference", "${params.flag}]", "${params.flags}]", "${params.flags} is not declared"},
+		{"bad type", "      type: int\n", "      type: number\n", "spec.parameters.workers.type"},
+		{"bad default", "      default: 2\n", "      default: two\n", "spec.parameters.workers.default"},
+		{"bad name", "    debug:\n", "    de-bug:\n", "spec.parameters.de-bug"},
+		{"unknown key", "      description: required, no default\n", "      help: required\n", `spec.parameters.flag.help: unknown field "help"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := strings.Replace(paramsManifest, tt.from, tt.to, 1)
+			if doc == paramsManifest {
+				t.Fatalf("replacement %q did not apply", tt.from)
+			}
+			_, err := manifest.LoadBytes([]byte(doc), "test")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateParamsInCloudInitFile(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"stack.yaml": strings.Replace(paramsManifest, `      cloudInit:
+        userData: |
+          #cloud-config
+          packages: ${params.targetPackages}
+          runcmd: [echo ${params.targetVersion} ${params.flag}]
+`, "      cloudInit:\n        userDataFile: user-data\n", 1),
+		"user-data": "#cloud-config\npackages: ${params.packages}\n",
+	})
+	_, err := manifest.Load(dir + "/stack.yaml")
+	if err == nil || !strings.Contains(err.Error(), "${params.packages} is not declared") || !strings.Contains(err.Error(), "user-data)") {
+		t.Errorf("error = %v, want the undeclared reference attributed to user-data", err)
+	}
+}
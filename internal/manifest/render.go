@@ -0,0 +1,593 @@
+package manifest
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+const (
+	// DefaultDiskDir is where virt-install creates VM disks in the default
+	// libvirt storage pool.
+	DefaultDiskDir = "/var/lib/libvirt/images"
+	// DefaultDiskSize is the overlay size, in GiB, of a VM without disk.size.
+	DefaultDiskSize = 20
+)
+
+// networkModes are the accepted values of spec.networks.<n>.mode.
+var networkModes = []string{"nat", "route", "open", "isolated"}
+
+// RenderOptions supplies the host-side values a rendered domain refers to.
+type RenderOptions struct {
+	Stack     string // domains are named <stack>-<vm>
+	BaseImage string // used when a VM sets no image
+	ImageDir  string // resolves image names that are not absolute paths
+	DiskDir   string // where overlay disks live (DefaultDiskDir when empty)
+	SeedDir   string // where cloud-init seed ISOs are written
+}
+
+// PrimaryNetwork returns the alphabetically first network of the manifest,
+// which VMs without spec.vms.<n>.networks attach to.
+func PrimaryNetwork(m *types.StackManifest) string {
+	names := make([]string, 0, len(m.Spec.Networks))
+	for name := range m.Spec.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+// VMNetworks returns the networks a typed VM is attached to.
+func VMNetworks(m *types.StackManifest, vm types.VMSpec) []string {
+	if len(vm.Networks) > 0 {
+		return vm.Networks
+	}
+	if p := PrimaryNetwork(m); p != "" {
+		return []string{p}
+	}
+	return nil
+}
+
+// DiskSize returns a typed VM's overlay size in GiB.
+func DiskSize(vm types.VMSpec) int {
+	if vm.Disk != nil && vm.Disk.Size > 0 {
+		return vm.Disk.Size
+	}
+	return DefaultDiskSize
+}
+
+// ImagePath resolves a typed VM's base image against opts.
+func ImagePath(vm types.VMSpec, opts RenderOptions) string {
+	switch {
+	case vm.Image == "":
+		return opts.BaseImage
+	case filepath.IsAbs(vm.Image):
+		return vm.Image
+	default:
+		return filepath.Join(opts.ImageDir, vm.Image)
+	}
+}
+
+// NetworkXML returns the libvirt network XML for spec.networks.<name>: the raw
+// xml when given, otherwise the XML rendered from the typed fields.
+func NetworkXML(name string, n types.NetworkSpec) (string, error) {
+	if !n.Typed() {
+		return strings.TrimSpace(n.XML) + "\n", nil
+	}
+	if _, auto := AutoPrefix(n.CIDR); auto {
+		return "", fmt.Errorf("spec.networks.%s.cidr: %s has not been allocated a subnet", name, n.CIDR)
+	}
+	if n.Bridge == Auto {
+		return "", fmt.Errorf("spec.networks.%s.bridge: auto has not been allocated a bridge", name)
+	}
+	subnet, err := parseSubnet(n.CIDR)
+	if err != nil {
+		return "", fmt.Errorf("spec.networks.%s.cidr: %w", name, err)
+	}
+	doc := xmlNetwork{Name: name}
+	if n.Bridge != "" {
+		doc.Bridge = &xmlBridge{Name: n.Bridge, STP: "on", Delay: "0"}
+	}
+	if mode := networkMode(n); mode != "isolated" {
+		doc.Forward = &xmlForward{Mode: mode}
+	}
+	doc.IP = xmlIP{
+		Address: subnet.host(1).String(),
+		Netmask: net.IP(subnet.Mask).String(),
+	}
+	if n.DHCP == nil || n.DHCP.Enabled {
+		start, end := subnet.defaultRange()
+		if n.DHCP != nil && n.DHCP.Start != "" {
+			start, end = net.ParseIP(n.DHCP.Start), net.ParseIP(n.DHCP.End)
+		}
+		doc.IP.DHCP = &xmlDHCP{Range: xmlRange{Start: start.String(), End: end.String()}}
+	}
+	return marshalXML(doc)
+}
+
+// DomainXML returns the libvirt domain XML for spec.vms.<name>: the raw xml
+// when given, otherwise the XML rendered from the typed fields.
+func DomainXML(m *types.StackManifest, name string, opts RenderOptions) (string, error) {
+	vm, ok := m.Spec.VMs[name]
+	if !ok {
+		return "", fmt.Errorf("spec.vms.%s: no such VM", name)
+	}
+	if !vm.Typed() {
+		return strings.TrimSpace(vm.XML) + "\n", nil
+	}
+	domain := opts.Stack + "-" + name
+	diskDir := opts.DiskDir
+	if diskDir == "" {
+		diskDir = DefaultDiskDir
+	}
+	image := ImagePath(vm, opts)
+	doc := xmlDomain{
+		Type:     "kvm",
+		Name:     domain,
+		Memory:   xmlMemory{Unit: "MiB", Value: vm.Memory},
+		VCPU:     xmlVCPU{Placement: "static", Value: vm.VCPUs},
+		OS:       xmlOS{Type: xmlOSType{Arch: "x86_64", Machine: "pc", Value: "hvm"}, Boot: xmlBoot{Dev: "hd"}},
+		Features: &xmlFeatures{},
+	}
+	doc.Devices.Disks = []xmlDisk{
+		{
+			Comment: fmt.Sprintf(" %d GiB copy-on-write overlay of %s ", DiskSize(vm), image),
+			Type:    "file", Device: "disk",
+			Driver: xmlDriver{Name: "qemu", Type: "qcow2"},
+			Source: xmlSource{File: filepath.Join(diskDir, domain+".qcow2")},
+			BackingStore: &xmlBackingStore{Type: "file", Format: xmlFormat{Type: "qcow2"},
+				Source: xmlSource{File: image}},
+			Target: xmlTarget{Dev: "vda", Bus: "virtio"},
+		},
+		{
+			Type: "file", Device: "cdrom",
+			Driver:   xmlDriver{Name: "qemu", Type: "raw"},
+			Source:   xmlSource{File: filepath.Join(opts.SeedDir, domain+"-seed.iso")},
+			Target:   xmlTarget{Dev: "sda", Bus: "sata"},
+			ReadOnly: &struct{}{},
+		},
+	}
+	for _, n := range VMNetworks(m, vm) {
+		doc.Devices.Interfaces = append(doc.Devices.Interfaces, xmlInterface{
+			Type: "network", Source: xmlIfaceSource{Network: n}, Model: xmlModel{Type: "virtio"}})
+	}
+	doc.Devices.Serial = &xmlChar{Type: "pty"}
+	doc.Devices.Console = &xmlChar{Type: "pty"}
+	doc.Devices.Channel = &xmlChannel{Type: "unix",
+		Target: xmlChannelTarget{Type: "virtio", Name: "org.qemu.guest_agent.0"}}
+	return marshalXML(doc)
+}
+
+// validateTypedNetwork checks the typed fields of spec.networks.<name>.
+func validateTypedNetwork(name string, n types.NetworkSpec) []string {
+	var errs []string
+	at := "spec.networks." + name
+	var subnet *subnet
+	if prefix, auto := AutoPrefix(n.CIDR); auto {
+		if prefix < minAutoPrefix || prefix > 30 {
+			errs = append(errs, fmt.Sprintf("%s.cidr: %q must ask for /%d to /30", at, n.CIDR, minAutoPrefix))
+		}
+		if d := n.DHCP; d != nil && (d.Start != "" || d.End != "") {
+			errs = append(errs, fmt.Sprintf("%s.dhcp: a range needs a fixed cidr; an auto subnet gets the default range", at))
+		}
+	} else if s, err := parseSubnet(n.CIDR); err != nil {
+		errs = append(errs, fmt.Sprintf("%s.cidr: %v", at, err))
+	} else {
+		subnet = s
+	}
+	if n.Mode != "" && !contains(networkModes, n.Mode) {
+		errs = append(errs, fmt.Sprintf("%s.mode: %q is not one of %s", at, n.Mode, strings.Join(networkModes, ", ")))
+	}
+	errs = append(errs, validateEgress(at, n)...)
+	if len(n.Bridge) > 15 {
+		errs = append(errs, fmt.Sprintf("%s.bridge: %q is longer than 15 characters", at, n.Bridge))
+	}
+	if d := n.DHCP; d != nil && (d.Start != "" || d.End != "") {
+		start, end := net.ParseIP(d.Start).To4(), net.ParseIP(d.End).To4()
+		switch {
+		case start == nil || end == nil:
+			errs = append(errs, fmt.Sprintf("%s.dhcp: start and end must both be IPv4 addresses", at))
+		case subnet != nil && !(subnet.usable(start) && subnet.usable(end)):
+			errs = append(errs, fmt.Sprintf("%s.dhcp: range %s-%s is outside %s", at, start, end, n.CIDR))
+		case ipUint(start) > ipUint(end):
+			errs = append(errs, fmt.Sprintf("%s.dhcp: start %s is after end %s", at, start, end))
+		}
+	}
+	return errs
+}
+
+// validateTypedVM checks the typed fields of spec.vms.<name>.
+func validateTypedVM(m *types.StackManifest, name string, vm types.VMSpec) []string {
+	var errs []string
+	at := "spec.vms." + name
+	if vm.Memory <= 0 {
+		errs = append(errs, fmt.Sprintf("%s.memory: must be a positive number of MiB", at))
+	}
+	if vm.VCPUs <= 0 {
+		errs = append(errs, fmt.Sprintf("%s.vcpus: must be a positive number", at))
+	}
+	if vm.Disk != nil && vm.Disk.Size < 0 {
+		errs = append(errs, fmt.Sprintf("%s.disk.size: must be a positive number of GiB", at))
+	}
+	seen := map[string]bool{}
+	for _, n := range vm.Networks {
+		if _, ok := m.Spec.Networks[n]; !ok {
+			errs = append(errs, fmt.Sprintf("%s.networks: %q is not defined in spec.networks", at, n))
+		} else if seen[n] {
+			errs = append(errs, fmt.Sprintf("%s.networks: %q is listed twice", at, n))
+		}
+		seen[n] = true
+	}
+	return errs
+}
+
+// domainRe matches a DNS name with at least two labels.
+var domainRe = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]{2,63}\.?$`)
+
+// validateEgress checks the egress policy of a typed network against its
+// mode; at is the network's path.
+func validateEgress(at string, n types.NetworkSpec) []string {
+	e := n.Egress
+	if e == nil {
+		return nil
+	}
+	var errs []string
+	switch {
+	case e.Policy == types.EgressNone && n.Mode != "" && n.Mode != "isolated":
+		errs = append(errs, fmt.Sprintf("%s.egress: none needs mode isolated, not %s", at, n.Mode))
+	case e.Policy == types.EgressNAT && n.Mode != "" && n.Mode != "nat":
+		errs = append(errs, fmt.Sprintf("%s.egress: nat needs mode nat, not %s", at, n.Mode))
+	case e.Policy == types.EgressAllow && n.Mode == "isolated":
+		errs = append(errs, fmt.Sprintf("%s.egress: an isolated network forwards nothing to allow", at))
+	}
+	for i, a := range e.Allow {
+		if _, _, err := net.ParseCIDR(a); err == nil && strings.Contains(a, ".") {
+			continue
+		}
+		if ip := net.ParseIP(a); ip.To4() != nil || domainRe.MatchString(a) {
+			continue
+		}
+		errs = append(errs, fmt.Sprintf("%s.egress.allow[%d]: %q is not an IPv4 address, CIDR or domain name", at, i, a))
+	}
+	return errs
+}
+
+var (
+	lossRe = regexp.MustCompile(`^(\d+(\.\d+)?)%$`)
+	rateRe = regexp.MustCompile(`^\d+(\.\d+)?([kmg]?bit|[kmg]?bps)$`)
+)
+
+// ValidateImpairment checks an impairment; at is its path, or the flag
+// prefix when it comes from the command line.
+func ValidateImpairment(at string, im types.ImpairmentSpec) []string {
+	var errs []string
+	if im == (types.ImpairmentSpec{}) {
+		return []string{fmt.Sprintf("%s: needs at least one of delay, loss and rate", at)}
+	}
+	for field, v := range map[string]string{"delay": im.Delay, "jitter": im.Jitter} {
+		if d, err := time.ParseDuration(v); v != "" && (err != nil || d < 0) {
+			errs = append(errs, fmt.Sprintf("%s.%s: %q is not a duration such as 200ms", at, field, v))
+		}
+	}
+	if im.Jitter != "" && im.Delay == "" {
+		errs = append(errs, fmt.Sprintf("%s.jitter: needs a delay to vary", at))
+	}
+	if m := lossRe.FindStringSubmatch(im.Loss); im.Loss != "" && m == nil {
+		errs = append(errs, fmt.Sprintf("%s.loss: %q is not a percentage such as 5%%", at, im.Loss))
+	} else if m != nil {
+		if p, _ := strconv.ParseFloat(m[1], 64); p > 100 {
+			errs = append(errs, fmt.Sprintf("%s.loss: %s is over 100%%", at, im.Loss))
+		}
+	}
+	if im.Rate != "" && !rateRe.MatchString(strings.ToLower(im.Rate)) {
+		errs = append(errs, fmt.Sprintf("%s.rate: %q is not a rate such as 1mbit", at, im.Rate))
+	}
+	sort.Strings(errs)
+	return errs
+}
+
+// validatePorts checks the ports of every VM, and that no two of them listen
+// on the same host address, port and protocol.
+func validatePorts(m *types.StackManifest) []string {
+	var errs []string
+	owner := map[string]string{}
+	for _, name := range sortedNames(m.Spec.VMs) {
+		for i, p := range m.Spec.VMs[name].Ports {
+			at := fmt.Sprintf("spec.vms.%s.ports[%d]", name, i)
+			if p.Host < 1 || p.Host > 65535 {
+				errs = append(errs, fmt.Sprintf("%s.host: %d is not a port", at, p.Host))
+			}
+			if p.Guest < 0 || p.Guest > 65535 {
+				errs = append(errs, fmt.Sprintf("%s.guest: %d is not a port", at, p.Guest))
+			}
+			if p.Proto != "" && p.Proto != "tcp" && p.Proto != "udp" {
+				errs = append(errs, fmt.Sprintf("%s.proto: %q is not tcp or udp", at, p.Proto))
+			}
+			if p.Bind != "" && net.ParseIP(p.Bind) == nil {
+				errs = append(errs, fmt.Sprintf("%s.bind: %q is not an IP address", at, p.Bind))
+			}
+			key := fmt.Sprintf("%s:%d/%s", orDefault(p.Bind, "127.0.0.1"), p.Host, orDefault(p.Proto, "tcp"))
+			if prev, ok := owner[key]; ok {
+				errs = append(errs, fmt.Sprintf("%s: %s is already forwarded by %s", at, key, prev))
+			}
+			owner[key] = at
+		}
+	}
+	return errs
+}
+
+func networkMode(n types.NetworkSpec) string {
+	if n.Mode == "" && n.Egress != nil && n.Egress.Policy == types.EgressNone {
+		return "isolated"
+	}
+	if n.Mode == "" {
+		return "nat"
+	}
+	return n.Mode
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// emptyElement matches a line holding an element with no content, which
+// encoding/xml writes as <x ...></x>.
+var emptyElement = regexp.MustCompile(`^(\s*)<([A-Za-z]+)([^<>]*)></([A-Za-z]+)>$`)
+
+// marshalXML indents doc the way libvirt prints XML, with empty elements
+// self-closed.
+func marshalXML(doc interface{}) (string, error) {
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(string(out), "\n")
+	for i, line := range lines {
+		if m := emptyElement.FindStringSubmatch(line); m != nil && m[2] == m[4] {
+			lines[i] = m[1] + "<" + m[2] + m[3] + "/>"
+		}
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// ── subnet arithmetic ─────────────────────────────────────────────────────────
+
+// Auto, as a network's cidr or bridge, asks nlab to allocate one when the
+// stack comes up.
+const Auto = "auto"
+
+// minAutoPrefix is the largest subnet a network can ask to be allocated.
+const minAutoPrefix = 16
+
+// AutoPrefix reports whether cidr asks for an allocated subnet, "auto" for a
+// /24 or "auto/<prefix>" for another size, and the prefix length asked for.
+// A malformed size yields 0.
+func AutoPrefix(cidr string) (int, bool) {
+	if cidr == Auto {
+		return 24, true
+	}
+	size, ok := strings.CutPrefix(cidr, Auto+"/")
+	if !ok {
+		return 0, false
+	}
+	prefix, err := strconv.Atoi(size)
+	if err != nil {
+		return 0, true
+	}
+	return prefix, true
+}
+
+// subnet is an IPv4 network with at least two usable host addresses.
+type subnet struct{ *net.IPNet }
+
+func parseSubnet(cidr string) (*subnet, error) {
+	if cidr == "" {
+		return nil, fmt.Errorf("is required")
+	}
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil || ip.To4() == nil {
+		return nil, fmt.Errorf("%q is not an IPv4 CIDR such as 10.10.10.0/24", cidr)
+	}
+	if ones, _ := ipnet.Mask.Size(); ones > 30 {
+		return nil, fmt.Errorf("%q is too small; use /30 or larger", cidr)
+	}
+	if !ip.Equal(ipnet.IP) {
+		return nil, fmt.Errorf("%q has host bits set; did you mean %s?", cidr, ipnet)
+	}
+	return &subnet{ipnet}, nil
+}
+
+func (s *subnet) size() uint32 {
+	ones, bits := s.Mask.Size()
+	return 1 << uint(bits-ones)
+}
+
+// host returns the address at offset i from the network address.
+func (s *subnet) host(i uint32) net.IP {
+	return uintIP(ipUint(s.IP) + i)
+}
+
+// usable reports whether ip is a host address of s other than the gateway.
+func (s *subnet) usable(ip net.IP) bool {
+	off := ipUint(ip) - ipUint(s.IP)
+	return s.Contains(ip) && off > 1 && off < s.size()-1
+}
+
+// defaultRange is .100-.200 in a /24 or larger, otherwise the upper half of
+// the host addresses.
+func (s *subnet) defaultRange() (net.IP, net.IP) {
+	if s.size() >= 256 {
+		return s.host(100), s.host(200)
+	}
+	return s.host(s.size() / 2), s.host(s.size() - 2)
+}
+
+func ipUint(ip net.IP) uint32 { return binary.BigEndian.Uint32(ip.To4()) }
+
+func uintIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// ── XML documents ─────────────────────────────────────────────────────────────
+
+type xmlNetwork struct {
+	XMLName xml.Name    `xml:"network"`
+	Name    string      `xml:"name"`
+	Bridge  *xmlBridge  `xml:"bridge"`
+	Forward *xmlForward `xml:"forward"`
+	IP      xmlIP       `xml:"ip"`
+}
+
+type xmlBridge struct {
+	Name  string `xml:"name,attr"`
+	STP   string `xml:"stp,attr"`
+	Delay string `xml:"delay,attr"`
+}
+
+type xmlForward struct {
+	Mode string `xml:"mode,attr"`
+}
+
+type xmlIP struct {
+	Address string   `xml:"address,attr"`
+	Netmask string   `xml:"netmask,attr"`
+	DHCP    *xmlDHCP `xml:"dhcp"`
+}
+
+type xmlDHCP struct {
+	Range xmlRange `xml:"range"`
+}
+
+type xmlRange struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+type xmlDomain struct {
+	XMLName  xml.Name     `xml:"domain"`
+	Type     string       `xml:"type,attr"`
+	Name     string       `xml:"name"`
+	Memory   xmlMemory    `xml:"memory"`
+	VCPU     xmlVCPU      `xml:"vcpu"`
+	OS       xmlOS        `xml:"os"`
+	Features *xmlFeatures `xml:"features"`
+	Devices  struct {
+		Disks      []xmlDisk      `xml:"disk"`
+		Interfaces []xmlInterface `xml:"interface"`
+		Serial     *xmlChar       `xml:"serial"`
+		Console    *xmlChar       `xml:"console"`
+		Channel    *xmlChannel    `xml:"channel"`
+	} `xml:"devices"`
+}
+
+type xmlMemory struct {
+	Unit  string `xml:"unit,attr"`
+	Value int    `xml:",chardata"`
+}
+
+type xmlVCPU struct {
+	Placement string `xml:"placement,attr"`
+	Value     int    `xml:",chardata"`
+}
+
+type xmlOS struct {
+	Type xmlOSType `xml:"type"`
+	Boot xmlBoot   `xml:"boot"`
+}
+
+type xmlOSType struct {
+	Arch    string `xml:"arch,attr"`
+	Machine string `xml:"machine,attr"`
+	Value   string `xml:",chardata"`
+}
+
+type xmlBoot struct {
+	Dev string `xml:"dev,attr"`
+}
+
+type xmlFeatures struct {
+	ACPI struct{} `xml:"acpi"`
+	APIC struct{} `xml:"apic"`
+}
+
+type xmlDisk struct {
+	Comment      string           `xml:",comment"`
+	Type         string           `xml:"type,attr"`
+	Device       string           `xml:"device,attr"`
+	Driver       xmlDriver        `xml:"driver"`
+	Source       xmlSource        `xml:"source"`
+	BackingStore *xmlBackingStore `xml:"backingStore"`
+	Target       xmlTarget        `xml:"target"`
+	ReadOnly     *struct{}        `xml:"readonly"`
+}
+
+type xmlDriver struct {
+	Name string `xml:"name,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type xmlSource struct {
+	File string `xml:"file,attr"`
+}
+
+type xmlBackingStore struct {
+	Type   string    `xml:"type,attr"`
+	Format xmlFormat `xml:"format"`
+	Source xmlSource `xml:"source"`
+}
+
+type xmlFormat struct {
+	Type string `xml:"type,attr"`
+}
+
+type xmlTarget struct {
+	Dev string `xml:"dev,attr"`
+	Bus string `xml:"bus,attr"`
+}
+
+type xmlInterface struct {
+	Type   string         `xml:"type,attr"`
+	Source xmlIfaceSource `xml:"source"`
+	Model  xmlModel       `xml:"model"`
+}
+
+type xmlIfaceSource struct {
+	Network string `xml:"network,attr"`
+}
+
+type xmlModel struct {
+	Type string `xml:"type,attr"`
+}
+
+type xmlChar struct {
+	Type string `xml:"type,attr"`
+}
+
+type xmlChannel struct {
+	Type   string           `xml:"type,attr"`
+	Target xmlChannelTarget `xml:"target"`
+}
+
+type xmlChannelTarget struct {
+	Type string `xml:"type,attr"`
+	Name string `xml:"name,attr"`
+}
@@ -0,0 +1,223 @@
+package manifest_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+const typedManifest = `
+apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: typed
+spec:
+  networks:
+    lan:
+      cidr: 10.20.1.0/28
+      mode: isolated
+      dhcp: {start: 10.20.1.5, end: 10.20.1.9}
+    wan:
+      cidr: 10.20.0.0/24
+      bridge: virbr-typed
+  vms:
+    attacker:
+      memory: 4096
+      vcpus: 2
+      disk: {size: 40}
+      networks: [wan, lan]
+    target:
+      memory: 2048
+      vcpus: 1
+      image: focal.img
+`
+
+var renderOpts = manifest.RenderOptions{
+	Stack:     "typed",
+	BaseImage: "/images/base.qcow2",
+	ImageDir:  "/cache",
+	SeedDir:   "/seeds",
+}
+
+func TestNetworkXMLTyped(t *testing.T) {
+	m, err := manifest.LoadBytes([]byte(typedManifest), "test")
+	if err != nil {
+		t.Fatalf("LoadBytes: %v", err)
+	}
+	wan, err := manifest.NetworkXML("wan", m.Spec.Networks["wan"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"<name>wan</name>",
+		`<bridge name="virbr-typed" stp="on" delay="0"/>`,
+		`<forward mode="nat"/>`,
+		`<ip address="10.20.0.1" netmask="255.255.255.0">`,
+		`<range start="10.20.0.100" end="10.20.0.200"/>`,
+	} {
+		if !strings.Contains(wan, want) {
+			t.Errorf("wan XML missing %s:\n%s", want, wan)
+		}
+	}
+	lan, err := manifest.NetworkXML("lan", m.Spec.Networks["lan"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(lan, "<forward") || strings.Contains(lan, "<bridge") {
+		t.Errorf("isolated network without bridge should have neither forward nor bridge:\n%s", lan)
+	}
+	if !strings.Contains(lan, `<range start="10.20.1.5" end="10.20.1.9"/>`) {
+		t.Errorf("lan XML should use the explicit DHCP range:\n%s", lan)
+	}
+}
+
+func TestNetworkXMLDHCPDisabledAndSmallSubnet(t *testing.T) {
+	off, err := manifest.NetworkXML("n", types.NetworkSpec{CIDR: "10.0.0.0/24", DHCP: &types.DHCPSpec{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(off, "<dhcp>") {
+		t.Errorf("dhcp: false should render no <dhcp>:\n%s", off)
+	}
+	small, err := manifest.NetworkXML("n", types.NetworkSpec{CIDR: "10.0.0.16/28"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(small, `<range start="10.0.0.24" end="10.0.0.30"/>`) {
+		t.Errorf("/28 should default to the upper half of its hosts:\n%s", small)
+	}
+}
+
+func TestAutoPrefix(t *testing.T) {
+	for cidr, want := range map[string]int{"auto": 24, "auto/26": 26, "auto/x": 0} {
+		if got, ok := manifest.AutoPrefix(cidr); !ok || got != want {
+			t.Errorf("AutoPrefix(%q) = %d, %v; want %d", cidr, got, ok, want)
+		}
+	}
+	if _, ok := manifest.AutoPrefix("10.0.0.0/24"); ok {
+		t.Error("a fixed cidr is not auto")
+	}
+	if _, err := manifest.NetworkXML("n", types.NetworkSpec{CIDR: "auto"}); err == nil || !strings.Contains(err.Error(), "not been allocated") {
+		t.Errorf("rendering an unallocated network: %v", err)
+	}
+}
+
+func TestNetworkXMLEgress(t *testing.T) {
+	none, err := manifest.NetworkXML("n", types.NetworkSpec{CIDR: "10.0.0.0/24", Egress: &types.EgressSpec{Policy: types.EgressNone}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(none, "<forward") {
+		t.Errorf("egress none should not forward:\n%s", none)
+	}
+	allow, err := manifest.NetworkXML("n", types.NetworkSpec{CIDR: "10.0.0.0/24",
+		Egress: &types.EgressSpec{Policy: types.EgressAllow, Allow: []string{"deb.debian.org"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(allow, `<forward mode="nat"`) {
+		t.Errorf("an allow-list is enforced on top of nat:\n%s", allow)
+	}
+}
+
+func TestValidateImpairment(t *testing.T) {
+	ok := types.ImpairmentSpec{Delay: "200ms", Jitter: "20ms", Loss: "0.5%", Rate: "1mbit"}
+	if errs := manifest.ValidateImpairment("i", ok); len(errs) > 0 {
+		t.Errorf("%+v: %v", ok, errs)
+	}
+	bad := types.ImpairmentSpec{Delay: "soon", Loss: "150%", Rate: "fast"}
+	got := strings.Join(manifest.ValidateImpairment("i", bad), "\n")
+	for _, want := range []string{"i.delay", "over 100%", "i.rate"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("errors lack %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestNetworkXMLRawPassthrough(t *testing.T) {
+	raw := "<network><name>n</name></network>"
+	got, err := manifest.NetworkXML("n", types.NetworkSpec{XML: "\n" + raw + "\n\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != raw+"\n" {
+		t.Errorf("raw XML = %q, want it unchanged", got)
+	}
+}
+
+func TestDomainXMLTyped(t *testing.T) {
+	m, err := manifest.LoadBytes([]byte(typedManifest), "test")
+	if err != nil {
+		t.Fatalf("LoadBytes: %v", err)
+	}
+	attacker, err := manifest.DomainXML(m, "attacker", renderOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"<name>typed-attacker</name>",
+		`<memory unit="MiB">4096</memory>`,
+		`<vcpu placement="static">2</vcpu>`,
+		"40 GiB copy-on-write overlay of /images/base.qcow2",
+		`<source file="/var/lib/libvirt/images/typed-attacker.qcow2"/>`,
+		`<source file="/seeds/typed-attacker-seed.iso"/>`,
+		"org.qemu.guest_agent.0",
+	} {
+		if !strings.Contains(attacker, want) {
+			t.Errorf("attacker XML missing %s:\n%s", want, attacker)
+		}
+	}
+	if w, l := strings.Index(attacker, `network="wan"`), strings.Index(attacker, `network="lan"`); w < 0 || l < 0 || w > l {
+		t.Errorf("interfaces should follow spec order wan, lan:\n%s", attacker)
+	}
+
+	target, err := manifest.DomainXML(m, "target", renderOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(target, `<source file="/cache/focal.img"/>`) {
+		t.Errorf("relative image should resolve in ImageDir:\n%s", target)
+	}
+	if !strings.Contains(target, `network="lan"`) || strings.Contains(target, `network="wan"`) {
+		t.Errorf("VM without networks should attach to the primary network only:\n%s", target)
+	}
+}
+
+func TestValidateTypedErrors(t *testing.T) {
+	tests := []struct {
+		name, network, vm, want string
+	}{
+		{"xml and typed", "cidr: 10.0.0.0/24\n      xml: <network/>", "memory: 1\n      vcpus: 1", "cannot be combined"},
+		{"bad cidr", "cidr: 10.0.0.1/24", "memory: 1\n      vcpus: 1", "host bits set"},
+		{"bad mode", "cidr: 10.0.0.0/24\n      mode: bridge", "memory: 1\n      vcpus: 1", "mode"},
+		{"dhcp outside", "cidr: 10.0.0.0/24\n      dhcp: {start: 10.0.1.5, end: 10.0.1.9}", "memory: 1\n      vcpus: 1", "outside"},
+		{"missing vcpus", "cidr: 10.0.0.0/24", "memory: 1", "vcpus"},
+		{"unknown network", "cidr: 10.0.0.0/24", "memory: 1\n      vcpus: 1\n      networks: [nope]", `"nope" is not defined`},
+		{"unknown dhcp key", "cidr: 10.0.0.0/24\n      dhcp: {first: 10.0.0.5}", "memory: 1\n      vcpus: 1", "first"},
+		{"auto too big", "cidr: auto/8", "memory: 1\n      vcpus: 1", "must ask for /16 to /30"},
+		{"auto with range", "cidr: auto\n      dhcp: {start: 10.0.0.5, end: 10.0.0.9}", "memory: 1\n      vcpus: 1", "needs a fixed cidr"},
+		{"bad egress", "cidr: 10.0.0.0/24\n      egress: open", "memory: 1\n      vcpus: 1", "egress must be none, nat or an allow list"},
+		{"egress none routed", "cidr: 10.0.0.0/24\n      mode: route\n      egress: none", "memory: 1\n      vcpus: 1", "none needs mode isolated"},
+		{"egress allow isolated", "cidr: 10.0.0.0/24\n      mode: isolated\n      egress: {allow: [10.1.0.0/16]}", "memory: 1\n      vcpus: 1", "forwards nothing"},
+		{"egress allow entry", "cidr: 10.0.0.0/24\n      egress: {allow: [not_a_host]}", "memory: 1\n      vcpus: 1", `"not_a_host" is not`},
+		{"empty impairment", "cidr: 10.0.0.0/24\n      impairment: {}", "memory: 1\n      vcpus: 1", "needs at least one of"},
+		{"bad loss", "xml: <network><name>net</name></network>\n      impairment: {loss: 5}", "memory: 1\n      vcpus: 1", "is not a percentage"},
+		{"jitter alone", "cidr: 10.0.0.0/24\n      impairment: {jitter: 10ms}", "memory: 1\n      vcpus: 1", "needs a delay"},
+		{"bad port", "cidr: 10.0.0.0/24", "memory: 1\n      vcpus: 1\n      ports: [{host: 70000, guest: 80}]", "70000 is not a port"},
+		{"bad proto", "cidr: 10.0.0.0/24", "memory: 1\n      vcpus: 1\n      ports: [{host: 8080, proto: sctp}]", "not tcp or udp"},
+		{"port twice", "cidr: 10.0.0.0/24", "memory: 1\n      vcpus: 1\n      ports: [{host: 8080, guest: 80}, {host: 8080, guest: 443}]", "already forwarded"},
+		{"egress unknown key", "cidr: 10.0.0.0/24\n      egress: {deny: [10.1.0.0/16]}", "memory: 1\n      vcpus: 1", "deny"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := "apiVersion: nlab.io/v1alpha1\nkind: Stack\nmetadata:\n  name: t\nspec:\n  networks:\n    net:\n      " +
+				tt.network + "\n  vms:\n    vm:\n      " + tt.vm + "\n"
+			_, err := manifest.LoadBytes([]byte(doc), "test")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+// SchemaURL is where the published JSON Schema of a Stack manifest lives.
+// Scaffolded stacks point the YAML language server at it.
+const SchemaURL = schemaBase + "stack.json"
+
+// schemaBase is where the published schemas live, one <kind>.json each.
+const schemaBase = "https://raw.githubusercontent.com/h3ow3d/nlab/main/schema/v1alpha1/"
+
+// SchemaHeader is the comment that makes editors validate and complete a
+// stack.yaml against the schema.
+const SchemaHeader = "# yaml-language-server: $schema=" + SchemaURL + "\n"
+
+// schemaKinds maps the kinds nlab publishes a schema for to their Go type.
+var schemaKinds = map[string]reflect.Type{
+	supportedKind: reflect.TypeOf(types.StackManifest{}),
+	networkKind:   reflect.TypeOf(types.NetworkManifest{}),
+	vmKind:        reflect.TypeOf(types.VMManifest{}),
+	componentKind: reflect.TypeOf(types.ComponentManifest{}),
+}
+
+// SchemaFile returns the file name a kind's schema is published as.
+func SchemaFile(kind string) string {
+	return strings.ToLower(kind) + ".json"
+}
+
+// SchemaKinds returns the kinds Schema accepts.
+func SchemaKinds() []string {
+	return sortedNames(schemaKinds)
+}
+
+// schemaHints adds what the Go types cannot say to the generated schema,
+// keyed "Type" or "Type.yamlField". Enums come from the validator's own
+// lists, so the schema accepts exactly what nlab validate does.
+var schemaHints = map[string]map[string]interface{}{
+	"StackManifest":              {"required": []string{"apiVersion", "kind", "metadata", "spec"}},
+	"StackManifest.apiVersion":   {"const": supportedAPIVersion},
+	"StackManifest.kind":         {"const": supportedKind},
+	"ObjectMeta":                 {"required": []string{"name"}},
+	"NetworkManifest":            {"required": []string{"apiVersion", "kind", "metadata", "spec"}},
+	"NetworkManifest.apiVersion": {"const": supportedAPIVersion},
+	"NetworkManifest.kind":       {"const": networkKind},
+	"NetworkManifest.metadata":   {"description": "The network name, and the stack it joins in labels[\"" + StackLabel + "\"]."},
+	"VMManifest":                 {"required": []string{"apiVersion", "kind", "metadata", "spec"}},
+	"VMManifest.apiVersion":      {"const": supportedAPIVersion},
+	"VMManifest.kind":            {"const": vmKind},
+	"VMManifest.metadata":        {"description": "The VM role, and the stack it joins in labels[\"" + StackLabel + "\"]."},
+	"ObjectMeta.name":            {"minLength": 1, "description": "The stack name, or the name of a standalone network or VM. libvirt objects are named <stack>-<vm>."},
+	"StackSpec.networks":         {"minProperties": 1, "description": "libvirt networks, keyed by network name."},
+	"StackSpec.vms":              {"minProperties": 1, "description": "VMs, keyed by role; domains are named <stack>-<role>."},
+	"StackSpec.parameters":       {"propertyNames": map[string]interface{}{"pattern": envNameRe.String()}},
+	"ParameterSpec.type":         {"enum": paramTypes},
+	"DefaultsSpec.memory":        {"minimum": 1},
+	"DefaultsSpec.vcpus":         {"minimum": 1},
+	"DefaultsSpec.sshUser":       {"pattern": sshUserRe.String()},
+	"NetworkSpec.xml":            xmlHint("network"),
+	"NetworkSpec.xmlFile":        {"description": "A libvirt <network> XML file, relative to the manifest."},
+	"NetworkSpec.cidr":           {"pattern": `^(auto(/\d{1,2})?|\d{1,3}(\.\d{1,3}){3}/\d{1,2})$`, "examples": []string{"10.10.10.0/24", "auto", "auto/26"}},
+	"NetworkSpec.mode":           {"enum": networkModes},
+	"NetworkSpec.bridge":         {"maxLength": maxBridgeLen},
+	"VMSpec.xml":                 xmlHint("domain"),
+	"VMSpec.xmlFile":             {"description": "A libvirt <domain> XML file, relative to the manifest."},
+	"VMSpec.memory":              {"minimum": 1},
+	"VMSpec.vcpus":               {"minimum": 1},
+	"VMSpec.sshUser":             {"pattern": sshUserRe.String()},
+	"DiskSpec.size":              {"minimum": 1},
+	"TmuxSpec.preset":            {"enum": sortedNames(tmuxPresets)},
+	"TmuxWindow":                 {"required": []string{"panes"}},
+	"TmuxWindow.layout":          {"enum": tmuxLayouts},
+	"TmuxWindow.panes":           {"minItems": 1},
+	"TmuxPane.type":              {"enum": []string{"ssh", "command", "shell"}},
+	"TmuxPane.env":               {"propertyNames": map[string]interface{}{"pattern": envNameRe.String()}},
+}
+
+func xmlHint(root string) map[string]interface{} {
+	return map[string]interface{}{
+		"contentMediaType": "application/xml",
+		"description":      fmt.Sprintf("Verbatim libvirt <%s> XML. ${params.<name>} references are substituted.", root),
+		"pattern":          `^\s*(<\?xml[^>]*>\s*)?(<!--[\s\S]*?-->\s*)*<` + root + `[\s>]`,
+	}
+}
+
+// Schema returns the JSON Schema (draft 2020-12) of a manifest kind,
+// generated from the Go types: field names from their yaml tags,
+// descriptions from their doc comments.
+func Schema(kind string) ([]byte, error) {
+	t, ok := schemaKinds[kind]
+	if !ok {
+		return nil, fmt.Errorf("no schema for kind %q (known: %s)", kind, strings.Join(SchemaKinds(), ", "))
+	}
+	docs, err := types.Docs()
+	if err != nil {
+		return nil, err
+	}
+	g := schemaGen{docs: docs, defs: map[string]interface{}{}}
+	root := g.object(t)
+	root["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	root["$id"] = schemaBase + SchemaFile(kind)
+	root["title"] = fmt.Sprintf("nlab %s %s", supportedAPIVersion, kind)
+	root["$defs"] = g.defs
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false) // descriptions mention XML elements
+	if err := enc.Encode(root); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type schemaGen struct {
+	docs map[string]string
+	defs map[string]interface{}
+}
+
+// object returns the schema of struct type t.
+func (g *schemaGen) object(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		s := g.schema(f.Type)
+		doc, ok := g.docs[t.Name()+"."+f.Name]
+		if !ok && t.Name() == "DefaultsSpec" {
+			doc = g.docs["VMSpec."+f.Name] // the field it is the default of
+		}
+		if doc != "" {
+			// Doc comments start with the Go name; the YAML name is what
+			// an editor shows.
+			s["description"] = name + strings.TrimPrefix(doc, f.Name)
+		}
+		for k, v := range schemaHints[t.Name()+"."+name] {
+			s[k] = v
+		}
+		props[name] = s
+	}
+	s := map[string]interface{}{"type": "object", "properties": props, "additionalProperties": false}
+	if doc := g.docs[t.Name()]; doc != "" {
+		s["description"] = doc
+	}
+	for k, v := range schemaHints[t.Name()] {
+		s[k] = v
+	}
+	return s
+}
+
+// schema returns the schema of a field of type t. Named structs are
+// defined once under $defs and referenced.
+func (g *schemaGen) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(types.DHCPSpec{}):
+		// Decoded by DHCPSpec.UnmarshalYAML.
+		return map[string]interface{}{"oneOf": []interface{}{
+			map[string]interface{}{"type": "boolean"},
+			map[string]interface{}{"type": "object", "additionalProperties": false,
+				"properties": map[string]interface{}{
+					"start": map[string]interface{}{"type": "string", "format": "ipv4"},
+					"end":   map[string]interface{}{"type": "string", "format": "ipv4"},
+				}},
+		}}
+	case reflect.TypeOf(types.EgressSpec{}):
+		// Decoded by EgressSpec.UnmarshalYAML.
+		return map[string]interface{}{"oneOf": []interface{}{
+			map[string]interface{}{"enum": []interface{}{types.EgressNone, types.EgressNAT}},
+			map[string]interface{}{"type": "object", "additionalProperties": false,
+				"properties": map[string]interface{}{
+					"allow": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				}},
+		}}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		elem := g.schema(t.Elem())
+		if _, ok := elem["$ref"]; ok {
+			// An entry inherited through spec.extends or spec.components can
+			// be removed.
+			elem = map[string]interface{}{"anyOf": []interface{}{elem, map[string]interface{}{"const": deleteMarker}}}
+		}
+		return map[string]interface{}{"type": "object", "additionalProperties": elem}
+	case reflect.Struct:
+		if _, ok := g.defs[t.Name()]; !ok {
+			g.defs[t.Name()] = nil // recursion guard
+			g.defs[t.Name()] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	}
+	return map[string]interface{}{} // interface{}: any value
+}
@@ -0,0 +1,275 @@
+package manifest_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+)
+
+func stackSchema(t *testing.T) map[string]interface{} {
+	t.Helper()
+	data, err := manifest.Schema("Stack")
+	if err != nil {
+		t.Fatalf("Schema: %v", err)
+	}
+	var s map[string]interface{}
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatalf("schema is not JSON: %v", err)
+	}
+	return s
+}
+
+func TestPublishedSchemaIsCurrent(t *testing.T) {
+	for _, kind := range manifest.SchemaKinds() {
+		want, _ := manifest.Schema(kind)
+		got, err := os.ReadFile(filepath.Join("..", "..", "schema", "v1alpha1", manifest.SchemaFile(kind)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("schema/v1alpha1/%s is out of date; run make schema", manifest.SchemaFile(kind))
+		}
+	}
+}
+
+func TestVMSchema(t *testing.T) {
+	data, err := manifest.Schema("VM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s map[string]interface{}
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatal(err)
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal([]byte(vmDoc), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if errs := checkSchema(s, s, doc, ""); len(errs) > 0 {
+		t.Errorf("a kind: VM document should validate: %v", errs)
+	}
+	if !strings.HasSuffix(s["$id"].(string), "/vm.json") {
+		t.Errorf("$id = %v", s["$id"])
+	}
+}
+
+func TestSchemaUnknownKind(t *testing.T) {
+	if _, err := manifest.Schema("Cluster"); err == nil || !strings.Contains(err.Error(), "Stack") {
+		t.Errorf("expected an error listing the known kinds, got %v", err)
+	}
+}
+
+func TestSchemaContent(t *testing.T) {
+	s := stackSchema(t)
+	net := s["$defs"].(map[string]interface{})["NetworkSpec"].(map[string]interface{})["properties"].(map[string]interface{})
+	mode := net["mode"].(map[string]interface{})
+	if fmt.Sprint(mode["enum"]) != "[nat route open isolated]" {
+		t.Errorf("mode enum = %v", mode["enum"])
+	}
+	if d, _ := mode["description"].(string); !strings.HasPrefix(d, "mode is nat (the default)") {
+		t.Errorf("mode description should come from the doc comment, got %q", d)
+	}
+	if net["xml"].(map[string]interface{})["contentMediaType"] != "application/xml" {
+		t.Errorf("xml should be marked as embedded XML: %v", net["xml"])
+	}
+	if fmt.Sprint(s["required"]) != "[apiVersion kind metadata spec]" {
+		t.Errorf("required = %v", s["required"])
+	}
+}
+
+// TestStacksMatchSchema keeps the schema and the shipped stacks in step:
+// everything nlab accepts under stacks/ must validate.
+func TestStacksMatchSchema(t *testing.T) {
+	s := stackSchema(t)
+	files, _ := filepath.Glob(filepath.Join("..", "..", "stacks", "*", "stack.yaml"))
+	if len(files) == 0 {
+		t.Fatal("no stacks found")
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, []byte(manifest.SchemaHeader)) {
+			t.Errorf("%s: missing the schema modeline", f)
+		}
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			t.Fatalf("%s: %v", f, err)
+		}
+		for _, e := range checkSchema(s, s, doc, "") {
+			t.Errorf("%s: %s", f, e)
+		}
+	}
+}
+
+func TestSchemaRejects(t *testing.T) {
+	s := stackSchema(t)
+	for _, tc := range []struct{ name, yaml, want string }{
+		{"unknown field", "spec:\n  networks:\n    n: {cidr: 10.0.0.0/24, colour: red}\n", "/spec/networks/n: unknown property colour"},
+		{"enum", "spec:\n  networks:\n    n: {mode: bridge}\n", "/spec/networks/n/mode: bridge is not one of"},
+		{"dhcp", "spec:\n  networks:\n    n: {dhcp: maybe}\n", "/spec/networks/n/dhcp: matches no alternative"},
+		{"xml root", "spec:\n  vms:\n    v: {xml: '<network/>'}\n", "/spec/vms/v/xml: does not match"},
+		{"required", "kind: Stack\n", "missing required property apiVersion"},
+	} {
+		var doc interface{}
+		if err := yaml.Unmarshal([]byte(tc.yaml), &doc); err != nil {
+			t.Fatal(err)
+		}
+		errs := strings.Join(checkSchema(s, s, doc, ""), "\n")
+		if !strings.Contains(errs, tc.want) {
+			t.Errorf("%s: want %q in:\n%s", tc.name, tc.want, errs)
+		}
+	}
+}
+
+// checkSchema validates v against the subset of JSON Schema that
+// manifest.Schema emits.
+func checkSchema(root, s map[string]interface{}, v interface{}, at string) []string {
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf("%s: %s", orRoot(at), fmt.Sprintf(format, args...)))
+	}
+	if ref, ok := s["$ref"].(string); ok {
+		def := root["$defs"].(map[string]interface{})[strings.TrimPrefix(ref, "#/$defs/")]
+		errs = append(errs, checkSchema(root, def.(map[string]interface{}), v, at)...)
+	}
+	if alts, ok := s["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, alt := range alts {
+			if len(checkSchema(root, alt.(map[string]interface{}), v, at)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("matches no alternative")
+		}
+	}
+	if alts, ok := s["anyOf"].([]interface{}); ok {
+		var first []string
+		for i, alt := range alts {
+			errs := checkSchema(root, alt.(map[string]interface{}), v, at)
+			if len(errs) == 0 {
+				first = nil
+				break
+			}
+			if i == 0 {
+				first = errs
+			}
+		}
+		errs = append(errs, first...) // the errors of the main alternative
+	}
+	if c, ok := s["const"]; ok && v != c {
+		fail("%v is not %v", v, c)
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == v
+		}
+		if !found {
+			fail("%v is not one of %v", v, enum)
+		}
+	}
+	switch s["type"] {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			fail("expected an object")
+			break
+		}
+		props, _ := s["properties"].(map[string]interface{})
+		for _, r := range asList(s["required"]) {
+			if _, ok := obj[r.(string)]; !ok {
+				fail("missing required property %s", r)
+			}
+		}
+		if n, ok := s["minProperties"].(float64); ok && len(obj) < int(n) {
+			fail("needs at least %v properties", n)
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if pn, ok := s["propertyNames"].(map[string]interface{}); ok {
+				errs = append(errs, checkSchema(root, pn, k, at+"/"+k)...)
+			}
+			switch extra := s["additionalProperties"].(type) {
+			case map[string]interface{}:
+				errs = append(errs, checkSchema(root, extra, obj[k], at+"/"+k)...)
+				continue
+			}
+			p, ok := props[k]
+			if !ok {
+				fail("unknown property %s", k)
+				continue
+			}
+			errs = append(errs, checkSchema(root, p.(map[string]interface{}), obj[k], at+"/"+k)...)
+		}
+	case "array":
+		list, ok := v.([]interface{})
+		if !ok {
+			fail("expected an array")
+			break
+		}
+		if n, ok := s["minItems"].(float64); ok && len(list) < int(n) {
+			fail("needs at least %v items", n)
+		}
+		for i, item := range list {
+			errs = append(errs, checkSchema(root, s["items"].(map[string]interface{}), item, fmt.Sprintf("%s/%d", at, i))...)
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			fail("expected a string, got %v", v)
+			break
+		}
+		if p, ok := s["pattern"].(string); ok && !regexp.MustCompile(p).MatchString(str) {
+			fail("does not match %s", p)
+		}
+		if n, ok := s["minLength"].(float64); ok && len(str) < int(n) {
+			fail("shorter than %v", n)
+		}
+		if n, ok := s["maxLength"].(float64); ok && len(str) > int(n) {
+			fail("longer than %v", n)
+		}
+	case "integer":
+		n, ok := v.(int)
+		if !ok {
+			fail("expected an integer, got %v", v)
+			break
+		}
+		if min, ok := s["minimum"].(float64); ok && float64(n) < min {
+			fail("less than %v", min)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			fail("expected a boolean, got %v", v)
+		}
+	}
+	return errs
+}
+
+func asList(v interface{}) []interface{} {
+	l, _ := v.([]interface{})
+	return l
+}
+
+func orRoot(at string) string {
+	if at == "" {
+		return "/"
+	}
+	return at
+}
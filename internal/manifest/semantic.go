@@ -0,0 +1,431 @@
+package manifest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+// maxBridgeLen is the longest Linux interface name (IFNAMSIZ - 1).
+const maxBridgeLen = 15
+
+// minMemoryMiB is the memory below which a VM is unlikely to boot a cloud
+// image.
+const minMemoryMiB = 256
+
+// memoryUnits maps the libvirt memory units to their size in KiB.
+var memoryUnits = map[string]float64{
+	"": 1, "k": 1, "kib": 1, "kb": 1000.0 / 1024,
+	"m": 1024, "mib": 1024, "mb": 1e6 / 1024,
+	"g": 1 << 20, "gib": 1 << 20, "gb": 1e9 / 1024,
+	"t": 1 << 30, "tib": 1 << 30, "tb": 1e12 / 1024,
+	"b": 1.0 / 1024, "bytes": 1.0 / 1024,
+}
+
+// domainDoc is the part of a libvirt domain the semantic checks read.
+type domainDoc struct {
+	Name   string `xml:"name"`
+	Memory *struct {
+		Unit  string `xml:"unit,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"memory"`
+	VCPU  *string `xml:"vcpu"`
+	Disks []struct {
+		Device string `xml:"device,attr"`
+		Source struct {
+			File string `xml:"file,attr"`
+		} `xml:"source"`
+	} `xml:"devices>disk"`
+	Interfaces []struct {
+		Type string `xml:"type,attr"`
+		MAC  struct {
+			Address string `xml:"address,attr"`
+		} `xml:"mac"`
+		Source struct {
+			Network string `xml:"network,attr"`
+			Bridge  string `xml:"bridge,attr"`
+		} `xml:"source"`
+	} `xml:"devices>interface"`
+}
+
+// networkDoc is the part of a libvirt network the semantic checks read.
+type networkDoc struct {
+	Name   string `xml:"name"`
+	Bridge struct {
+		Name string `xml:"name,attr"`
+	} `xml:"bridge"`
+	IPs []struct {
+		Family  string `xml:"family,attr"`
+		Address string `xml:"address,attr"`
+		Netmask string `xml:"netmask,attr"`
+		Prefix  string `xml:"prefix,attr"`
+		Ranges  []struct {
+			Start string `xml:"start,attr"`
+			End   string `xml:"end,attr"`
+		} `xml:"dhcp>range"`
+		Hosts []struct {
+			MAC string `xml:"mac,attr"`
+			IP  string `xml:"ip,attr"`
+		} `xml:"dhcp>host"`
+	} `xml:"ip"`
+}
+
+// HostNetwork is an IPv4 network of a stack, as the host sees it.
+type HostNetwork struct {
+	Stack   string
+	Name    string
+	Bridge  string // empty when libvirt picks one
+	Subnet  *net.IPNet
+	Gateway net.IP
+}
+
+// Route is one entry of the host routing table.
+type Route struct {
+	Dest *net.IPNet
+	Dev  string
+}
+
+// Host is what else lives on the host: other stacks' networks and the
+// routing table. CheckHost compares a manifest against it.
+type Host struct {
+	Networks []HostNetwork
+	Routes   []Route
+}
+
+// HostNetworks returns the IPv4 networks of a manifest, sorted by name.
+// Networks whose XML cannot be rendered or parsed are skipped, as are those
+// still waiting for an auto subnet; an auto bridge is left empty.
+func HostNetworks(m *types.StackManifest) []HostNetwork {
+	var out []HostNetwork
+	for _, name := range sortedNames(m.Spec.Networks) {
+		n := m.Spec.Networks[name]
+		if n.Bridge == Auto {
+			n.Bridge = ""
+		}
+		doc, ok := parseNetwork(name, n)
+		if !ok {
+			continue
+		}
+		for _, ip := range doc.IPs {
+			if subnet, gw := ipSubnet(ip.Address, ip.Netmask, ip.Prefix); subnet != nil {
+				out = append(out, HostNetwork{Stack: m.Metadata.Name, Name: name,
+					Bridge: doc.Bridge.Name, Subnet: subnet, Gateway: gw})
+			}
+		}
+	}
+	return out
+}
+
+// CheckHost reports the manifest's networks that would clash with other
+// stacks or the host's routes. Everything it finds is a warning: the other
+// stack may never run at the same time.
+func CheckHost(m *types.StackManifest, source string, host Host) []Issue {
+	var issues []Issue
+	warn := func(format string, args ...interface{}) {
+		issues = append(issues, Issue{File: source, Severity: SeverityWarning, Message: fmt.Sprintf(format, args...)})
+	}
+	own := HostNetworks(m)
+	bridges := map[string]bool{}
+	for _, n := range own {
+		if n.Bridge != "" {
+			bridges[n.Bridge] = true
+		}
+	}
+	for _, n := range own {
+		at := "spec.networks." + n.Name
+		for _, o := range host.Networks {
+			if o.Stack == m.Metadata.Name {
+				continue
+			}
+			if overlaps(n.Subnet, o.Subnet) {
+				warn("%s: %s overlaps %s of stack %q (spec.networks.%s)", at, n.Subnet, o.Subnet, o.Stack, o.Name)
+			}
+			if n.Bridge != "" && n.Bridge == o.Bridge {
+				warn("%s: bridge %s is also used by stack %q", at, n.Bridge, o.Stack)
+			}
+		}
+		for _, r := range host.Routes {
+			if bridges[r.Dev] || r.Dest == nil {
+				continue
+			}
+			if ones, _ := r.Dest.Mask.Size(); ones == 0 {
+				continue // default route
+			}
+			if overlaps(n.Subnet, r.Dest) {
+				warn("%s: %s overlaps the host route to %s via %s", at, n.Subnet, r.Dest, r.Dev)
+			}
+		}
+	}
+	return issues
+}
+
+// validateSemantics cross-checks the networks and raw VM XML of m: names,
+// references, addresses and storage paths. Values that still hold a
+// ${params.<name>} reference are not checked.
+func validateSemantics(m *types.StackManifest, source string) []Issue {
+	var issues []Issue
+	file := source
+	add := func(sev Severity, format string, args ...interface{}) {
+		issues = append(issues, Issue{File: file, Severity: sev, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// Networks.
+	type netInfo struct {
+		name   string
+		nets   []HostNetwork
+		ranges [][2]net.IP
+	}
+	var infos []netInfo
+	bridges := map[string]string{}
+	ips := map[string]string{}
+	macs := map[string]string{}
+	for _, name := range sortedNames(m.Spec.Networks) {
+		n := m.Spec.Networks[name]
+		at := "spec.networks." + name
+		file = orSource(n.XMLFile, source)
+		doc, ok := parseNetwork(name, n)
+		if !ok {
+			continue
+		}
+		if !n.Typed() && !hasParamRef(doc.Name) && strings.TrimSpace(doc.Name) != name {
+			add(SeverityError, "%s: <name> is %q but nlab starts the network as %q; they must match", at, strings.TrimSpace(doc.Name), name)
+		}
+		if b := doc.Bridge.Name; b != "" && !hasParamRef(b) {
+			if len(b) > maxBridgeLen {
+				add(SeverityError, "%s: bridge name %q is longer than %d characters", at, b, maxBridgeLen)
+			}
+			if other, dup := bridges[b]; dup {
+				add(SeverityError, "%s: bridge %q is also used by spec.networks.%s", at, b, other)
+			}
+			bridges[b] = name
+		}
+		info := netInfo{name: name}
+		for _, ip := range doc.IPs {
+			if ip.Family != "" && ip.Family != "ipv4" {
+				continue
+			}
+			subnet, gw := ipSubnet(ip.Address, ip.Netmask, ip.Prefix)
+			if subnet == nil {
+				if !hasParamRef(ip.Address) {
+					add(SeverityError, "%s: <ip address=%q> is not a valid IPv4 address with netmask or prefix", at, ip.Address)
+				}
+				continue
+			}
+			info.nets = append(info.nets, HostNetwork{Name: name, Subnet: subnet, Gateway: gw})
+			for _, r := range ip.Ranges {
+				start, end := net.ParseIP(r.Start), net.ParseIP(r.End)
+				switch {
+				case start.To4() == nil || end.To4() == nil:
+					add(SeverityError, "%s: DHCP range %s-%s is not a pair of IPv4 addresses", at, r.Start, r.End)
+				case !subnet.Contains(start) || !subnet.Contains(end):
+					add(SeverityError, "%s: DHCP range %s-%s is outside %s", at, r.Start, r.End, subnet)
+				case ipUint(start) > ipUint(end):
+					add(SeverityError, "%s: DHCP range %s-%s ends before it starts", at, r.Start, r.End)
+				default:
+					if ipUint(start) <= ipUint(gw) && ipUint(gw) <= ipUint(end) {
+						add(SeverityError, "%s: DHCP range %s-%s includes the host address %s", at, r.Start, r.End, gw)
+					}
+					for _, o := range info.ranges {
+						if ipUint(start) <= ipUint(o[1]) && ipUint(o[0]) <= ipUint(end) {
+							add(SeverityError, "%s: DHCP ranges %s-%s and %s-%s overlap", at, r.Start, r.End, o[0], o[1])
+						}
+					}
+					info.ranges = append(info.ranges, [2]net.IP{start, end})
+				}
+			}
+			for _, h := range ip.Hosts {
+				if h.IP != "" {
+					if hip := net.ParseIP(h.IP); hip == nil || !subnet.Contains(hip) {
+						add(SeverityError, "%s: DHCP host address %s is outside %s", at, h.IP, subnet)
+					} else if other, dup := ips[hip.String()]; dup {
+						add(SeverityError, "%s: address %s is also assigned in %s", at, h.IP, other)
+					} else {
+						ips[hip.String()] = at
+					}
+				}
+				if h.MAC != "" {
+					mac := strings.ToLower(h.MAC)
+					if other, dup := macs[mac]; dup && other != at {
+						add(SeverityError, "%s: MAC %s is also used in %s", at, h.MAC, other)
+					}
+					macs[mac] = at
+				}
+			}
+		}
+		infos = append(infos, info)
+	}
+	file = source
+	for i, a := range infos {
+		for _, b := range infos[i+1:] {
+			for _, an := range a.nets {
+				for _, bn := range b.nets {
+					if overlaps(an.Subnet, bn.Subnet) {
+						add(SeverityError, "spec.networks.%s: %s overlaps %s of spec.networks.%s", a.name, an.Subnet, bn.Subnet, b.name)
+					}
+				}
+			}
+		}
+	}
+
+	// Raw VMs.
+	storage := []string{DefaultDiskDir}
+	if s := m.Spec.Storage; s != nil && s.DiskDir != "" {
+		storage = append(storage, s.DiskDir)
+	}
+	domainMACs := map[string]string{}
+	for _, name := range sortedNames(m.Spec.VMs) {
+		vm := m.Spec.VMs[name]
+		if vm.Typed() || strings.TrimSpace(vm.XML) == "" {
+			continue
+		}
+		at := "spec.vms." + name
+		file = orSource(vm.XMLFile, source)
+		var d domainDoc
+		if err := xml.Unmarshal([]byte(vm.XML), &d); err != nil {
+			continue // reported as malformed
+		}
+		if want := m.Metadata.Name + "-" + name; !hasParamRef(d.Name) && strings.TrimSpace(d.Name) != want {
+			add(SeverityWarning, "%s: <name> is %q; nlab names the domain %q", at, strings.TrimSpace(d.Name), want)
+		}
+		switch {
+		case d.Memory == nil:
+			add(SeverityError, "%s: <memory> is missing", at)
+		case hasParamRef(d.Memory.Value):
+		default:
+			unit, ok := memoryUnits[strings.ToLower(d.Memory.Unit)]
+			value, err := strconv.ParseFloat(strings.TrimSpace(d.Memory.Value), 64)
+			switch {
+			case !ok:
+				add(SeverityError, "%s: <memory unit=%q> is not a libvirt memory unit (KiB, MiB, GiB, …)", at, d.Memory.Unit)
+			case err != nil || value <= 0:
+				add(SeverityError, "%s: <memory> %q is not a positive number", at, d.Memory.Value)
+			case value*unit/1024 < minMemoryMiB:
+				add(SeverityWarning, "%s: <memory> is %.0f MiB; cloud images need at least %d MiB (unit is %s)",
+					at, value*unit/1024, minMemoryMiB, orDefault(d.Memory.Unit, "KiB"))
+			}
+		}
+		if d.VCPU == nil {
+			// libvirt defaults to one vCPU.
+		} else if v, err := strconv.Atoi(strings.TrimSpace(*d.VCPU)); !hasParamRef(*d.VCPU) && (err != nil || v <= 0) {
+			add(SeverityError, "%s: <vcpu> %q is not a positive number", at, strings.TrimSpace(*d.VCPU))
+		}
+		attached := map[string]bool{}
+		for _, iface := range d.Interfaces {
+			switch iface.Type {
+			case "network":
+				n := iface.Source.Network
+				switch {
+				case n == "":
+					add(SeverityError, "%s: <interface type=\"network\"> has no <source network=...>", at)
+				case hasParamRef(n):
+				case !networkDefined(m, n):
+					add(SeverityError, "%s: <source network=%q> is not defined in spec.networks", at, n)
+				case attached[n]:
+					add(SeverityWarning, "%s: attached to %q more than once", at, n)
+				}
+				attached[n] = true
+			case "bridge":
+				if b := iface.Source.Bridge; b != "" && bridges[b] == "" && !hasParamRef(b) {
+					add(SeverityWarning, "%s: <source bridge=%q> is not a bridge of this stack", at, b)
+				}
+			}
+			if mac := strings.ToLower(iface.MAC.Address); mac != "" && !hasParamRef(mac) {
+				if _, err := net.ParseMAC(mac); err != nil {
+					add(SeverityError, "%s: MAC %s is not a valid MAC address", at, iface.MAC.Address)
+				} else if other, dup := domainMACs[mac]; dup {
+					add(SeverityError, "%s: MAC %s is also used by %s", at, iface.MAC.Address, other)
+				} else {
+					domainMACs[mac] = at
+				}
+			}
+		}
+		for _, disk := range d.Disks {
+			f := disk.Source.File
+			if f == "" || disk.Device == "cdrom" || hasParamRef(f) {
+				continue
+			}
+			if !underAny(f, storage) {
+				add(SeverityWarning, "%s: disk %s is outside nlab storage (%s)", at, f, strings.Join(storage, ", "))
+			}
+		}
+	}
+	return issues
+}
+
+// parseNetwork parses the raw or rendered XML of a network.
+func parseNetwork(name string, n types.NetworkSpec) (*networkDoc, bool) {
+	x, err := NetworkXML(name, n)
+	if err != nil || strings.TrimSpace(x) == "" {
+		return nil, false
+	}
+	var doc networkDoc
+	if err := xml.Unmarshal([]byte(x), &doc); err != nil {
+		return nil, false
+	}
+	return &doc, true
+}
+
+func networkDefined(m *types.StackManifest, name string) bool {
+	_, ok := m.Spec.Networks[name]
+	return ok
+}
+
+// ipSubnet returns the subnet and host address of an <ip> element.
+func ipSubnet(address, netmask, prefix string) (*net.IPNet, net.IP) {
+	ip := net.ParseIP(address).To4()
+	if ip == nil {
+		return nil, nil
+	}
+	var mask net.IPMask
+	switch {
+	case netmask != "":
+		m := net.ParseIP(netmask).To4()
+		if m == nil {
+			return nil, nil
+		}
+		mask = net.IPMask(m)
+		if ones, bits := mask.Size(); ones == 0 && bits == 0 {
+			return nil, nil
+		}
+	case prefix != "":
+		p, err := strconv.Atoi(prefix)
+		if err != nil || p < 0 || p > 32 {
+			return nil, nil
+		}
+		mask = net.CIDRMask(p, 32)
+	default:
+		mask = ip.DefaultMask()
+	}
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, ip
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func hasParamRef(s string) bool {
+	return paramRefRe.MatchString(s)
+}
+
+// underAny reports whether path is inside one of dirs.
+func underAny(path string, dirs []string) bool {
+	path = filepath.Clean(path)
+	for _, d := range dirs {
+		if rel, err := filepath.Rel(filepath.Clean(d), path); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return true
+		}
+	}
+	return false
+}
+
+func orDefault(s, def string) string {
+	if s != "" {
+		return s
+	}
+	return def
+}
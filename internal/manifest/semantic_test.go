@@ -0,0 +1,200 @@
+package manifest_test
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+)
+
+// semanticManifest wraps networks and vms YAML (indented for spec) in a stack
+// named lab.
+func semanticManifest(networks, vms string) []byte {
+	return []byte("apiVersion: nlab.io/v1alpha1\nkind: Stack\nmetadata:\n  name: lab\nspec:\n  networks:\n" +
+		networks + "  vms:\n" + vms)
+}
+
+const semanticNet = `    lan:
+      xml: |
+        <network>
+          <name>lan</name>
+          <bridge name="virbr-lab"/>
+          <ip address="10.1.0.1" netmask="255.255.255.0">
+            <dhcp>
+              <range start="10.1.0.100" end="10.1.0.200"/>
+              <host mac="52:54:00:00:00:01" ip="10.1.0.10"/>
+            </dhcp>
+          </ip>
+        </network>
+`
+
+const semanticVM = `    box:
+      xml: |
+        <domain type="kvm">
+          <name>lab-box</name>
+          <memory unit="GiB">2</memory>
+          <vcpu>2</vcpu>
+          <devices>
+            <disk type="file" device="disk"><source file="/var/lib/libvirt/images/lab-box.qcow2"/></disk>
+            <interface type="network"><mac address="52:54:00:00:00:01"/><source network="lan"/></interface>
+          </devices>
+        </domain>
+`
+
+func TestCheckBytesClean(t *testing.T) {
+	_, warnings, err := manifest.CheckBytes(semanticManifest(semanticNet, semanticVM), "test")
+	if err != nil {
+		t.Fatalf("CheckBytes: %v", err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+}
+
+func TestSemanticErrors(t *testing.T) {
+	cases := []struct {
+		name, networks, vms, want string
+	}{
+		{"network name", strings.Replace(semanticNet, "<name>lan</name>", "<name>wan</name>", 1), semanticVM,
+			`spec.networks.lan: <name> is "wan"`},
+		{"undefined network", semanticNet, strings.Replace(semanticVM, `network="lan"`, `network="dmz"`, 1),
+			`<source network="dmz"> is not defined`},
+		{"missing memory", semanticNet, strings.Replace(semanticVM, `<memory unit="GiB">2</memory>`, "", 1),
+			"<memory> is missing"},
+		{"memory unit", semanticNet, strings.Replace(semanticVM, `unit="GiB"`, `unit="gigs"`, 1),
+			`<memory unit="gigs"> is not a libvirt memory unit`},
+		{"vcpu", semanticNet, strings.Replace(semanticVM, "<vcpu>2</vcpu>", "<vcpu>two</vcpu>", 1),
+			`<vcpu> "two" is not a positive number`},
+		{"long bridge", strings.Replace(semanticNet, "virbr-lab", "virbr-much-too-long", 1), semanticVM,
+			"longer than 15 characters"},
+		{"shared bridge", semanticNet + strings.NewReplacer("lan", "wan", "10.1.", "10.2.", ":01", ":02").Replace(semanticNet), semanticVM,
+			`bridge "virbr-lab" is also used by spec.networks.lan`},
+		{"subnet overlap", semanticNet + `    wan:
+      cidr: 10.1.0.0/16
+`, semanticVM, "10.1.0.0/24 overlaps 10.1.0.0/16 of spec.networks.wan"},
+		{"range outside", strings.Replace(semanticNet, `end="10.1.0.200"`, `end="10.1.1.200"`, 1), semanticVM,
+			"DHCP range 10.1.0.100-10.1.1.200 is outside 10.1.0.0/24"},
+		{"range gateway", strings.Replace(semanticNet, `start="10.1.0.100"`, `start="10.1.0.1"`, 1), semanticVM,
+			"includes the host address 10.1.0.1"},
+		{"ranges overlap", strings.Replace(semanticNet, `<range start="10.1.0.100" end="10.1.0.200"/>`,
+			`<range start="10.1.0.100" end="10.1.0.200"/><range start="10.1.0.150" end="10.1.0.250"/>`, 1), semanticVM,
+			"DHCP ranges 10.1.0.150-10.1.0.250 and 10.1.0.100-10.1.0.200 overlap"},
+		{"duplicate ip", strings.Replace(semanticNet, `<host mac="52:54:00:00:00:01" ip="10.1.0.10"/>`,
+			`<host mac="52:54:00:00:00:01" ip="10.1.0.10"/><host mac="52:54:00:00:00:02" ip="10.1.0.10"/>`, 1), semanticVM,
+			"address 10.1.0.10 is also assigned"},
+		{"duplicate mac", semanticNet, semanticVM + strings.Replace(semanticVM, "box", "other", -1),
+			"spec.vms.other: MAC 52:54:00:00:00:01 is also used by spec.vms.box"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := manifest.CheckBytes(semanticManifest(tc.networks, tc.vms), "test")
+			var verr *manifest.ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected a ValidationError, got %v", err)
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("error should contain %q, got: %v", tc.want, err)
+			}
+			for _, is := range verr.Issues {
+				if is.Severity != manifest.SeverityError {
+					t.Errorf("issue %q has severity %q", is.Message, is.Severity)
+				}
+			}
+		})
+	}
+}
+
+func TestSemanticWarnings(t *testing.T) {
+	vm := strings.NewReplacer(
+		"<name>lab-box</name>", "<name>box</name>",
+		`<memory unit="GiB">2</memory>`, `<memory unit="MiB">128</memory>`,
+		"/var/lib/libvirt/images/", "/home/me/",
+		`</devices>`, `<interface type="bridge"><source bridge="br0"/></interface></devices>`,
+	).Replace(semanticVM)
+	m, warnings, err := manifest.CheckBytes(semanticManifest(semanticNet, vm), "test")
+	if err != nil || m == nil {
+		t.Fatalf("warnings must not fail the load: %v", err)
+	}
+	want := []string{
+		`<name> is "box"; nlab names the domain "lab-box"`,
+		"<memory> is 128 MiB",
+		`<source bridge="br0"> is not a bridge of this stack`,
+		"disk /home/me/lab-box.qcow2 is outside nlab storage",
+	}
+	if len(warnings) != len(want) {
+		t.Fatalf("got %d warnings, want %d: %v", len(warnings), len(want), warnings)
+	}
+	for i, w := range want {
+		if warnings[i].Severity != manifest.SeverityWarning || !strings.Contains(warnings[i].Message, w) {
+			t.Errorf("warning %d = %+v, want %q", i, warnings[i], w)
+		}
+	}
+	if _, err := manifest.LoadBytes(semanticManifest(semanticNet, vm), "test"); err != nil {
+		t.Errorf("LoadBytes should ignore warnings: %v", err)
+	}
+}
+
+func TestSemanticSkipsParams(t *testing.T) {
+	data := []byte(`apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: lab
+spec:
+  parameters:
+    mem: {type: int, default: 1024}
+    net: {default: lan}
+  networks:
+    lan: {cidr: 10.1.0.0/24}
+  vms:
+    box:
+      xml: |
+        <domain type="kvm"><name>lab-box</name><memory unit="MiB">${params.mem}</memory>
+          <devices><interface type="network"><source network="${params.net}"/></interface></devices></domain>
+`)
+	if _, warnings, err := manifest.CheckBytes(data, "test"); err != nil || len(warnings) > 0 {
+		t.Errorf("parameter references should not be checked: %v %v", err, warnings)
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	m, err := manifest.LoadBytes(semanticManifest(semanticNet, semanticVM), "test")
+	if err != nil {
+		t.Fatalf("LoadBytes: %v", err)
+	}
+	nets := manifest.HostNetworks(m)
+	if len(nets) != 1 || nets[0].Stack != "lab" || nets[0].Bridge != "virbr-lab" || nets[0].Subnet.String() != "10.1.0.0/24" {
+		t.Fatalf("HostNetworks = %+v", nets)
+	}
+	cidr := func(s string) *net.IPNet {
+		_, n, _ := net.ParseCIDR(s)
+		return n
+	}
+	host := manifest.Host{
+		Networks: []manifest.HostNetwork{
+			{Stack: "other", Name: "net", Bridge: "virbr-lab", Subnet: cidr("10.1.0.128/25")},
+			{Stack: "lab", Name: "lan", Bridge: "virbr-lab", Subnet: cidr("10.1.0.0/24")},
+			{Stack: "far", Name: "net", Bridge: "virbr-far", Subnet: cidr("10.9.0.0/24")},
+		},
+		Routes: []manifest.Route{
+			{Dev: "eth0", Dest: cidr("0.0.0.0/0")},
+			{Dev: "virbr-lab", Dest: cidr("10.1.0.0/24")},
+			{Dev: "wg0", Dest: cidr("10.0.0.0/8")},
+		},
+	}
+	issues := manifest.CheckHost(m, "test", host)
+	want := []string{
+		`10.1.0.0/24 overlaps 10.1.0.128/25 of stack "other"`,
+		`bridge virbr-lab is also used by stack "other"`,
+		"10.1.0.0/24 overlaps the host route to 10.0.0.0/8 via wg0",
+	}
+	if len(issues) != len(want) {
+		t.Fatalf("got %d issues, want %d: %v", len(issues), len(want), issues)
+	}
+	for i, w := range want {
+		if issues[i].Severity != manifest.SeverityWarning || !strings.Contains(issues[i].Message, w) {
+			t.Errorf("issue %d = %+v, want %q", i, issues[i], w)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package manifest
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+// tmuxPresets maps spec.tmux.preset to the tmux layout its windows use.
+var tmuxPresets = map[string]string{
+	"default": "main-vertical",
+	"grid":    "tiled",
+	"wide":    "even-horizontal",
+}
+
+// tmuxLayouts are the named layouts tmux select-layout accepts.
+var tmuxLayouts = []string{"even-horizontal", "even-vertical", "main-horizontal", "main-vertical", "tiled"}
+
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// bridgeRefRe matches a {bridge:<network>} reference in a pane command.
+var bridgeRefRe = regexp.MustCompile(`\{bridge:([^}]*)\}`)
+
+// PresetLayout returns the tmux layout of a spec.tmux preset; an empty
+// preset is "default".
+func PresetLayout(preset string) string {
+	if preset == "" {
+		preset = "default"
+	}
+	return tmuxPresets[preset]
+}
+
+// validateTmux checks spec.tmux against the VMs of the manifest.
+func validateTmux(m *types.StackManifest) []string {
+	t := m.Spec.Tmux
+	var errs []string
+	if t.Preset != "" && tmuxPresets[t.Preset] == "" {
+		errs = append(errs, fmt.Sprintf("spec.tmux.preset: %q is not one of default, grid, wide", t.Preset))
+	}
+	names := map[string]bool{}
+	for i, w := range t.Windows {
+		at := fmt.Sprintf("spec.tmux.windows[%d]", i)
+		if w.Name != "" {
+			if names[w.Name] {
+				errs = append(errs, fmt.Sprintf("%s.name: window %q is defined twice", at, w.Name))
+			}
+			names[w.Name] = true
+		}
+		if w.Layout != "" && !contains(tmuxLayouts, w.Layout) {
+			errs = append(errs, fmt.Sprintf("%s.layout: %q is not one of %s", at, w.Layout, strings.Join(tmuxLayouts, ", ")))
+		}
+		if len(w.Panes) == 0 {
+			errs = append(errs, fmt.Sprintf("%s.panes: at least one pane is required", at))
+		}
+		for j, p := range w.Panes {
+			errs = append(errs, validatePane(m, fmt.Sprintf("%s.panes[%d]", at, j), p)...)
+		}
+	}
+	return errs
+}
+
+func validatePane(m *types.StackManifest, at string, p types.TmuxPane) []string {
+	var errs []string
+	switch p.PaneType() {
+	case "ssh":
+		if p.VM == "" {
+			errs = append(errs, fmt.Sprintf("%s.vm: required for an ssh pane", at))
+		} else if _, ok := m.Spec.VMs[p.VM]; !ok {
+			errs = append(errs, fmt.Sprintf("%s.vm: %q is not defined in spec.vms", at, p.VM))
+		}
+		if p.Command != "" {
+			errs = append(errs, fmt.Sprintf("%s.command: not allowed on an ssh pane", at))
+		}
+	case "command":
+		if strings.TrimSpace(p.Command) == "" {
+			errs = append(errs, fmt.Sprintf("%s.command: required for a command pane", at))
+		}
+	case "shell":
+		if p.Command != "" {
+			errs = append(errs, fmt.Sprintf("%s.command: not allowed on a shell pane; use type: command", at))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("%s.type: %q is not one of ssh, command, shell", at, p.Type))
+	}
+	if p.VM != "" && p.PaneType() != "ssh" {
+		errs = append(errs, fmt.Sprintf("%s.vm: only allowed on an ssh pane", at))
+	}
+	for _, ref := range bridgeRefRe.FindAllStringSubmatch(p.Command, -1) {
+		if _, ok := m.Spec.Networks[ref[1]]; !ok {
+			errs = append(errs, fmt.Sprintf("%s.command: %s: %q is not defined in spec.networks", at, ref[0], ref[1]))
+		}
+	}
+	for _, k := range sortedNames(p.Env) {
+		if !envNameRe.MatchString(k) {
+			errs = append(errs, fmt.Sprintf("%s.env: %q is not a valid variable name", at, k))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,85 @@
+package manifest_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+)
+
+func tmuxDoc(tmux string) string {
+	return "apiVersion: nlab.io/v1alpha1\nkind: Stack\nmetadata:\n  name: t\nspec:\n  networks:\n    net:\n      cidr: 10.0.0.0/24\n" +
+		"  vms:\n    vm:\n      memory: 1\n      vcpus: 1\n  tmux:\n" + tmux
+}
+
+func TestLoadTmux(t *testing.T) {
+	m, err := manifest.LoadBytes([]byte(tmuxDoc(`    preset: grid
+    windows:
+      - name: lab
+        panes:
+          - vm: vm
+          - command: htop
+            cwd: work
+            env: {TERM: xterm}
+          - title: scratch
+`)), "test")
+	if err != nil {
+		t.Fatalf("LoadBytes: %v", err)
+	}
+	panes := m.Spec.Tmux.Windows[0].Panes
+	for i, want := range []string{"ssh", "command", "shell"} {
+		if got := panes[i].PaneType(); got != want {
+			t.Errorf("panes[%d].PaneType() = %q, want %q", i, got, want)
+		}
+	}
+	if got := manifest.PresetLayout(m.Spec.Tmux.Preset); got != "tiled" {
+		t.Errorf("PresetLayout(grid) = %q, want tiled", got)
+	}
+	if got := manifest.PresetLayout(""); got != "main-vertical" {
+		t.Errorf("PresetLayout(\"\") = %q, want main-vertical", got)
+	}
+}
+
+func TestValidateTmuxErrors(t *testing.T) {
+	tests := []struct {
+		name, tmux, want string
+	}{
+		{"bad preset", "    preset: huge\n", "spec.tmux.preset"},
+		{"bad layout", "    windows:\n      - layout: spiral\n        panes: [{vm: vm}]\n", "spec.tmux.windows[0].layout"},
+		{"no panes", "    windows:\n      - name: a\n", "at least one pane"},
+		{"duplicate window", "    windows:\n      - {name: a, panes: [{vm: vm}]}\n      - {name: a, panes: [{vm: vm}]}\n", "defined twice"},
+		{"unknown vm", "    windows:\n      - panes: [{type: ssh, vm: nope}]\n", `"nope" is not defined`},
+		{"ssh without vm", "    windows:\n      - panes: [{type: ssh}]\n", "required for an ssh pane"},
+		{"command without command", "    windows:\n      - panes: [{type: command}]\n", "required for a command pane"},
+		{"vm on command pane", "    windows:\n      - panes: [{type: command, command: ls, vm: vm}]\n", "only allowed on an ssh pane"},
+		{"bad type", "    windows:\n      - panes: [{type: web}]\n", "not one of ssh, command, shell"},
+		{"unknown bridge", "    windows:\n      - panes: [{command: \"tcpdump -i {bridge:nope}\"}]\n", `"nope" is not defined in spec.networks`},
+		{"bad env", "    windows:\n      - panes: [{command: ls, env: {1X: y}}]\n", "not a valid variable name"},
+		{"unknown key", "    windows:\n      - panes: [{vm: vm, host: x}]\n", "host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := manifest.LoadBytes([]byte(tmuxDoc(tt.tmux)), "test")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTmuxEnvOrder(t *testing.T) {
+	doc := tmuxDoc("    windows:\n      - panes: [{command: ls, env: {3C: z, 1A: x, 2B: y, 4D: w}}]\n")
+	_, err := manifest.LoadBytes([]byte(doc), "test")
+	if err == nil {
+		t.Fatal("invalid env names were accepted")
+	}
+	msg := err.Error()
+	last := -1
+	for _, k := range []string{"1A", "2B", "3C", "4D"} {
+		i := strings.Index(msg, `"`+k+`"`)
+		if i < 0 || i < last {
+			t.Fatalf("env errors are not in name order:\n%s", msg)
+		}
+		last = i
+	}
+}
@@ -0,0 +1,236 @@
+package lab
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+// legacyStack is the flat stack.yaml format that predates v1alpha1: one
+// network, whose XML is in network.xml, and VMs with memory and vcpus only.
+type legacyStack struct {
+	Network string `yaml:"network"`
+	VMs     []struct {
+		Name   string `yaml:"name"`
+		Memory int    `yaml:"memory"`
+		VCPUs  int    `yaml:"vcpus"`
+	} `yaml:"vms"`
+}
+
+// Migration is a legacy stack converted to a v1alpha1 manifest.
+type Migration struct {
+	Path     string   // the legacy stack.yaml
+	Manifest []byte   // the v1alpha1 manifest that replaces it
+	Retired  []string // files next to it that the manifest now embeds
+}
+
+// MigrateStack converts the legacy stack.yaml at path to a v1alpha1 manifest.
+// network.xml is inlined, every VM gets the domain XML nlab would render for
+// its memory and vcpus, and layout.yaml (or one ssh pane per VM) becomes
+// spec.tmux. Comments are carried over to the network and VM they were next
+// to. The stack is named after its directory.
+func MigrateStack(path string) (*Migration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read stack config %s: %w", path, err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parse stack config %s: %w", path, err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("stack config %s: not a YAML mapping", path)
+	}
+	root := doc.Content[0]
+	if k, _ := mappingValue(root, "apiVersion"); k != nil {
+		return nil, fmt.Errorf("%s is already a v1alpha1 manifest", path)
+	}
+	var legacy legacyStack
+	if err := root.Decode(&legacy); err != nil {
+		return nil, fmt.Errorf("parse stack config %s: %w", path, err)
+	}
+	if legacy.Network == "" || len(legacy.VMs) == 0 {
+		return nil, fmt.Errorf("stack config %s: a legacy stack needs network and vms", path)
+	}
+
+	dir := filepath.Dir(path)
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	stack := filepath.Base(abs)
+	mg := &Migration{Path: path}
+	netPath := filepath.Join(dir, "network.xml")
+	netXML, err := os.ReadFile(netPath)
+	if err != nil {
+		return nil, fmt.Errorf("read the network XML of %s: %w", path, err)
+	}
+	mg.Retired = append(mg.Retired, netPath)
+
+	m := types.StackManifest{
+		APIVersion: "nlab.io/v1alpha1",
+		Kind:       "Stack",
+		Metadata:   types.ObjectMeta{Name: stack},
+		Spec: types.StackSpec{
+			Networks: map[string]types.NetworkSpec{legacy.Network: {XML: strings.TrimSpace(string(netXML)) + "\n"}},
+			VMs:      make(map[string]types.VMSpec),
+		},
+	}
+	opts := renderOptions(stack, nil)
+	var roles []string
+	for _, v := range legacy.VMs {
+		typed := &types.StackManifest{Spec: types.StackSpec{VMs: map[string]types.VMSpec{
+			v.Name: {Memory: v.Memory, VCPUs: v.VCPUs, Networks: []string{legacy.Network}}}}}
+		x, err := manifest.DomainXML(typed, v.Name, opts)
+		if err != nil {
+			return nil, err
+		}
+		m.Spec.VMs[v.Name] = types.VMSpec{XML: x}
+		roles = append(roles, v.Name)
+	}
+
+	// A layout.yaml is kept as it is; only without one is there a pane per VM.
+	layoutPath := filepath.Join(dir, "layout.yaml")
+	m.Spec.Tmux = &types.TmuxSpec{}
+	if fileExists(layoutPath) {
+		l, err := LoadLayout(layoutPath)
+		if err != nil {
+			return nil, err
+		}
+		m.Spec.Tmux.Windows = []types.TmuxWindow{l.tmuxWindow()}
+		mg.Retired = append(mg.Retired, layoutPath)
+	} else {
+		w := types.TmuxWindow{Name: "lab"}
+		for _, role := range roles {
+			w.Panes = append(w.Panes, types.TmuxPane{Type: "ssh", VM: role, Title: role})
+		}
+		m.Spec.Tmux.Windows = []types.TmuxWindow{w}
+	}
+
+	var out yaml.Node
+	if err := out.Encode(&m); err != nil {
+		return nil, fmt.Errorf("encode manifest: %w", err)
+	}
+	carryComments(root, &out, legacy.Network)
+	outDoc := &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{&out},
+		HeadComment: doc.HeadComment, FootComment: doc.FootComment}
+	var buf bytes.Buffer
+	buf.WriteString(manifest.SchemaHeader)
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(outDoc); err != nil {
+		return nil, fmt.Errorf("encode manifest: %w", err)
+	}
+	if _, err := manifest.LoadBytes(buf.Bytes(), path); err != nil {
+		return nil, fmt.Errorf("migrated manifest is invalid: %w", err)
+	}
+	mg.Manifest = buf.Bytes()
+	return mg, nil
+}
+
+// Write saves the legacy stack.yaml as stack.yaml.bak, writes the v1alpha1
+// manifest in its place and renames the retired files to <name>.bak.
+func (mg *Migration) Write() error {
+	old, err := os.ReadFile(mg.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(mg.Path+".bak", old, 0o644); err != nil {
+		return fmt.Errorf("back up %s: %w", mg.Path, err)
+	}
+	if err := os.WriteFile(mg.Path, mg.Manifest, 0o644); err != nil {
+		return fmt.Errorf("write %s: %w", mg.Path, err)
+	}
+	for _, f := range mg.Retired {
+		if err := os.Rename(f, f+".bak"); err != nil {
+			return fmt.Errorf("back up %s: %w", f, err)
+		}
+	}
+	return nil
+}
+
+// carryComments copies the comments of the legacy mapping to the matching
+// places of the v1alpha1 one: network comments go to
+// spec.networks.<network> and everything written in or next to a VM entry
+// goes above spec.vms.<name>.
+func carryComments(legacy, out *yaml.Node, network string) {
+	spec := mappingNode(out, "spec")
+	for i := 0; i+1 < len(legacy.Content); i += 2 {
+		key, value := legacy.Content[i], legacy.Content[i+1]
+		switch key.Value {
+		case "network":
+			if k, _ := mappingValue(mappingNode(spec, "networks"), network); k != nil {
+				k.HeadComment = joinComments(key.HeadComment, key.LineComment, value.LineComment)
+			}
+		case "vms":
+			vmsKey, vms := mappingValue(spec, "vms")
+			vmsKey.HeadComment = joinComments(key.HeadComment, key.LineComment)
+			for _, item := range value.Content {
+				name := ""
+				if _, n := mappingValue(item, "name"); n != nil {
+					name = n.Value
+				}
+				if k, _ := mappingValue(vms, name); k != nil {
+					k.HeadComment = joinComments(nodeComments(item)...)
+				}
+			}
+		}
+	}
+}
+
+// nodeComments returns every comment in and around n, in document order.
+// A comment at the end of a "key: value" line names the key it was on.
+func nodeComments(n *yaml.Node) []string {
+	out := []string{n.HeadComment, n.LineComment}
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			out = append(out, k.HeadComment)
+			if line := joinComments(k.LineComment, v.LineComment); line != "" {
+				out = append(out, "# "+k.Value+": "+strings.TrimSpace(strings.TrimPrefix(line, "#")))
+			}
+			out = append(out, nodeComments(&yaml.Node{Kind: v.Kind, Content: v.Content, HeadComment: v.HeadComment, FootComment: v.FootComment})...)
+			out = append(out, k.FootComment)
+		}
+		return append(out, n.FootComment)
+	}
+	for _, c := range n.Content {
+		out = append(out, nodeComments(c)...)
+	}
+	return append(out, n.FootComment)
+}
+
+func joinComments(comments ...string) string {
+	var lines []string
+	for _, c := range comments {
+		if c = strings.TrimSpace(c); c != "" {
+			lines = append(lines, c)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// mappingValue returns the key and value nodes of key in mapping n.
+func mappingValue(n *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i], n.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+func mappingNode(n *yaml.Node, key string) *yaml.Node {
+	_, v := mappingValue(n, key)
+	return v
+}
@@ -0,0 +1,139 @@
+package lab_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lab "github.com/h3ow3d/nlab/internal"
+	"github.com/h3ow3d/nlab/internal/manifest"
+)
+
+const legacyStack = `# Old-style lab.
+network: old_net # the lab network
+vms:
+  # Kali box
+  - name: attacker
+    memory: 4096 # plenty for burp
+    vcpus: 2
+  - name: target
+    memory: 2048
+    vcpus: 1
+`
+
+const legacyNetwork = `<network>
+  <name>old_net</name>
+  <bridge name="virbr-old"/>
+  <ip address="10.88.0.1" netmask="255.255.255.0"/>
+</network>
+`
+
+func TestMigrateStack(t *testing.T) {
+	isolateXDG(t)
+	dir := filepath.Join("stacks", "old")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := writeFile(t, dir, "stack.yaml", legacyStack)
+	writeFile(t, dir, "network.xml", legacyNetwork)
+	writeFile(t, dir, "layout.yaml", "layout: tiled\npanes:\n  - {name: box, type: ssh, vm: attacker}\n  - {name: mon, type: command, command: htop}\n")
+
+	mg, err := lab.MigrateStack(path)
+	if err != nil {
+		t.Fatalf("MigrateStack: %v", err)
+	}
+	out := string(mg.Manifest)
+	if !strings.HasPrefix(out, manifest.SchemaHeader) {
+		t.Errorf("missing schema modeline:\n%s", out)
+	}
+	m, err := manifest.LoadBytes(mg.Manifest, path)
+	if err != nil {
+		t.Fatalf("migrated manifest: %v\n%s", err, out)
+	}
+	if m.Metadata.Name != "old" || !strings.Contains(m.Spec.Networks["old_net"].XML, `<bridge name="virbr-old"/>`) {
+		t.Errorf("network not inlined:\n%s", out)
+	}
+	for _, want := range []string{"<name>old-attacker</name>", `<memory unit="MiB">4096</memory>`, `<source network="old_net"/>`} {
+		if !strings.Contains(m.Spec.VMs["attacker"].XML, want) {
+			t.Errorf("attacker XML missing %q:\n%s", want, m.Spec.VMs["attacker"].XML)
+		}
+	}
+	if w := m.Spec.Tmux.Windows; len(w) != 1 || w[0].Layout != "tiled" || len(w[0].Panes) != 2 || w[0].Panes[1].Command != "htop" {
+		t.Errorf("layout.yaml not carried into spec.tmux: %+v", m.Spec.Tmux)
+	}
+	for _, want := range []string{"# Old-style lab.", "    # the lab network\n    old_net:", "    # Kali box\n    # memory: plenty for burp\n    attacker:"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("comment %q not kept:\n%s", want, out)
+		}
+	}
+
+	if err := mg.Write(); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	for _, f := range []string{"stack.yaml.bak", "network.xml.bak", "layout.yaml.bak"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Errorf("expected backup %s: %v", f, err)
+		}
+	}
+	if bak, _ := os.ReadFile(path + ".bak"); string(bak) != legacyStack {
+		t.Errorf("stack.yaml.bak = %q", bak)
+	}
+	cfg, err := lab.LoadStack("old")
+	if err != nil || len(cfg.VMs) != 2 {
+		t.Fatalf("LoadStack after migration: %v", err)
+	}
+	if _, err := lab.MigrateStack(path); err == nil || !strings.Contains(err.Error(), "already a v1alpha1") {
+		t.Errorf("migrating twice should fail, got %v", err)
+	}
+}
+
+func TestMigrateStackKeepsLayoutPanes(t *testing.T) {
+	isolateXDG(t)
+	dir := filepath.Join("stacks", "old")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := writeFile(t, dir, "stack.yaml", legacyStack)
+	writeFile(t, dir, "network.xml", legacyNetwork)
+	// Only attacker has a pane, and it comes after the monitor.
+	writeFile(t, dir, "layout.yaml", "panes:\n  - {name: mon, type: command, command: htop}\n  - {name: box, type: ssh, vm: attacker}\n")
+
+	mg, err := lab.MigrateStack(path)
+	if err != nil {
+		t.Fatalf("MigrateStack: %v", err)
+	}
+	m, err := manifest.LoadBytes(mg.Manifest, path)
+	if err != nil {
+		t.Fatalf("migrated manifest: %v\n%s", err, mg.Manifest)
+	}
+	w := m.Spec.Tmux.Windows
+	if len(w) != 1 || len(w[0].Panes) != 2 {
+		t.Fatalf("spec.tmux = %+v, want the layout's two panes", m.Spec.Tmux)
+	}
+	if p := w[0].Panes; p[0].Command != "htop" || p[0].Title != "mon" || p[1].VM != "attacker" || p[1].Title != "box" {
+		t.Errorf("panes = %+v, want mon then box as in layout.yaml", p)
+	}
+
+	// Without a layout.yaml every VM gets an ssh pane.
+	if err := os.Remove(filepath.Join(dir, "layout.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if mg, err = lab.MigrateStack(path); err != nil {
+		t.Fatalf("MigrateStack without layout.yaml: %v", err)
+	}
+	if m, err = manifest.LoadBytes(mg.Manifest, path); err != nil {
+		t.Fatal(err)
+	}
+	if p := m.Spec.Tmux.Windows[0].Panes; len(p) != 2 || p[0].VM != "attacker" || p[1].VM != "target" {
+		t.Errorf("panes without layout.yaml = %+v, want one per VM", p)
+	}
+}
+
+func TestMigrateStackNeedsNetworkXML(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "stack.yaml", legacyStack)
+	if _, err := lab.MigrateStack(path); err == nil || !strings.Contains(err.Error(), "network XML") {
+		t.Errorf("expected a missing network.xml error, got %v", err)
+	}
+}
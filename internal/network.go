@@ -9,7 +9,11 @@ import (
 // CreateNetwork defines and starts a libvirt network from an XML string.
 // It writes the XML to a temporary file, calls virsh net-define, then removes
 // the temporary file.
-func CreateNetwork(networkXML, networkName string) error {
+func CreateNetwork(stack, networkXML, networkName string) error {
+	return publishError(stack, "network", "", createNetwork(stack, networkXML, networkName))
+}
+
+func createNetwork(stack, networkXML, networkName string) error {
 	// Write XML to a temp file for virsh net-define.
 	tmp, err := os.CreateTemp("", "nlab-net-*.xml")
 	if err != nil {
@@ -31,6 +35,8 @@ func CreateNetwork(networkXML, networkName string) error {
 		if err := virsh("net-define", tmpPath); err != nil {
 			return fmt.Errorf("net-define: %w", err)
 		}
+		Publish(Event{Stack: stack, Type: EventNetworkDefined, Source: "network",
+			Message: fmt.Sprintf("Network %s defined", networkName)})
 	}
 
 	if networkActive(networkName) {
@@ -40,6 +46,8 @@ func CreateNetwork(networkXML, networkName string) error {
 		if err := virsh("net-start", networkName); err != nil {
 			return fmt.Errorf("net-start: %w", err)
 		}
+		Publish(Event{Stack: stack, Type: EventNetworkStarted, Source: "network",
+			Message: fmt.Sprintf("Network %s started", networkName)})
 	}
 
 	if err := virsh("net-autostart", networkName); err != nil {
@@ -51,7 +59,11 @@ func CreateNetwork(networkXML, networkName string) error {
 }
 
 // DestroyNetwork stops and undefines a libvirt network.
-func DestroyNetwork(networkName string) error {
+func DestroyNetwork(stack, networkName string) error {
+	return publishError(stack, "network", "", destroyNetwork(stack, networkName))
+}
+
+func destroyNetwork(stack, networkName string) error {
 	if !networkDefined(networkName) {
 		Skip(fmt.Sprintf("Network %s does not exist", networkName))
 		return nil
@@ -64,9 +76,33 @@ func DestroyNetwork(networkName string) error {
 	}
 
 	Ok(fmt.Sprintf("Network %s removed", networkName))
+	Publish(Event{Stack: stack, Type: EventNetworkDestroyed, Source: "network",
+		Message: fmt.Sprintf("Network %s removed", networkName)})
 	return nil
 }
 
+// networkInfo parses virsh net-info for name; bridge is "n/a" when the
+// network is not defined.
+func networkInfo(name string) (defined, active, autostart bool, bridge string) {
+	bridge = "n/a"
+	info, err := virshCmd("net-info", name).Output()
+	if err != nil {
+		return
+	}
+	defined = true
+	for _, line := range strings.Split(string(info), "\n") {
+		switch {
+		case strings.HasPrefix(line, "Active:"):
+			active = strings.TrimSpace(strings.TrimPrefix(line, "Active:")) == "yes"
+		case strings.HasPrefix(line, "Autostart:"):
+			autostart = strings.TrimSpace(strings.TrimPrefix(line, "Autostart:")) == "yes"
+		case strings.HasPrefix(line, "Bridge:"):
+			bridge = strings.TrimSpace(strings.TrimPrefix(line, "Bridge:"))
+		}
+	}
+	return
+}
+
 func networkDefined(name string) bool {
 	return virshCmd("net-info", name).Run() == nil
 }
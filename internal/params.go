@@ -0,0 +1,56 @@
+package lab
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+// ParamValues merges a --values file and --set key=value pairs into the
+// parameter values passed to LoadStackParams; --set wins. It never returns
+// nil, so the result always replaces the values saved in the stack state.
+func ParamValues(valuesFile string, sets []string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	if valuesFile != "" {
+		data, err := os.ReadFile(valuesFile)
+		if err != nil {
+			return nil, fmt.Errorf("read values file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &values); err != nil {
+			return nil, fmt.Errorf("parse values file %s: %w", valuesFile, err)
+		}
+		if values == nil {
+			values = make(map[string]interface{})
+		}
+	}
+	for _, s := range sets {
+		k, v, ok := strings.Cut(s, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("--set %q: expected key=value", s)
+		}
+		values[strings.TrimSpace(k)] = v
+	}
+	return values, nil
+}
+
+// stackParams resolves the parameter values of the stack's manifest m: values
+// when non-nil, else those saved by the last nlab up, dropping any the
+// manifest no longer declares.
+func stackParams(stack string, m *types.StackManifest, values map[string]interface{}) (map[string]string, error) {
+	if values == nil {
+		values = make(map[string]interface{})
+		if st, err := LoadStackState(stack); err == nil {
+			for k, v := range st.Parameters {
+				if _, ok := m.Spec.Parameters[k]; ok {
+					values[k] = v
+				}
+			}
+		}
+	}
+	return manifest.ResolveParams(m, values)
+}
@@ -0,0 +1,156 @@
+package lab_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lab "github.com/h3ow3d/nlab/internal"
+)
+
+const paramsStack = `
+apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: web
+spec:
+  parameters:
+    targetVersion:
+      default: "2.4.52"
+    targetPackages:
+      type: list
+      default: [apache2]
+  networks:
+    web_net:
+      cidr: 10.40.0.0/24
+  vms:
+    target:
+      xml: |
+        <domain type="kvm"><name>web-target</name><memory unit="MiB">1024</memory><description>apache ${params.targetVersion}</description></domain>
+  tmux:
+    windows:
+      - panes:
+          - command: echo ${params.targetPackages}
+`
+
+func TestParamValues(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "values.yaml", "targetVersion: 2.4.49\ntargetPackages: [apache2, php]\n")
+	values, err := lab.ParamValues(path, []string{"targetVersion=2.4.50", "empty="})
+	if err != nil {
+		t.Fatalf("ParamValues: %v", err)
+	}
+	if values["targetVersion"] != "2.4.50" || values["empty"] != "" {
+		t.Errorf("--set should win over --values: %v", values)
+	}
+	if list, ok := values["targetPackages"].([]interface{}); !ok || len(list) != 2 {
+		t.Errorf("targetPackages = %#v, want the YAML list", values["targetPackages"])
+	}
+	if _, err := lab.ParamValues("", []string{"novalue"}); err == nil {
+		t.Error("ParamValues accepted --set without =")
+	}
+	if v, err := lab.ParamValues("", nil); err != nil || v == nil {
+		t.Errorf("ParamValues() = %v, %v; want an empty, non-nil map", v, err)
+	}
+}
+
+func TestLoadStackParamsAndState(t *testing.T) {
+	isolateXDG(t)
+	setupStack(t, "web", paramsStack)
+
+	cfg, err := lab.LoadStack("web")
+	if err != nil {
+		t.Fatalf("LoadStack: %v", err)
+	}
+	if cfg.Params["targetVersion"] != "2.4.52" {
+		t.Errorf("default targetVersion = %q", cfg.Params["targetVersion"])
+	}
+
+	cfg, err = lab.LoadStackParams("web", map[string]interface{}{"targetVersion": "2.4.49", "targetPackages": "apache2,php"})
+	if err != nil {
+		t.Fatalf("LoadStackParams: %v", err)
+	}
+	if got := cfg.Tmux.Windows[0].Panes[0].Command; got != "echo [apache2, php]" {
+		t.Errorf("tmux command = %q", got)
+	}
+	if err := lab.SaveStackState("web", lab.StackState{Manifest: "stacks/web/stack.yaml", Parameters: cfg.Params}); err != nil {
+		t.Fatalf("SaveStackState: %v", err)
+	}
+
+	// Later commands reuse the saved values.
+	cfg, err = lab.LoadStack("web")
+	if err != nil {
+		t.Fatalf("LoadStack after up: %v", err)
+	}
+	if cfg.Params["targetVersion"] != "2.4.49" || cfg.Params["targetPackages"] != "[apache2, php]" {
+		t.Errorf("saved params not reused: %v", cfg.Params)
+	}
+	docs, err := lab.RenderStack("web", nil)
+	if err != nil {
+		t.Fatalf("RenderStack: %v", err)
+	}
+	if x := docs[len(docs)-1].XML; !strings.Contains(x, "apache 2.4.49") {
+		t.Errorf("rendered XML not substituted:\n%s", x)
+	}
+
+	if _, err := lab.LoadStackParams("web", map[string]interface{}{"nope": "1"}); err == nil {
+		t.Error("LoadStackParams accepted an undeclared parameter")
+	}
+}
+
+func TestStackState(t *testing.T) {
+	tmp := isolateXDG(t)
+	if _, err := lab.LoadStackState("web"); !os.IsNotExist(err) {
+		t.Fatalf("LoadStackState before save: err = %v, want not-exist", err)
+	}
+	if err := lab.SaveStackState("web", lab.StackState{Manifest: "/m.yaml", Parameters: map[string]string{"a": "1"}}); err != nil {
+		t.Fatalf("SaveStackState: %v", err)
+	}
+	if want := filepath.Join(tmp, "state", "nlab", "stacks", "web.yaml"); lab.StackStatePath("web") != want {
+		t.Errorf("StackStatePath = %q, want %q", lab.StackStatePath("web"), want)
+	}
+	st, err := lab.LoadStackState("web")
+	if err != nil {
+		t.Fatalf("LoadStackState: %v", err)
+	}
+	if st.Manifest != "/m.yaml" || st.Parameters["a"] != "1" || st.UpdatedAt.IsZero() {
+		t.Errorf("state = %+v", st)
+	}
+	if err := lab.RemoveStackState("web"); err != nil {
+		t.Fatalf("RemoveStackState: %v", err)
+	}
+	if err := lab.RemoveStackState("web"); err != nil {
+		t.Errorf("RemoveStackState twice: %v", err)
+	}
+}
+
+func TestReleaseStackState(t *testing.T) {
+	isolateXDG(t)
+	leases := map[string]lab.SubnetLease{
+		"web_net": {CIDR: "10.232.0.0/24", Bridge: "virbr-web"},
+		"dmz":     {CIDR: "10.232.1.0/24"},
+	}
+	if err := lab.SaveStackState("web", lab.StackState{Manifest: "/m.yaml", Leases: leases}); err != nil {
+		t.Fatal(err)
+	}
+
+	// web_net could not be torn down: its lease stays taken.
+	if err := lab.ReleaseStackState("web", []string{"web_net"}); err != nil {
+		t.Fatalf("ReleaseStackState: %v", err)
+	}
+	st, err := lab.LoadStackState("web")
+	if err != nil {
+		t.Fatalf("state of a stack with a network left behind: %v", err)
+	}
+	if len(st.Leases) != 1 || st.Leases["web_net"] != leases["web_net"] {
+		t.Errorf("leases = %+v, want only web_net's", st.Leases)
+	}
+
+	if err := lab.ReleaseStackState("web", nil); err != nil {
+		t.Fatalf("ReleaseStackState: %v", err)
+	}
+	if _, err := lab.LoadStackState("web"); !os.IsNotExist(err) {
+		t.Errorf("state kept after every network was removed: %v", err)
+	}
+}
@@ -0,0 +1,397 @@
+package lab
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Forwarder timings: how long a resolved VM address is trusted, how long a
+// connection to the VM may take, and how long an idle UDP flow is kept.
+const (
+	forwardAddrTTL     = 5 * time.Second
+	forwardDialTimeout = 5 * time.Second
+	forwardUDPIdle     = 2 * time.Minute
+)
+
+// PortForward is one host port forwarded to a port of a VM.
+type PortForward struct {
+	VM    string `yaml:"vm"` // role
+	Host  int    `yaml:"host"`
+	Guest int    `yaml:"guest"`
+	Proto string `yaml:"proto"`
+	Bind  string `yaml:"bind"`
+}
+
+// Listen returns the host address the forward listens on.
+func (f PortForward) Listen() string {
+	return net.JoinHostPort(f.Bind, strconv.Itoa(f.Host))
+}
+
+func (f PortForward) String() string {
+	return fmt.Sprintf("%s → %s:%d/%s", f.Listen(), f.VM, f.Guest, f.Proto)
+}
+
+// ParsePortForward parses [bind:]host:guest[/proto] as a forward to role. An
+// IPv6 bind address is written in brackets, as in [::1]:8080:80.
+func ParsePortForward(role, spec string) (PortForward, error) {
+	f := PortForward{VM: role, Proto: "tcp", Bind: "127.0.0.1"}
+	rest, proto, ok := strings.Cut(spec, "/")
+	if ok {
+		f.Proto = proto
+	}
+	var parts []string
+	if bind, ports, ok := strings.Cut(rest, "]:"); ok && strings.HasPrefix(bind, "[") {
+		f.Bind, parts = bind[1:], strings.Split(ports, ":") // [::1]:host:guest
+	} else if parts = strings.Split(rest, ":"); len(parts) == 3 {
+		f.Bind, parts = parts[0], parts[1:]
+	}
+	if len(parts) != 2 {
+		return f, fmt.Errorf("port forward %q: want [bind:]host:guest[/tcp|udp]", spec)
+	}
+	var err1, err2 error
+	f.Host, err1 = strconv.Atoi(parts[0])
+	f.Guest, err2 = strconv.Atoi(parts[1])
+	switch {
+	case err1 != nil || err2 != nil || f.Host < 1 || f.Host > 65535 || f.Guest < 1 || f.Guest > 65535:
+		return f, fmt.Errorf("port forward %q: ports must be 1-65535", spec)
+	case f.Proto != "tcp" && f.Proto != "udp":
+		return f, fmt.Errorf("port forward %q: protocol %q is not tcp or udp", spec, f.Proto)
+	case net.ParseIP(f.Bind) == nil:
+		return f, fmt.Errorf("port forward %q: bind address %q is not an IP address", spec, f.Bind)
+	}
+	return f, nil
+}
+
+// StackForwards returns the forwards the VMs of cfg ask for in their ports,
+// with the defaults filled in.
+func StackForwards(cfg *StackConfig) []PortForward {
+	var out []PortForward
+	for _, vm := range cfg.VMs {
+		for _, p := range vm.Ports {
+			f := PortForward{VM: vm.Name, Host: p.Host, Guest: p.Guest,
+				Proto: orDefault(p.Proto, "tcp"), Bind: orDefault(p.Bind, "127.0.0.1")}
+			if f.Guest == 0 {
+				f.Guest = f.Host
+			}
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// ForwardRecord is what a running nlab port-forward writes to the forwards
+// directory, so that stack status can list it and nlab down can stop it.
+type ForwardRecord struct {
+	Stack string `yaml:"stack"`
+	PID   int    `yaml:"pid"`
+	// Manifest is set for the forwarder nlab up starts for spec.vms.*.ports.
+	Manifest bool          `yaml:"manifest,omitempty"`
+	Forwards []PortForward `yaml:"forwards"`
+	Started  time.Time     `yaml:"started"`
+}
+
+func forwardRecordPath(stack string, pid int) string {
+	return filepath.Join(DefaultXDGDirs().ForwardsDir(), fmt.Sprintf("%s.%d.yaml", stack, pid))
+}
+
+// ActiveForwards returns the records of stack's running forwarders, oldest
+// first. Records left behind by a forwarder that died are removed.
+func ActiveForwards(stack string) []ForwardRecord {
+	files, _ := filepath.Glob(filepath.Join(DefaultXDGDirs().ForwardsDir(), stack+".*.yaml"))
+	var out []ForwardRecord
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		var r ForwardRecord
+		if yaml.Unmarshal(data, &r) != nil || r.Stack != stack {
+			continue
+		}
+		if !processAlive(r.PID) {
+			_ = os.Remove(f)
+			continue
+		}
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+// StopForwards stops every running forwarder of stack.
+func StopForwards(stack string) error {
+	var first error
+	for _, r := range ActiveForwards(stack) {
+		if err := syscall.Kill(r.PID, syscall.SIGTERM); err != nil && !errors.Is(err, syscall.ESRCH) {
+			if first == nil {
+				first = fmt.Errorf("stop port forwarder %d: %w", r.PID, err)
+			}
+			continue
+		}
+		_ = os.Remove(forwardRecordPath(stack, r.PID))
+		Ok(fmt.Sprintf("Port forwarder %d stopped (%d forwards)", r.PID, len(r.Forwards)))
+	}
+	return first
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Forwarder proxies host ports to the VMs of a stack in userspace. The VM's
+// address is looked up again when the last one is stale or stops
+// answering, so a forward survives a new DHCP lease.
+type Forwarder struct {
+	Stack string
+	// Resolve returns the current address of the VM with the given role.
+	Resolve func(role string) (string, error)
+
+	mu    sync.Mutex
+	addrs map[string]resolved
+
+	// connMu guards the connections open to clients and VMs, which Run
+	// closes on shutdown.
+	connMu sync.Mutex
+	conns  map[io.Closer]bool
+	closed bool
+}
+
+type resolved struct {
+	ip string
+	at time.Time
+}
+
+// NewForwarder returns a Forwarder for the VMs of cfg, which reaches each VM
+// at its lease on the first of its networks the host has an address on.
+func NewForwarder(stack string, cfg *StackConfig) *Forwarder {
+	return &Forwarder{Stack: stack, Resolve: func(role string) (string, error) {
+		return StackVMAddress(stack, cfg, role)
+	}}
+}
+
+// Run listens on every forward, records them for stack status and proxies
+// until done is closed, when every connection still open is closed too. It
+// fails without forwarding anything when one of the host ports cannot be
+// bound.
+func (fw *Forwarder) Run(forwards []PortForward, manifest bool, done <-chan struct{}) error {
+	var closers []io.Closer
+	defer func() {
+		for _, c := range closers {
+			_ = c.Close()
+		}
+	}()
+	var serve []func()
+	for _, f := range forwards {
+		f := f
+		if f.Proto == "udp" {
+			pc, err := net.ListenPacket("udp", f.Listen())
+			if err != nil {
+				return fmt.Errorf("forward %s: %w", f, err)
+			}
+			closers = append(closers, pc)
+			serve = append(serve, func() { fw.serveUDP(f, pc) })
+			continue
+		}
+		l, err := net.Listen("tcp", f.Listen())
+		if err != nil {
+			return fmt.Errorf("forward %s: %w", f, err)
+		}
+		closers = append(closers, l)
+		serve = append(serve, func() { fw.serveTCP(f, l) })
+	}
+
+	rec := ForwardRecord{Stack: fw.Stack, PID: os.Getpid(), Manifest: manifest, Forwards: forwards, Started: time.Now().UTC()}
+	path := forwardRecordPath(fw.Stack, rec.PID)
+	data, err := yaml.Marshal(&rec)
+	if err != nil {
+		return fmt.Errorf("encode forward record: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("create forwards dir: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("write forward record: %w", err)
+	}
+	defer os.Remove(path)
+
+	for _, f := range forwards {
+		Ok("Forwarding " + f.String())
+	}
+	for _, s := range serve {
+		go s()
+	}
+	<-done
+	fw.closeConns()
+	return nil
+}
+
+// track records c as open, or closes it when Run is shutting down.
+func (fw *Forwarder) track(c io.Closer) bool {
+	fw.connMu.Lock()
+	defer fw.connMu.Unlock()
+	if fw.closed {
+		_ = c.Close()
+		return false
+	}
+	if fw.conns == nil {
+		fw.conns = map[io.Closer]bool{}
+	}
+	fw.conns[c] = true
+	return true
+}
+
+// untrack closes c and forgets it.
+func (fw *Forwarder) untrack(c io.Closer) {
+	fw.connMu.Lock()
+	delete(fw.conns, c)
+	fw.connMu.Unlock()
+	_ = c.Close()
+}
+
+// closeConns closes every tracked connection; later ones are closed as
+// soon as they are tracked.
+func (fw *Forwarder) closeConns() {
+	fw.connMu.Lock()
+	defer fw.connMu.Unlock()
+	fw.closed = true
+	for c := range fw.conns {
+		_ = c.Close()
+	}
+	fw.conns = nil
+}
+
+// vmAddr returns the VM's address, looking it up when the cached one is
+// older than forwardAddrTTL or fresh is set.
+func (fw *Forwarder) vmAddr(role string, fresh bool) (string, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if r, ok := fw.addrs[role]; ok && !fresh && time.Since(r.at) < forwardAddrTTL {
+		return r.ip, nil
+	}
+	ip, err := fw.Resolve(role)
+	if err != nil {
+		return "", err
+	}
+	if fw.addrs == nil {
+		fw.addrs = map[string]resolved{}
+	}
+	fw.addrs[role] = resolved{ip: ip, at: time.Now()}
+	return ip, nil
+}
+
+// dial connects to the guest port of f's VM, looking the address up again
+// once when the cached one does not answer.
+func (fw *Forwarder) dial(f PortForward) (net.Conn, error) {
+	var err error
+	for _, fresh := range []bool{false, true} {
+		var ip string
+		if ip, err = fw.vmAddr(f.VM, fresh); err != nil {
+			continue
+		}
+		var c net.Conn
+		if c, err = net.DialTimeout(f.Proto, net.JoinHostPort(ip, strconv.Itoa(f.Guest)), forwardDialTimeout); err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
+func (fw *Forwarder) serveTCP(f PortForward, l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return // closed
+		}
+		if !fw.track(c) {
+			return
+		}
+		go func() {
+			defer fw.untrack(c)
+			up, err := fw.dial(f)
+			if err != nil {
+				Warn(fmt.Sprintf("%s: %v", f, err))
+				return
+			}
+			if !fw.track(up) {
+				return
+			}
+			defer fw.untrack(up)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _ = io.Copy(up, c)
+				if tc, ok := up.(*net.TCPConn); ok {
+					_ = tc.CloseWrite()
+				}
+			}()
+			_, _ = io.Copy(c, up)
+			if tc, ok := c.(*net.TCPConn); ok {
+				_ = tc.CloseWrite()
+			}
+			wg.Wait()
+		}()
+	}
+}
+
+// serveUDP relays datagrams: each client address gets its own socket to
+// the VM, dropped after forwardUDPIdle without traffic.
+func (fw *Forwarder) serveUDP(f PortForward, pc net.PacketConn) {
+	var mu sync.Mutex
+	flows := map[string]net.Conn{}
+	buf := make([]byte, 64*1024)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			return // closed
+		}
+		mu.Lock()
+		up, ok := flows[client.String()]
+		mu.Unlock()
+		if !ok {
+			if up, err = fw.dial(f); err != nil {
+				Warn(fmt.Sprintf("%s: %v", f, err))
+				continue
+			}
+			if !fw.track(up) {
+				return
+			}
+			mu.Lock()
+			flows[client.String()] = up
+			mu.Unlock()
+			go func(client net.Addr, up net.Conn) {
+				defer func() {
+					mu.Lock()
+					delete(flows, client.String())
+					mu.Unlock()
+					fw.untrack(up)
+				}()
+				b := make([]byte, 64*1024)
+				for {
+					_ = up.SetReadDeadline(time.Now().Add(forwardUDPIdle))
+					n, err := up.Read(b)
+					if err != nil {
+						return
+					}
+					if _, err := pc.WriteTo(b[:n], client); err != nil {
+						return
+					}
+				}
+			}(client, up)
+		}
+		_, _ = up.Write(buf[:n])
+	}
+}
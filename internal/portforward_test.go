@@ -0,0 +1,190 @@
+package lab_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	lab "github.com/h3ow3d/nlab/internal"
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+func TestParsePortForward(t *testing.T) {
+	for spec, want := range map[string]string{
+		"8080:80":              "127.0.0.1:8080 → target:80/tcp",
+		"0.0.0.0:8443:443":     "0.0.0.0:8443 → target:443/tcp",
+		"5353:53/udp":          "127.0.0.1:5353 → target:53/udp",
+		"8080":                 "error",
+		"8080:80/sctp":         "error",
+		"host:8080:80":         "error",
+		"8080:0":               "error",
+		"127.0.0.1:99999:80":   "error",
+		"127.0.0.1:8080:80:22": "error",
+		"[::1]:8080:80":        "[::1]:8080 → target:80/tcp",
+		"[::]:5353:53/udp":     "[::]:5353 → target:53/udp",
+		"::1:8080:80":          "error",
+		"[::1]8080:80":         "error",
+		"[::1]:8080":           "error",
+		"[host]:8080:80":       "error",
+	} {
+		f, err := lab.ParsePortForward("target", spec)
+		got := f.String()
+		if err != nil {
+			got = "error"
+		}
+		if got != want {
+			t.Errorf("ParsePortForward(%q) = %s (%v), want %s", spec, got, err, want)
+		}
+	}
+
+	cfg := &lab.StackConfig{VMs: []lab.VMSpec{
+		{Name: "web", Ports: []types.PortSpec{{Host: 8080, Guest: 80}, {Host: 5353, Proto: "udp", Bind: "0.0.0.0"}}},
+		{Name: "box"},
+	}}
+	got := fmt.Sprint(lab.StackForwards(cfg))
+	if want := "[127.0.0.1:8080 → web:80/tcp 0.0.0.0:5353 → web:5353/udp]"; got != want {
+		t.Errorf("StackForwards = %s, want %s", got, want)
+	}
+}
+
+// freePort returns a port nothing listens on for proto.
+func freePort(t *testing.T, proto string) int {
+	t.Helper()
+	if proto == "udp" {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+		return pc.LocalAddr().(*net.UDPAddr).Port
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestForwarder(t *testing.T) {
+	isolateXDG(t)
+
+	// The "VM" echoes over TCP and UDP on guest, first at 127.0.0.2 and then,
+	// after a new lease, at 127.0.0.1.
+	guest := freePort(t, "tcp")
+	echo := func(ip string) func() {
+		l, err := net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(guest)))
+		if err != nil {
+			t.Skipf("cannot listen on %s: %v", ip, err)
+		}
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer c.Close()
+					line, _ := bufio.NewReader(c).ReadString('\n')
+					fmt.Fprintf(c, "%s says %s", ip, line)
+				}()
+			}
+		}()
+		pc, err := net.ListenPacket("udp", net.JoinHostPort(ip, strconv.Itoa(guest)))
+		if err != nil {
+			l.Close()
+			t.Skipf("cannot listen on udp %s: %v", ip, err)
+		}
+		go func() {
+			b := make([]byte, 512)
+			for {
+				n, from, err := pc.ReadFrom(b)
+				if err != nil {
+					return
+				}
+				_, _ = pc.WriteTo(append([]byte(ip+" says "), b[:n]...), from)
+			}
+		}()
+		stop := func() { l.Close(); pc.Close() }
+		t.Cleanup(stop)
+		return stop
+	}
+	stop := echo("127.0.0.2")
+
+	var mu sync.Mutex
+	vmIP := "127.0.0.2"
+	fw := &lab.Forwarder{Stack: "fwd", Resolve: func(role string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return vmIP, nil
+	}}
+	tcp := lab.PortForward{VM: "web", Host: freePort(t, "tcp"), Guest: guest, Proto: "tcp", Bind: "127.0.0.1"}
+	udp := lab.PortForward{VM: "web", Host: freePort(t, "udp"), Guest: guest, Proto: "udp", Bind: "127.0.0.1"}
+	done := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() { errc <- fw.Run([]lab.PortForward{tcp, udp}, true, done) }()
+
+	var recs []lab.ForwardRecord
+	for i := 0; i < 50 && len(recs) == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+		recs = lab.ActiveForwards("fwd")
+	}
+	if len(recs) != 1 || !recs[0].Manifest || len(recs[0].Forwards) != 2 {
+		t.Fatalf("ActiveForwards = %+v", recs)
+	}
+
+	ask := func(proto string, port int) string {
+		c, err := net.DialTimeout(proto, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		_ = c.SetDeadline(time.Now().Add(2 * time.Second))
+		fmt.Fprint(c, "hi\n")
+		b := make([]byte, 512)
+		n, _ := c.Read(b)
+		return string(b[:n])
+	}
+	if got := ask("tcp", tcp.Host); got != "127.0.0.2 says hi\n" {
+		t.Errorf("tcp forward: %q", got)
+	}
+	if got := ask("udp", udp.Host); got != "127.0.0.2 says hi\n" {
+		t.Errorf("udp forward: %q", got)
+	}
+
+	// The cached address stops answering; the next connection looks again.
+	stop()
+	echo("127.0.0.1")
+	mu.Lock()
+	vmIP = "127.0.0.1"
+	mu.Unlock()
+	if got := ask("tcp", tcp.Host); got != "127.0.0.1 says hi\n" {
+		t.Errorf("tcp forward after a new lease: %q", got)
+	}
+
+	// A connection still open when the forwarder stops is closed with it.
+	held, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(tcp.Host)), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	time.Sleep(100 * time.Millisecond) // let the forwarder reach the VM
+
+	close(done)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	_ = held.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := held.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("open connection after shutdown: read = %v, want it closed", err)
+	}
+	if recs := lab.ActiveForwards("fwd"); len(recs) != 0 {
+		t.Errorf("record left behind: %+v", recs)
+	}
+}
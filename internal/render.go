@@ -0,0 +1,145 @@
+package lab
+
+import (
+	"bytes"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+// RenderedXML is the libvirt XML nlab defines for one resource of a stack.
+type RenderedXML struct {
+	Kind string // "network" or "vm"
+	Name string // key under spec.networks or spec.vms
+	XML  string
+}
+
+// RenderStack validates the stack's v1alpha1 manifest and returns the
+// effective XML of every network and VM, networks first, each sorted by name.
+// Raw xml is returned as written; typed specs are rendered. An empty stack
+// renders the -f manifest under its metadata.name. values are the
+// spec.parameters values, as for LoadStackParams.
+func RenderStack(stack string, values map[string]interface{}) ([]RenderedXML, error) {
+	m, stack, err := effectiveManifest(stack, values)
+	if err != nil {
+		return nil, err
+	}
+	var out []RenderedXML
+	for _, name := range sortedKeys(m.Spec.Networks) {
+		x, err := manifest.NetworkXML(name, m.Spec.Networks[name])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, RenderedXML{Kind: "network", Name: name, XML: x})
+	}
+	opts := renderOptions(stack, m.Spec.Storage)
+	for _, name := range sortedKeys(m.Spec.VMs) {
+		x, err := manifest.DomainXML(m, name, opts)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, RenderedXML{Kind: "vm", Name: name, XML: x})
+	}
+	return out, nil
+}
+
+// EffectiveManifest validates the stack's v1alpha1 manifest and returns it
+// as YAML with spec.defaults applied to every VM, parameters substituted
+// (their defaults show the values used) and referenced files resolved, i.e.
+// the settings nlab actually uses.
+func EffectiveManifest(stack string, values map[string]interface{}) ([]byte, error) {
+	m, _, err := effectiveManifest(stack, values)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(m); err != nil {
+		return nil, fmt.Errorf("encode manifest: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// FlattenedManifest validates the stack's v1alpha1 manifest and returns it
+// as one Stack document, with the stacks it extends, the components it
+// imports and its Network and VM documents merged in. Fields that come from
+// another file say which, in a comment.
+func FlattenedManifest(stack string) ([]byte, error) {
+	path, err := ResolveStackFile(stack)
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Flatten(path)
+}
+
+// effectiveManifest loads and validates the stack's manifest, applies
+// spec.defaults and substitutes parameters. It also returns the stack name,
+// which for an -f manifest without one is its metadata.name.
+func effectiveManifest(stack string, values map[string]interface{}) (*types.StackManifest, string, error) {
+	path, err := ResolveStackFile(stack)
+	if err != nil {
+		return nil, "", err
+	}
+	m, err := manifest.Load(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if stack == "" {
+		stack = m.Metadata.Name
+	}
+	m = manifest.Effective(m)
+	params, err := stackParams(stack, m, values)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := manifest.ApplyParams(m, params); err != nil {
+		return nil, "", err
+	}
+	if st, err := LoadStackState(stack); err == nil && st.Instance != "" {
+		if _, err := instantiate(stack, path, st.Instance, m); err != nil {
+			return nil, "", err
+		}
+	} else if _, err := allocateNetworks(stack, path, m); err != nil {
+		return nil, "", err
+	}
+	if len(params) > 0 {
+		resolved := make(map[string]types.ParameterSpec, len(params))
+		for name, p := range m.Spec.Parameters {
+			p.Default = manifest.ParamValue(p, params[name])
+			resolved[name] = p
+		}
+		m.Spec.Parameters = resolved
+	}
+	return m, stack, nil
+}
+
+// renderOptions returns the host paths rendered domains of stack refer to;
+// they match where createVM puts disks and seed ISOs. storage, when set,
+// overrides the disk and image directories.
+func renderOptions(stack string, storage *types.StorageSpec) manifest.RenderOptions {
+	d := DefaultXDGDirs()
+	opts := manifest.RenderOptions{
+		Stack:     stack,
+		BaseImage: conf.BaseImage,
+		ImageDir:  d.ImagesDir(),
+		DiskDir:   manifest.DefaultDiskDir,
+		SeedDir:   d.CloudInitDir(),
+	}
+	if storage != nil {
+		opts.DiskDir = orDefault(storage.DiskDir, opts.DiskDir)
+		opts.ImageDir = orDefault(storage.ImageDir, opts.ImageDir)
+	}
+	return opts
+}
+
+// String labels the resource the way the manifest addresses it.
+func (r RenderedXML) String() string {
+	if r.Kind == "network" {
+		return fmt.Sprintf("spec.networks.%s", r.Name)
+	}
+	return fmt.Sprintf("spec.vms.%s", r.Name)
+}
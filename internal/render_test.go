@@ -0,0 +1,272 @@
+package lab_test
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lab "github.com/h3ow3d/nlab/internal"
+	"github.com/h3ow3d/nlab/internal/manifest"
+)
+
+func TestRenderStack(t *testing.T) {
+	isolateXDG(t)
+	setupStack(t, "mixed", `
+apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: mixed
+spec:
+  networks:
+    mixed_net:
+      cidr: 10.30.0.0/24
+  vms:
+    raw:
+      xml: |
+        <domain type="kvm"><name>mixed-raw</name><memory unit="MiB">1024</memory></domain>
+    typed:
+      memory: 1024
+      vcpus: 1
+`)
+	docs, err := lab.RenderStack("mixed", nil)
+	if err != nil {
+		t.Fatalf("RenderStack: %v", err)
+	}
+	var got []string
+	for _, d := range docs {
+		got = append(got, d.String())
+	}
+	if want := "spec.networks.mixed_net spec.vms.raw spec.vms.typed"; strings.Join(got, " ") != want {
+		t.Fatalf("rendered %v, want %s", got, want)
+	}
+	if !strings.Contains(docs[0].XML, `<ip address="10.30.0.1"`) {
+		t.Errorf("network XML not rendered:\n%s", docs[0].XML)
+	}
+	if docs[1].XML != "<domain type=\"kvm\"><name>mixed-raw</name><memory unit=\"MiB\">1024</memory></domain>\n" {
+		t.Errorf("raw VM XML changed: %q", docs[1].XML)
+	}
+	if !strings.Contains(docs[2].XML, "<name>mixed-typed</name>") || !strings.Contains(docs[2].XML, `network="mixed_net"`) {
+		t.Errorf("typed VM XML:\n%s", docs[2].XML)
+	}
+}
+
+func TestRenderStackRejectsInvalidManifest(t *testing.T) {
+	isolateXDG(t)
+	setupStack(t, "bad", `
+apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: bad
+spec:
+  networks:
+    n:
+      cidr: 10.30.0.0/24
+  vms:
+    vm:
+      memory: 1024
+`)
+	if _, err := lab.RenderStack("bad", nil); err == nil || !strings.Contains(err.Error(), "vcpus") {
+		t.Errorf("RenderStack error = %v, want vcpus validation failure", err)
+	}
+}
+
+const defaultsStack = `
+apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: defs
+spec:
+  storage:
+    diskDir: /srv/disks
+  defaults:
+    memory: 2048
+    vcpus: 2
+    sshUser: kali
+  networks:
+    defs_net:
+      cidr: 10.30.0.0/24
+  vms:
+    attacker:
+      memory: 4096
+    target: {}
+`
+
+func TestEffectiveManifest(t *testing.T) {
+	isolateXDG(t)
+	setupStack(t, "defs", defaultsStack)
+	out, err := lab.EffectiveManifest("defs", nil)
+	if err != nil {
+		t.Fatalf("EffectiveManifest: %v", err)
+	}
+	got := string(out)
+	if strings.Contains(got, "defaults:") {
+		t.Errorf("effective manifest still has spec.defaults:\n%s", got)
+	}
+	for _, want := range []string{"memory: 4096", "memory: 2048", "sshUser: kali", "diskDir: /srv/disks"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("effective manifest missing %q:\n%s", want, got)
+		}
+	}
+
+	docs, err := lab.RenderStack("defs", nil)
+	if err != nil {
+		t.Fatalf("RenderStack: %v", err)
+	}
+	if x := docs[len(docs)-1].XML; !strings.Contains(x, "/srv/disks/defs-target.qcow2") || !strings.Contains(x, ">2048</memory>") {
+		t.Errorf("target XML does not use defaults and storage:\n%s", x)
+	}
+}
+
+func TestEffectiveManifestTypedParams(t *testing.T) {
+	isolateXDG(t)
+	setupStack(t, "typed", `
+apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: typed
+spec:
+  parameters:
+    workers: {type: int, default: 2}
+    debug: {type: bool, default: false}
+    packages: {type: list, default: [apache2]}
+    version: {default: "2.4"}
+  networks:
+    net:
+      cidr: 10.40.0.0/24
+  vms:
+    target: {memory: 512, vcpus: 1}
+`)
+	out, err := lab.EffectiveManifest("typed", map[string]interface{}{"workers": "4", "debug": "true", "packages": "apache2,php"})
+	if err != nil {
+		t.Fatalf("EffectiveManifest: %v", err)
+	}
+	for _, want := range []string{"default: 4\n", "default: true\n", "default: \"2.4\"\n"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("effective manifest lacks %q:\n%s", want, out)
+		}
+	}
+
+	// The output loads again, with the values it shows.
+	m, err := manifest.LoadBytes(out, "effective")
+	if err != nil {
+		t.Fatalf("effective manifest does not load: %v\n%s", err, out)
+	}
+	params, err := manifest.ResolveParams(m, nil)
+	if err != nil {
+		t.Fatalf("ResolveParams: %v", err)
+	}
+	want := map[string]string{"workers": "4", "debug": "true", "packages": "[apache2, php]", "version": "2.4"}
+	for name, v := range want {
+		if params[name] != v {
+			t.Errorf("%s = %q, want %q", name, params[name], v)
+		}
+	}
+}
+
+func TestLoadStackAppliesDefaults(t *testing.T) {
+	isolateXDG(t)
+	setupStack(t, "defs", defaultsStack)
+	cfg, err := lab.LoadStack("defs")
+	if err != nil {
+		t.Fatalf("LoadStack: %v", err)
+	}
+	if cfg.DiskDir != "/srv/disks" {
+		t.Errorf("DiskDir = %q, want /srv/disks", cfg.DiskDir)
+	}
+	target, ok := cfg.VM("target")
+	if !ok {
+		t.Fatal("VM(target) not found")
+	}
+	if target.Memory != 2048 || target.VCPUs != 2 || target.User() != "kali" {
+		t.Errorf("target = %+v, want the defaults", target)
+	}
+	if a, _ := cfg.VM("attacker"); a.Memory != 4096 {
+		t.Errorf("attacker memory = %d, want its own 4096", a.Memory)
+	}
+}
+
+// TestRenderMatchesVirtInstall keeps the domain XML nlab render prints for a
+// typed VM in step with the virt-install arguments that create it.
+func TestRenderMatchesVirtInstall(t *testing.T) {
+	isolateXDG(t)
+	setupStack(t, "sync", `
+apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: sync
+spec:
+  storage: {diskDir: /srv/disks, imageDir: /srv/images}
+  networks:
+    lan: {cidr: 10.31.0.0/24}
+    dmz: {cidr: 10.31.1.0/24}
+  vms:
+    web:
+      memory: 2048
+      vcpus: 2
+      disk: {size: 30}
+      image: jammy.img
+      networks: [lan, dmz]
+`)
+	cfg, err := lab.LoadStack("sync")
+	if err != nil {
+		t.Fatalf("LoadStack: %v", err)
+	}
+	docs, err := lab.RenderStack("sync", nil)
+	if err != nil {
+		t.Fatalf("RenderStack: %v", err)
+	}
+	var dom struct {
+		Name   string `xml:"name"`
+		Memory int    `xml:"memory"`
+		VCPU   int    `xml:"vcpu"`
+		Disks  []struct {
+			Source struct {
+				File string `xml:"file,attr"`
+			} `xml:"source"`
+			Backing struct {
+				Source struct {
+					File string `xml:"file,attr"`
+				} `xml:"source"`
+			} `xml:"backingStore"`
+		} `xml:"devices>disk"`
+		Interfaces []struct {
+			Source struct {
+				Network string `xml:"network,attr"`
+			} `xml:"source"`
+			Model struct {
+				Type string `xml:"type,attr"`
+			} `xml:"model"`
+		} `xml:"devices>interface"`
+	}
+	if err := xml.Unmarshal([]byte(docs[len(docs)-1].XML), &dom); err != nil {
+		t.Fatal(err)
+	}
+	if dom.Name != "sync-web" || len(dom.Disks) != 2 || len(dom.Interfaces) != 2 {
+		t.Fatalf("rendered domain = %+v", dom)
+	}
+	var nets []string
+	for _, i := range dom.Interfaces {
+		nets = append(nets, fmt.Sprintf("--network network=%s,model=%s", i.Source.Network, i.Model.Type))
+	}
+	rendered := []string{
+		"--name " + dom.Name,
+		fmt.Sprintf("--memory %d", dom.Memory),
+		fmt.Sprintf("--vcpus %d", dom.VCPU),
+		fmt.Sprintf("--disk path=%s,size=30,backing_store=%s,format=qcow2", dom.Disks[0].Source.File, dom.Disks[0].Backing.Source.File),
+		fmt.Sprintf("--disk path=%s,device=cdrom,readonly=on", dom.Disks[1].Source.File),
+		strings.Join(nets, " "),
+	}
+
+	vm := cfg.VMs[0]
+	args := strings.Join(lab.VirtInstallArgs(lab.VMConfig{
+		Stack: "sync", Role: vm.Name, Memory: vm.Memory, VCPUs: vm.VCPUs, Network: cfg.Network,
+		Networks: vm.Networks, DiskSize: vm.DiskSize, Image: vm.Image, DiskDir: cfg.DiskDir,
+	}, "sync-web", filepath.Join(lab.DefaultXDGDirs().CloudInitDir(), "sync-web-seed.iso")), " ")
+	for _, want := range rendered {
+		if !strings.Contains(args, want) {
+			t.Errorf("virt-install arguments lack %q from the rendered XML:\n%s", want, args)
+		}
+	}
+}
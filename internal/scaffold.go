@@ -0,0 +1,583 @@
+package lab
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+	"github.com/h3ow3d/nlab/internal/types"
+	"github.com/h3ow3d/nlab/stacks"
+)
+
+// maxStackNameLen keeps the bridge name "virbr-<stack>" within the kernel's
+// 15-character interface name limit.
+const maxStackNameLen = 15 - len("virbr-")
+
+var (
+	stackNameRe = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+	ipv4Re      = regexp.MustCompile(`\b\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}\b`)
+	netmaskRe   = regexp.MustCompile(`netmask=["'][^"']*["']`)
+	prefixRe    = regexp.MustCompile(`prefix=["'][^"']*["']`)
+)
+
+// StackInitOptions controls how 'nlab stack init' renders a new stack.
+type StackInitOptions struct {
+	Name   string
+	Subnet string   // CIDR for the primary network; empty keeps the source's
+	Roles  []string // VM roles; empty keeps the source's
+}
+
+// StackScaffold is a rendered stack: file contents keyed by slash-separated
+// path relative to the stack directory.
+type StackScaffold struct {
+	Name  string
+	Files map[string][]byte
+}
+
+// Write creates dir and writes every file into it. dir must not exist yet.
+func (s *StackScaffold) Write(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("%s already exists", dir)
+	}
+	paths := make([]string, 0, len(s.Files))
+	for p := range s.Files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		full := filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			return fmt.Errorf("create %s: %w", filepath.Dir(full), err)
+		}
+		if err := os.WriteFile(full, s.Files[p], 0o644); err != nil {
+			return fmt.Errorf("write %s: %w", full, err)
+		}
+	}
+	return nil
+}
+
+// FindStackDir locates a stack directory by name on StackSearchPath, or
+// accepts ref as a directory path when it contains a stack.yaml.
+func FindStackDir(ref string) (string, error) {
+	if strings.ContainsRune(ref, os.PathSeparator) || ref == "." {
+		if _, err := os.Stat(filepath.Join(ref, stackFileName)); err != nil {
+			return "", fmt.Errorf("%s is not a stack directory: %w", ref, err)
+		}
+		return filepath.Abs(ref)
+	}
+	for _, dir := range StackSearchPath() {
+		candidate := filepath.Join(dir, ref)
+		if _, err := os.Stat(filepath.Join(candidate, stackFileName)); err == nil {
+			return filepath.Abs(candidate)
+		}
+	}
+	return "", fmt.Errorf("stack %q not found on the search path (%s)", ref, strings.Join(StackSearchPath(), ", "))
+}
+
+// StackInitSource locates the stack nlab stack init renders from, as
+// FindStackDir does. When the search path has no "template", the copy built
+// into nlab is written to a temporary directory, which cleanup removes.
+func StackInitSource(ref string) (dir string, cleanup func(), err error) {
+	cleanup = func() {}
+	dir, err = FindStackDir(ref)
+	if err == nil || ref != "template" {
+		return dir, cleanup, err
+	}
+	Info("No template stack on the search path; using the one built into nlab")
+	tmp, err := os.MkdirTemp("", "nlab-template-")
+	if err != nil {
+		return "", cleanup, err
+	}
+	cleanup = func() { _ = os.RemoveAll(tmp) }
+	sub, err := fs.Sub(stacks.Template, "template")
+	if err == nil {
+		err = os.CopyFS(tmp, sub)
+	}
+	if err != nil {
+		cleanup()
+		return "", func() {}, fmt.Errorf("write the built-in template: %w", err)
+	}
+	return tmp, cleanup, nil
+}
+
+// StackLocation is one stack found on the search path.
+type StackLocation struct {
+	Name     string
+	Dir      string
+	Shadowed bool // an earlier search path entry has a stack with the same name
+}
+
+// ListStacks returns every stack on StackSearchPath in search order.
+func ListStacks() []StackLocation {
+	seen := make(map[string]bool)
+	var out []StackLocation
+	for _, dir := range StackSearchPath() {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*", stackFileName))
+		sort.Strings(matches)
+		for _, m := range matches {
+			d := filepath.Dir(m)
+			abs, err := filepath.Abs(d)
+			if err != nil {
+				abs = d
+			}
+			name := filepath.Base(d)
+			out = append(out, StackLocation{Name: name, Dir: abs, Shadowed: seen[name]})
+			seen[name] = true
+		}
+	}
+	return out
+}
+
+// ValidateStackName checks that name is usable for libvirt objects and the
+// network bridge derived from it.
+func ValidateStackName(name string) error {
+	if !stackNameRe.MatchString(name) {
+		return fmt.Errorf("stack name %q must start with a letter and contain only a-z, 0-9 and '-'", name)
+	}
+	if len(name) > maxStackNameLen {
+		return fmt.Errorf("stack name %q is too long: bridge virbr-%s exceeds 15 characters (max %d)",
+			name, name, maxStackNameLen)
+	}
+	return nil
+}
+
+// RenderStackInit renders a new stack from the stack at srcDir. Every
+// libvirt object name, bridge, disk path, hostname and (with Subnet) address
+// derived from the source is rewritten for the new name.
+func RenderStackInit(srcDir string, opts StackInitOptions) (*StackScaffold, error) {
+	if err := ValidateStackName(opts.Name); err != nil {
+		return nil, err
+	}
+	for _, r := range opts.Roles {
+		if !stackNameRe.MatchString(r) {
+			return nil, fmt.Errorf("role %q must start with a letter and contain only a-z, 0-9 and '-'", r)
+		}
+	}
+
+	// Network and VM manifests next to stack.yaml are folded in; referenced
+	// files are inlined (XML) or copied into <role>/ (cloud-init).
+	parsed, err := manifest.Parse(filepath.Join(srcDir, stackFileName))
+	if err != nil {
+		return nil, fmt.Errorf("read source manifest: %w", err)
+	}
+	src := *parsed
+	if len(src.Spec.Networks) == 0 || len(src.Spec.VMs) == 0 {
+		return nil, fmt.Errorf("source %s must be a v1alpha1 manifest with spec.networks and spec.vms", srcDir)
+	}
+	oldName := src.Metadata.Name
+	if oldName == "" {
+		oldName = filepath.Base(srcDir)
+	}
+
+	srcRoles := sortedKeys(src.Spec.VMs)
+	roles := opts.Roles
+	if len(roles) == 0 {
+		roles = srcRoles
+	}
+
+	// Network names and the bridge are renamed everywhere they appear.
+	netNames := make(map[string]string)
+	var pairs []string
+	for _, n := range sortedKeys(src.Spec.Networks) {
+		renamed := opts.Name + "_" + n
+		if strings.Contains(n, oldName) {
+			renamed = strings.Replace(n, oldName, opts.Name, 1)
+		}
+		netNames[n] = renamed
+		pairs = append(pairs, n, renamed)
+	}
+	pairs = append(pairs, "virbr-"+oldName, "virbr-"+opts.Name)
+
+	var subnetMap func(string) (string, error)
+	primary := primaryNetwork(src.Spec.Networks)
+	_, autoPrimary := manifest.AutoPrefix(src.Spec.Networks[primary].CIDR)
+	if opts.Subnet != "" && autoPrimary {
+		if _, err := parseSubnetFlag(opts.Subnet); err != nil {
+			return nil, err
+		}
+	} else if opts.Subnet != "" {
+		primaryXML, err := manifest.NetworkXML(primary, src.Spec.Networks[primary])
+		if err != nil {
+			return nil, err
+		}
+		if subnetMap, err = subnetRewriter(primaryXML, opts.Subnet); err != nil {
+			return nil, err
+		}
+	}
+
+	out := &StackScaffold{Name: opts.Name, Files: make(map[string][]byte)}
+	m := types.StackManifest{
+		APIVersion: src.APIVersion,
+		Kind:       src.Kind,
+		Metadata:   types.ObjectMeta{Name: opts.Name, Labels: src.Metadata.Labels, Annotations: src.Metadata.Annotations},
+		Spec: types.StackSpec{
+			Networks:   make(map[string]types.NetworkSpec),
+			VMs:        make(map[string]types.VMSpec),
+			Storage:    src.Spec.Storage,
+			Parameters: src.Spec.Parameters,
+		},
+	}
+	if d := src.Spec.Defaults; d != nil {
+		defaults := *d
+		defaults.Networks = nil
+		for _, n := range d.Networks {
+			defaults.Networks = append(defaults.Networks, netNames[n])
+		}
+		defaults.CloudInit = nil // inherited cloud-init is written to <role>/
+		m.Spec.Defaults = &defaults
+	}
+	effective := manifest.Effective(&src)
+
+	for n, spec := range src.Spec.Networks {
+		rn := strings.NewReplacer(pairs...)
+		spec.XML = rn.Replace(spec.XML)
+		spec.XMLFile = ""
+		spec.Bridge = rn.Replace(spec.Bridge)
+		if n == primary && autoPrimary && opts.Subnet != "" {
+			spec.CIDR = opts.Subnet
+		}
+		if n == primary && subnetMap != nil {
+			if spec.XML, err = subnetMap(spec.XML); err != nil {
+				return nil, err
+			}
+			if spec.CIDR != "" {
+				spec.CIDR = opts.Subnet
+			}
+			if d := spec.DHCP; d != nil && d.Start != "" {
+				start, err1 := subnetMap(d.Start)
+				end, err2 := subnetMap(d.End)
+				if err1 != nil || err2 != nil {
+					return nil, fmt.Errorf("dhcp range %s-%s does not fit in --subnet %s", d.Start, d.End, opts.Subnet)
+				}
+				spec.DHCP = &types.DHCPSpec{Enabled: true, Start: start, End: end}
+			}
+		}
+		m.Spec.Networks[netNames[n]] = spec
+	}
+
+	for _, role := range roles {
+		base := templateRole(role, src.Spec.VMs, srcRoles)
+		r := roleReplacer(pairs, oldName, base, opts.Name, role)
+		vm := src.Spec.VMs[base]
+		vm.XML = r.Replace(vm.XML)
+		vm.XMLFile = ""
+		vm.Networks = nil
+		for _, n := range src.Spec.VMs[base].Networks {
+			vm.Networks = append(vm.Networks, netNames[n])
+		}
+		vm.CloudInit = nil // cloud-init files are written to <role>/
+
+		var ci types.CloudInitSpec
+		if c := effective.Spec.VMs[base].CloudInit; c != nil {
+			ci = *c
+		}
+		if ci.Dir == "" {
+			ci.Dir = filepath.Join(srcDir, base)
+		}
+		files := map[string]string{
+			"user-data":      orDefault(ci.UserDataFile, filepath.Join(ci.Dir, "user-data")),
+			"meta-data":      orDefault(ci.MetaDataFile, filepath.Join(ci.Dir, "meta-data")),
+			"network-config": ci.NetworkConfigFile,
+		}
+		for _, f := range []string{"user-data", "meta-data", "network-config"} {
+			var content []byte
+			var err error
+			switch {
+			case f == "user-data" && ci.UserData != "":
+				content = []byte(ci.UserData)
+			case files[f] == "":
+				continue
+			default:
+				content, err = os.ReadFile(files[f])
+			}
+			if os.IsNotExist(err) {
+				content = defaultCloudInit(f, base)
+			} else if err != nil {
+				return nil, err
+			}
+			if f == "network-config" {
+				vm.CloudInit = &types.CloudInitSpec{NetworkConfigFile: role + "/network-config"}
+			}
+			text := renameHost(r.Replace(string(content)), base, role)
+			if subnetMap != nil {
+				if text, err = subnetMap(text); err != nil {
+					return nil, err
+				}
+			}
+			out.Files[role+"/"+f] = []byte(text)
+		}
+		m.Spec.VMs[role] = vm
+	}
+
+	if m.Spec.Tmux, err = scaffoldTmux(src.Spec.Tmux, filepath.Join(srcDir, "layout.yaml"),
+		strings.NewReplacer(pairs...), roles); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(manifest.SchemaHeader)
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&m); err != nil {
+		return nil, fmt.Errorf("encode manifest: %w", err)
+	}
+	out.Files[stackFileName] = buf.Bytes()
+	return out, nil
+}
+
+// orDefault returns s, or def when s is empty.
+func orDefault(s, def string) string {
+	if s != "" {
+		return s
+	}
+	return def
+}
+
+// primaryNetwork returns the alphabetically first network with a host
+// address, falling back to the first network.
+func primaryNetwork(networks map[string]types.NetworkSpec) string {
+	names := sortedKeys(networks)
+	for _, n := range names {
+		if networks[n].CIDR != "" || strings.Contains(networks[n].XML, "<ip ") {
+			return n
+		}
+	}
+	return names[0]
+}
+
+// templateRole picks the source VM a new role is cloned from: the role itself
+// when the source has it, else "target", else the last source role.
+func templateRole(role string, vms map[string]types.VMSpec, srcRoles []string) string {
+	if _, ok := vms[role]; ok {
+		return role
+	}
+	if _, ok := vms["target"]; ok {
+		return "target"
+	}
+	return srcRoles[len(srcRoles)-1]
+}
+
+// roleReplacer renames <old>-<base> (domain names, disk paths) to
+// <new>-<role> in addition to the stack-wide pairs.
+func roleReplacer(pairs []string, oldStack, base, newStack, role string) *strings.Replacer {
+	all := append([]string{oldStack + "-" + base, newStack + "-" + role}, pairs...)
+	return strings.NewReplacer(all...)
+}
+
+var hostKeysRe = regexp.MustCompile(`(?m)^([ \t]*(?:hostname|local-hostname|instance-id):[ \t]*)(\S+)[ \t]*$`)
+
+// renameHost rewrites cloud-init hostname, local-hostname and instance-id
+// values equal to from.
+func renameHost(text, from, to string) string {
+	return hostKeysRe.ReplaceAllStringFunc(text, func(line string) string {
+		sub := hostKeysRe.FindStringSubmatch(line)
+		if sub[2] != from {
+			return line
+		}
+		return sub[1] + to
+	})
+}
+
+func defaultCloudInit(file, role string) []byte {
+	if file == "meta-data" {
+		return []byte(fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", role, role))
+	}
+	return []byte(fmt.Sprintf(`#cloud-config
+hostname: %s
+
+users:
+  - name: ubuntu
+    sudo: ALL=(ALL) NOPASSWD:ALL
+    groups: sudo
+    shell: /bin/bash
+    ssh_authorized_keys:
+      - __SSH_PUBLIC_KEY__
+
+disable_root: true
+ssh_pwauth: false
+
+packages: []
+`, role))
+}
+
+// scaffoldTmux builds the new stack's spec.tmux from the source's spec.tmux,
+// or from its legacy layout.yaml. Command panes are kept with names rewritten
+// by r; the window holding ssh panes gets one per role, reusing the source
+// pane of the same VM. Other windows drop ssh panes for roles that are gone.
+func scaffoldTmux(src *types.TmuxSpec, layoutPath string, r *strings.Replacer, roles []string) (*types.TmuxSpec, error) {
+	if src == nil {
+		src = &types.TmuxSpec{}
+		if _, err := os.Stat(layoutPath); err == nil {
+			l, err := LoadLayout(layoutPath)
+			if err != nil {
+				return nil, err
+			}
+			src.Windows = []types.TmuxWindow{l.tmuxWindow()}
+		}
+	}
+	out := &types.TmuxSpec{Preset: src.Preset}
+	if len(src.Windows) == 0 {
+		return out, nil // the preset opens a pane per VM
+	}
+
+	keep := make(map[string]bool)
+	for _, role := range roles {
+		keep[role] = true
+	}
+	sshWindow := 0
+	for i, w := range src.Windows {
+		if hasSSHPane(w) {
+			sshWindow = i
+			break
+		}
+	}
+	for i, w := range src.Windows {
+		nw := types.TmuxWindow{Name: w.Name, Layout: w.Layout}
+		byVM := make(map[string]types.TmuxPane)
+		var other []types.TmuxPane
+		for _, p := range w.Panes {
+			switch {
+			case p.PaneType() == "ssh" && i == sshWindow:
+				byVM[p.VM] = p
+			case p.PaneType() == "ssh":
+				if keep[p.VM] {
+					nw.Panes = append(nw.Panes, p)
+				}
+			default:
+				p.Command = r.Replace(p.Command)
+				other = append(other, p)
+			}
+		}
+		if i == sshWindow {
+			for _, role := range roles {
+				p, ok := byVM[role]
+				if !ok {
+					p = types.TmuxPane{Type: "ssh", VM: role, Title: role}
+				}
+				nw.Panes = append(nw.Panes, p)
+			}
+		}
+		nw.Panes = append(nw.Panes, other...)
+		if len(nw.Panes) > 0 {
+			out.Windows = append(out.Windows, nw)
+		}
+	}
+	return out, nil
+}
+
+func hasSSHPane(w types.TmuxWindow) bool {
+	for _, p := range w.Panes {
+		if p.PaneType() == "ssh" {
+			return true
+		}
+	}
+	return false
+}
+
+// subnetRewriter returns a function that moves every IPv4 address inside the
+// source network's subnet to the same offset in cidr and rewrites the
+// netmask/prefix attributes.
+func subnetRewriter(networkXML, cidr string) (func(string) (string, error), error) {
+	dst, err := parseSubnetFlag(cidr)
+	if err != nil {
+		return nil, err
+	}
+	dstOnes, _ := dst.Mask.Size()
+
+	src, err := networkSubnet(networkXML)
+	if err != nil {
+		return nil, err
+	}
+	srcBase := ipToUint(src.IP)
+	dstBase := ipToUint(dst.IP)
+	dstSize := uint32(1) << (32 - dstOnes)
+
+	return func(text string) (string, error) {
+		var rerr error
+		text = ipv4Re.ReplaceAllStringFunc(text, func(s string) string {
+			ip := net.ParseIP(s).To4()
+			if ip == nil || !src.Contains(ip) {
+				return s
+			}
+			off := ipToUint(ip) - srcBase
+			if off >= dstSize-1 {
+				rerr = fmt.Errorf("address %s does not fit in --subnet %s", s, cidr)
+				return s
+			}
+			return uintToIP(dstBase + off).String()
+		})
+		text = netmaskRe.ReplaceAllString(text, fmt.Sprintf(`netmask="%s"`, net.IP(dst.Mask).String()))
+		text = prefixRe.ReplaceAllString(text, fmt.Sprintf(`prefix="%d"`, dstOnes))
+		return text, rerr
+	}, nil
+}
+
+// parseSubnetFlag checks the --subnet of nlab stack init.
+func parseSubnetFlag(cidr string) (*net.IPNet, error) {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil || subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("--subnet %q must be an IPv4 CIDR such as 10.10.30.0/24", cidr)
+	}
+	if ones, _ := subnet.Mask.Size(); ones > 30 {
+		return nil, fmt.Errorf("--subnet %s is too small; use /30 or larger", cidr)
+	}
+	return subnet, nil
+}
+
+var ipElemRe = regexp.MustCompile(`<ip\s[^>]*>`)
+var attrRe = regexp.MustCompile(`(\w+)=["']([^"']*)["']`)
+
+// networkSubnet returns the subnet of the first <ip> element in a libvirt
+// network definition.
+func networkSubnet(networkXML string) (*net.IPNet, error) {
+	elem := ipElemRe.FindString(networkXML)
+	if elem == "" {
+		return nil, fmt.Errorf("source network has no <ip> element to re-address")
+	}
+	attrs := make(map[string]string)
+	for _, m := range attrRe.FindAllStringSubmatch(elem, -1) {
+		attrs[m[1]] = m[2]
+	}
+	ip := net.ParseIP(attrs["address"]).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("source network <ip> has no IPv4 address")
+	}
+	mask := net.IPMask(net.ParseIP(attrs["netmask"]).To4())
+	if p, err := strconv.Atoi(attrs["prefix"]); err == nil {
+		mask = net.CIDRMask(p, 32)
+	}
+	if mask == nil {
+		return nil, fmt.Errorf("source network <ip> has neither netmask nor prefix")
+	}
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+func ipToUint(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uintToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,187 @@
+package lab_test
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	lab "github.com/h3ow3d/nlab/internal"
+	"github.com/h3ow3d/nlab/internal/manifest"
+)
+
+func TestRenderStackInitRewritesNames(t *testing.T) {
+	sc, err := lab.RenderStackInit(filepath.Join("..", "stacks", "basic"), lab.StackInitOptions{
+		Name:   "ad",
+		Subnet: "10.10.30.0/24",
+		Roles:  []string{"attacker", "dc"},
+	})
+	if err != nil {
+		t.Fatalf("RenderStackInit: %v", err)
+	}
+
+	m := string(sc.Files["stack.yaml"])
+	if _, err := manifest.LoadBytes(sc.Files["stack.yaml"], "ad"); err != nil {
+		t.Fatalf("rendered manifest is invalid: %v", err)
+	}
+	if !strings.HasPrefix(m, manifest.SchemaHeader) {
+		t.Errorf("manifest should start with the schema modeline:\n%s", m)
+	}
+	for _, want := range []string{
+		"name: ad\n",
+		"<name>ad_net</name>",
+		`<bridge name="virbr-ad"`,
+		`<ip address="10.10.30.1" netmask="255.255.255.0">`,
+		`<range start="10.10.30.100" end="10.10.30.200"/>`,
+		"<name>ad-attacker</name>",
+		"<name>ad-dc</name>",
+		"/var/lib/libvirt/images/ad-dc.qcow2",
+		`<source network="ad_net"/>`,
+	} {
+		if !strings.Contains(m, want) {
+			t.Errorf("manifest missing %q", want)
+		}
+	}
+	for _, stale := range []string{"basic", "10.10.10.", "target:"} {
+		if strings.Contains(m, stale) {
+			t.Errorf("manifest still contains %q", stale)
+		}
+	}
+
+	if got := string(sc.Files["dc/meta-data"]); got != "instance-id: dc\nlocal-hostname: dc\n" {
+		t.Errorf("dc/meta-data = %q", got)
+	}
+	if ud := string(sc.Files["dc/user-data"]); !strings.Contains(ud, "hostname: dc\n") || !strings.Contains(ud, "__SSH_PUBLIC_KEY__") {
+		t.Errorf("dc/user-data not rewritten:\n%s", ud)
+	}
+	if _, ok := sc.Files["target/user-data"]; ok {
+		t.Error("dropped role target still has cloud-init files")
+	}
+
+	if _, ok := sc.Files["layout.yaml"]; ok {
+		t.Error("scaffold should put the layout in spec.tmux, not layout.yaml")
+	}
+	if !strings.Contains(m, "vm: dc") || strings.Contains(m, "vm: target") {
+		t.Errorf("spec.tmux panes not rewritten:\n%s", m)
+	}
+	if !strings.Contains(m, "{bridge:ad_net}") {
+		t.Errorf("spec.tmux lost the monitor pane or its network rename:\n%s", m)
+	}
+}
+
+func TestRenderStackInitRejectsBadInput(t *testing.T) {
+	src := filepath.Join("..", "stacks", "template")
+	for _, opts := range []lab.StackInitOptions{
+		{Name: "Bad_Name"},
+		{Name: "waytoolongname"},
+		{Name: "ok", Roles: []string{"no spaces"}},
+		{Name: "ok", Subnet: "10.10.30.0/31"},
+		{Name: "ok", Subnet: "fd00::/64"},
+	} {
+		if _, err := lab.RenderStackInit(src, opts); err == nil {
+			t.Errorf("RenderStackInit(%+v) succeeded, want error", opts)
+		}
+	}
+}
+
+func TestStackScaffoldWrite(t *testing.T) {
+	sc, err := lab.RenderStackInit(filepath.Join("..", "stacks", "template"), lab.StackInitOptions{Name: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "web")
+	if err := sc.Write(dir); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := manifest.Load(filepath.Join(dir, "stack.yaml")); err != nil {
+		t.Errorf("written manifest is invalid: %v", err)
+	}
+	if err := sc.Write(dir); err == nil {
+		t.Error("Write over an existing directory succeeded")
+	}
+}
+
+func TestRenderStackInitTypedSource(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, src, "stack.yaml", `
+apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: typed
+spec:
+  networks:
+    typed_net:
+      cidr: 10.20.0.0/24
+      bridge: virbr-typed
+      dhcp: {start: 10.20.0.50, end: 10.20.0.60}
+  vms:
+    attacker:
+      memory: 2048
+      vcpus: 2
+      networks: [typed_net]
+      cloudInit: {dir: ci/attacker}
+`)
+	if err := os.MkdirAll(filepath.Join(src, "ci", "attacker"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, src, "ci/attacker/meta-data", "instance-id: attacker\nlocal-hostname: attacker\n")
+
+	sc, err := lab.RenderStackInit(src, lab.StackInitOptions{Name: "lab", Subnet: "10.40.0.0/24"})
+	if err != nil {
+		t.Fatalf("RenderStackInit: %v", err)
+	}
+	m, err := manifest.LoadBytes(sc.Files["stack.yaml"], "lab")
+	if err != nil {
+		t.Fatalf("rendered manifest is invalid: %v\n%s", err, sc.Files["stack.yaml"])
+	}
+	n, ok := m.Spec.Networks["lab_net"]
+	if !ok || n.CIDR != "10.40.0.0/24" || n.Bridge != "virbr-lab" || n.DHCP.Start != "10.40.0.50" || n.DHCP.End != "10.40.0.60" {
+		t.Errorf("lab_net = %+v (dhcp %+v)", n, n.DHCP)
+	}
+	vm := m.Spec.VMs["attacker"]
+	if vm.Memory != 2048 || len(vm.Networks) != 1 || vm.Networks[0] != "lab_net" || vm.CloudInit != nil {
+		t.Errorf("attacker = %+v", vm)
+	}
+	if got := string(sc.Files["attacker/meta-data"]); got != "instance-id: attacker\nlocal-hostname: attacker\n" {
+		t.Errorf("attacker/meta-data = %q, want the source's cloudInit.dir copy", got)
+	}
+}
+
+func TestStackInitSourceBuiltinTemplate(t *testing.T) {
+	isolateXDG(t) // a temp dir with no stacks/ and an empty library
+	if _, err := lab.FindStackDir("template"); err == nil {
+		t.Fatal("template found on the search path of an empty temp dir")
+	}
+	dir, cleanup, err := lab.StackInitSource("template")
+	if err != nil {
+		t.Fatalf("StackInitSource: %v", err)
+	}
+	sc, err := lab.RenderStackInit(dir, lab.StackInitOptions{Name: "foo"})
+	cleanup()
+	if err != nil {
+		t.Fatalf("RenderStackInit from the built-in template: %v", err)
+	}
+	if _, err := manifest.LoadBytes(sc.Files["stack.yaml"], "foo"); err != nil {
+		t.Errorf("rendered manifest is invalid: %v", err)
+	}
+	if _, ok := sc.Files["attacker/user-data"]; !ok {
+		t.Errorf("cloud-init files missing: %v", sortedFiles(sc))
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("cleanup left %s behind", dir)
+	}
+
+	if _, _, err := lab.StackInitSource("nope"); err == nil {
+		t.Error("StackInitSource fell back to the template for another name")
+	}
+}
+
+func sortedFiles(sc *lab.StackScaffold) []string {
+	var out []string
+	for p := range sc.Files {
+		out = append(out, p)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,503 @@
+package lab
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// sshProbeTimeout bounds a single readiness probe (dial + handshake + auth).
+	sshProbeTimeout = 2 * time.Second
+	// sshProbeInterval is the minimum time between two real probes of the same
+	// address; callers polling faster get the cached result.
+	sshProbeInterval = time.Second
+)
+
+// SSHState describes how far an SSH readiness probe got.
+type SSHState int
+
+const (
+	SSHUnknown         SSHState = iota // not probed yet (e.g. no IP address)
+	SSHTCPClosed                       // connection refused, timed out, or closed before the banner
+	SSHBanner                          // server banner received but the handshake did not complete
+	SSHHostKeyMismatch                 // host key is not the one pinned in known_hosts
+	SSHAuthFailed                      // handshake completed but the public key was rejected
+	SSHAuthOK                          // authenticated; the VM is ready
+)
+
+// String returns a short human-readable label for the state.
+func (s SSHState) String() string {
+	switch s {
+	case SSHTCPClosed:
+		return "tcp closed"
+	case SSHBanner:
+		return "banner"
+	case SSHHostKeyMismatch:
+		return "host key mismatch"
+	case SSHAuthFailed:
+		return "auth failed"
+	case SSHAuthOK:
+		return "auth ok"
+	default:
+		return "unknown"
+	}
+}
+
+// Ready reports whether the probe authenticated successfully.
+func (s SSHState) Ready() bool { return s == SSHAuthOK }
+
+// SSHClient is a pure-Go SSH client that keeps one authenticated connection
+// per address and reuses it for readiness probes and remote commands.
+// Host keys are always verified against the KnownHosts file; use
+// SetHostAlias to check an address against a named entry such as
+// <stack>-<role>. It is safe for concurrent use.
+type SSHClient struct {
+	User       string
+	KeyPaths   []string      // private keys offered in order; missing files are skipped
+	KnownHosts string        // known_hosts file holding the pinned host keys
+	Timeout    time.Duration // per-probe timeout; 0 → sshProbeTimeout
+
+	mu      sync.Mutex
+	signers []ssh.Signer
+	aliases map[string]string
+	users   map[string]string // alias → login user, when not User
+	clients map[string]*ssh.Client
+	last    map[string]sshProbeResult
+}
+
+type sshProbeResult struct {
+	state SSHState
+	at    time.Time
+}
+
+// NewSSHClient returns a client that authenticates as user with the given
+// private keys and verifies host keys against knownHosts. Keys are read
+// lazily on first use.
+func NewSSHClient(user, knownHosts string, keyPaths ...string) *SSHClient {
+	return &SSHClient{
+		User:       user,
+		KeyPaths:   keyPaths,
+		KnownHosts: knownHosts,
+		aliases:    make(map[string]string),
+		users:      make(map[string]string),
+		clients:    make(map[string]*ssh.Client),
+		last:       make(map[string]sshProbeResult),
+	}
+}
+
+// StackSSHClient returns a new client that authenticates with the stack's
+// keys (including any per-VM keys) and trusts only the stack's pinned host
+// keys. VMs with their own sshUser log in as that user.
+func StackSSHClient(stack string) *SSHClient {
+	c := NewSSHClient(conf.SSHUser, KnownHostsPath(stack), StackKeyPaths(stack)...)
+	if cfg, err := LoadStack(stack); err == nil {
+		for _, v := range cfg.VMs {
+			if v.SSHUser != "" {
+				c.SetUser(stack+"-"+v.Name, v.SSHUser)
+			}
+		}
+	}
+	return c
+}
+
+var (
+	sharedSSHMu      sync.Mutex
+	sharedSSHClients = make(map[string]*SSHClient)
+)
+
+// sharedSSHClient returns the process-wide client for stack so that the
+// dashboard and the readiness wait loop share connections and probe results.
+func sharedSSHClient(stack string) *SSHClient {
+	sharedSSHMu.Lock()
+	defer sharedSSHMu.Unlock()
+	c, ok := sharedSSHClients[stack]
+	if !ok {
+		c = StackSSHClient(stack)
+		sharedSSHClients[stack] = c
+	}
+	return c
+}
+
+// SetHostAlias makes host-key verification for addr look up alias in the
+// known_hosts file instead of the address itself. VM addresses come from
+// DHCP and may change; the pinned entry is keyed by the VM name.
+func (c *SSHClient) SetHostAlias(addr, alias string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.aliases[sshAddr(addr)] = alias
+}
+
+// SetUser makes connections checked against alias log in as user instead of
+// User.
+func (c *SSHClient) SetUser(alias, user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users[alias] = user
+}
+
+// Probe checks SSH readiness of addr (host or host:port). Results are cached
+// for sshProbeInterval so concurrent pollers do not multiply connection
+// attempts. Once authenticated, the connection is kept open and subsequent
+// probes only send a keepalive.
+func (c *SSHClient) Probe(addr string) SSHState {
+	addr = sshAddr(addr)
+
+	c.mu.Lock()
+	if r, ok := c.last[addr]; ok && time.Since(r.at) < sshProbeInterval {
+		c.mu.Unlock()
+		return r.state
+	}
+	c.mu.Unlock()
+
+	state := SSHAuthOK
+	if _, err := c.client(addr); err != nil {
+		state = classifySSHError(err)
+	}
+
+	c.mu.Lock()
+	c.last[addr] = sshProbeResult{state: state, at: time.Now()}
+	c.mu.Unlock()
+	return state
+}
+
+// Run executes command on addr, wiring the given streams to the remote
+// session. Any nil stream is left unattached.
+func (c *SSHClient) Run(addr, command string, stdin io.Reader, stdout, stderr io.Writer) error {
+	client, err := c.client(sshAddr(addr))
+	if err != nil {
+		return err
+	}
+	sess, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("ssh session: %w", err)
+	}
+	defer sess.Close()
+	sess.Stdin = stdin
+	sess.Stdout = stdout
+	sess.Stderr = stderr
+	return sess.Run(command)
+}
+
+// Output runs command on addr and returns its stdout.
+func (c *SSHClient) Output(addr, command string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	if err := c.Run(addr, command, nil, &stdout, &stderr); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return stdout.Bytes(), fmt.Errorf("%w: %s", err, msg)
+		}
+		return stdout.Bytes(), err
+	}
+	return stdout.Bytes(), nil
+}
+
+// CopyTo uploads the local file src to dst on addr, preserving its mode bits.
+func (c *SSHClient) CopyTo(addr, src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	q := shellQuote(dst)
+	cmd := fmt.Sprintf("cat > %s && chmod %o %s", q, fi.Mode().Perm(), q)
+	var stderr bytes.Buffer
+	if err := c.Run(addr, cmd, f, nil, &stderr); err != nil {
+		return fmt.Errorf("copy %s to %s: %w: %s", src, addr, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// CopyFrom downloads src on addr to the local file dst.
+func (c *SSHClient) CopyFrom(addr, src, dst string) error {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var stderr bytes.Buffer
+	if err := c.Run(addr, "cat "+shellQuote(src), nil, f, &stderr); err != nil {
+		return fmt.Errorf("copy %s from %s: %w: %s", src, addr, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Close closes every cached connection.
+func (c *SSHClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for addr, cl := range c.clients {
+		_ = cl.Close()
+		delete(c.clients, addr)
+	}
+}
+
+// client returns a live, authenticated connection to addr, dialing a new one
+// if there is no cached connection or the cached one no longer answers a
+// keepalive.
+func (c *SSHClient) client(addr string) (*ssh.Client, error) {
+	c.mu.Lock()
+	cl := c.clients[addr]
+	c.mu.Unlock()
+
+	if cl != nil {
+		if c.alive(cl) {
+			return cl, nil
+		}
+		_ = cl.Close()
+		c.mu.Lock()
+		if c.clients[addr] == cl {
+			delete(c.clients, addr)
+		}
+		c.mu.Unlock()
+	}
+
+	cl, err := c.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if existing := c.clients[addr]; existing != nil {
+		// Another goroutine won the race; keep its connection.
+		c.mu.Unlock()
+		_ = cl.Close()
+		return existing, nil
+	}
+	c.clients[addr] = cl
+	c.mu.Unlock()
+	return cl, nil
+}
+
+// alive sends an OpenSSH keepalive request and waits at most one timeout for
+// the reply.
+func (c *SSHClient) alive(cl *ssh.Client) bool {
+	res := make(chan error, 1)
+	go func() {
+		_, _, err := cl.SendRequest("keepalive@openssh.com", true, nil)
+		res <- err
+	}()
+	select {
+	case err := <-res:
+		return err == nil
+	case <-time.After(c.timeout()):
+		return false
+	}
+}
+
+func (c *SSHClient) dial(addr string) (*ssh.Client, error) {
+	signers, err := c.loadSigners()
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCheck, err := c.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	alias, ok := c.aliases[addr]
+	user := c.User
+	if u, found := c.users[alias]; ok && found {
+		user = u
+	}
+	c.mu.Unlock()
+	if !ok {
+		alias, _, _ = net.SplitHostPort(addr)
+	}
+	timeout := c.timeout()
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, &sshProbeError{state: SSHTCPClosed, err: err}
+	}
+	bc := &bannerConn{Conn: conn}
+	_ = bc.SetDeadline(time.Now().Add(timeout))
+
+	var hostKeyErr error
+	config := &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: func(_ string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = hostKeyCheck(net.JoinHostPort(alias, "22"), remote, key)
+			return hostKeyErr
+		},
+		HostKeyAlgorithms: []string{ssh.KeyAlgoED25519},
+		Timeout:           timeout,
+	}
+	sc, chans, reqs, err := ssh.NewClientConn(bc, addr, config)
+	if err != nil {
+		_ = conn.Close()
+		state := SSHTCPClosed
+		switch {
+		case hostKeyErr != nil:
+			state = SSHHostKeyMismatch
+		case strings.Contains(err.Error(), "unable to authenticate"):
+			state = SSHAuthFailed
+		case bc.banner:
+			state = SSHBanner
+		}
+		return nil, &sshProbeError{state: state, err: err}
+	}
+	// Clear the handshake deadline; sessions may run for a long time.
+	_ = bc.SetDeadline(time.Time{})
+	return ssh.NewClient(sc, chans, reqs), nil
+}
+
+// hostKeyCallback loads the pinned host keys. A missing known_hosts file
+// means nothing is pinned yet, so every host key is rejected.
+func (c *SSHClient) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if c.KnownHosts == "" {
+		return nil, fmt.Errorf("no known_hosts file configured for host-key verification")
+	}
+	if _, err := os.Stat(c.KnownHosts); os.IsNotExist(err) {
+		return func(hostname string, _ net.Addr, _ ssh.PublicKey) error {
+			return fmt.Errorf("no pinned host key for %s in %s (recreate the VM to pin one)", hostname, c.KnownHosts)
+		}, nil
+	}
+	cb, err := knownhosts.New(c.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("load pinned host keys: %w", err)
+	}
+	return cb, nil
+}
+
+func (c *SSHClient) loadSigners() ([]ssh.Signer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.signers != nil {
+		return c.signers, nil
+	}
+	var signers []ssh.Signer
+	for _, p := range c.KeyPaths {
+		data, err := os.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read SSH key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse SSH key %s: %w", p, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no SSH key found (looked in %s)", strings.Join(c.KeyPaths, ", "))
+	}
+	c.signers = signers
+	return signers, nil
+}
+
+func (c *SSHClient) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return sshProbeTimeout
+}
+
+// sshProbeError carries the readiness state reached before a dial failed.
+type sshProbeError struct {
+	state SSHState
+	err   error
+}
+
+func (e *sshProbeError) Error() string { return e.err.Error() }
+func (e *sshProbeError) Unwrap() error { return e.err }
+
+// classifySSHError maps a dial error to the readiness state it implies.
+func classifySSHError(err error) SSHState {
+	if pe, ok := err.(*sshProbeError); ok {
+		return pe.state
+	}
+	return SSHUnknown
+}
+
+// bannerConn records whether the remote side has sent its SSH version banner.
+// The handshake reads the version line a byte at a time, so the first bytes
+// are accumulated until the "SSH-" prefix can be recognised.
+type bannerConn struct {
+	net.Conn
+	prefix []byte
+	banner bool
+}
+
+func (b *bannerConn) Read(p []byte) (int, error) {
+	n, err := b.Conn.Read(p)
+	if !b.banner && n > 0 {
+		b.prefix = append(b.prefix, p[:n]...)
+		b.banner = bytes.Contains(b.prefix, []byte("SSH-"))
+		if len(b.prefix) > 256 {
+			b.prefix = b.prefix[len(b.prefix)-4:]
+		}
+	}
+	return n, err
+}
+
+// sshAddr appends the default SSH port when addr has none.
+func sshAddr(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, "22")
+}
+
+// shellQuote single-quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// VMAddress resolves the DHCP-leased IP address of <stack>-<role> on network,
+// from the MAC of its interface there.
+func VMAddress(stack, network, role string) (string, error) {
+	name := stack + "-" + role
+	mac := DomainMACOn(name, network)
+	if mac == "" {
+		return "", fmt.Errorf("VM %s has no interface on %s (is it defined?)", name, network)
+	}
+	ip := DHCPLeaseIP(network, mac)
+	if ip == "" {
+		return "", fmt.Errorf("VM %s has no DHCP lease on %s yet", name, network)
+	}
+	return ip, nil
+}
+
+// StackVMAddress resolves the DHCP-leased address of <stack>-<role> on the
+// first of its networks the host has an address on, the primary network for
+// a legacy stack.
+func StackVMAddress(stack string, cfg *StackConfig, role string) (string, error) {
+	vm, ok := cfg.VM(role)
+	if !ok {
+		return "", fmt.Errorf("stack %s has no VM %q", stack, role)
+	}
+	hostNets := map[string]bool{}
+	for _, n := range cfg.HostNetworks {
+		hostNets[n] = true
+	}
+	networks := vm.Networks
+	if len(networks) == 0 {
+		networks = []string{cfg.Network}
+		hostNets[cfg.Network] = true
+	}
+	name := stack + "-" + role
+	for _, n := range networks {
+		if !hostNets[n] {
+			continue
+		}
+		if mac := DomainMACOn(name, n); mac != "" {
+			if ip := DHCPLeaseIP(n, mac); ip != "" {
+				return ip, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("VM %s has no DHCP lease on a network the host is on (%s)", name, strings.Join(networks, ", "))
+}
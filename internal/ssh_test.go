@@ -0,0 +1,239 @@
+package lab_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	lab "github.com/h3ow3d/nlab/internal"
+)
+
+// writeTestKey generates an ed25519 key, writes the private half in OpenSSH
+// PEM format to dir/id_ed25519 and returns its path and public key.
+func writeTestKey(t *testing.T, dir string) (string, ssh.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, sshPub
+}
+
+// startSSHServer runs a minimal SSH server that accepts only authorized and
+// answers every "exec" request by echoing the command to stdout. It returns
+// the listen address and the server's host public key.
+func startSSHServer(t *testing.T, authorized ssh.PublicKey) (string, ssh.PublicKey) {
+	t.Helper()
+	_, hostPriv, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSHConn(conn, config)
+		}
+	}()
+	return ln.Addr().String(), hostSigner.PublicKey()
+}
+
+// pinnedClient returns a client for key that trusts hostKey under the alias
+// "test-vm" for addr.
+func pinnedClient(t *testing.T, key, addr string, hostKey ssh.PublicKey) *lab.SSHClient {
+	t.Helper()
+	kh := filepath.Join(t.TempDir(), "known_hosts")
+	if err := lab.PinHostKey(kh, "test-vm", hostKey); err != nil {
+		t.Fatal(err)
+	}
+	c := lab.NewSSHClient("ubuntu", kh, key)
+	c.SetHostAlias(addr, "test-vm")
+	return c
+}
+
+func serveSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for req := range chReqs {
+				if req.Type != "exec" {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				_ = req.Reply(true, nil)
+				var payload struct{ Command string }
+				_ = ssh.Unmarshal(req.Payload, &payload)
+				_, _ = ch.Write([]byte(payload.Command))
+				_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+				return
+			}
+		}()
+	}
+}
+
+func TestSSHProbeAuthOK(t *testing.T) {
+	key, pub := writeTestKey(t, t.TempDir())
+	addr, hostKey := startSSHServer(t, pub)
+
+	c := pinnedClient(t, key, addr, hostKey)
+	defer c.Close()
+	if got := c.Probe(addr); got != lab.SSHAuthOK {
+		t.Errorf("Probe = %v, want %v", got, lab.SSHAuthOK)
+	}
+
+	out, err := c.Output(addr, "hostname")
+	if err != nil {
+		t.Fatalf("Output: %v", err)
+	}
+	if string(out) != "hostname" {
+		t.Errorf("Output = %q, want %q", out, "hostname")
+	}
+}
+
+func TestSSHProbeAuthFailed(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := writeTestKey(t, dir)
+	_, other := writeTestKey(t, t.TempDir())
+	addr, hostKey := startSSHServer(t, other)
+
+	c := pinnedClient(t, key, addr, hostKey)
+	defer c.Close()
+	if got := c.Probe(addr); got != lab.SSHAuthFailed {
+		t.Errorf("Probe = %v, want %v", got, lab.SSHAuthFailed)
+	}
+}
+
+func TestSSHProbeHostKeyMismatch(t *testing.T) {
+	key, pub := writeTestKey(t, t.TempDir())
+	addr, _ := startSSHServer(t, pub)
+	impostor, err := lab.GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := pinnedClient(t, key, addr, impostor.Public)
+	defer c.Close()
+	if got := c.Probe(addr); got != lab.SSHHostKeyMismatch {
+		t.Errorf("Probe = %v, want %v", got, lab.SSHHostKeyMismatch)
+	}
+}
+
+func TestSSHProbeBannerOnly(t *testing.T) {
+	key, _ := writeTestKey(t, t.TempDir())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("SSH-2.0-OpenSSH_test\r\n"))
+		time.Sleep(50 * time.Millisecond)
+		conn.Close()
+	}()
+
+	c := lab.NewSSHClient("ubuntu", filepath.Join(t.TempDir(), "known_hosts"), key)
+	if got := c.Probe(ln.Addr().String()); got != lab.SSHBanner {
+		t.Errorf("Probe = %v, want %v", got, lab.SSHBanner)
+	}
+}
+
+func TestSSHProbeTCPClosed(t *testing.T) {
+	key, _ := writeTestKey(t, t.TempDir())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c := lab.NewSSHClient("ubuntu", filepath.Join(t.TempDir(), "known_hosts"), key)
+	c.Timeout = 200 * time.Millisecond
+	if got := c.Probe(addr); got != lab.SSHTCPClosed {
+		t.Errorf("Probe = %v, want %v", got, lab.SSHTCPClosed)
+	}
+}
+
+func TestSSHStateString(t *testing.T) {
+	cases := map[lab.SSHState]string{
+		lab.SSHUnknown:         "unknown",
+		lab.SSHTCPClosed:       "tcp closed",
+		lab.SSHBanner:          "banner",
+		lab.SSHHostKeyMismatch: "host key mismatch",
+		lab.SSHAuthFailed:      "auth failed",
+		lab.SSHAuthOK:          "auth ok",
+	}
+	for s, want := range cases {
+		if got := s.String(); got != want {
+			t.Errorf("SSHState(%d).String() = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestVMAddressOnNetwork(t *testing.T) {
+	fakeVirsh(t, map[string]string{
+		"domiflist ad-dc": " Interface   Type      Source   Model    MAC\n" +
+			"-----------------------------------------------------------\n" +
+			" vnet0       network   outer    virtio   52:54:00:00:00:0a\n" +
+			" vnet1       network   inner    virtio   52:54:00:00:00:0b",
+		"net-dhcp-leases inner": " Expiry Time   MAC address         Protocol   IP address    Hostname   Client ID or DUID\n" +
+			" 2030-01-01    52:54:00:00:00:0b   ipv4       10.9.0.5/24   dc         -",
+	})
+	if ip, err := lab.VMAddress("ad", "inner", "dc"); err != nil || ip != "10.9.0.5" {
+		t.Errorf("VMAddress(inner) = %q, %v; want the lease of the interface on inner", ip, err)
+	}
+	if _, err := lab.VMAddress("ad", "outer", "dc"); err == nil {
+		t.Error("VMAddress(outer) found a lease the network does not have")
+	}
+}
@@ -0,0 +1,208 @@
+package lab
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SSHHost is one Host block in a generated OpenSSH config fragment.
+type SSHHost struct {
+	Alias        string // <stack>-<role>
+	HostName     string // empty when the VM has no DHCP lease yet
+	User         string
+	IdentityFile string
+	KnownHosts   string
+	ProxyJump    string // alias of the jump host, when the host cannot reach the VM directly
+}
+
+// StackSSHHosts resolves the Host entries for every VM in a stack. VMs with
+// no interface on a network the host has an address on are reached through
+// ProxyJump via the first (alphabetical) VM that shares a network with them
+// and is itself directly reachable.
+func StackSSHHosts(stack string, cfg *StackConfig) ([]SSHHost, error) {
+	knownHosts := KnownHostsPath(stack)
+
+	hostNets := make(map[string]bool)
+	for _, n := range cfg.HostNetworks {
+		hostNets[n] = true
+	}
+
+	vms := append([]VMSpec(nil), cfg.VMs...)
+	sort.Slice(vms, func(i, j int) bool { return vms[i].Name < vms[j].Name })
+
+	direct := func(v VMSpec) (string, bool) {
+		for _, n := range v.Networks {
+			if hostNets[n] {
+				return n, true
+			}
+		}
+		return "", false
+	}
+
+	var hosts []SSHHost
+	for _, v := range vms {
+		// The key that logs in to this VM: its own, or one a rotation kept.
+		key, err := filepath.Abs(KeyPathFor(stack, v.Name))
+		if err != nil {
+			return nil, err
+		}
+		h := SSHHost{
+			Alias:        stack + "-" + v.Name,
+			User:         v.User(),
+			IdentityFile: key,
+			KnownHosts:   knownHosts,
+		}
+		if network, ok := direct(v); ok {
+			h.HostName = DHCPLeaseIP(network, DomainMACOn(h.Alias, network))
+		} else if jump, network := sshJumpHost(v, vms, direct); jump != "" {
+			h.ProxyJump = stack + "-" + jump
+			h.HostName = DHCPLeaseIP(network, DomainMACOn(h.Alias, network))
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
+
+// sshJumpHost picks a directly reachable VM sharing a network with v and
+// returns its role and the shared network.
+func sshJumpHost(v VMSpec, vms []VMSpec, direct func(VMSpec) (string, bool)) (string, string) {
+	for _, j := range vms {
+		if j.Name == v.Name {
+			continue
+		}
+		if _, ok := direct(j); !ok {
+			continue
+		}
+		for _, n := range v.Networks {
+			for _, jn := range j.Networks {
+				if n == jn {
+					return j.Name, n
+				}
+			}
+		}
+	}
+	return "", ""
+}
+
+// RenderSSHConfig renders the OpenSSH config fragment for a stack. Hosts
+// without an address are listed as comments so the file stays valid.
+func RenderSSHConfig(stack string, hosts []SSHHost) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by nlab for stack %q. Do not edit; regenerate with:\n", stack)
+	fmt.Fprintf(&b, "#   nlab ssh-config %s\n", stack)
+	for _, h := range hosts {
+		b.WriteString("\n")
+		if h.HostName == "" {
+			fmt.Fprintf(&b, "# %s: no address yet (VM not running or no DHCP lease)\n", h.Alias)
+			continue
+		}
+		fmt.Fprintf(&b, "Host %s\n", h.Alias)
+		fmt.Fprintf(&b, "    HostName %s\n", h.HostName)
+		fmt.Fprintf(&b, "    User %s\n", h.User)
+		fmt.Fprintf(&b, "    IdentityFile %s\n", sshConfigQuote(h.IdentityFile))
+		b.WriteString("    IdentitiesOnly yes\n")
+		fmt.Fprintf(&b, "    UserKnownHostsFile %s\n", sshConfigQuote(h.KnownHosts))
+		b.WriteString("    StrictHostKeyChecking yes\n")
+		fmt.Fprintf(&b, "    HostKeyAlias %s\n", h.Alias)
+		if h.ProxyJump != "" {
+			fmt.Fprintf(&b, "    ProxyJump %s\n", h.ProxyJump)
+		}
+	}
+	return b.String()
+}
+
+// WriteSSHConfig regenerates the stack's OpenSSH config fragment under
+// XDGDirs.SSHConfigFile and returns its path.
+func WriteSSHConfig(stack string, cfg *StackConfig) (string, error) {
+	hosts, err := StackSSHHosts(stack, cfg)
+	if err != nil {
+		return "", err
+	}
+	path := DefaultXDGDirs().SSHConfigFile(stack)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", fmt.Errorf("create ssh config dir: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(RenderSSHConfig(stack, hosts)), 0o600); err != nil {
+		return "", fmt.Errorf("write ssh config: %w", err)
+	}
+	return path, nil
+}
+
+// RemoveSSHConfig deletes the stack's OpenSSH config fragment, if any.
+func RemoveSSHConfig(stack string) error {
+	err := os.Remove(DefaultXDGDirs().SSHConfigFile(stack))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove ssh config: %w", err)
+	}
+	return nil
+}
+
+// SSHIncludeLine returns the single Include directive that pulls every
+// generated stack fragment into the user's OpenSSH config.
+func SSHIncludeLine() string {
+	return "Include " + sshConfigQuote(filepath.Join(DefaultXDGDirs().SSHConfigDir(), "*.conf"))
+}
+
+// UserSSHConfigPath returns ~/.ssh/config.
+func UserSSHConfigPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".ssh", "config"), nil
+}
+
+// HasSSHInclude reports whether the OpenSSH config at path already contains
+// line.
+func HasSSHInclude(path, line string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, l := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(l) == line {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AddSSHInclude prepends line to the OpenSSH config at path unless it is
+// already present. Include must come before any Host block to apply
+// globally, so it is always inserted at the top.
+func AddSSHInclude(path, line string) error {
+	has, err := HasSSHInclude(path, line)
+	if err != nil || has {
+		return err
+	}
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("create %s: %w", filepath.Dir(path), err)
+	}
+	content := "# Added by nlab\n" + line + "\n"
+	if len(existing) > 0 {
+		content += "\n" + string(existing)
+	}
+	mode := os.FileMode(0o600)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	return os.WriteFile(path, []byte(content), mode)
+}
+
+// sshConfigQuote double-quotes s when it contains whitespace.
+func sshConfigQuote(s string) string {
+	if strings.ContainsAny(s, " \t") {
+		return `"` + s + `"`
+	}
+	return s
+}
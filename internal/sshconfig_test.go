@@ -0,0 +1,137 @@
+package lab_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lab "github.com/h3ow3d/nlab/internal"
+)
+
+func TestRenderSSHConfig(t *testing.T) {
+	hosts := []lab.SSHHost{
+		{
+			Alias:        "basic-attacker",
+			HostName:     "10.10.10.101",
+			User:         "ubuntu",
+			IdentityFile: "/home/u/keys/basic/id_ed25519",
+			KnownHosts:   "/home/u/.local/state/nlab/known_hosts/basic",
+		},
+		{
+			Alias:        "basic-dc",
+			HostName:     "10.10.30.5",
+			User:         "ubuntu",
+			IdentityFile: "/home/u/my keys/id_ed25519",
+			KnownHosts:   "/kh",
+			ProxyJump:    "basic-attacker",
+		},
+		{Alias: "basic-target"},
+	}
+	got := lab.RenderSSHConfig("basic", hosts)
+
+	for _, want := range []string{
+		"Host basic-attacker\n    HostName 10.10.10.101\n    User ubuntu\n",
+		"    UserKnownHostsFile /home/u/.local/state/nlab/known_hosts/basic\n",
+		"    StrictHostKeyChecking yes\n    HostKeyAlias basic-attacker\n",
+		"    IdentityFile \"/home/u/my keys/id_ed25519\"\n",
+		"    ProxyJump basic-attacker\n",
+		"# basic-target: no address yet",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("rendered config missing %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "Host basic-target") {
+		t.Errorf("host without address must not get a Host block:\n%s", got)
+	}
+}
+
+func TestStackSSHHostsProxyJump(t *testing.T) {
+	isolateXDG(t)
+	cfg := &lab.StackConfig{
+		Network:      "lab_net",
+		HostNetworks: []string{"lab_net"},
+		VMs: []lab.VMSpec{
+			{Name: "target", Networks: []string{"inner_net"}},
+			{Name: "attacker", Networks: []string{"lab_net", "inner_net"}},
+		},
+	}
+	hosts, err := lab.StackSSHHosts("ad", cfg)
+	if err != nil {
+		t.Fatalf("StackSSHHosts: %v", err)
+	}
+	if len(hosts) != 2 {
+		t.Fatalf("len(hosts) = %d, want 2", len(hosts))
+	}
+	if hosts[0].Alias != "ad-attacker" || hosts[0].ProxyJump != "" {
+		t.Errorf("hosts[0] = %+v, want direct ad-attacker", hosts[0])
+	}
+	if hosts[1].Alias != "ad-target" || hosts[1].ProxyJump != "ad-attacker" {
+		t.Errorf("hosts[1] = %+v, want ad-target via ad-attacker", hosts[1])
+	}
+	if !filepath.IsAbs(hosts[0].IdentityFile) {
+		t.Errorf("IdentityFile %q is not absolute", hosts[0].IdentityFile)
+	}
+}
+
+func TestStackSSHHostsPerVMKey(t *testing.T) {
+	isolateXDG(t)
+	if err := lab.EnsureKey("ad"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lab.EnsureVMKey("ad", "target"); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &lab.StackConfig{Network: "lab_net", HostNetworks: []string{"lab_net"},
+		VMs: []lab.VMSpec{{Name: "attacker"}, {Name: "target"}}}
+	hosts, err := lab.StackSSHHosts("ad", cfg)
+	if err != nil {
+		t.Fatalf("StackSSHHosts: %v", err)
+	}
+	if hosts[0].IdentityFile != lab.StackKeyPath("ad") {
+		t.Errorf("attacker IdentityFile = %q, want the stack key", hosts[0].IdentityFile)
+	}
+	if hosts[1].IdentityFile != lab.VMKeyPath("ad", "target") {
+		t.Errorf("target IdentityFile = %q, want its own key %q", hosts[1].IdentityFile, lab.VMKeyPath("ad", "target"))
+	}
+}
+
+func TestAddSSHInclude(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".ssh", "config")
+	const line = "Include /home/u/.config/nlab/ssh/*.conf"
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("Host work\n    HostName example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lab.AddSSHInclude(path, line); err != nil {
+		t.Fatalf("AddSSHInclude: %v", err)
+	}
+	if err := lab.AddSSHInclude(path, line); err != nil {
+		t.Fatalf("AddSSHInclude (second): %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), line); n != 1 {
+		t.Errorf("Include line appears %d times, want 1:\n%s", n, data)
+	}
+	if strings.Index(string(data), line) > strings.Index(string(data), "Host work") {
+		t.Errorf("Include line must precede existing Host blocks:\n%s", data)
+	}
+	fi, _ := os.Stat(path)
+	if fi.Mode().Perm() != 0o644 {
+		t.Errorf("mode = %o, want existing 644 preserved", fi.Mode().Perm())
+	}
+
+	has, err := lab.HasSSHInclude(path, line)
+	if err != nil || !has {
+		t.Errorf("HasSSHInclude = %v, %v; want true", has, err)
+	}
+}
@@ -4,45 +4,171 @@ import (
 	"encoding/xml"
 	"fmt"
 	"os"
-	"sort"
+	"regexp"
 	"strings"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+	"github.com/h3ow3d/nlab/internal/types"
 )
 
-// StackConfig is the top-level structure of a stacks/<name>/stack.yaml file.
+// StackConfig is the top-level structure of a <stack>/stack.yaml file.
 type StackConfig struct {
 	Network    string   `yaml:"network"`
 	NetworkXML string   `yaml:"-"` // populated from v1alpha1 spec.networks.<name>.xml
 	VMs        []VMSpec `yaml:"vms"`
+
+	// HostNetworks lists the networks on which the host itself has an address
+	// (an <ip> element in the network XML), i.e. those it can reach VMs on.
+	HostNetworks []string `yaml:"-"`
+
+	// Tmux is the v1alpha1 spec.tmux, nil when the manifest has none.
+	Tmux *types.TmuxSpec `yaml:"-"`
+
+	// NetworkDefs holds every v1alpha1 network, sorted by name, with its raw
+	// or rendered XML.
+	NetworkDefs []NetworkDef `yaml:"-"`
+
+	// DiskDir is the v1alpha1 spec.storage.diskDir; empty means libvirt's
+	// default pool.
+	DiskDir string `yaml:"-"`
+
+	// Params holds the effective spec.parameters values substituted into the
+	// manifest; cloud-init files are substituted when a VM is created.
+	Params map[string]string `yaml:"-"`
+
+	// Leases holds the subnets and bridges allocated to auto networks, keyed
+	// by network; nlab up saves them in the stack state.
+	Leases map[string]SubnetLease `yaml:"-"`
+
+	// Instance is the instance name when the stack was loaded as one, whose
+	// networks are named <network>-<instance>.
+	Instance string `yaml:"-"`
+}
+
+// bridgeNameRe captures the name of a <bridge> element in network XML.
+var bridgeNameRe = regexp.MustCompile(`<bridge\s[^>]*name=["']([^"']*)["']`)
+
+// Bridge returns the host bridge of the stack's network named network in the
+// manifest: the one its XML names, which includes a leased bridge, or else
+// the one libvirt picked for the running network. It is empty when neither
+// is known.
+func (c *StackConfig) Bridge(network string) string {
+	name := c.NetworkName(network)
+	for _, n := range c.AllNetworks() {
+		if n.Name != name {
+			continue
+		}
+		if m := bridgeNameRe.FindStringSubmatch(n.XML); m != nil {
+			return m[1]
+		}
+		if _, _, _, bridge := networkInfo(name); bridge != "n/a" && bridge != "" {
+			return bridge
+		}
+	}
+	return ""
+}
+
+// NetworkName returns the libvirt name of the stack's network named network
+// in the manifest: <network>-<instance> for an instance, else network.
+func (c *StackConfig) NetworkName(network string) string {
+	if c.Instance != "" {
+		return network + "-" + c.Instance
+	}
+	return network
+}
+
+// NetworkDef is one libvirt network of a stack.
+type NetworkDef struct {
+	Name string
+	XML  string
+	// Egress is the network's egress policy, nil when it has none.
+	Egress *types.EgressSpec
+	// Impairment degrades the links of the network's VMs, nil when it has
+	// none.
+	Impairment *types.ImpairmentSpec
+}
+
+// AllNetworks returns the networks nlab defines for the stack: NetworkDefs,
+// or just the primary network for legacy stacks.
+func (c *StackConfig) AllNetworks() []NetworkDef {
+	if len(c.NetworkDefs) > 0 {
+		return c.NetworkDefs
+	}
+	return []NetworkDef{{Name: c.Network, XML: c.NetworkXML}}
 }
 
 // VMSpec describes one VM within a stack.
 type VMSpec struct {
-	Name   string `yaml:"name"`
-	Memory int    `yaml:"memory"` // MiB
-	VCPUs  int    `yaml:"vcpus"`
+	Name     string   `yaml:"name"`
+	Memory   int      `yaml:"memory"` // MiB
+	VCPUs    int      `yaml:"vcpus"`
+	Networks []string `yaml:"-"` // networks the VM has interfaces on
+
+	// Set only for typed v1alpha1 VMs; zero values mean the defaults.
+	DiskSize int    `yaml:"-"` // GiB
+	Image    string `yaml:"-"` // absolute base image path
+
+	// CloudInit is the v1alpha1 cloudInit section with absolute paths.
+	CloudInit types.CloudInitSpec `yaml:"-"`
+
+	// SSHUser is the v1alpha1 sshUser, after spec.defaults.
+	SSHUser string `yaml:"-"`
+
+	// Ports is the v1alpha1 ports section.
+	Ports []types.PortSpec `yaml:"-"`
+}
+
+// User returns the login user of the VM: its sshUser, else the configured
+// one.
+func (v VMSpec) User() string {
+	return orDefault(v.SSHUser, conf.SSHUser)
 }
 
-// LoadStack reads stacks/<name>/stack.yaml and returns the parsed StackConfig.
-// It supports both the legacy flat format and the v1alpha1 manifest format.
+// VM returns the VM named role.
+func (c *StackConfig) VM(role string) (VMSpec, bool) {
+	for _, v := range c.VMs {
+		if v.Name == role {
+			return v, true
+		}
+	}
+	return VMSpec{}, false
+}
+
+// LoadStack reads the stack's manifest, located with ResolveStackFile, and
+// returns the parsed StackConfig. It supports both the legacy flat format and
+// the v1alpha1 manifest format. Parameters take the values saved by the last
+// nlab up (see LoadStackParams).
 func LoadStack(stackName string) (*StackConfig, error) {
-	path := fmt.Sprintf("stacks/%s/stack.yaml", stackName)
+	return LoadStackParams(stackName, nil)
+}
+
+// LoadStackParams is LoadStack with spec.parameters values (from
+// ParamValues) overriding the manifest defaults. nil values means the ones
+// saved in the stack state by the last nlab up.
+func LoadStackParams(stackName string, values map[string]interface{}) (*StackConfig, error) {
+	if st, err := LoadStackState(stackName); err == nil && st.Instance != "" {
+		return loadInstance(st.Manifest, st.Stack, st.Instance, values)
+	}
+	path, err := ResolveStackFile(stackName)
+	if err != nil {
+		return nil, err
+	}
+	if isV1alpha1(path) {
+		return loadStackV1alpha1(path, stackName, values, "")
+	}
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("read stack config %s: %w", path, err)
 	}
-
-	// Detect v1alpha1 format by checking for top-level apiVersion and kind keys.
-	var meta struct {
-		APIVersion string `yaml:"apiVersion"`
-		Kind       string `yaml:"kind"`
-	}
-	if err := yaml.Unmarshal(data, &meta); err == nil && meta.APIVersion != "" && meta.Kind != "" {
-		return loadStackV1alpha1(data, path)
+	if len(values) > 0 {
+		return nil, fmt.Errorf("stack config %s: parameters need a v1alpha1 manifest", path)
 	}
 
 	// Legacy flat format.
+	Warn(fmt.Sprintf("%s uses the deprecated legacy format, which the next minor release drops: run nlab migrate %s",
+		path, orDefault(stackName, "-f "+path)))
 	var cfg StackConfig
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("parse stack config %s: %w", path, err)
@@ -53,36 +179,67 @@ func LoadStack(stackName string) (*StackConfig, error) {
 	if len(cfg.VMs) == 0 {
 		return nil, fmt.Errorf("stack config %s: at least one vm is required", path)
 	}
+	cfg.HostNetworks = []string{cfg.Network}
+	for i := range cfg.VMs {
+		cfg.VMs[i].Networks = []string{cfg.Network}
+	}
 	return &cfg, nil
 }
 
-// v1alpha1Raw is used to unmarshal only the fields LoadStack needs from a
-// v1alpha1 manifest, without importing the manifest package (avoiding cycles).
-type v1alpha1Raw struct {
-	Spec struct {
-		Networks map[string]struct {
-			XML string `yaml:"xml"`
-		} `yaml:"networks"`
-		VMs map[string]struct {
-			XML string `yaml:"xml"`
-		} `yaml:"vms"`
-	} `yaml:"spec"`
-}
-
-// domainMemVCPU is a minimal representation used to extract memory and vcpu
-// from a libvirt domain XML fragment.
+// domainMemVCPU is a minimal representation used to extract memory, vcpu and
+// attached networks from a libvirt domain XML fragment.
 type domainMemVCPU struct {
 	Memory struct {
 		Unit  string `xml:"unit,attr"`
 		Value int    `xml:",chardata"`
 	} `xml:"memory"`
-	VCPU int `xml:"vcpu"`
+	VCPU       int `xml:"vcpu"`
+	Interfaces []struct {
+		Source struct {
+			Network string `xml:"network,attr"`
+		} `xml:"source"`
+	} `xml:"devices>interface"`
 }
 
-func loadStackV1alpha1(data []byte, path string) (*StackConfig, error) {
-	var raw v1alpha1Raw
-	if err := yaml.Unmarshal(data, &raw); err != nil {
-		return nil, fmt.Errorf("parse stack config %s: %w", path, err)
+// networkHostIP is a minimal representation used to tell whether the host has
+// an address on a libvirt network.
+type networkHostIP struct {
+	IPs []struct {
+		Address string `xml:"address,attr"`
+	} `xml:"ip"`
+}
+
+// isV1alpha1 reports whether path is a directory of manifests or a file with
+// top-level apiVersion and kind keys, i.e. not a legacy flat stack.
+func isV1alpha1(path string) bool {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return true
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	var meta struct {
+		APIVersion string `yaml:"apiVersion"`
+		Kind       string `yaml:"kind"`
+	}
+	return yaml.Unmarshal(data, &meta) == nil && meta.APIVersion != "" && meta.Kind != ""
+}
+
+// loadStackV1alpha1 loads the manifest at path as stackName, or as its
+// instance when one is given.
+func loadStackV1alpha1(path, stackName string, values map[string]interface{}, instance string) (*StackConfig, error) {
+	parsed, err := manifest.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := *manifest.Effective(parsed)
+	params, err := stackParams(stackName, &raw, values)
+	if err != nil {
+		return nil, fmt.Errorf("stack config %s: %w", path, err)
+	}
+	if err := manifest.ApplyParams(&raw, params); err != nil {
+		return nil, fmt.Errorf("stack config %s: %w", path, err)
 	}
 
 	if len(raw.Spec.Networks) == 0 {
@@ -91,27 +248,66 @@ func loadStackV1alpha1(data []byte, path string) (*StackConfig, error) {
 	if len(raw.Spec.VMs) == 0 {
 		return nil, fmt.Errorf("stack config %s: spec.vms is required", path)
 	}
+	var leases map[string]SubnetLease
+	if instance != "" {
+		leases, err = instantiate(stackName, path, instance, &raw)
+	} else {
+		leases, err = allocateNetworks(orDefault(stackName, raw.Metadata.Name), path, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("stack config %s: %w", path, err)
+	}
 
 	// Use the first network (sorted alphabetically for deterministic selection).
 	// v1alpha1 manifests typically define a single network; if multiple are
 	// present the alphabetically first name is chosen.
-	var networkNames []string
-	for name := range raw.Spec.Networks {
-		networkNames = append(networkNames, name)
+	networkName := manifest.PrimaryNetwork(&raw)
+	networkXMLs := map[string]string{}
+	for name, n := range raw.Spec.Networks {
+		x, err := manifest.NetworkXML(name, n)
+		if err != nil {
+			return nil, fmt.Errorf("stack config %s: %w", path, err)
+		}
+		networkXMLs[name] = x
 	}
-	sort.Strings(networkNames)
-	networkName := networkNames[0]
-	networkXML := strings.TrimSpace(raw.Spec.Networks[networkName].XML)
+	networkXML := strings.TrimSpace(networkXMLs[networkName])
 
 	if networkXML == "" {
-		return nil, fmt.Errorf("stack config %s: spec.networks.%s.xml is required and must be non-empty", path, networkName)
+		return nil, fmt.Errorf("stack config %s: spec.networks.%s needs xml or cidr", path, networkName)
 	}
 
-	cfg := &StackConfig{Network: networkName, NetworkXML: networkXML}
+	cfg := &StackConfig{Network: networkName, NetworkXML: networkXML, Tmux: raw.Spec.Tmux, Params: params, Leases: leases, Instance: instance}
+	for _, name := range sortedKeys(networkXMLs) {
+		cfg.NetworkDefs = append(cfg.NetworkDefs, NetworkDef{Name: name, XML: strings.TrimSpace(networkXMLs[name]),
+			Egress: raw.Spec.Networks[name].Egress, Impairment: raw.Spec.Networks[name].Impairment})
+		var n networkHostIP
+		if err := xml.Unmarshal([]byte(networkXMLs[name]), &n); err != nil {
+			continue
+		}
+		for _, ip := range n.IPs {
+			if ip.Address != "" {
+				cfg.HostNetworks = append(cfg.HostNetworks, name)
+				break
+			}
+		}
+	}
 
+	opts := renderOptions(raw.Metadata.Name, raw.Spec.Storage)
+	if raw.Spec.Storage != nil {
+		cfg.DiskDir = raw.Spec.Storage.DiskDir
+	}
 	for name, vm := range raw.Spec.VMs {
-		spec := VMSpec{Name: name}
-		if vm.XML != "" {
+		spec := VMSpec{Name: name, SSHUser: vm.SSHUser, Ports: vm.Ports}
+		if vm.CloudInit != nil {
+			spec.CloudInit = *vm.CloudInit
+		}
+		if vm.Typed() {
+			spec.Memory = vm.Memory
+			spec.VCPUs = vm.VCPUs
+			spec.Networks = manifest.VMNetworks(&raw, vm)
+			spec.DiskSize = manifest.DiskSize(vm)
+			spec.Image = manifest.ImagePath(vm, opts)
+		} else if vm.XML != "" {
 			var d domainMemVCPU
 			if err := xml.Unmarshal([]byte(vm.XML), &d); err != nil {
 				return nil, fmt.Errorf("stack config %s: parse VM %s domain XML: %w", path, name, err)
@@ -128,6 +324,11 @@ func loadStackV1alpha1(data []byte, path string) (*StackConfig, error) {
 			}
 			spec.Memory = mem
 			spec.VCPUs = d.VCPU
+			for _, iface := range d.Interfaces {
+				if iface.Source.Network != "" {
+					spec.Networks = append(spec.Networks, iface.Source.Network)
+				}
+			}
 		}
 		cfg.VMs = append(cfg.VMs, spec)
 	}
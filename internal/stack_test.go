@@ -3,6 +3,7 @@ package lab_test
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	lab "github.com/h3ow3d/nlab/internal"
@@ -143,3 +144,136 @@ spec:
 		t.Errorf("attacker.VCPUs = %d, want 2", attacker.VCPUs)
 	}
 }
+
+func TestLoadStackV1alpha1Networks(t *testing.T) {
+	setupStack(t, "multi", `
+apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: multi
+spec:
+  networks:
+    outer:
+      xml: |
+        <network><name>outer</name><ip address="10.0.0.1" netmask="255.255.255.0"/></network>
+    inner:
+      xml: |
+        <network><name>inner</name></network>
+  vms:
+    gw:
+      xml: |
+        <domain type="kvm">
+          <memory unit="MiB">1024</memory>
+          <vcpu>1</vcpu>
+          <devices>
+            <interface type="network"><source network="outer"/></interface>
+            <interface type="network"><source network="inner"/></interface>
+          </devices>
+        </domain>
+`)
+	cfg, err := lab.LoadStack("multi")
+	if err != nil {
+		t.Fatalf("LoadStack: %v", err)
+	}
+	if len(cfg.HostNetworks) != 1 || cfg.HostNetworks[0] != "outer" {
+		t.Errorf("HostNetworks = %v, want [outer]", cfg.HostNetworks)
+	}
+	if got := cfg.VMs[0].Networks; len(got) != 2 || got[0] != "outer" || got[1] != "inner" {
+		t.Errorf("gw.Networks = %v, want [outer inner]", got)
+	}
+}
+
+func TestLoadStackV1alpha1Typed(t *testing.T) {
+	dir := isolateXDG(t)
+	setupStack(t, "typed", `
+apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: typed
+spec:
+  networks:
+    lan:
+      cidr: 10.20.1.0/24
+      mode: isolated
+    wan:
+      cidr: 10.20.0.0/24
+  vms:
+    attacker:
+      memory: 4096
+      vcpus: 2
+      disk: {size: 40}
+      networks: [wan, lan]
+      image: focal.img
+      cloudInit: {dir: shared/attacker}
+`)
+	cfg, err := lab.LoadStack("typed")
+	if err != nil {
+		t.Fatalf("LoadStack: %v", err)
+	}
+	if cfg.Network != "lan" || !strings.Contains(cfg.NetworkXML, "<name>lan</name>") {
+		t.Errorf("primary network = %q with XML %q, want rendered lan", cfg.Network, cfg.NetworkXML)
+	}
+	if len(cfg.NetworkDefs) != 2 || cfg.NetworkDefs[0].Name != "lan" || cfg.NetworkDefs[1].Name != "wan" {
+		t.Errorf("NetworkDefs = %+v, want lan and wan", cfg.NetworkDefs)
+	}
+	if len(cfg.HostNetworks) != 2 {
+		t.Errorf("HostNetworks = %v, want both typed networks", cfg.HostNetworks)
+	}
+	vm := cfg.VMs[0]
+	if vm.Memory != 4096 || vm.VCPUs != 2 || vm.DiskSize != 40 {
+		t.Errorf("attacker = %+v", vm)
+	}
+	if len(vm.Networks) != 2 || vm.Networks[0] != "wan" || vm.Networks[1] != "lan" {
+		t.Errorf("attacker.Networks = %v, want [wan lan]", vm.Networks)
+	}
+	if want := filepath.Join(dir, "data", "nlab", "images", "focal.img"); vm.Image != want {
+		t.Errorf("attacker.Image = %q, want %q", vm.Image, want)
+	}
+	if !strings.HasSuffix(vm.CloudInit.Dir, filepath.Join("stacks", "typed", "shared", "attacker")) || !filepath.IsAbs(vm.CloudInit.Dir) {
+		t.Errorf("attacker.CloudInit.Dir = %q, want an absolute path under the stack dir", vm.CloudInit.Dir)
+	}
+}
+
+func TestLoadStackV1alpha1FileRefs(t *testing.T) {
+	setupStack(t, "refs", `
+apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: refs
+spec:
+  networks:
+    net:
+      xmlFile: net.xml
+  vms:
+    attacker:
+      xmlFile: attacker.xml
+      cloudInit:
+        userDataFile: attacker.cloud-config
+`)
+	dir := filepath.Join("stacks", "refs")
+	writeFile(t, dir, "net.xml", `<network><name>net</name><ip address="10.0.0.1" netmask="255.255.255.0"/></network>`)
+	writeFile(t, dir, "attacker.xml", `<domain type="kvm"><memory unit="MiB">3072</memory><vcpu>3</vcpu></domain>`)
+	writeFile(t, dir, "attacker.cloud-config", "#cloud-config\nhostname: attacker\n")
+
+	cfg, err := lab.LoadStack("refs")
+	if err != nil {
+		t.Fatalf("LoadStack: %v", err)
+	}
+	if !strings.Contains(cfg.NetworkXML, `address="10.0.0.1"`) {
+		t.Errorf("NetworkXML = %q, want the contents of net.xml", cfg.NetworkXML)
+	}
+	vm := cfg.VMs[0]
+	if vm.Memory != 3072 || vm.VCPUs != 3 {
+		t.Errorf("attacker = %+v, want memory and vcpus from attacker.xml", vm)
+	}
+	if !filepath.IsAbs(vm.CloudInit.UserDataFile) || filepath.Base(vm.CloudInit.UserDataFile) != "attacker.cloud-config" {
+		t.Errorf("UserDataFile = %q, want an absolute path", vm.CloudInit.UserDataFile)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "attacker.xml")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lab.LoadStack("refs"); err == nil || !strings.Contains(err.Error(), "attacker.xml") {
+		t.Errorf("LoadStack with a missing xmlFile: err = %v", err)
+	}
+}
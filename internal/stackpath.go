@@ -0,0 +1,132 @@
+package lab
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+)
+
+// stackFileName is the manifest file inside a stack directory.
+const stackFileName = "stack.yaml"
+
+func init() {
+	// spec.extends names stacks the way the CLI does, but never means -f.
+	manifest.FindStack = searchStack
+}
+
+// stackFileOverride is the manifest given with -f. When set it is used for
+// every stack instead of searching StackSearchPath.
+var stackFileOverride string
+
+// SetStackFile makes path the manifest for every stack loaded by this
+// process, bypassing the search path. An empty path restores the search.
+func SetStackFile(path string) {
+	stackFileOverride = path
+}
+
+// StackSearchPath returns the absolute directories searched, in order, for
+// <dir>/<stack>/stack.yaml: those of the stackPath setting, by default
+// ./stacks, then XDGDirs.StacksDir.
+func StackSearchPath() []string {
+	return conf.stackPath()
+}
+
+// ResolveStackFile returns the absolute path of the manifest for stack: the
+// -f file or directory when one was given, the manifest an instance was
+// brought up from, otherwise the first match on StackSearchPath.
+func ResolveStackFile(stack string) (string, error) {
+	if stackFileOverride != "" {
+		if _, err := os.Stat(stackFileOverride); err != nil {
+			return "", fmt.Errorf("stack file: %w", err)
+		}
+		return filepath.Abs(stackFileOverride)
+	}
+	if st, err := LoadStackState(stack); err == nil && st.Instance != "" {
+		return st.Manifest, nil
+	}
+	path, err := searchStack(stack)
+	if err != nil {
+		return "", fmt.Errorf("%w; use -f <file> to point at a manifest", err)
+	}
+	return path, nil
+}
+
+// searchStack returns the absolute path of the first manifest for stack on
+// StackSearchPath.
+func searchStack(stack string) (string, error) {
+	var tried []string
+	for _, dir := range StackSearchPath() {
+		path := filepath.Join(dir, stack, stackFileName)
+		if _, err := os.Stat(path); err == nil {
+			return filepath.Abs(path)
+		}
+		tried = append(tried, path)
+	}
+	return "", fmt.Errorf("stack %q not found (looked in %s)", stack, strings.Join(tried, ", "))
+}
+
+// StackDir returns the directory holding the stack's manifest. Files the
+// manifest references (XML, cloud-init, tmux pane cwd) are resolved relative
+// to it.
+func StackDir(stack string) (string, error) {
+	path, err := ResolveStackFile(stack)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return path, nil
+	}
+	return filepath.Dir(path), nil
+}
+
+// MigrateLegacyDirs moves the keys and logs that older nlab versions wrote
+// under root into their XDG locations: keys/<stack>/id_ed25519{,.pub} and
+// logs/<stack>-*.log or logs/<stack>-events.jsonl, for each stack in
+// root/stacks. Nothing happens unless root is an nlab working directory
+// (it has a stacks directory), and any other file in keys/ or logs/ is left
+// alone. Files that already exist at the destination are left where they
+// are. It returns the destination of every file moved.
+func (d XDGDirs) MigrateLegacyDirs(root string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(root, "stacks"))
+	if err != nil {
+		return nil, nil // not an nlab working directory
+	}
+	var moves [][2]string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		stack := e.Name()
+		for _, name := range []string{keyFileName, keyFileName + ".pub"} {
+			moves = append(moves, [2]string{
+				filepath.Join(root, "keys", stack, name),
+				filepath.Join(d.KeysDir(), stack, name),
+			})
+		}
+		logs, _ := filepath.Glob(filepath.Join(root, "logs", stack+"-*.log"))
+		logs = append(logs, filepath.Join(root, "logs", stack+"-events.jsonl"))
+		for _, l := range logs {
+			moves = append(moves, [2]string{l, filepath.Join(d.LogsDir(), filepath.Base(l))})
+		}
+	}
+
+	var moved []string
+	for _, m := range moves {
+		src, dst := m[0], m[1]
+		if !fileExists(src) || fileExists(dst) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+			return moved, err
+		}
+		if err := moveFile(src, dst); err != nil {
+			return moved, fmt.Errorf("migrate %s: %w", src, err)
+		}
+		moved = append(moved, dst)
+		_ = os.Remove(filepath.Dir(src)) // keys/<stack>, once emptied
+	}
+	return moved, nil
+}
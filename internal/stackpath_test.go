@@ -0,0 +1,212 @@
+package lab_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lab "github.com/h3ow3d/nlab/internal"
+)
+
+func writeStackFile(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("network: lab\nvms:\n  - name: a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveStackFileSearchOrder(t *testing.T) {
+	tmp := isolateXDG(t)
+	t.Cleanup(func() { lab.SetStackFile("") })
+
+	library := filepath.Join(lab.DefaultXDGDirs().StacksDir(), "basic", "stack.yaml")
+	writeStackFile(t, library)
+	if got, err := lab.ResolveStackFile("basic"); err != nil || got != library {
+		t.Errorf("ResolveStackFile = %q, %v; want XDG library %q", got, err, library)
+	}
+
+	local := filepath.Join(tmp, "stacks", "basic", "stack.yaml")
+	writeStackFile(t, local)
+	if got, err := lab.ResolveStackFile("basic"); err != nil || got != local {
+		t.Errorf("ResolveStackFile = %q, %v; want ./stacks %q", got, err, local)
+	}
+
+	explicit := filepath.Join(tmp, "elsewhere", "lab.yaml")
+	writeStackFile(t, explicit)
+	lab.SetStackFile(explicit)
+	if got, err := lab.ResolveStackFile("basic"); err != nil || got != explicit {
+		t.Errorf("ResolveStackFile with -f = %q, %v; want %q", got, err, explicit)
+	}
+	if dir, _ := lab.StackDir("basic"); dir != filepath.Dir(explicit) {
+		t.Errorf("StackDir with -f = %q, want %q", dir, filepath.Dir(explicit))
+	}
+	lab.SetStackFile("")
+
+	_, err := lab.ResolveStackFile("missing")
+	if err == nil || !strings.Contains(err.Error(), "-f") {
+		t.Errorf("ResolveStackFile(missing) error = %v, want a hint about -f", err)
+	}
+}
+
+func TestStackPathSetting(t *testing.T) {
+	tmp := isolateXDG(t)
+	t.Cleanup(func() { lab.SetConfig(lab.DefaultConfig()) })
+	confDir := filepath.Join(tmp, "team")
+	path := filepath.Join(confDir, "config.yaml")
+	if err := os.MkdirAll(confDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("stackPath: labs:"+filepath.Join(tmp, "shared")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	writeStackFile(t, filepath.Join(tmp, "stacks", "web", "stack.yaml")) // ./stacks is not on this path
+	shared := filepath.Join(tmp, "shared", "web", "stack.yaml")
+	writeStackFile(t, shared)
+	labs := filepath.Join(confDir, "labs", "web", "stack.yaml")
+	writeStackFile(t, labs)
+
+	cfg, err := lab.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	lab.SetConfig(cfg)
+	if got := lab.StackSearchPath(); len(got) != 2 || got[0] != filepath.Join(confDir, "labs") {
+		t.Errorf("StackSearchPath = %v, want labs relative to the config file first", got)
+	}
+	if got, err := lab.ResolveStackFile("web"); err != nil || got != labs {
+		t.Errorf("ResolveStackFile = %q, %v; want %q", got, err, labs)
+	}
+
+	// The environment wins over the file.
+	t.Setenv("NLAB_STACK_PATH", filepath.Join(tmp, "shared"))
+	if cfg, err = lab.LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	lab.SetConfig(cfg)
+	if got, err := lab.ResolveStackFile("web"); err != nil || got != shared || cfg.Source("stackPath") != lab.SourceEnv {
+		t.Errorf("ResolveStackFile with NLAB_STACK_PATH = %q, %v; want %q", got, err, shared)
+	}
+}
+
+func TestMigrateLegacyDirs(t *testing.T) {
+	tmp := isolateXDG(t)
+	dirs := lab.DefaultXDGDirs()
+
+	files := map[string]string{
+		"keys/.gitkeep":             "",
+		"keys/basic/id_ed25519":     "private",
+		"keys/basic/id_ed25519.pub": "public",
+		"keys/foo/id_rsa":           "not nlab's",
+		"logs/basic-attacker.log":   "log",
+		"logs/basic-events.jsonl":   "events",
+		"logs/app.log":              "not nlab's",
+	}
+	for path, content := range files {
+		full := filepath.Join(tmp, path)
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without a stacks directory this is not an nlab working directory.
+	if moved, err := dirs.MigrateLegacyDirs(tmp); err != nil || len(moved) != 0 {
+		t.Fatalf("MigrateLegacyDirs outside a working directory = %v, %v; want nothing moved", moved, err)
+	}
+
+	writeStackFile(t, filepath.Join(tmp, "stacks", "basic", "stack.yaml"))
+	// An existing destination must not be overwritten.
+	existing := filepath.Join(dirs.LogsDir(), "basic-attacker.log")
+	writeStackFile(t, existing)
+
+	moved, err := dirs.MigrateLegacyDirs(tmp)
+	if err != nil {
+		t.Fatalf("MigrateLegacyDirs: %v", err)
+	}
+	if len(moved) != 3 {
+		t.Errorf("moved = %v, want the two key files and the event journal", moved)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dirs.KeysDir(), "basic", "id_ed25519")); string(data) != "private" {
+		t.Errorf("migrated key = %q, want %q", data, "private")
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "keys", "basic")); !os.IsNotExist(err) {
+		t.Error("emptied legacy keys/basic was not removed")
+	}
+	for _, path := range []string{"keys/.gitkeep", "keys/foo/id_rsa", "logs/app.log", "logs/basic-attacker.log"} {
+		if _, err := os.Stat(filepath.Join(tmp, path)); err != nil {
+			t.Errorf("%s must be left in place", path)
+		}
+	}
+}
+
+func TestLoadStackFromDirectory(t *testing.T) {
+	tmp := isolateXDG(t)
+	t.Cleanup(func() { lab.SetStackFile("") })
+	dir := filepath.Join(tmp, "big")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, "lab.yaml", `apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata: {name: big}
+spec:
+  defaults: {memory: 1024, vcpus: 1, networks: [lan]}
+  networks:
+    lan: {cidr: 10.40.0.0/24}
+`)
+	for _, role := range []string{"web", "db"} {
+		writeFile(t, dir, role+".yaml", "apiVersion: nlab.io/v1alpha1\nkind: VM\nmetadata:\n  name: "+role+
+			"\n  labels: {nlab.io/stack: big}\nspec: {}\n")
+	}
+	lab.SetStackFile(dir)
+	if got, _ := lab.StackDir("big"); got != dir {
+		t.Errorf("StackDir with -f <dir> = %q, want %q", got, dir)
+	}
+	cfg, err := lab.LoadStack("big")
+	if err != nil {
+		t.Fatalf("LoadStack: %v", err)
+	}
+	if len(cfg.VMs) != 2 || cfg.Network != "lan" {
+		t.Errorf("cfg = %+v, want web and db on lan", cfg)
+	}
+}
+
+func TestExtendsUsesSearchPath(t *testing.T) {
+	tmp := isolateXDG(t)
+	t.Cleanup(func() { lab.SetStackFile("") })
+	library := filepath.Join(lab.DefaultXDGDirs().StacksDir(), "base")
+	if err := os.MkdirAll(library, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, library, "stack.yaml", `apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata: {name: base}
+spec:
+  defaults: {memory: 1024, vcpus: 1}
+  networks:
+    lan: {cidr: 10.60.0.0/24}
+  vms:
+    attacker: {}
+`)
+	lab.SetStackFile(writeFile(t, tmp, "lab.yaml", `apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata: {name: mine}
+spec:
+  extends: [base]
+  vms:
+    target: {memory: 2048}
+`))
+	cfg, err := lab.LoadStack("mine")
+	if err != nil {
+		t.Fatalf("LoadStack: %v", err)
+	}
+	if len(cfg.VMs) != 2 || cfg.Network != "lan" {
+		t.Errorf("cfg = %+v, want attacker from the library base plus target", cfg)
+	}
+}
@@ -0,0 +1,101 @@
+package lab
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StackState is what nlab up records about a stack so that later commands
+// (vm create, session, render, …) and a repeated up reproduce it exactly.
+type StackState struct {
+	// Manifest is the stack.yaml the stack was brought up from.
+	Manifest string `yaml:"manifest"`
+	// Stack and Instance are set for an instance brought up with nlab up
+	// --instance; the state is then that of its qualified name.
+	Stack    string `yaml:"stack,omitempty"`
+	Instance string `yaml:"instance,omitempty"`
+	// Parameters are the effective spec.parameters values, after defaults,
+	// --values and --set.
+	Parameters map[string]string `yaml:"parameters,omitempty"`
+	// Leases are the subnets and bridges allocated to networks that asked
+	// for auto, held until nlab down.
+	Leases map[string]SubnetLease `yaml:"leases,omitempty"`
+	// PreviousKeys maps the VMs a forced nlab key rotate skipped to the old
+	// private key they still authorize, kept until they are rotated or
+	// recreated.
+	PreviousKeys map[string]string `yaml:"previousKeys,omitempty"`
+	UpdatedAt    time.Time         `yaml:"updatedAt"`
+}
+
+// StackStatePath returns the state file of a stack.
+func StackStatePath(stack string) string {
+	return DefaultXDGDirs().StackStateFile(stack)
+}
+
+// SaveStackState writes the state of a stack, replacing any previous one.
+func SaveStackState(stack string, s StackState) error {
+	path := StackStatePath(stack)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("create state dir: %w", err)
+	}
+	if s.UpdatedAt.IsZero() {
+		s.UpdatedAt = time.Now().UTC()
+	}
+	data, err := yaml.Marshal(&s)
+	if err != nil {
+		return fmt.Errorf("encode stack state: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("write stack state: %w", err)
+	}
+	return nil
+}
+
+// LoadStackState reads the state of a stack. It returns an error satisfying
+// os.IsNotExist when the stack has not been brought up.
+func LoadStackState(stack string) (*StackState, error) {
+	data, err := os.ReadFile(StackStatePath(stack))
+	if err != nil {
+		return nil, err
+	}
+	var s StackState
+	if err := yaml.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parse stack state %s: %w", StackStatePath(stack), err)
+	}
+	return &s, nil
+}
+
+// ReleaseStackState deletes the state of a stack that nlab down took down.
+// When networks named in kept could not be removed, the state stays with
+// just their leases, so no other network is given their subnet or bridge
+// until a later nlab down removes them.
+func ReleaseStackState(stack string, kept []string) error {
+	st, err := LoadStackState(stack)
+	if err != nil || len(kept) == 0 {
+		return RemoveStackState(stack)
+	}
+	leases := map[string]SubnetLease{}
+	for _, n := range kept {
+		if l, ok := st.Leases[n]; ok {
+			leases[n] = l
+		}
+	}
+	if len(leases) == 0 {
+		return RemoveStackState(stack)
+	}
+	st.Leases, st.UpdatedAt = leases, time.Time{}
+	return SaveStackState(stack, *st)
+}
+
+// RemoveStackState deletes the state of a stack; a missing file is not an
+// error.
+func RemoveStackState(stack string) error {
+	if err := os.Remove(StackStatePath(stack)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove stack state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package lab
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+// StackStatus is a one-off snapshot of a stack's networks, VMs, links and
+// port forwards, as nlab stack status prints it.
+type StackStatus struct {
+	Networks []NetworkStatus
+	VMs      []VMStatus
+	Links    []LinkStatus
+	Forwards []ForwardRecord
+}
+
+// NetworkStatus is one network of a stack as libvirt reports it.
+type NetworkStatus struct {
+	Name   string
+	Active bool
+	Bridge string // empty when the network is not defined
+	Egress string // nat, route, open, none or allow and its entries
+}
+
+// VMStatus is one VM of a stack as libvirt reports it.
+type VMStatus struct {
+	Name  string // role
+	State string // empty when the domain is not defined
+	IP    string // the DHCP lease on the primary network
+}
+
+// LinkStatus is a running VM link and the impairment tc reports on it.
+type LinkStatus struct {
+	VMLink
+	Impairment string // empty when the link is not impaired
+}
+
+// Status takes a snapshot of stack, loaded as cfg.
+func Status(stack string, cfg *StackConfig) StackStatus {
+	var st StackStatus
+	for _, n := range cfg.AllNetworks() {
+		defined, active, _, bridge := networkInfo(n.Name)
+		if !defined {
+			bridge = ""
+		}
+		st.Networks = append(st.Networks, NetworkStatus{Name: n.Name, Active: active, Bridge: bridge, Egress: egressSummary(n)})
+	}
+	for _, vm := range cfg.VMs {
+		domain := stack + "-" + vm.Name
+		s := VMStatus{Name: vm.Name}
+		if DomainExists(domain) {
+			s.State = DomainState(domain)
+			if mac := DomainMAC(domain); mac != "" {
+				s.IP = DHCPLeaseIP(cfg.Network, mac)
+			}
+		}
+		st.VMs = append(st.VMs, s)
+	}
+	for _, l := range StackLinks(stack, cfg) {
+		st.Links = append(st.Links, LinkStatus{VMLink: l, Impairment: ActiveImpairment(l.Dev)})
+	}
+	st.Forwards = ActiveForwards(stack)
+	return st
+}
+
+var forwardModeRe = regexp.MustCompile(`<forward\b(?:[^>]*?\smode=["']([^"']*)["'])?`)
+
+// egressSummary describes what n forwards: its egress policy, or else the
+// forward mode of its XML, none when it has no <forward>.
+func egressSummary(n NetworkDef) string {
+	if e := n.Egress; e != nil {
+		if e.Policy == types.EgressAllow {
+			return strings.TrimSpace("allow " + strings.Join(e.Allow, ", "))
+		}
+		return e.Policy
+	}
+	m := forwardModeRe.FindStringSubmatch(n.XML)
+	if m == nil {
+		return types.EgressNone
+	}
+	return orDefault(m[1], "nat")
+}
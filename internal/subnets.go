@@ -0,0 +1,250 @@
+package lab
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+// sysNet lists the host's network interfaces.
+const sysNet = "/sys/class/net"
+
+// SubnetLease is what nlab allocated to a network that asked for an auto
+// cidr or bridge. nlab up saves it in the stack state; nlab down releases it.
+type SubnetLease struct {
+	CIDR   string `yaml:"cidr,omitempty"`
+	Bridge string `yaml:"bridge,omitempty"`
+}
+
+// allocateNetworks fills in the auto cidrs and bridges of m's networks and
+// returns the leases, keyed by network. A lease saved for stack by the last
+// nlab up is kept; anything else is picked clear of every subnet and bridge
+// in use on the host. path is the manifest m was loaded from.
+func allocateNetworks(stack, path string, m *types.StackManifest) (map[string]SubnetLease, error) {
+	var names []string
+	for _, name := range sortedKeys(m.Spec.Networks) {
+		n := m.Spec.Networks[name]
+		if _, auto := manifest.AutoPrefix(n.CIDR); auto || n.Bridge == manifest.Auto {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	_, pool, err := net.ParseCIDR(conf.SubnetPool)
+	if err != nil {
+		return nil, fmt.Errorf("subnetPool %q is not an IPv4 network", conf.SubnetPool)
+	}
+	var prev map[string]SubnetLease
+	if st, err := LoadStackState(stack); err == nil {
+		prev = st.Leases
+	}
+
+	var used *netUsage // gathered the first time a lease has to be picked
+	leases := make(map[string]SubnetLease, len(names))
+	for _, name := range names {
+		n, lease := m.Spec.Networks[name], prev[name]
+		if prefix, auto := manifest.AutoPrefix(n.CIDR); auto {
+			if !leaseFits(lease.CIDR, prefix, pool) {
+				if used == nil {
+					used = hostUsage(stack, path, m)
+				}
+				subnet, err := AllocateSubnet(pool, prefix, used.subnets)
+				if err != nil {
+					return nil, fmt.Errorf("spec.networks.%s.cidr: %w", name, err)
+				}
+				lease.CIDR = subnet.String()
+			}
+			n.CIDR = lease.CIDR
+		} else {
+			lease.CIDR = ""
+		}
+		if n.Bridge == manifest.Auto {
+			if lease.Bridge == "" {
+				if used == nil {
+					used = hostUsage(stack, path, m)
+				}
+				lease.Bridge = used.bridge(stack)
+			}
+			n.Bridge = lease.Bridge
+		} else {
+			lease.Bridge = ""
+		}
+		if used != nil {
+			used.add(n.CIDR, n.Bridge)
+		}
+		m.Spec.Networks[name] = n
+		leases[name] = lease
+	}
+	return leases, nil
+}
+
+// AllocateSubnet returns the first /prefix subnet of pool that overlaps none
+// of used.
+func AllocateSubnet(pool *net.IPNet, prefix int, used []*net.IPNet) (*net.IPNet, error) {
+	ones, _ := pool.Mask.Size()
+	if prefix < ones || prefix > 30 {
+		return nil, fmt.Errorf("a /%d does not fit in the subnet pool %s", prefix, pool)
+	}
+	mask := net.CIDRMask(prefix, 32)
+	step := uint32(1) << uint(32-prefix)
+	base := ipToUint(pool.IP)
+	for i := uint64(0); i < uint64(1)<<uint(prefix-ones); i++ {
+		candidate := &net.IPNet{IP: uintToIP(base + uint32(i)*step), Mask: mask}
+		if !overlapsAny(candidate, used) {
+			return candidate, nil
+		}
+	}
+	return nil, fmt.Errorf("no free /%d left in the subnet pool %s; free one with nlab down or widen subnetPool", prefix, pool)
+}
+
+// leaseFits reports whether a saved lease still answers a request for a
+// /prefix from pool, i.e. neither the manifest nor the pool has changed.
+func leaseFits(cidr string, prefix int, pool *net.IPNet) bool {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	ones, _ := subnet.Mask.Size()
+	return ones == prefix && pool.Contains(subnet.IP)
+}
+
+// netUsage is what an allocated subnet or bridge must stay clear of.
+type netUsage struct {
+	subnets []*net.IPNet
+	bridges map[string]bool
+}
+
+// hostUsage collects the subnets and bridges in use outside stack: other
+// stacks' networks and leases, libvirt networks, host routes and
+// interfaces, and the fixed networks of m itself.
+func hostUsage(stack, path string, m *types.StackManifest) *netUsage {
+	u := &netUsage{bridges: map[string]bool{}}
+	own := map[string]bool{} // bridges of this stack's running networks
+	for _, n := range libvirtNetworks() {
+		if _, ok := m.Spec.Networks[n.Name]; ok {
+			own[n.Bridge] = true
+			continue
+		}
+		u.addNet(n.Subnet, n.Bridge)
+	}
+	host := HostContext(path)
+	for _, n := range host.Networks {
+		if n.Stack != stack {
+			u.addNet(n.Subnet, n.Bridge)
+		}
+	}
+	for other, leases := range savedLeases() {
+		if other == stack {
+			continue
+		}
+		for _, l := range leases {
+			u.add(l.CIDR, l.Bridge)
+		}
+	}
+	for _, r := range host.Routes {
+		if ones, _ := r.Dest.Mask.Size(); ones > 0 && !own[r.Dev] {
+			u.addNet(r.Dest, "")
+		}
+	}
+	for _, n := range manifest.HostNetworks(m) {
+		u.addNet(n.Subnet, n.Bridge)
+	}
+	if entries, err := os.ReadDir(sysNet); err == nil {
+		for _, e := range entries {
+			if !own[e.Name()] {
+				u.bridges[e.Name()] = true
+			}
+		}
+	}
+	return u
+}
+
+func (u *netUsage) add(cidr, bridge string) {
+	_, subnet, _ := net.ParseCIDR(cidr)
+	u.addNet(subnet, bridge)
+}
+
+func (u *netUsage) addNet(subnet *net.IPNet, bridge string) {
+	if subnet != nil {
+		u.subnets = append(u.subnets, subnet)
+	}
+	if bridge != "" {
+		u.bridges[bridge] = true
+	}
+}
+
+// bridge returns a free bridge name: virbr-<stack> when it fits and is free,
+// otherwise the first free nlabbrN.
+func (u *netUsage) bridge(stack string) string {
+	name := "virbr-" + stack
+	for i := 0; u.bridges[name] || len(name) > 15; i++ {
+		name = fmt.Sprintf("nlabbr%d", i)
+	}
+	return name
+}
+
+// libvirtNetworks returns the IPv4 networks defined in libvirt, named after
+// the libvirt network. It is empty when virsh is unavailable.
+func libvirtNetworks() []manifest.HostNetwork {
+	out, err := virshCmd("net-list", "--all", "--name").Output()
+	if err != nil {
+		return nil
+	}
+	m := &types.StackManifest{Spec: types.StackSpec{Networks: map[string]types.NetworkSpec{}}}
+	for _, name := range strings.Fields(string(out)) {
+		if x, err := virshCmd("net-dumpxml", name).Output(); err == nil {
+			m.Spec.Networks[name] = types.NetworkSpec{XML: string(x)}
+		}
+	}
+	return manifest.HostNetworks(m)
+}
+
+// savedLeases returns the leases in every stack state, keyed by stack.
+func savedLeases() map[string]map[string]SubnetLease {
+	out := map[string]map[string]SubnetLease{}
+	files, _ := filepath.Glob(filepath.Join(DefaultXDGDirs().StackStateDir(), "*.yaml"))
+	for _, f := range files {
+		stack := strings.TrimSuffix(filepath.Base(f), ".yaml")
+		if st, err := LoadStackState(stack); err == nil && len(st.Leases) > 0 {
+			out[stack] = st.Leases
+		}
+	}
+	return out
+}
+
+// applyLeases fills in the auto cidrs and bridges of m from the leases saved
+// for stack, leaving those without one as they are.
+func applyLeases(stack string, m *types.StackManifest) {
+	st, err := LoadStackState(stack)
+	if err != nil {
+		return
+	}
+	for name, l := range st.Leases {
+		n, ok := m.Spec.Networks[name]
+		if !ok {
+			continue
+		}
+		if _, auto := manifest.AutoPrefix(n.CIDR); auto && l.CIDR != "" {
+			n.CIDR = l.CIDR
+		}
+		if n.Bridge == manifest.Auto && l.Bridge != "" {
+			n.Bridge = l.Bridge
+		}
+		m.Spec.Networks[name] = n
+	}
+}
+
+func overlapsAny(subnet *net.IPNet, others []*net.IPNet) bool {
+	for _, o := range others {
+		if subnet.Contains(o.IP) || o.Contains(subnet.IP) {
+			return true
+		}
+	}
+	return false
+}
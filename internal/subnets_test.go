@@ -0,0 +1,114 @@
+package lab_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lab "github.com/h3ow3d/nlab/internal"
+)
+
+func TestAllocateSubnet(t *testing.T) {
+	_, pool, _ := net.ParseCIDR("10.200.0.0/16")
+	var used []*net.IPNet
+	for _, s := range []string{"10.200.0.0/24", "10.200.1.128/25", "10.0.0.0/8"} {
+		_, n, _ := net.ParseCIDR(s)
+		used = append(used, n)
+	}
+	if got, err := lab.AllocateSubnet(pool, 24, used); err == nil || !strings.Contains(err.Error(), "no free /24") {
+		t.Errorf("a route to 10.0.0.0/8 covers the pool, got %v, %v", got, err)
+	}
+	used = used[:2]
+	for prefix, want := range map[int]string{24: "10.200.2.0/24", 26: "10.200.1.0/26", 16: "<none>"} {
+		got, err := lab.AllocateSubnet(pool, prefix, used)
+		if want == "<none>" {
+			if err == nil {
+				t.Errorf("/%d: got %s, want an error", prefix, got)
+			}
+			continue
+		}
+		if err != nil || got.String() != want {
+			t.Errorf("/%d: got %v, %v; want %s", prefix, got, err, want)
+		}
+	}
+	if _, err := lab.AllocateSubnet(pool, 8, nil); err == nil || !strings.Contains(err.Error(), "does not fit") {
+		t.Errorf("a /8 from a /16 pool: %v", err)
+	}
+}
+
+const autoStack = `apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata: {name: NAME}
+spec:
+  networks:
+    lan: {cidr: auto}
+    dmz: {cidr: auto/26, bridge: auto}
+    mgmt: {cidr: 10.231.3.0/24}
+  vms:
+    box: {memory: 512, vcpus: 1}
+`
+
+func TestAutoNetworkLeases(t *testing.T) {
+	isolateXDG(t)
+	cfg := lab.DefaultConfig()
+	if err := cfg.Set("subnetPool", "10.231.0.0/16", lab.SourceFlag); err != nil {
+		t.Fatal(err)
+	}
+	lab.SetConfig(cfg)
+	t.Cleanup(func() { lab.SetConfig(lab.DefaultConfig()) })
+	for _, name := range []string{"one", "two"} {
+		dir := filepath.Join("stacks", name)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, dir, "stack.yaml", strings.Replace(autoStack, "NAME", name, 1))
+	}
+
+	one, err := lab.LoadStack("one")
+	if err != nil {
+		t.Fatalf("LoadStack: %v", err)
+	}
+	if got := one.Leases["dmz"]; got.CIDR != "10.231.0.0/26" || got.Bridge == "" {
+		t.Errorf("dmz lease = %+v", got)
+	}
+	if got := one.Leases["lan"]; got.CIDR != "10.231.1.0/24" || got.Bridge != "" {
+		t.Errorf("lan lease = %+v", got)
+	}
+	if _, ok := one.Leases["mgmt"]; ok {
+		t.Error("a fixed network has no lease")
+	}
+	for _, d := range one.NetworkDefs {
+		if d.Name == "lan" && !strings.Contains(d.XML, `<range start="10.231.1.100" end="10.231.1.200"/>`) {
+			t.Errorf("lan XML lacks the leased DHCP range:\n%s", d.XML)
+		}
+	}
+	if err := lab.SaveStackState("one", lab.StackState{Manifest: "stacks/one/stack.yaml", Leases: one.Leases}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another stack steers clear of the leases and of stack one's fixed mgmt.
+	two, err := lab.LoadStack("two")
+	if err != nil {
+		t.Fatalf("LoadStack: %v", err)
+	}
+	if two.Leases["dmz"].CIDR != "10.231.0.64/26" || two.Leases["lan"].CIDR != "10.231.2.0/24" {
+		t.Errorf("two's leases = %+v", two.Leases)
+	}
+	if two.Leases["dmz"].Bridge == one.Leases["dmz"].Bridge {
+		t.Errorf("both stacks got bridge %s", one.Leases["dmz"].Bridge)
+	}
+
+	// A saved lease is kept even when an earlier subnet frees up.
+	if err := lab.SaveStackState("two", lab.StackState{Manifest: "stacks/two/stack.yaml", Leases: two.Leases}); err != nil {
+		t.Fatal(err)
+	}
+	if err := lab.RemoveStackState("one"); err != nil {
+		t.Fatal(err)
+	}
+	again, err := lab.LoadStack("two")
+	if err != nil || again.Leases["lan"] != two.Leases["lan"] || again.Leases["dmz"] != two.Leases["dmz"] {
+		t.Errorf("leases changed across loads: %+v, %v", again.Leases, err)
+	}
+}
@@ -4,31 +4,27 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
-const maxWaitSeconds = 180
-
-// LaunchTmux waits for all SSH VMs defined in layout.yaml to become reachable,
-// then opens a tmux session with the configured pane layout.
-func LaunchTmux(stack, network string) error {
-	layoutFile := fmt.Sprintf("stacks/%s/layout.yaml", stack)
-	if _, err := os.Stat(layoutFile); err != nil {
-		return fmt.Errorf("no layout.yaml found at %s", layoutFile)
-	}
-
-	l, err := LoadLayout(layoutFile)
+// LaunchTmux waits for all SSH VMs of the stack's tmux layout (see
+// StackLayout) to become reachable, refreshes the stack's generated ssh
+// config, then opens a tmux session with the configured windows and panes.
+func LaunchTmux(stack string, cfg *StackConfig) error {
+	network := cfg.Network
+	l, err := StackLayout(stack, cfg)
 	if err != nil {
 		return err
 	}
 
-	key := fmt.Sprintf("keys/%s/id_ed25519", stack)
 	session := fmt.Sprintf("red-team-%s", stack)
 	sshVMs := l.SSHVMs()
 
 	vmMAC := make(map[string]string)
 	vmIP := make(map[string]string)
-	vmSSHReady := make(map[string]bool)
+	vmSSH := make(map[string]SSHState)
 
 	// Reserve N+1 lines for the readiness table (section header + column header + one per VM).
 	fmt.Println(dashSectionHeader("Waiting for VMs")[0])
@@ -37,20 +33,26 @@ func LaunchTmux(stack, network string) error {
 		fmt.Println()
 	}
 
-	if err := waitForVMsReady(stack, network, key, sshVMs, vmMAC, vmIP, vmSSHReady); err != nil {
+	if err := waitForVMsReady(stack, network, sshVMs, vmMAC, vmIP, vmSSH); err != nil {
 		return err
 	}
 
 	fmt.Println()
+	if path, err := WriteSSHConfig(stack, cfg); err != nil {
+		Error(err.Error())
+	} else {
+		Ok("SSH config updated at " + path)
+	}
 	Ok("All VMs ready — launching tmux session")
 	time.Sleep(500 * time.Millisecond)
 
-	return launchTmuxSession(session, stack, key, l, vmIP)
+	return launchTmuxSession(session, stack, cfg, l, vmIP)
 }
 
-func waitForVMsReady(stack, network, key string, sshVMs []string,
-	vmMAC, vmIP map[string]string, vmSSHReady map[string]bool,
+func waitForVMsReady(stack, network string, sshVMs []string,
+	vmMAC, vmIP map[string]string, vmSSH map[string]SSHState,
 ) error {
+	client := sharedSSHClient(stack)
 	elapsed := 0
 	// redrawLines is the number of VM rows to overwrite on each refresh tick.
 	redrawLines := len(sshVMs)
@@ -69,7 +71,7 @@ func waitForVMsReady(stack, network, key string, sshVMs []string,
 		}
 
 		if !allMACs {
-			if elapsed >= maxWaitSeconds {
+			if elapsed >= conf.MaxWaitSeconds {
 				return fmt.Errorf("timeout waiting for VM network interfaces")
 			}
 			time.Sleep(time.Second)
@@ -81,11 +83,11 @@ func waitForVMsReady(stack, network, key string, sshVMs []string,
 			if vmMAC[v] != "" {
 				vmIP[v] = DHCPLeaseIP(network, vmMAC[v])
 			}
-			if vmIP[v] != "" && !vmSSHReady[v] {
-				if sshReachable(key, vmIP[v]) {
-					vmSSHReady[v] = true
-				}
+			if vmIP[v] != "" && !vmSSH[v].Ready() {
+				client.SetHostAlias(vmIP[v], stack+"-"+v)
+				vmSSH[v] = client.Probe(vmIP[v])
 			}
+			observeVM(stack, v, vmIP[v], vmSSH[v])
 		}
 
 		// Move cursor up to overwrite the VM rows.
@@ -101,13 +103,13 @@ func waitForVMsReady(stack, network, key string, sshVMs []string,
 				dc(dWhite, name),
 				stateBadge(state),
 				ipStr,
-				sshBadge(vmSSHReady[v]),
+				sshBadge(vmSSH[v]),
 			)
 		}
 
 		allReady := true
 		for _, v := range sshVMs {
-			if !vmSSHReady[v] {
+			if !vmSSH[v].Ready() {
 				allReady = false
 				break
 			}
@@ -116,7 +118,7 @@ func waitForVMsReady(stack, network, key string, sshVMs []string,
 			return nil
 		}
 
-		if elapsed >= maxWaitSeconds {
+		if elapsed >= conf.MaxWaitSeconds {
 			return fmt.Errorf("timeout waiting for VM readiness")
 		}
 
@@ -125,38 +127,84 @@ func waitForVMsReady(stack, network, key string, sshVMs []string,
 	}
 }
 
-func launchTmuxSession(session, stack, key string, l *Layout, vmIP map[string]string) error {
-	_ = exec.Command("tmux", "kill-session", "-t", session).Run()
-
-	if err := exec.Command("tmux", "new-session", "-d", "-s", session).Run(); err != nil {
-		return fmt.Errorf("tmux new-session: %w", err)
+// sshCommand builds the interactive ssh command line for a pane. The host key
+// is checked strictly against the stack's managed known_hosts file under the
+// <stack>-<role> alias, so DHCP address changes do not matter. When the
+// stack's keys are loaded in ssh-agent the pane does not reference the key
+// file at all, unless the VM is still on an old key a rotation skipped.
+func sshCommand(stack, role, user, ip string, useAgent bool) string {
+	key := KeyPathFor(stack, role)
+	identity := fmt.Sprintf("-i %s -o IdentitiesOnly=yes ", key)
+	if useAgent && key == currentKeyPath(stack, role) {
+		identity = ""
 	}
+	return fmt.Sprintf("ssh %s-o UserKnownHostsFile=%s -o StrictHostKeyChecking=yes -o HostKeyAlias=%s-%s %s@%s",
+		identity, KnownHostsPath(stack), stack, role, user, ip)
+}
 
-	for i := 1; i < len(l.Panes); i++ {
-		if err := exec.Command("tmux", "split-window", "-t", session).Run(); err != nil {
-			return fmt.Errorf("tmux split-window: %w", err)
-		}
-	}
+func launchTmuxSession(session, stack string, cfg *StackConfig, l *Layout, vmIP map[string]string) error {
+	useAgent := AgentHasKeys(stack)
+
+	_ = exec.Command("tmux", "kill-session", "-t", session).Run()
+
+	for w, win := range l.AllWindows() {
+		var first string
+		for i, pane := range win.Panes {
+			var args []string
+			switch {
+			case w == 0 && i == 0:
+				args = []string{"new-session", "-d", "-s", session}
+			case i == 0:
+				args = []string{"new-window", "-t", session + ":"}
+			default:
+				args = []string{"split-window", "-t", first}
+			}
+			if i == 0 && win.Name != "" {
+				args = append(args, "-n", win.Name)
+			}
+			args = append(args, "-P", "-F", "#{pane_id}")
+			args = append(args, paneOptions(pane, stack)...)
+			out, err := exec.Command("tmux", args...).Output()
+			if err != nil {
+				return fmt.Errorf("tmux %s: %w", args[0], err)
+			}
+			id := strings.TrimSpace(string(out))
+			if i == 0 {
+				first = id
+			} else {
+				// Re-tile after each split so later splits have room.
+				_ = exec.Command("tmux", "select-layout", "-t", first, "tiled").Run()
+			}
 
-	for i, pane := range l.Panes {
-		if err := exec.Command("tmux", "select-pane", "-t", fmt.Sprintf("%d", i)).Run(); err != nil {
-			return fmt.Errorf("tmux select-pane %d: %w", i, err)
+			if pane.Title != "" {
+				_ = exec.Command("tmux", "select-pane", "-t", id, "-T", ExpandCommand(pane.Title, stack, cfg)).Run()
+			}
+			var cmd string
+			switch pane.Type {
+			case "ssh":
+				user := conf.SSHUser
+				if v, ok := cfg.VM(pane.VM); ok {
+					user = v.User()
+				}
+				cmd = sshCommand(stack, pane.VM, user, vmIP[pane.VM], useAgent)
+			case "command":
+				cmd = ExpandCommand(pane.Command, stack, cfg)
+			}
+			if cmd == "" {
+				continue
+			}
+			if err := exec.Command("tmux", "send-keys", "-t", id, cmd, "C-m").Run(); err != nil {
+				return fmt.Errorf("tmux send-keys pane %d: %w", i, err)
+			}
 		}
-		var cmd string
-		if pane.Type == "ssh" {
-			ip := vmIP[pane.VM]
-			cmd = fmt.Sprintf("ssh -i %s -o StrictHostKeyChecking=no %s@%s", key, sshUser, ip)
-		} else {
-			cmd = ExpandCommand(pane.Command, stack)
+		if first == "" {
+			continue
 		}
-		if err := exec.Command("tmux", "send-keys", "-t", session, cmd, "C-m").Run(); err != nil {
-			return fmt.Errorf("tmux send-keys pane %d: %w", i, err)
+		if err := exec.Command("tmux", "select-layout", "-t", first, win.Layout).Run(); err != nil {
+			return fmt.Errorf("tmux select-layout %s: %w", win.Layout, err)
 		}
 	}
-
-	if err := exec.Command("tmux", "select-layout", l.Layout).Run(); err != nil {
-		return fmt.Errorf("tmux select-layout: %w", err)
-	}
+	_ = exec.Command("tmux", "select-window", "-t", session+":^").Run()
 
 	attach := exec.Command("tmux", "attach-session", "-t", session)
 	attach.Stdin = os.Stdin
@@ -164,3 +212,20 @@ func launchTmuxSession(session, stack, key string, l *Layout, vmIP map[string]st
 	attach.Stderr = os.Stderr
 	return attach.Run()
 }
+
+// paneOptions returns the tmux -c/-e options that start a pane in its working
+// directory with its environment.
+func paneOptions(p Pane, stack string) []string {
+	var args []string
+	if p.Cwd != "" {
+		cwd := ExpandCommand(p.Cwd, stack, nil)
+		if home, err := os.UserHomeDir(); err == nil && (cwd == "~" || strings.HasPrefix(cwd, "~/")) {
+			cwd = filepath.Join(home, strings.TrimPrefix(cwd, "~"))
+		}
+		args = append(args, "-c", cwd)
+	}
+	for _, k := range sortedKeys(p.Env) {
+		args = append(args, "-e", k+"="+p.Env[k])
+	}
+	return args
+}
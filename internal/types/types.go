@@ -1,6 +1,12 @@
 // Package types defines the typed model for nlab stack manifests (v1alpha1).
 package types
 
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
 // StackManifest is the top-level structure of a v1alpha1 stack manifest.
 type StackManifest struct {
 	APIVersion string     `yaml:"apiVersion"`
@@ -9,7 +15,34 @@ type StackManifest struct {
 	Spec       StackSpec  `yaml:"spec"`
 }
 
-// ObjectMeta holds identity metadata for a stack manifest.
+// NetworkManifest is a standalone kind: Network document. It joins the stack
+// its nlab.io/stack label names as spec.networks.<metadata.name>.
+type NetworkManifest struct {
+	APIVersion string      `yaml:"apiVersion"`
+	Kind       string      `yaml:"kind"`
+	Metadata   ObjectMeta  `yaml:"metadata"`
+	Spec       NetworkSpec `yaml:"spec"`
+}
+
+// VMManifest is a standalone kind: VM document. It joins the stack its
+// nlab.io/stack label names as spec.vms.<metadata.name>.
+type VMManifest struct {
+	APIVersion string     `yaml:"apiVersion"`
+	Kind       string     `yaml:"kind"`
+	Metadata   ObjectMeta `yaml:"metadata"`
+	Spec       VMSpec     `yaml:"spec"`
+}
+
+// ComponentManifest is a reusable piece of a stack, kind: Component. Stacks
+// import it with spec.components; its spec is merged into theirs.
+type ComponentManifest struct {
+	APIVersion string     `yaml:"apiVersion"`
+	Kind       string     `yaml:"kind"`
+	Metadata   ObjectMeta `yaml:"metadata"`
+	Spec       StackSpec  `yaml:"spec"`
+}
+
+// ObjectMeta holds identity metadata for a manifest document.
 type ObjectMeta struct {
 	Name        string            `yaml:"name"`
 	Labels      map[string]string `yaml:"labels,omitempty"`
@@ -18,19 +51,320 @@ type ObjectMeta struct {
 
 // StackSpec is the spec section of a StackManifest.
 type StackSpec struct {
+	// Extends lists stacks, by name or manifest path, this one builds on.
+	// Their specs are merged in order, then Components, then this spec.
+	Extends []string `yaml:"extends,omitempty"`
+	// Components lists kind: Component manifests to merge in, relative to
+	// the manifest.
+	Components []string `yaml:"components,omitempty"`
+
 	Networks map[string]NetworkSpec `yaml:"networks"`
 	VMs      map[string]VMSpec      `yaml:"vms"`
-	Storage  map[string]interface{} `yaml:"storage,omitempty"`
-	Tmux     map[string]interface{} `yaml:"tmux,omitempty"`
-	Defaults map[string]interface{} `yaml:"defaults,omitempty"`
+	Storage  *StorageSpec           `yaml:"storage,omitempty"`
+	Tmux     *TmuxSpec              `yaml:"tmux,omitempty"`
+	Defaults *DefaultsSpec          `yaml:"defaults,omitempty"`
+	// Parameters are referenced as ${params.<name>} in XML, cloud-init and
+	// spec.tmux, and set with nlab up --set/--values.
+	Parameters map[string]ParameterSpec `yaml:"parameters,omitempty"`
+}
+
+// ParameterSpec declares one spec.parameters entry.
+type ParameterSpec struct {
+	// Type is string (the default), int, bool or list. A list is
+	// substituted as a YAML flow sequence, e.g. [nginx, php].
+	Type string `yaml:"type,omitempty"`
+	// Default is used when no value is given; without one the parameter
+	// is required.
+	Default     interface{} `yaml:"default,omitempty"`
+	Description string      `yaml:"description,omitempty"`
+}
+
+// StorageSpec is spec.storage: where the stack's disks and base images live
+// on the host.
+type StorageSpec struct {
+	// DiskDir holds the VMs' overlay disks. Defaults to
+	// /var/lib/libvirt/images.
+	DiskDir string `yaml:"diskDir,omitempty"`
+	// ImageDir is where image file names are looked up. Defaults to the
+	// image cache.
+	ImageDir string `yaml:"imageDir,omitempty"`
+}
+
+// DefaultsSpec is spec.defaults: settings every VM inherits unless it sets
+// its own. Memory, VCPUs, Disk, Image and Networks only apply to typed VMs;
+// SSHUser and CloudInit apply to raw XML VMs too.
+type DefaultsSpec struct {
+	Memory   int       `yaml:"memory,omitempty"`
+	VCPUs    int       `yaml:"vcpus,omitempty"`
+	Disk     *DiskSpec `yaml:"disk,omitempty"`
+	Image    string    `yaml:"image,omitempty"`
+	Networks []string  `yaml:"networks,omitempty"`
+	SSHUser  string    `yaml:"sshUser,omitempty"`
+	// CloudInit is inherited field by field; userData and userDataFile
+	// count as one field.
+	CloudInit *CloudInitSpec `yaml:"cloudInit,omitempty"`
 }
 
-// NetworkSpec describes a single libvirt network resource.
+// NetworkSpec describes a single libvirt network resource. Either XML is
+// given verbatim (inline or in XMLFile), or the typed fields are rendered to
+// network XML.
 type NetworkSpec struct {
-	XML string `yaml:"xml"`
+	XML string `yaml:"xml,omitempty"`
+	// XMLFile is a network XML file, relative to the manifest. The loader
+	// reads it into XML and makes the path absolute.
+	XMLFile string `yaml:"xmlFile,omitempty"`
+
+	// CIDR is the network's IPv4 subnet; the host takes the first address.
+	// "auto" (a /24) or "auto/<prefix>" has nlab pick a free subnet from its
+	// subnetPool setting.
+	CIDR string `yaml:"cidr,omitempty"`
+	// Mode is nat (the default), route, open or isolated (no forwarding).
+	Mode string `yaml:"mode,omitempty"`
+	// Egress limits what VMs on the network can reach beyond it. Nil means
+	// whatever Mode forwards.
+	Egress *EgressSpec `yaml:"egress,omitempty"`
+	// Bridge names the host bridge; libvirt picks virbrN when empty, and
+	// "auto" has nlab pick virbr-<stack> or the first free nlabbrN.
+	Bridge string `yaml:"bridge,omitempty"`
+	// DHCP configures the address range handed to VMs. Nil means enabled
+	// with the default range.
+	DHCP *DHCPSpec `yaml:"dhcp,omitempty"`
+
+	// Impairment degrades the link of every VM on the network; unlike the
+	// fields above it applies to raw XML networks too.
+	Impairment *ImpairmentSpec `yaml:"impairment,omitempty"`
+}
+
+// Typed reports whether the network is described by typed fields rather than
+// raw XML.
+func (n NetworkSpec) Typed() bool {
+	return n.CIDR != "" || n.Mode != "" || n.Bridge != "" || n.DHCP != nil || n.Egress != nil
+}
+
+// Egress policies of a typed network.
+const (
+	EgressNone  = "none"  // nothing beyond the network and the host
+	EgressNAT   = "nat"   // anywhere, through the host's NAT
+	EgressAllow = "allow" // only the destinations in Allow
+)
+
+// EgressSpec is the egress section of a typed network. In YAML it is either
+// a policy (`egress: none` or `egress: nat`) or an allow-list
+// (`egress: {allow: [10.0.0.0/8, deb.debian.org]}`) of CIDRs, addresses and
+// domain names.
+type EgressSpec struct {
+	Policy string
+	Allow  []string
 }
 
-// VMSpec describes a single libvirt domain (VM) resource.
+// UnmarshalYAML accepts none, nat or an allow mapping.
+func (e *EgressSpec) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		if node.Value != EgressNone && node.Value != EgressNAT {
+			return fmt.Errorf("line %d: egress must be none, nat or an allow list", node.Line)
+		}
+		*e = EgressSpec{Policy: node.Value}
+		return nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: egress must be none, nat or an allow list", node.Line)
+	}
+	for i := 0; i < len(node.Content); i += 2 {
+		if k := node.Content[i].Value; k != "allow" {
+			return fmt.Errorf("line %d: field %s not found in egress", node.Content[i].Line, k)
+		}
+	}
+	var r struct {
+		Allow []string `yaml:"allow"`
+	}
+	if err := node.Decode(&r); err != nil {
+		return err
+	}
+	*e = EgressSpec{Policy: EgressAllow, Allow: r.Allow}
+	return nil
+}
+
+// MarshalYAML writes the form UnmarshalYAML reads.
+func (e EgressSpec) MarshalYAML() (interface{}, error) {
+	if e.Policy != EgressAllow {
+		return e.Policy, nil
+	}
+	return map[string][]string{"allow": e.Allow}, nil
+}
+
+// DHCPSpec is the dhcp section of a typed network. In YAML it is either a
+// boolean (`dhcp: false`) or a range (`dhcp: {start: …, end: …}`).
+type DHCPSpec struct {
+	Enabled bool
+	Start   string
+	End     string
+}
+
+// UnmarshalYAML accepts a boolean or a start/end mapping.
+func (d *DHCPSpec) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var on bool
+		if err := node.Decode(&on); err != nil {
+			return fmt.Errorf("line %d: dhcp must be true, false or a start/end range", node.Line)
+		}
+		*d = DHCPSpec{Enabled: on}
+		return nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: dhcp must be true, false or a start/end range", node.Line)
+	}
+	for i := 0; i < len(node.Content); i += 2 {
+		if k := node.Content[i].Value; k != "start" && k != "end" {
+			return fmt.Errorf("line %d: field %s not found in dhcp", node.Content[i].Line, k)
+		}
+	}
+	var r struct {
+		Start string `yaml:"start"`
+		End   string `yaml:"end"`
+	}
+	if err := node.Decode(&r); err != nil {
+		return err
+	}
+	*d = DHCPSpec{Enabled: true, Start: r.Start, End: r.End}
+	return nil
+}
+
+// MarshalYAML writes the form UnmarshalYAML reads.
+func (d DHCPSpec) MarshalYAML() (interface{}, error) {
+	if !d.Enabled || (d.Start == "" && d.End == "") {
+		return d.Enabled, nil
+	}
+	return map[string]string{"start": d.Start, "end": d.End}, nil
+}
+
+// ImpairmentSpec degrades a link the way tc netem and tbf do: the traffic a
+// VM's interface receives is delayed, dropped or throttled.
+type ImpairmentSpec struct {
+	// Delay is added to every packet, e.g. 200ms.
+	Delay string `yaml:"delay,omitempty"`
+	// Jitter varies Delay by up to this much either way.
+	Jitter string `yaml:"jitter,omitempty"`
+	// Loss is the share of packets dropped, e.g. 5%.
+	Loss string `yaml:"loss,omitempty"`
+	// Rate caps the bandwidth, in tc units such as 1mbit or 500kbit.
+	Rate string `yaml:"rate,omitempty"`
+}
+
+// VMSpec describes a single libvirt domain (VM) resource. Either XML is given
+// verbatim (inline or in XMLFile), or the typed fields are rendered to domain
+// XML. CloudInit applies to both forms.
 type VMSpec struct {
-	XML string `yaml:"xml"`
+	XML string `yaml:"xml,omitempty"`
+	// XMLFile is a domain XML file, relative to the manifest. The loader reads
+	// it into XML and makes the path absolute.
+	XMLFile string `yaml:"xmlFile,omitempty"`
+
+	// Memory is the VM's RAM in MiB.
+	Memory int `yaml:"memory,omitempty"`
+	// VCPUs is the number of virtual CPUs.
+	VCPUs int `yaml:"vcpus,omitempty"`
+	// Disk sizes the VM's copy-on-write overlay of Image.
+	Disk *DiskSpec `yaml:"disk,omitempty"`
+	// Networks lists spec.networks the VM has an interface on, in order.
+	// Empty means the stack's primary (alphabetically first) network.
+	Networks []string `yaml:"networks,omitempty"`
+	// Image is the base image: an absolute path, or a file name in the image
+	// cache. Empty means the configured baseImage.
+	Image string `yaml:"image,omitempty"`
+	// CloudInit locates the VM's user-data and meta-data.
+	CloudInit *CloudInitSpec `yaml:"cloudInit,omitempty"`
+	// SSHUser is the login user nlab connects as. Empty means the
+	// configured sshUser.
+	SSHUser string `yaml:"sshUser,omitempty"`
+	// Ports are forwarded from the host to the VM while the stack is up.
+	// Like CloudInit they apply to raw XML VMs too.
+	Ports []PortSpec `yaml:"ports,omitempty"`
+}
+
+// PortSpec forwards a port on the host to a port of the VM, following the
+// VM's address when it changes.
+type PortSpec struct {
+	// Host is the port nlab listens on.
+	Host int `yaml:"host"`
+	// Guest is the VM's port. Zero means the same as Host.
+	Guest int `yaml:"guest,omitempty"`
+	// Proto is tcp (the default) or udp.
+	Proto string `yaml:"proto,omitempty"`
+	// Bind is the host address nlab listens on. Empty means 127.0.0.1.
+	Bind string `yaml:"bind,omitempty"`
+}
+
+// Typed reports whether the VM's domain is described by typed fields rather
+// than raw XML.
+func (v VMSpec) Typed() bool {
+	return v.Memory != 0 || v.VCPUs != 0 || v.Disk != nil || len(v.Networks) > 0 || v.Image != ""
+}
+
+// DiskSpec is the disk section of a typed VM.
+type DiskSpec struct {
+	// Size is the overlay's virtual size in GiB (default 20).
+	Size int `yaml:"size,omitempty"`
+}
+
+// CloudInitSpec is the cloudInit section of a VM. Files not given explicitly
+// are looked up in Dir; relative paths are resolved against the manifest and
+// made absolute by the loader.
+type CloudInitSpec struct {
+	// Dir holds user-data and meta-data, relative to the manifest. Defaults
+	// to the VM's name.
+	Dir string `yaml:"dir,omitempty"`
+	// UserData is inline user-data, so a stack can be a single file.
+	UserData string `yaml:"userData,omitempty"`
+	// UserDataFile replaces <dir>/user-data.
+	UserDataFile string `yaml:"userDataFile,omitempty"`
+	// MetaDataFile replaces <dir>/meta-data.
+	MetaDataFile string `yaml:"metaDataFile,omitempty"`
+	// NetworkConfigFile is an optional cloud-init network-config.
+	NetworkConfigFile string `yaml:"networkConfigFile,omitempty"`
+}
+
+// TmuxSpec is spec.tmux: the tmux session nlab opens once the VMs are
+// reachable.
+type TmuxSpec struct {
+	// Preset is default, grid or wide. It sets the tmux layout of windows
+	// that name none; without Windows it also opens one ssh pane per VM.
+	Preset  string       `yaml:"preset,omitempty"`
+	Windows []TmuxWindow `yaml:"windows,omitempty"`
+}
+
+// TmuxWindow is one window of the session.
+type TmuxWindow struct {
+	Name string `yaml:"name,omitempty"`
+	// Layout is a tmux select-layout name; it overrides the preset.
+	Layout string     `yaml:"layout,omitempty"`
+	Panes  []TmuxPane `yaml:"panes"`
+}
+
+// TmuxPane is one pane of a window. {stack} in Command, Cwd and Title is
+// replaced with the stack name, and {bridge:<network>} in Command and Title
+// with the host bridge of that network.
+type TmuxPane struct {
+	// Type is ssh (log in to VM), command (run Command) or shell. When empty
+	// it is inferred from VM and Command.
+	Type    string `yaml:"type,omitempty"`
+	VM      string `yaml:"vm,omitempty"`
+	Command string `yaml:"command,omitempty"`
+	// Cwd is the pane's working directory, relative to the manifest.
+	Cwd   string            `yaml:"cwd,omitempty"`
+	Env   map[string]string `yaml:"env,omitempty"`
+	Title string            `yaml:"title,omitempty"`
+}
+
+// PaneType returns Type, or the type implied by VM and Command.
+func (p TmuxPane) PaneType() string {
+	switch {
+	case p.Type != "":
+		return p.Type
+	case p.VM != "":
+		return "ssh"
+	case p.Command != "":
+		return "command"
+	default:
+		return "shell"
+	}
 }
@@ -0,0 +1,88 @@
+package lab
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+	"github.com/h3ow3d/nlab/internal/types"
+)
+
+// routeTable is the kernel's IPv4 routing table.
+const routeTable = "/proc/net/route"
+
+// CheckStackFile loads the manifest at path like manifest.Check and adds the
+// warnings that depend on the host: subnets and bridges shared with other
+// stacks on the search path and subnets that overlap a host route.
+func CheckStackFile(path string) (*types.StackManifest, []manifest.Issue, error) {
+	m, warnings, err := manifest.Check(path)
+	if err != nil {
+		return nil, warnings, err
+	}
+	host := manifest.CheckHost(m, path, HostContext(path))
+	manifest.Locate(host, path)
+	return m, append(warnings, host...), nil
+}
+
+// HostContext collects the networks of every other stack on the search path,
+// with the subnets leased to them, and the host's routes. Stacks that fail to
+// load are left out.
+func HostContext(path string) manifest.Host {
+	var host manifest.Host
+	self, _ := filepath.Abs(path)
+	for _, loc := range ListStacks() {
+		file := filepath.Join(loc.Dir, stackFileName)
+		if loc.Shadowed || file == self || loc.Dir == self {
+			continue
+		}
+		m, err := manifest.Load(file)
+		if err != nil {
+			continue
+		}
+		applyLeases(loc.Name, m)
+		host.Networks = append(host.Networks, manifest.HostNetworks(m)...)
+	}
+	if f, err := os.Open(routeTable); err == nil {
+		host.Routes, _ = ParseRoutes(f)
+		f.Close()
+	}
+	return host
+}
+
+// ParseRoutes reads routes in the format of /proc/net/route, where
+// addresses are little-endian hex.
+func ParseRoutes(r io.Reader) ([]manifest.Route, error) {
+	var routes []manifest.Route
+	sc := bufio.NewScanner(r)
+	for first := true; sc.Scan(); first = false {
+		fields := strings.Fields(sc.Text())
+		if first || len(fields) < 8 {
+			continue // header
+		}
+		dst, err1 := procIP(fields[1])
+		mask, err2 := procIP(fields[7])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		routes = append(routes, manifest.Route{Dev: fields[0],
+			Dest: &net.IPNet{IP: dst, Mask: net.IPMask(mask)}})
+	}
+	return routes, sc.Err()
+}
+
+// procIP decodes an address of /proc/net/route.
+func procIP(s string) (net.IP, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return nil, &net.ParseError{Type: "route address", Text: s}
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(b))
+	return ip, nil
+}
@@ -0,0 +1,72 @@
+package lab_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lab "github.com/h3ow3d/nlab/internal"
+)
+
+func TestParseRoutes(t *testing.T) {
+	table := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0102A8C0	0003	0	0	100	00000000	0	0	0
+eth0	0002A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+wg0	0000000A	00000000	0001	0	0	0	000000FF	0	0	0
+`
+	routes, err := lab.ParseRoutes(strings.NewReader(table))
+	if err != nil {
+		t.Fatalf("ParseRoutes: %v", err)
+	}
+	var got []string
+	for _, r := range routes {
+		got = append(got, r.Dev+" "+r.Dest.String())
+	}
+	if want := "eth0 0.0.0.0/0,eth0 192.168.2.0/24,wg0 10.0.0.0/8"; strings.Join(got, ",") != want {
+		t.Errorf("routes = %v, want %s", got, want)
+	}
+}
+
+func TestCheckStackFileWarnsAboutOtherStacks(t *testing.T) {
+	isolateXDG(t)
+	write := func(name, cidr string) string {
+		dir := filepath.Join("stacks", name)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		return writeFile(t, dir, "stack.yaml", `apiVersion: nlab.io/v1alpha1
+kind: Stack
+metadata:
+  name: `+name+`
+spec:
+  networks:
+    net:
+      cidr: `+cidr+`
+  vms:
+    box:
+      memory: 1024
+      vcpus: 1
+`)
+	}
+	path := write("one", "10.50.0.0/24")
+	write("two", "10.50.0.0/16")
+	write("three", "10.51.0.0/24")
+
+	m, warnings, err := lab.CheckStackFile(path)
+	if err != nil || m == nil {
+		t.Fatalf("CheckStackFile: %v", err)
+	}
+	var found bool
+	for _, w := range warnings {
+		if strings.Contains(w.Message, "three") || strings.Contains(w.Message, `stack "one"`) {
+			t.Errorf("unexpected warning: %s", w.Message)
+		}
+		if strings.Contains(w.Message, `10.50.0.0/24 overlaps 10.50.0.0/16 of stack "two"`) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected an overlap warning for stack two, got %v", warnings)
+	}
+}
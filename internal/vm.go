@@ -5,13 +5,13 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
-)
 
-const (
-	libvirtURI = "qemu:///system"
-	baseImage  = "/var/lib/libvirt/images/ubuntu-base.qcow2"
-	sshUser    = "ubuntu"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/h3ow3d/nlab/internal/manifest"
+	"github.com/h3ow3d/nlab/internal/types"
 )
 
 // VMConfig holds the parameters needed to create one VM.
@@ -25,6 +25,44 @@ type VMConfig struct {
 	VCPUs   int
 	Network string
 	Out     io.Writer // nil → os.Stdout
+
+	// Networks, when set, replaces Network with one interface per entry.
+	Networks []string
+
+	// Also optional; zero values mean a 20 GiB disk backed by Config.BaseImage
+	// and cloud-init files in <stack dir>/<role>.
+	DiskSize  int                 // GiB
+	Image     string              // base image path
+	DiskDir   string              // overlay directory; empty → libvirt's default pool
+	CloudInit types.CloudInitSpec // absolute paths, as resolved by the manifest loader
+
+	// Params are substituted for ${params.<name>} in the cloud-init files.
+	Params map[string]string
+}
+
+// baseImage returns the image the VM's disk is backed by.
+func (cfg VMConfig) baseImage() string {
+	if cfg.Image != "" {
+		return cfg.Image
+	}
+	return conf.BaseImage
+}
+
+// diskSize returns the VM's disk size in GiB.
+func (cfg VMConfig) diskSize() int {
+	if cfg.DiskSize > 0 {
+		return cfg.DiskSize
+	}
+	return manifest.DefaultDiskSize
+}
+
+// disk returns the virt-install --disk value of the VM's overlay.
+func (cfg VMConfig) disk(name string) string {
+	d := fmt.Sprintf("size=%d,backing_store=%s,format=qcow2", cfg.diskSize(), cfg.baseImage())
+	if cfg.DiskDir != "" {
+		d = fmt.Sprintf("path=%s,", filepath.Join(cfg.DiskDir, name+".qcow2")) + d
+	}
+	return d
 }
 
 // vmOut returns the writer to use for subprocess output.
@@ -45,15 +83,20 @@ func (cfg VMConfig) vmLog(fn func(string), msg string) {
 // CreateVM provisions a VM from the base cloud image using virt-install and
 // cloud-init.
 func CreateVM(cfg VMConfig) error {
+	return publishError(cfg.Stack, "create-vm", cfg.Role, createVM(cfg))
+}
+
+func createVM(cfg VMConfig) error {
 	name := cfg.Stack + "-" + cfg.Role
-	seed := name + "-seed.iso"
-	pubKeyFile := fmt.Sprintf("keys/%s/id_ed25519.pub", cfg.Stack)
-	userDataTpl := fmt.Sprintf("stacks/%s/%s/user-data", cfg.Stack, cfg.Role)
-	metaData := fmt.Sprintf("stacks/%s/%s/meta-data", cfg.Stack, cfg.Role)
-	tmpUserData := fmt.Sprintf("/tmp/%s-user-data", name)
+	stackDir, err := StackDir(cfg.Stack)
+	if err != nil {
+		return err
+	}
+	seed := seedPath(name)
+	pubKeyFile := currentKeyPath(cfg.Stack, cfg.Role) + ".pub"
 
-	if _, err := os.Stat(baseImage); err != nil {
-		return fmt.Errorf("base image not found at %s – run 'nlab image download' first", baseImage)
+	if _, err := os.Stat(cfg.baseImage()); err != nil {
+		return fmt.Errorf("base image not found at %s – run 'nlab image download' first", cfg.baseImage())
 	}
 	if _, err := os.Stat(pubKeyFile); err != nil {
 		return fmt.Errorf("SSH public key not found at %s – run 'nlab key generate %s' first", pubKeyFile, cfg.Stack)
@@ -63,17 +106,43 @@ func CreateVM(cfg VMConfig) error {
 		cfg.vmLog(Skip, fmt.Sprintf("VM %s already exists", name))
 		return nil
 	}
+	inputs, err := cfg.cloudInitInputs(stackDir)
+	if err != nil {
+		return err
+	}
+
+	Publish(Event{Stack: cfg.Stack, Type: EventVMCreating, Source: "create-vm", VM: cfg.Role,
+		Message: fmt.Sprintf("Creating VM %s (%d MiB, %d vCPU)", name, cfg.Memory, cfg.VCPUs)})
 
-	if err := prepareCloudInit(cfg, userDataTpl, metaData, pubKeyFile, tmpUserData, seed, name); err != nil {
+	// Every (re)created VM gets a fresh host key; the previous pin is replaced.
+	hostKey, err := GenerateHostKey()
+	if err != nil {
+		return err
+	}
+	if err := prepareCloudInit(cfg, inputs, pubKeyFile, seed, name, hostKey); err != nil {
 		return err
 	}
-	return installVM(cfg, name, seed)
+	if err := installVM(cfg, name, seed); err != nil {
+		return err
+	}
+	// Pinned only once the domain exists, so a failed install leaves no pin.
+	if err := PinHostKey(KnownHostsPath(cfg.Stack), name, hostKey.Public); err != nil {
+		return err
+	}
+	Publish(Event{Stack: cfg.Stack, Type: EventVMCreated, Source: "create-vm", VM: cfg.Role,
+		Message: fmt.Sprintf("VM %s deployed", name),
+		Data:    map[string]string{"hostKey": ssh.FingerprintSHA256(hostKey.Public)}})
+	return nil
 }
 
 // DestroyVM stops and undefines a VM and removes its storage.
 func DestroyVM(stack, role string) error {
+	return publishError(stack, "destroy-vm", role, destroyVM(stack, role))
+}
+
+func destroyVM(stack, role string) error {
 	name := stack + "-" + role
-	seed := name + "-seed.iso"
+	seed := seedPath(name)
 
 	Info(fmt.Sprintf("Destroy request: %s", name))
 
@@ -89,12 +158,21 @@ func DestroyVM(stack, role string) error {
 	}
 
 	_ = os.Remove(seed)
+	if err := UnpinHostKey(KnownHostsPath(stack), name); err != nil {
+		Error(err.Error())
+	}
+	// A recreated VM authorizes the current key, not one a rotation skipped.
+	if err := updatePreviousKeys(stack, map[string]string{role: ""}); err != nil {
+		Error(err.Error())
+	}
 
 	if DomainExists(name) {
 		return fmt.Errorf("FAILED: %s still exists after destroy", name)
 	}
 
 	Ok(fmt.Sprintf("%s deleted", name))
+	Publish(Event{Stack: stack, Type: EventVMDestroyed, Source: "destroy-vm", VM: role,
+		Message: fmt.Sprintf("VM %s deleted", name)})
 	return nil
 }
 
@@ -132,6 +210,22 @@ func DomainMAC(name string) string {
 	return ""
 }
 
+// DomainMACOn returns the MAC address of the domain's interface attached to
+// the given libvirt network.
+func DomainMACOn(name, network string) string {
+	out, err := virshCmd("domiflist", name).Output()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 5 && fields[1] == "network" && fields[2] == network {
+			return fields[4]
+		}
+	}
+	return ""
+}
+
 // DHCPLeaseIP looks up the IP for a MAC address in the named network's DHCP leases.
 func DHCPLeaseIP(network, mac string) string {
 	out, err := virshCmd("net-dhcp-leases", network).Output()
@@ -151,48 +245,125 @@ func DHCPLeaseIP(network, mac string) string {
 	return ""
 }
 
-func prepareCloudInit(cfg VMConfig, userDataTpl, metaData, pubKeyFile, tmpUserData, seed, name string) error {
+// seedPath returns where the cloud-init seed ISO for a domain is written.
+func seedPath(name string) string {
+	return filepath.Join(DefaultXDGDirs().CloudInitDir(), name+"-seed.iso")
+}
+
+// cloudInitInputs is what a VM's cloud-init seed is built from.
+type cloudInitInputs struct {
+	userData      string // template; __SSH_PUBLIC_KEY__ is substituted
+	metaData      string
+	networkConfig string // optional network-config
+}
+
+// cloudInitInputs reads the VM's cloud-init data: inline userData or the
+// named files first, then user-data and meta-data in the cloud-init dir
+// (<stack dir>/<role> unless set). Missing meta-data is generated. Parameter
+// references are substituted in all of them.
+func (cfg VMConfig) cloudInitInputs(stackDir string) (*cloudInitInputs, error) {
+	in, err := cfg.readCloudInit(stackDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range []*string{&in.userData, &in.metaData, &in.networkConfig} {
+		if *s, err = manifest.Substitute(*s, cfg.Params); err != nil {
+			return nil, fmt.Errorf("cloud-init for %s: %w", cfg.Role, err)
+		}
+	}
+	return in, nil
+}
+
+func (cfg VMConfig) readCloudInit(stackDir string) (*cloudInitInputs, error) {
+	ci := cfg.CloudInit
+	dir := ci.Dir
+	if dir == "" {
+		dir = filepath.Join(stackDir, cfg.Role)
+	}
+	in := &cloudInitInputs{userData: ci.UserData}
+	if ci.NetworkConfigFile != "" {
+		data, err := os.ReadFile(ci.NetworkConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("read network-config: %w", err)
+		}
+		in.networkConfig = string(data)
+	}
+	if in.userData == "" {
+		path := ci.UserDataFile
+		if path == "" {
+			path = filepath.Join(dir, "user-data")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read user-data template: %w", err)
+		}
+		in.userData = string(data)
+	}
+	path := ci.MetaDataFile
+	if path == "" {
+		path = filepath.Join(dir, "meta-data")
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		in.metaData = string(data)
+	case os.IsNotExist(err) && ci.MetaDataFile == "":
+		in.metaData = string(defaultCloudInit("meta-data", cfg.Role))
+	default:
+		return nil, fmt.Errorf("read meta-data: %w", err)
+	}
+	return in, nil
+}
+
+func prepareCloudInit(cfg VMConfig, in *cloudInitInputs, pubKeyFile, seed, name string, hostKey *HostKey) error {
 	pubKey, err := os.ReadFile(pubKeyFile)
 	if err != nil {
 		return fmt.Errorf("read public key: %w", err)
 	}
-	tplBytes, err := os.ReadFile(userDataTpl)
+	rendered, err := hostKey.AddToUserData(strings.ReplaceAll(in.userData, "__SSH_PUBLIC_KEY__", strings.TrimSpace(string(pubKey))))
 	if err != nil {
-		return fmt.Errorf("read user-data template: %w", err)
+		return fmt.Errorf("%s: %w", name, err)
 	}
-	rendered := strings.ReplaceAll(string(tplBytes), "__SSH_PUBLIC_KEY__", strings.TrimSpace(string(pubKey)))
+	if err := os.MkdirAll(filepath.Dir(seed), 0o700); err != nil {
+		return fmt.Errorf("create cloud-init dir: %w", err)
+	}
+	tmpUserData := filepath.Join(filepath.Dir(seed), name+"-user-data")
+	tmpMetaData := filepath.Join(filepath.Dir(seed), name+"-meta-data")
+	tmpNetworkConfig := filepath.Join(filepath.Dir(seed), name+"-network-config")
+	defer func() {
+		_ = os.Remove(tmpUserData)
+		_ = os.Remove(tmpMetaData)
+		_ = os.Remove(tmpNetworkConfig)
+	}()
 	if err := os.WriteFile(tmpUserData, []byte(rendered), 0o600); err != nil {
 		return fmt.Errorf("write temp user-data: %w", err)
 	}
+	if err := os.WriteFile(tmpMetaData, []byte(in.metaData), 0o600); err != nil {
+		return fmt.Errorf("write temp meta-data: %w", err)
+	}
 	cfg.vmLog(Info, fmt.Sprintf("Creating cloud-init ISO for %s", name))
 	out := cfg.vmOut()
-	cmd := exec.Command("cloud-localds", seed, tmpUserData, metaData)
+	var args []string
+	if in.networkConfig != "" {
+		if err := os.WriteFile(tmpNetworkConfig, []byte(in.networkConfig), 0o600); err != nil {
+			return fmt.Errorf("write temp network-config: %w", err)
+		}
+		args = append(args, "--network-config="+tmpNetworkConfig)
+	}
+	args = append(args, seed, tmpUserData, tmpMetaData)
+	cmd := exec.Command("cloud-localds", args...)
 	cmd.Stdout = out
 	cmd.Stderr = out
 	if err := cmd.Run(); err != nil {
-		_ = os.Remove(tmpUserData)
 		return fmt.Errorf("cloud-localds: %w", err)
 	}
-	_ = os.Remove(tmpUserData)
 	return nil
 }
 
 func installVM(cfg VMConfig, name, seed string) error {
 	cfg.vmLog(Info, fmt.Sprintf("Installing VM %s", name))
 	out := cfg.vmOut()
-	cmd := exec.Command("virt-install",
-		"--connect", libvirtURI,
-		"--name", name,
-		"--memory", fmt.Sprintf("%d", cfg.Memory),
-		"--vcpus", fmt.Sprintf("%d", cfg.VCPUs),
-		"--disk", fmt.Sprintf("size=20,backing_store=%s,format=qcow2", baseImage),
-		"--disk", fmt.Sprintf("path=%s,device=cdrom,readonly=on", seed),
-		"--os-variant", "ubuntu22.04",
-		"--network", fmt.Sprintf("network=%s", cfg.Network),
-		"--graphics", "none",
-		"--import",
-		"--noautoconsole",
-	)
+	cmd := exec.Command("virt-install", VirtInstallArgs(cfg, name, seed)...)
 	cmd.Stdout = out
 	cmd.Stderr = out
 	if err := cmd.Run(); err != nil {
@@ -202,7 +373,32 @@ func installVM(cfg VMConfig, name, seed string) error {
 	return nil
 }
 
-// virsh runs a virsh subcommand against qemu:///system with output attached.
+// VirtInstallArgs returns the virt-install arguments that create the domain
+// name with the seed ISO seed. They describe the same domain nlab render
+// prints for a typed VM: name, memory, vCPUs, overlay disk, seed and one
+// virtio interface per network.
+func VirtInstallArgs(cfg VMConfig, name, seed string) []string {
+	args := []string{
+		"--connect", conf.LibvirtURI,
+		"--name", name,
+		"--memory", fmt.Sprintf("%d", cfg.Memory),
+		"--vcpus", fmt.Sprintf("%d", cfg.VCPUs),
+		"--disk", cfg.disk(name),
+		"--disk", fmt.Sprintf("path=%s,device=cdrom,readonly=on", seed),
+		"--os-variant", "ubuntu22.04",
+	}
+	networks := cfg.Networks
+	if len(networks) == 0 {
+		networks = []string{cfg.Network}
+	}
+	for _, n := range networks {
+		args = append(args, "--network", fmt.Sprintf("network=%s,model=virtio", n))
+	}
+	return append(args, "--graphics", "none", "--import", "--noautoconsole")
+}
+
+// virsh runs a virsh subcommand against the configured libvirt URI with output
+// attached.
 func virsh(args ...string) error {
 	cmd := virshCmd(args...)
 	cmd.Stdout = os.Stdout
@@ -212,6 +408,15 @@ func virsh(args ...string) error {
 
 // virshCmd builds a virsh *exec.Cmd without attaching output.
 func virshCmd(args ...string) *exec.Cmd {
-	full := append([]string{"--connect", libvirtURI}, args...)
+	full := append([]string{"--connect", conf.LibvirtURI}, args...)
 	return exec.Command("virsh", full...)
 }
+
+// rootCmd builds a command that changes the host's network stack, run
+// through sudo -n when nlab is not root.
+func rootCmd(name string, args ...string) *exec.Cmd {
+	if os.Geteuid() != 0 {
+		return exec.Command("sudo", append([]string{"-n", name}, args...)...)
+	}
+	return exec.Command(name, args...)
+}
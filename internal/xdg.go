@@ -49,6 +49,11 @@ func (d XDGDirs) ImagesDir() string {
 	return filepath.Join(d.Data, "images")
 }
 
+// KeysDir returns the per-stack SSH key pair directory.
+func (d XDGDirs) KeysDir() string {
+	return filepath.Join(d.Data, "keys")
+}
+
 // StacksDir returns the optional stacks library directory.
 func (d XDGDirs) StacksDir() string {
 	return filepath.Join(d.Data, "stacks")
@@ -64,22 +69,70 @@ func (d XDGDirs) LogsDir() string {
 	return filepath.Join(d.State, "logs")
 }
 
+// EventsFile returns the JSON-lines event journal for a stack.
+func (d XDGDirs) EventsFile(stack string) string {
+	return filepath.Join(d.LogsDir(), stack+"-events.jsonl")
+}
+
+// StackStateDir returns the directory holding what nlab up recorded about
+// each stack.
+func (d XDGDirs) StackStateDir() string {
+	return filepath.Join(d.State, "stacks")
+}
+
+// StackStateFile returns the state file of a stack.
+func (d XDGDirs) StackStateFile(stack string) string {
+	return filepath.Join(d.StackStateDir(), stack+".yaml")
+}
+
+// ForwardsDir returns the directory where each running nlab port-forward
+// records its forwards.
+func (d XDGDirs) ForwardsDir() string {
+	return filepath.Join(d.State, "forwards")
+}
+
 // PcapDir returns the packet-capture directory.
 func (d XDGDirs) PcapDir() string {
 	return filepath.Join(d.State, "pcap")
 }
 
+// KnownHostsDir returns the directory holding nlab-managed known_hosts files.
+func (d XDGDirs) KnownHostsDir() string {
+	return filepath.Join(d.State, "known_hosts")
+}
+
+// KnownHostsFile returns the managed known_hosts file for a stack.
+func (d XDGDirs) KnownHostsFile(stack string) string {
+	return filepath.Join(d.KnownHostsDir(), stack)
+}
+
+// SSHConfigDir returns the directory holding generated per-stack OpenSSH
+// config fragments.
+func (d XDGDirs) SSHConfigDir() string {
+	return filepath.Join(d.Config, "ssh")
+}
+
+// SSHConfigFile returns the generated OpenSSH config fragment for a stack.
+func (d XDGDirs) SSHConfigFile(stack string) string {
+	return filepath.Join(d.SSHConfigDir(), stack+".conf")
+}
+
 // EnsureDirs creates all nlab XDG directories that do not yet exist.
 // Directories are created with mode 0700 so that only the owning user can
 // read them (private data / state / config).
 func (d XDGDirs) EnsureDirs() error {
 	dirs := []string{
 		d.Config,
+		d.SSHConfigDir(),
 		d.ImagesDir(),
+		d.KeysDir(),
 		d.StacksDir(),
 		d.CloudInitDir(),
 		d.LogsDir(),
+		d.StackStateDir(),
+		d.ForwardsDir(),
 		d.PcapDir(),
+		d.KnownHostsDir(),
 	}
 	for _, dir := range dirs {
 		if err := os.MkdirAll(dir, 0o700); err != nil {
@@ -36,10 +36,16 @@ func TestXDGDirs_SubPaths(t *testing.T) {
 	}{
 		{"ConfigFile", dirs.ConfigFile(), "/tmp/cfg/nlab/config.yaml"},
 		{"ImagesDir", dirs.ImagesDir(), "/tmp/data/nlab/images"},
+		{"KeysDir", dirs.KeysDir(), "/tmp/data/nlab/keys"},
 		{"StacksDir", dirs.StacksDir(), "/tmp/data/nlab/stacks"},
 		{"CloudInitDir", dirs.CloudInitDir(), "/tmp/data/nlab/cloudinit"},
 		{"LogsDir", dirs.LogsDir(), "/tmp/state/nlab/logs"},
+		{"EventsFile", dirs.EventsFile("basic"), "/tmp/state/nlab/logs/basic-events.jsonl"},
 		{"PcapDir", dirs.PcapDir(), "/tmp/state/nlab/pcap"},
+		{"KnownHostsDir", dirs.KnownHostsDir(), "/tmp/state/nlab/known_hosts"},
+		{"KnownHostsFile", dirs.KnownHostsFile("basic"), "/tmp/state/nlab/known_hosts/basic"},
+		{"SSHConfigDir", dirs.SSHConfigDir(), "/tmp/cfg/nlab/ssh"},
+		{"SSHConfigFile", dirs.SSHConfigFile("basic"), "/tmp/cfg/nlab/ssh/basic.conf"},
 	}
 	for _, tc := range cases {
 		if tc.got != tc.want {
@@ -81,11 +87,14 @@ func TestEnsureDirs_CreatesAll(t *testing.T) {
 
 	expected := []string{
 		dirs.Config,
+		dirs.SSHConfigDir(),
 		dirs.ImagesDir(),
+		dirs.KeysDir(),
 		dirs.StacksDir(),
 		dirs.CloudInitDir(),
 		dirs.LogsDir(),
 		dirs.PcapDir(),
+		dirs.KnownHostsDir(),
 	}
 	for _, d := range expected {
 		info, err := os.Stat(d)
@@ -0,0 +1,10 @@
+// Package stacks bundles the stacks shipped with nlab into the binary.
+package stacks
+
+import "embed"
+
+// Template is the stack nlab stack init starts from when no "template" is
+// on the search path; its files are under template/.
+//
+//go:embed template
+var Template embed.FS